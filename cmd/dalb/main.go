@@ -4,10 +4,21 @@ Copyright (c) 2019 Dave Hammers
 package main
 
 import (
+	"crypto/tls"
 	"flag"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
 
+	"dalb/internal/accesslog"
 	"dalb/internal/app/dalb"
 	"dalb/internal/cors"
+	"dalb/internal/node"
+	"dalb/internal/proxyproto"
+	"dalb/internal/requestid"
+	"dalb/internal/trace"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -24,6 +35,50 @@ var (
 	pDataPort *string
 	pCtrlPort *string
 	pHttp     *bool
+	pHistRes  *time.Duration
+	pHistRet  *time.Duration
+	pHistRaw  *time.Duration
+	pHistDir  *string
+	pOTLP     *string
+	pTraceF   *string
+	pTraceS   *float64
+	pALog     *string
+	pALogFmt  *string
+	pALogSmp  *float64
+	pALogFld  *string
+	pALogSize *int64
+	pALogAge  *time.Duration
+	pALogBak  *int
+	pReqID    *string
+	pReqIDTr  *bool
+	pTrusted  *string
+	pRwHost   *bool
+	pProxyPr  *bool
+	pTCP      *string
+	pTCPIdle  *time.Duration
+	pUDP      *string
+	pUDPIdle  *time.Duration
+	pUDPHash  *bool
+	pHealth   *time.Duration
+	pLoadHdr  *string
+	pRebal    *time.Duration
+	pLdRebal  *time.Duration
+	pBack429  *bool
+	pAffin    *string
+	pAffKey   *string
+	pAffAge   *time.Duration
+	pGrpHdr   *string
+	pGrpCk    *string
+	pGrpCli   *string
+	pMirror   *string
+	pMirDiff  *bool
+	pHedge    *float64
+	pHedgeDly *time.Duration
+	pConnTO   *time.Duration
+	pFirstTO  *time.Duration
+	pIdleTO   *time.Duration
+	pTotalTO  *time.Duration
+	pDeadHdr  *string
 	proxy     *dalb.DataPathProxy
 )
 
@@ -34,8 +89,60 @@ func commandLineInit() {
 		pDataPort = flag.String("data", DefaultDataPort, "HTTP listens on this port for datapath requests")
 		pCtrlPort = flag.String("ctrl", DefaultControlPort, "HTTP listens on this port for control requests")
 		pHttp = flag.Bool("http", false, "Use HTTP instead of HTTPS")
+		pHistRes = flag.Duration("history-resolution", node.DefaultHistoryResolution, "performance history sampling interval")
+		pHistRet = flag.Duration("history-retention", node.DefaultHistoryRetention, "how long performance history is kept")
+		pHistRaw = flag.Duration("history-raw-retention", node.DefaultHistoryRawRetention, "how long performance history is kept before it is downsampled")
+		pHistDir = flag.String("history-dir", "", "directory the performance history is saved in, empty to keep it in memory only")
+		pOTLP = flag.String("trace-otlp", "", "OTLP/HTTP endpoint traces are exported to, e.g. http://localhost:4318")
+		pTraceF = flag.String("trace-file", "", "file traces are written to as OTLP JSON lines")
+		pTraceS = flag.Float64("trace-sample", 1.0, "fraction of new traces that are sampled")
+		pALog = flag.String("access-log", "", "access log file, - for stdout, empty for no access log")
+		pALogFmt = flag.String("access-log-format", accesslog.FormatJSON, "access log format, json or combined")
+		pALogSmp = flag.Float64("access-log-sample", 1.0, "fraction of the requests that are logged, 5xx responses are always logged")
+		pALogFld = flag.String("access-log-fields", "", "comma separated access log fields, empty for all of them")
+		pALogSize = flag.Int64("access-log-max-size", 100, "access log file size in MB that triggers a rotation, 0 for no limit")
+		pALogAge = flag.Duration("access-log-max-age", 24*time.Hour, "access log file age that triggers a rotation, 0 for no limit")
+		pALogBak = flag.Int("access-log-max-backups", 7, "number of rotated access log files kept, 0 to keep all of them")
+		pReqID = flag.String("request-id-header", requestid.DefaultHeader, "header that carries the request ID to the worker nodes and back to the client")
+		pReqIDTr = flag.Bool("request-id-trust", true, "use the request ID sent by the client instead of generating a new one")
+		pTrusted = flag.String("trusted-proxies", "", "comma separated CIDRs of the proxies trusted to report the client address in X-Forwarded-For")
+		pTCP = flag.String("tcp", "", "comma separated TCP routes as name=[host]:port, worker nodes are added to a route with its name as the path")
+		pTCPIdle = flag.Duration("tcp-idle-timeout", dalb.DefaultTCPIdleTimeout, "how long a TCP route connection is kept without data in either direction")
+		pUDP = flag.String("udp", "", "comma separated UDP routes as name=[host]:port, worker nodes are added to a route with its name as the path")
+		pUDPIdle = flag.Duration("udp-idle-timeout", dalb.DefaultUDPIdleTimeout, "how long a UDP flow is kept without datagrams")
+		pUDPHash = flag.Bool("udp-hash", false, "pick the worker node of a UDP flow by a hash of the flow instead of the scheduler")
+		pProxyPr = flag.Bool("proxy-protocol", false, "accept PROXY protocol v1/v2 headers on the data port from the -trusted-proxies")
+		pRwHost = flag.Bool("rewrite-host", false, "send the worker node address as the Host header instead of the one sent by the client")
+		pLoadHdr = flag.String("load-header", dalb.DefaultLoadHeader, "response header the worker nodes report their load in, empty to ignore it")
+		pRebal = flag.Duration("rebalance-interval", node.RebalanceInterval, "how often the worker node calendar slots are rebalanced")
+		pLdRebal = flag.Duration("load-rebalance-interval", node.LoadRebalanceInterval, "how often the load reported by the worker nodes is applied to their calendar slots")
+		pBack429 = flag.Bool("backoff-429", false, "give a worker node that answers 429 no new requests for its Retry-After, like one that answers 503")
+		pAffin = flag.String("affinity", "", "session affinity: cookie[:NAME] for a dalb cookie, app-cookie:NAME or header:NAME for a hash of an application cookie or header")
+		pAffKey = flag.String("affinity-key", "", "key the dalb session cookies are signed with, random when empty so sessions end when dalb restarts")
+		pAffAge = flag.Duration("affinity-max-age", 0, "lifetime of the dalb session cookie, 0 for a browser session")
+		pGrpHdr = flag.String("group-header", "", "request header that sends a request of the -trusted-proxies or -group-clients to the node group it names, e.g. "+dalb.DefaultGroupHeader)
+		pGrpCk = flag.String("group-cookie", "", "cookie that sends a request of the -trusted-proxies or -group-clients to the node group it names, e.g. "+dalb.DefaultGroupCookie)
+		pGrpCli = flag.String("group-clients", "", "comma separated CIDRs of the clients that can name the node group of their requests with -group-header or -group-cookie")
+		pMirror = flag.String("mirror", "", "copy a percentage of the requests to a shadow node group as GROUP:PERCENT, e.g. shadow:10")
+		pMirDiff = flag.Bool("mirror-diff", false, "compare the status, Content-Type and body of the shadow responses with the primary ones")
+		pHedge = flag.Float64("hedge-budget", 0, "percent of extra requests that can be sent to a second node when a GET, HEAD or OPTIONS request is slow, 0 for no hedging")
+		pHedgeDly = flag.Duration("hedge-delay", 0, "how long to wait for a response before hedging, 0 for the p95 of the recent transaction times")
+		pConnTO = flag.Duration("connect-timeout", 0, "how long to wait for a connection to a worker node, 0 for no timeout")
+		pFirstTO = flag.Duration("first-byte-timeout", 0, "how long to wait for a worker node to start its response once the request was sent, 0 for no timeout")
+		pIdleTO = flag.Duration("idle-timeout", 0, "how long to wait for the next part of a worker node response body, 0 for no timeout")
+		pTotalTO = flag.Duration("request-timeout", 0, "how long a request can take from the time it arrived, 0 for no timeout")
+		pDeadHdr = flag.String("deadline-header", dalb.DefaultDeadlineHeader, "request header with the milliseconds the client is willing to wait, sent to the worker node with the time left, empty to ignore it")
+		pHealth = flag.Duration("health-interval", dalb.DefaultHealthInterval, "how often the worker nodes with a health check are checked")
 	}
 	flag.Parse()
+	if *pHistRes <= 0 {
+		log.Fatal("Invalid history resolution: ", *pHistRes)
+	}
+	node.History.Resolution = *pHistRes
+	node.History.Retention = *pHistRet
+	node.History.RawRetention = *pHistRaw
+	node.RebalanceInterval = *pRebal
+	node.LoadRebalanceInterval = *pLdRebal
 	if *pDebug {
 		log.SetReportCaller(true)
 		log.SetLevel(log.DebugLevel)
@@ -44,6 +151,24 @@ func commandLineInit() {
 
 func main() {
 	commandLineInit()
+	if *pHistDir != "" {
+		if err := node.OpenHistoryStore(*pHistDir); err != nil {
+			log.Fatal("Cannot open the history directory: ", err)
+		}
+	}
+	if *pOTLP != "" {
+		trace.Init(trace.NewOTLPExporter(*pOTLP), *pTraceS)
+	} else if *pTraceF != "" {
+		exporter, err := trace.OpenFileExporter(*pTraceF)
+		if err != nil {
+			log.Fatal("Cannot open the trace file: ", err)
+		}
+		trace.Init(exporter, *pTraceS)
+	}
+	if !*pHttp {
+		// Disable security check for HTTPS worker nodes
+		dalb.SetNodeTLSConfig(&tls.Config{InsecureSkipVerify: true})
+	}
 	// start the control HTTP server
 	go func() {
 		Router := dalb.CtrlPathInit()
@@ -58,12 +183,149 @@ func main() {
 
 	//start data path server
 	proxy = dalb.DataPathInit("/{path:.*}")
+	if err := proxy.SetRequestIDConfig(dalb.RequestIDConfig{Header: *pReqID, Trust: *pReqIDTr}); err != nil {
+		log.Fatal("Invalid request ID header: ", err)
+	}
+	proxy.RewriteHost = *pRwHost
+	proxy.LoadHeader = *pLoadHdr
+	proxy.BackoffTooManyRequests = *pBack429
+	proxy.GroupHeader = *pGrpHdr
+	proxy.GroupCookie = *pGrpCk
+	trusted, err := dalb.ParseCIDRs(*pTrusted)
+	if err != nil {
+		log.Fatal("Invalid trusted proxy list: ", err)
+	}
+	proxy.TrustedProxies = trusted
+	if proxy.GroupClients, err = dalb.ParseCIDRs(*pGrpCli); err != nil {
+		log.Fatal("Invalid group client list: ", err)
+	}
+	affinity, err := dalb.ParseAffinity(*pAffin)
+	if err == nil && affinity != nil {
+		if *pAffKey != "" {
+			affinity.Key = []byte(*pAffKey)
+		}
+		affinity.MaxAge = *pAffAge
+		err = proxy.SetAffinity(affinity)
+	}
+	if err != nil {
+		log.Fatal("Invalid session affinity: ", err)
+	}
+	mirror, err := dalb.ParseMirror(*pMirror)
+	if err == nil && mirror != nil && *pMirDiff {
+		mirror.Diff, err = dalb.NewResponseDiff(nil, nil, nil)
+	}
+	if err == nil {
+		err = proxy.SetMirror(mirror)
+	}
+	if err != nil {
+		log.Fatal("Invalid mirroring: ", err)
+	}
+	proxy.DeadlineHeader = *pDeadHdr
+	if err := proxy.SetTimeouts(dalb.Timeouts{Connect: *pConnTO, FirstByte: *pFirstTO, Idle: *pIdleTO, Total: *pTotalTO}); err != nil {
+		log.Fatal("Invalid timeouts: ", err)
+	}
+	if *pHedge != 0 {
+		hedge := dalb.NewHedge(*pHedge)
+		hedge.Delay = *pHedgeDly
+		if err := proxy.SetHedge(hedge); err != nil {
+			log.Fatal("Invalid hedging: ", err)
+		}
+	}
+	if *pALog != "" {
+		proxy.AccessLog = accessLogInit()
+	}
+	tcpRoutesInit(trusted)
+	dalb.StartHealthChecks(*pHealth)
+	udpRoutesInit()
+	l, err := net.Listen("tcp", ":"+*pDataPort)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *pProxyPr {
+		l = &proxyproto.Listener{Listener: l, Trusted: trusted}
+	}
 	if *pHttp {
 		log.Debug("Server started at http://localhost:", *pDataPort)
-		cors.StartCORSHandler(*pDataPort, proxy.Router)
+		cors.ServeCORSHandlerH2C(l, proxy.Router)
 	} else {
 		log.Debug("Server started at https://localhost:", *pDataPort)
-		cors.StartCORSHandlerHTTPS(*pDataPort, proxy.Router)
+		cors.ServeCORSHandlerHTTPS(l, proxy.Router)
+	}
+
+}
+
+//returns the name and address of the name=[host]:port routes in a comma separated list
+func parseRoutes(list string) (names, addrs []string) {
+	for _, route := range strings.Split(list, ",") {
+		if route = strings.TrimSpace(route); route == "" {
+			continue
+		}
+		eq := strings.Index(route, "=")
+		if eq <= 0 {
+			log.Fatal("Invalid route, expected name=[host]:port: ", route)
+		}
+		names = append(names, route[:eq])
+		addrs = append(addrs, route[eq+1:])
+	}
+	return
+}
+
+//start the TCP routes configured on the command line
+func tcpRoutesInit(trusted []*net.IPNet) {
+	names, addrs := parseRoutes(*pTCP)
+	for idx, name := range names {
+		addr := addrs[idx]
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *pProxyPr {
+			l = &proxyproto.Listener{Listener: l, Trusted: trusted}
+		}
+		tp := dalb.TCPPathInit(name)
+		tp.IdleTimeout = *pTCPIdle
+		log.Debug("TCP route ", name, " started at ", addr)
+		go func() {
+			log.Fatal(tp.Serve(l))
+		}()
+	}
+}
+
+//start the UDP routes configured on the command line
+func udpRoutesInit() {
+	names, addrs := parseRoutes(*pUDP)
+	for idx, name := range names {
+		conn, err := net.ListenPacket("udp", addrs[idx])
+		if err != nil {
+			log.Fatal(err)
+		}
+		up := dalb.UDPPathInit(name)
+		up.IdleTimeout = *pUDPIdle
+		up.HashFlows = *pUDPHash
+		log.Debug("UDP route ", name, " started at ", addrs[idx])
+		go func() {
+			log.Fatal(up.Serve(conn))
+		}()
 	}
+}
 
+//open the access log configured on the command line
+func accessLogInit() *accesslog.Logger {
+	var out io.Writer = os.Stdout
+	if *pALog != "-" {
+		rf, err := accesslog.OpenRotatingFile(*pALog, *pALogSize*1024*1024, *pALogAge, *pALogBak)
+		if err != nil {
+			log.Fatal("Cannot open the access log: ", err)
+		}
+		out = rf
+	}
+	l, err := accesslog.New(out, accesslog.Config{
+		Format:     *pALogFmt,
+		SampleRate: *pALogSmp,
+		Fields:     accesslog.ParseFields(*pALogFld),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return l
 }
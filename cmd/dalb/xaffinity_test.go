@@ -0,0 +1,211 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"dalb/internal/app/dalb"
+	"dalb/internal/node"
+)
+
+// returns a data path route with three worker nodes that answer with their node ID
+func affinityRoute(t *testing.T, path string) (*dalb.DataPathProxy, map[string]*node.Node, func()) {
+	proxy := dalb.DataPathInit(path)
+	nodes := make(map[string]*node.Node)
+	var workers []*httptest.Server
+	for idx := 0; idx < 3; idx++ {
+		n := node.NewNode()
+		worker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Node", n.ID)
+		}))
+		workers = append(workers, worker)
+		u, _ := url.Parse(worker.URL)
+		host, port, _ := net.SplitHostPort(u.Host)
+		n.IP = net.ParseIP(host)
+		n.Port, _ = strconv.Atoi(port)
+		n.MaxTransactions = 1
+		proxy.Sched.SchedAddNode(n)
+		nodes[n.ID] = n
+	}
+	return proxy, nodes, func() {
+		proxy.Sched.Delete()
+		for _, worker := range workers {
+			worker.Close()
+		}
+	}
+}
+
+func TestAffinityCookie(t *testing.T) {
+	proxy, nodes, done := affinityRoute(t, "/cookie")
+	defer done()
+	a, err := dalb.ParseAffinity("cookie")
+	if err == nil {
+		err = proxy.SetAffinity(a)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://example.com/cookie", nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		proxy.Router.ServeHTTP(w, r)
+		return w
+	}
+	cookieOf := func(w *httptest.ResponseRecorder) *http.Cookie {
+		for _, c := range w.Result().Cookies() {
+			if c.Name == dalb.DefaultAffinityCookie {
+				return c
+			}
+		}
+		return nil
+	}
+
+	w := send(nil)
+	cookie, first := cookieOf(w), w.Header().Get("X-Node")
+	if cookie == nil || !cookie.HttpOnly {
+		t.Fatal("no session cookie", w.Header())
+	}
+	for idx := 0; idx < 5; idx++ {
+		w := send(cookie)
+		if got := w.Header().Get("X-Node"); got != first {
+			t.Fatal("session went to node", got, "want", first)
+		}
+		if cookieOf(w) != nil {
+			t.Error("the session cookie is set again")
+		}
+	}
+	// a forged cookie is a new session
+	if w := send(&http.Cookie{Name: dalb.DefaultAffinityCookie, Value: first + ".forged"}); cookieOf(w) == nil {
+		t.Error("a forged cookie was accepted")
+	}
+	// the session fails over when its node is not healthy, and stays on the new node
+	proxy.Sched.SchedSetHealthy(nodes[first], false)
+	w = send(cookie)
+	failover := w.Header().Get("X-Node")
+	if failover == first || cookieOf(w) == nil {
+		t.Fatal("session did not fail over", failover)
+	}
+	if got := send(cookieOf(w)).Header().Get("X-Node"); got != failover {
+		t.Error("session went to node", got, "after the fail over to", failover)
+	}
+	hits, misses, sessions := proxy.Sched.AffinityCounts()
+	if hits != 6 || misses != 1 || sessions != 2 {
+		t.Error("hits", hits, "misses", misses, "new sessions", sessions)
+	}
+}
+
+func TestAffinityHeader(t *testing.T) {
+	proxy, nodes, done := affinityRoute(t, "/header")
+	defer done()
+	a, err := dalb.ParseAffinity("header:X-Session")
+	if err == nil {
+		err = proxy.SetAffinity(a)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(session string) string {
+		r := httptest.NewRequest("GET", "http://example.com/header", nil)
+		r.Header.Set("X-Session", session)
+		w := httptest.NewRecorder()
+		proxy.Router.ServeHTTP(w, r)
+		if len(w.Result().Cookies()) != 0 {
+			t.Error("a cookie was set for header affinity")
+		}
+		return w.Header().Get("X-Node")
+	}
+	sessions := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	owner := make(map[string]string)
+	for _, session := range sessions {
+		owner[session] = send(session)
+		for idx := 0; idx < 3; idx++ {
+			if got := send(session); got != owner[session] {
+				t.Fatal("session", session, "went to node", got, "want", owner[session])
+			}
+		}
+	}
+	// only the sessions of a node that is gone move
+	gone := owner["a"]
+	proxy.Sched.SchedDeleteNode(nodes[gone])
+	for _, session := range sessions {
+		got := send(session)
+		if owner[session] == gone && got == gone || owner[session] != gone && got != owner[session] {
+			t.Error("session", session, "went to node", got, "was on", owner[session])
+		}
+	}
+	if _, err := dalb.ParseAffinity("header"); err == nil {
+		t.Error("header affinity without a header name")
+	}
+}
+
+// the session affinity is set per route through the control API
+func TestAffinityPerRoute(t *testing.T) {
+	sticky, _, done := affinityRoute(t, "/aff1")
+	defer done()
+	other, _, otherDone := affinityRoute(t, "/aff2")
+	defer otherDone()
+	ctrl := dalb.CtrlPathInit()
+	call := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ctrl.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+	if w := call("PUT", "/affinity?path=/aff1", `{"mode":"header","name":"X-Session"}`); w.Code != http.StatusOK {
+		t.Fatal("session affinity was not set", w.Code, w.Body.String())
+	}
+	if w := call("PUT", "/affinity?path=/aff1", `{"mode":"header"}`); w.Code != http.StatusBadRequest {
+		t.Fatal("header affinity without a header name was accepted", w.Code)
+	}
+	if w := call("PUT", "/affinity?path=/aff1", `{"mode":"ip"}`); w.Code != http.StatusBadRequest {
+		t.Fatal("an invalid affinity mode was accepted", w.Code)
+	}
+	stats := dalb.AffinityConfig{}
+	json.NewDecoder(call("GET", "/affinity?path=/aff1", "").Body).Decode(&stats)
+	if stats.Mode != dalb.AffinityHeader || stats.Name != "X-Session" {
+		t.Fatal("session affinity is not correct", stats)
+	}
+	json.NewDecoder(call("GET", "/affinity?path=/aff2", "").Body).Decode(&stats)
+	if stats.Mode != "" {
+		t.Fatal("session affinity was set on the other route", stats)
+	}
+
+	send := func(proxy *dalb.DataPathProxy, path string) string {
+		r := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		r.Header.Set("X-Session", "a")
+		w := httptest.NewRecorder()
+		proxy.Router.ServeHTTP(w, r)
+		return w.Header().Get("X-Node")
+	}
+	distinct := func(proxy *dalb.DataPathProxy, path string) int {
+		seen := make(map[string]bool)
+		for idx := 0; idx < 6; idx++ {
+			seen[send(proxy, path)] = true
+		}
+		return len(seen)
+	}
+	if cnt := distinct(sticky, "/aff1"); cnt != 1 {
+		t.Error("the session went to", cnt, "nodes")
+	}
+	if cnt := distinct(other, "/aff2"); cnt == 1 {
+		t.Error("the route without session affinity kept the session on one node")
+	}
+	call("DELETE", "/affinity?path=/aff1", "")
+	if sticky.Affinity() != nil {
+		t.Fatal("session affinity was not turned off")
+	}
+	if cnt := distinct(sticky, "/aff1"); cnt == 1 {
+		t.Error("the session stayed on one node after session affinity was turned off")
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"dalb/internal/app/dalb"
+	"dalb/internal/node"
+)
+
+// a worker node answering like version v of a backend, responses to ?mismatch=1 differ between versions
+func diffWorker(v string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now().Add(time.Duration(len(v)) * time.Hour)
+		if r.URL.Query().Get("text") != "" {
+			fmt.Fprintf(w, "served at %s", now.Format("15:04:05.000000"))
+			return
+		}
+		name, items := "a", "[1,2]"
+		if r.URL.Query().Get("mismatch") != "" && v == "v2" {
+			w.Header().Set("X-Version", v)
+			w.Header().Set("Set-Cookie", "session=secret")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="secret"`)
+			name, items = "b", "[1,2,3]"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id":7,"time":%q,"requestTs":%d,"name":%q,"items":%s}`, now, now.UnixNano(), name, items)
+	}))
+}
+
+func TestMirrorDiff(t *testing.T) {
+	proxy := dalb.DataPathInit("/diff")
+	defer proxy.Sched.Delete()
+	primary, shadow := diffWorker("v1"), diffWorker("v2")
+	defer primary.Close()
+	defer shadow.Close()
+	u, _ := url.Parse(primary.URL)
+	n := node.NewNode()
+	n.IP = net.ParseIP(u.Hostname())
+	n.Port, _ = strconv.Atoi(u.Port())
+	n.MaxTransactions = 1
+	proxy.Sched.SchedAddNode(n)
+
+	ctrl := dalb.CtrlPathInit()
+	call := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ctrl.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+	if w := call("PUT", "/mirror?path=/diff", `{"percent":100,"diff":{"headers":["Content-Type","X-Version"],"ignorePointers":["/time"],"ignorePatterns":["Ts$","\\d\\d:\\d\\d:\\d\\d\\.\\d+"]}}`); w.Code != http.StatusOK {
+		t.Fatal("mirroring was not set", w.Code, w.Body.String())
+	}
+	u, _ = url.Parse(shadow.URL)
+	call("POST", "/node", `{"path":"/diff","group":"shadow","address":"`+u.Hostname()+`","port":`+u.Port()+`,"maxTransactions":5}`)
+
+	for _, target := range []string{"/diff", "/diff?mismatch=1", "/diff?text=1"} {
+		w := httptest.NewRecorder()
+		proxy.Router.ServeHTTP(w, httptest.NewRequest("POST", "http://example.com"+target, strings.NewReader("hello")))
+		if w.Code != http.StatusOK || w.Header().Get("X-Version") != "" {
+			t.Fatal("primary response", target, w.Code, w.Header())
+		}
+	}
+	var stats dalb.DiffStats
+	for cnt := 0; stats.Compared != 3 && cnt < 200; cnt++ {
+		time.Sleep(10 * time.Millisecond)
+		json.NewDecoder(call("GET", "/mirror/diff?path=/diff", "").Body).Decode(&stats)
+	}
+	if stats.Compared != 3 || stats.Matched != 2 || stats.StatusMismatches != 0 || stats.HeaderMismatches != 1 || stats.BodyMismatches != 1 {
+		t.Fatal("diff counts", stats.Compared, stats.Matched, stats.StatusMismatches, stats.HeaderMismatches, stats.BodyMismatches)
+	}
+	if len(stats.Samples) != 1 {
+		t.Fatal("diff samples", stats.Samples)
+	}
+	sample := stats.Samples[0]
+	if strings.Join(sample.Differences, ",") != "header X-Version,/items/2,/name" {
+		t.Fatal("differences", sample.Differences)
+	}
+	if sample.URL != "/diff?mismatch=1" || sample.RequestBody != "hello" || !strings.Contains(sample.Primary.Body, `"name":"a"`) || sample.Shadow.Headers.Get("X-Version") != "v2" {
+		t.Fatal("sample", sample)
+	}
+	// the credentials and sessions of the responses are not kept
+	if sample.Shadow.Headers.Get("Set-Cookie") != dalb.DiffRedacted || sample.Shadow.Headers.Get("WWW-Authenticate") != dalb.DiffRedacted {
+		t.Fatal("sample headers were not redacted", sample.Shadow.Headers)
+	}
+
+	if w := call("DELETE", "/mirror/diff?path=/diff", ""); w.Code != http.StatusOK {
+		t.Fatal("diff was not reset", w.Code)
+	}
+	stats = dalb.DiffStats{}
+	json.NewDecoder(call("GET", "/mirror/diff?path=/diff", "").Body).Decode(&stats)
+	if stats.Compared != 0 || len(stats.Samples) != 0 {
+		t.Fatal("diff was not reset", stats.Compared, stats.Samples)
+	}
+	if w := call("PUT", "/mirror?path=/diff", `{"percent":100,"diff":{"ignorePatterns":["("]}}`); w.Code != http.StatusBadRequest {
+		t.Fatal("invalid pattern", w.Code)
+	}
+}
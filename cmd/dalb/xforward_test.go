@@ -0,0 +1,212 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"dalb/internal/accesslog"
+	"dalb/internal/app/dalb"
+	"dalb/internal/node"
+	"dalb/internal/proxyproto"
+)
+
+// check the forwarding headers a worker node receives with and without a trusted proxy in front of dalb
+func TestForwardedHeaders(t *testing.T) {
+	var got *http.Request
+	worker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	}))
+	defer worker.Close()
+	u, _ := url.Parse(worker.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+
+	proxy := dalb.DataPathInit("/fwd")
+	defer proxy.Sched.Delete()
+	n := node.NewNode()
+	n.IP = net.ParseIP(host)
+	n.Port, _ = strconv.Atoi(port)
+	n.MaxTransactions = 1
+	proxy.Sched.SchedAddNode(n)
+	var err error
+	proxy.TrustedProxies, err = dalb.ParseCIDRs("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remote      string
+		xff         string
+		rewriteHost bool
+		wantXFF     string
+		wantFwd     string
+		wantHost    string
+	}{
+		// an untrusted peer cannot add to the chain
+		{"203.0.113.7:1234", "1.2.3.4", false, "203.0.113.7", "for=203.0.113.7;host=example.com;proto=http", "example.com"},
+		// a trusted proxy keeps the chain
+		{"10.1.2.3:1234", "1.2.3.4", false, "1.2.3.4, 10.1.2.3", "for=10.1.2.3;host=example.com;proto=http", "example.com"},
+		{"192.168.1.1:1234", "", true, "192.168.1.1", "for=192.168.1.1;host=example.com;proto=http", u.Host},
+	}
+	for _, tt := range tests {
+		proxy.RewriteHost = tt.rewriteHost
+		r := httptest.NewRequest("GET", "http://example.com/fwd", nil)
+		r.RemoteAddr = tt.remote
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		w := httptest.NewRecorder()
+		proxy.Router.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || got == nil {
+			t.Fatal("request was not proxied", w.Code)
+		}
+		if xff := got.Header.Get("X-Forwarded-For"); xff != tt.wantXFF {
+			t.Error("X-Forwarded-For", xff, "want", tt.wantXFF)
+		}
+		if fwd := got.Header.Get("Forwarded"); fwd != tt.wantFwd {
+			t.Error("Forwarded", fwd, "want", tt.wantFwd)
+		}
+		if got.Host != tt.wantHost {
+			t.Error("Host", got.Host, "want", tt.wantHost)
+		}
+		if got.Header.Get("X-Forwarded-Proto") != "http" || got.Header.Get("X-Forwarded-Host") != "example.com" {
+			t.Error("X-Forwarded-Proto/Host", got.Header)
+		}
+		got = nil
+	}
+
+	// the client is the first address from the right that is not a trusted proxy
+	var buf bytes.Buffer
+	proxy.AccessLog, err = accesslog.New(&buf, accesslog.Config{SampleRate: 1, Fields: []string{"client_ip"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "http://example.com/fwd", nil)
+	r.RemoteAddr = "10.1.2.3:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1, 1.2.3.4, 10.9.9.9")
+	proxy.Router.ServeHTTP(httptest.NewRecorder(), r)
+	proxy.AccessLog.Close()
+	if want := `{"client_ip":"1.2.3.4"}` + "\n"; buf.String() != want {
+		t.Error("access log", buf.String(), "want", want)
+	}
+}
+
+// a worker node that expects a PROXY protocol header sees the client address
+func TestProxyProtocolToNode(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	remote := make(chan string, 2)
+	worker := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remote <- r.RemoteAddr
+	})}
+	go worker.Serve(&proxyproto.Listener{Listener: ln, Trusted: []*net.IPNet{loopback}})
+	defer worker.Close()
+
+	proxy := dalb.DataPathInit("/pp")
+	defer proxy.Sched.Delete()
+	for _, version := range []int{proxyproto.V1, proxyproto.V2} {
+		n := node.NewNode()
+		n.IP = net.ParseIP("127.0.0.1")
+		n.Port = ln.Addr().(*net.TCPAddr).Port
+		n.MaxTransactions = 1
+		n.ProxyProtocol = version
+		proxy.Sched.SchedAddNode(n)
+
+		r := httptest.NewRequest("GET", "http://example.com/pp", nil)
+		r.RemoteAddr = "203.0.113.7:4321"
+		w := httptest.NewRecorder()
+		proxy.Router.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatal("request was not proxied", w.Code)
+		}
+		if got := <-remote; got != r.RemoteAddr {
+			t.Error("PROXY protocol", version, "worker node saw", got, "want", r.RemoteAddr)
+		}
+		proxy.Sched.SchedDeleteNode(n)
+	}
+
+	// HTTP/2 connections are shared by many clients, they cannot send a PROXY protocol header
+	ctrl := dalb.CtrlPathInit()
+	for _, proto := range []string{"h2", "h2c"} {
+		w := httptest.NewRecorder()
+		ctrl.ServeHTTP(w, httptest.NewRequest("POST", "/node", strings.NewReader(`{"path":"/pp","address":"127.0.0.1","port":9,"maxTransactions":1,"protocol":"`+proto+`","proxyProtocol":1}`)))
+		if w.Code != http.StatusBadRequest {
+			t.Error("PROXY protocol accepted with", proto, w.Code)
+		}
+	}
+	if len(proxy.Sched.SchedNodes()) != 0 {
+		t.Error("a node with an unsupported PROXY protocol was added")
+	}
+}
+
+// every route has its own request ID header and trust setting
+func TestRequestIDPerRoute(t *testing.T) {
+	var got *http.Request
+	worker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	}))
+	defer worker.Close()
+	u, _ := url.Parse(worker.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	paths := []string{"/rid1", "/rid2"}
+	proxies := make([]*dalb.DataPathProxy, 0, len(paths))
+	for _, path := range paths {
+		proxy := dalb.DataPathInit(path)
+		defer proxy.Sched.Delete()
+		n := node.NewNode()
+		n.IP = net.ParseIP(host)
+		n.Port, _ = strconv.Atoi(port)
+		n.MaxTransactions = 1
+		proxy.Sched.SchedAddNode(n)
+		proxies = append(proxies, proxy)
+	}
+	ctrl := dalb.CtrlPathInit()
+	call := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ctrl.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+	if w := call("PUT", "/requestid?path=/rid2", `{"header":"X-Correlation-ID","trust":false}`); w.Code != http.StatusOK {
+		t.Fatal("request ID settings were not set", w.Code, w.Body.String())
+	}
+	if w := call("PUT", "/requestid?path=/rid2", `{"header":"","trust":true}`); w.Code != http.StatusBadRequest {
+		t.Fatal("an empty request ID header was accepted", w.Code)
+	}
+	stats := dalb.RequestIDStats{}
+	json.NewDecoder(call("GET", "/requestid?path=/rid2", "").Body).Decode(&stats)
+	if stats.Header != "X-Correlation-ID" || stats.Trust {
+		t.Fatal("request ID settings are not correct", stats)
+	}
+
+	// the first route keeps the default header and uses the ID sent by the client
+	r := httptest.NewRequest("GET", "http://example.com/rid1", nil)
+	r.Header.Set("X-Request-ID", "client-1")
+	w := httptest.NewRecorder()
+	proxies[0].Router.ServeHTTP(w, r)
+	if got.Header.Get("X-Request-ID") != "client-1" || w.Header().Get("X-Request-ID") != "client-1" {
+		t.Error("the client request ID was not used", got.Header, w.Header())
+	}
+	// the second route uses its own header and generates a new ID
+	r = httptest.NewRequest("GET", "http://example.com/rid2", nil)
+	r.Header.Set("X-Correlation-ID", "client-2")
+	w = httptest.NewRecorder()
+	proxies[1].Router.ServeHTTP(w, r)
+	if id := got.Header.Get("X-Correlation-ID"); id == "" || id == "client-2" || w.Header().Get("X-Correlation-ID") != id {
+		t.Error("the route request ID header was not used", got.Header, w.Header())
+	}
+	if w.Header().Get("X-Request-ID") != "" {
+		t.Error("the default request ID header was sent", w.Header())
+	}
+}
@@ -0,0 +1,246 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"dalb/internal/app/dalb"
+	"dalb/internal/node"
+)
+
+func TestGroupSplit(t *testing.T) {
+	proxy, nodes, done := affinityRoute(t, "/groups")
+	defer done()
+	// the group header and cookie are off by default, the testers are the clients of httptest requests
+	proxy.GroupHeader, proxy.GroupCookie = dalb.DefaultGroupHeader, dalb.DefaultGroupCookie
+	proxy.GroupClients, _ = dalb.ParseCIDRs("192.0.2.0/24")
+	stable := make(map[string]bool)
+	for id := range nodes {
+		stable[id] = true
+	}
+	// a canary worker node added to a new group gets no requests until the group is given a weight
+	canary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Node", "canary")
+		if r.URL.Query().Get("fail") != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer canary.Close()
+	u, _ := url.Parse(canary.URL)
+	ctrl := dalb.CtrlPathInit()
+	call := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ctrl.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+	host, port := u.Hostname(), u.Port()
+	if w := call("POST", "/node", `{"path":"/groups","group":"canary","address":"`+host+`","port":`+port+`,"maxTransactions":1}`); w.Code != http.StatusOK {
+		t.Fatal("canary node was not added", w.Code, w.Body.String())
+	}
+	send := func(target string, header http.Header) string {
+		r := httptest.NewRequest("GET", "http://example.com"+target, nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		proxy.Router.ServeHTTP(w, r)
+		return w.Header().Get("X-Node")
+	}
+	count := func(cnt int) (canaries int) {
+		for idx := 0; idx < cnt; idx++ {
+			switch got := send("/groups", nil); {
+			case got == "canary":
+				canaries++
+			case !stable[got]:
+				t.Fatal("request went to node", got)
+			}
+		}
+		return
+	}
+	if got := count(20); got != 0 {
+		t.Fatal("canary with weight 0 got requests", got)
+	}
+	// testers force the canary with the group header
+	if got := send("/groups", http.Header{dalb.DefaultGroupHeader: {"canary"}}); got != "canary" {
+		t.Fatal("group header was not applied", got)
+	}
+
+	// the weights are capped so the group calendar stays small
+	for _, weight := range []string{"-1", "10001", "1000000000"} {
+		if w := call("PUT", "/group/canary?path=/groups", `{"weight":`+weight+`}`); w.Code != http.StatusBadRequest {
+			t.Fatal("weight", weight, "was accepted", w.Code)
+		}
+	}
+	if g := proxy.Group("canary"); g == nil || g.Weight() != 0 {
+		t.Fatal("an invalid weight was set")
+	}
+
+	// a 75/25 split
+	call("PUT", "/group/default?path=/groups", `{"weight":75}`)
+	if w := call("PUT", "/group/canary?path=/groups", `{"weight":25}`); w.Code != http.StatusOK {
+		t.Fatal("weight was not set", w.Code, w.Body.String())
+	}
+	if got := count(100); got != 25 {
+		t.Fatal("canary got", got, "of 100 requests")
+	}
+	r := httptest.NewRequest("GET", "http://example.com/groups?fail=1", nil)
+	r.AddCookie(&http.Cookie{Name: dalb.DefaultGroupCookie, Value: "canary"})
+	proxy.Router.ServeHTTP(httptest.NewRecorder(), r)
+
+	// the group statistics are kept apart
+	var stats dalb.GroupStats
+	if err := json.NewDecoder(call("GET", "/group?path=/groups", "").Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Groups) != 2 {
+		t.Fatal("groups", stats.Groups)
+	}
+	def, can := stats.Groups[0], stats.Groups[1]
+	if def.Name != "default" || def.Share != 0.75 || def.Nodes != 3 || def.Stats.TransactionCount != 95 || def.ErrorRate != 0 {
+		t.Fatal("default group stats", def.Name, def.Share, def.Nodes, def.Stats.TransactionCount, def.ErrorRate)
+	}
+	if can.Name != "canary" || can.Share != 0.25 || can.Nodes != 1 || can.Stats.TransactionCount != 27 || can.Stats.ErrorCount != 1 {
+		t.Fatal("canary group stats", can.Name, can.Share, can.Nodes, can.Stats.TransactionCount, can.Stats.ErrorCount)
+	}
+	if w := call("GET", "/node?path=/groups&group=canary", ""); !strings.Contains(w.Body.String(), `"port":`+port) {
+		t.Fatal("canary nodes", w.Body.String())
+	}
+	if w := call("GET", "/scheduler?path=/groups&group=blue", ""); w.Code != http.StatusNotFound {
+		t.Fatal("unknown group", w.Code)
+	}
+
+	// deleting the canary sends everything back to the default group
+	if w := call("DELETE", "/group/canary?path=/groups", ""); w.Code != http.StatusOK {
+		t.Fatal("group was not deleted", w.Code, w.Body.String())
+	}
+	if got := send("/groups", http.Header{dalb.DefaultGroupHeader: {"canary"}}); !stable[got] {
+		t.Fatal("deleted group got a request", got)
+	}
+	if w := call("DELETE", "/group/default?path=/groups", ""); w.Code != http.StatusBadRequest {
+		t.Fatal("default group was deleted", w.Code)
+	}
+}
+
+// only the trusted proxies and the group clients can name the group of a request, and no request
+// goes to the shadow group of the mirroring
+func TestGroupOverride(t *testing.T) {
+	proxy, nodes, done := affinityRoute(t, "/override")
+	defer done()
+	stable := make(map[string]bool)
+	for id := range nodes {
+		stable[id] = true
+	}
+	for _, name := range []string{"canary", "shadow"} {
+		name := name
+		worker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Node", name)
+		}))
+		defer worker.Close()
+		u, _ := url.Parse(worker.URL)
+		g, _ := proxy.SetGroup(name, 0)
+		n := node.NewNode()
+		n.IP = net.ParseIP(u.Hostname())
+		n.Port, _ = strconv.Atoi(u.Port())
+		n.MaxTransactions = 1
+		g.Sched.SchedAddNode(n)
+	}
+	m, _ := dalb.ParseMirror("shadow:0")
+	if err := proxy.SetMirror(m); err != nil {
+		t.Fatal(err)
+	}
+	send := func(remote, group string) string {
+		r := httptest.NewRequest("GET", "http://example.com/override", nil)
+		r.RemoteAddr = remote + ":1234"
+		r.Header.Set(dalb.DefaultGroupHeader, group)
+		w := httptest.NewRecorder()
+		proxy.Router.ServeHTTP(w, r)
+		return w.Header().Get("X-Node")
+	}
+	if got := send("192.0.2.1", "canary"); !stable[got] {
+		t.Fatal("the group header is used while it is off", got)
+	}
+	proxy.GroupHeader = dalb.DefaultGroupHeader
+	proxy.GroupClients, _ = dalb.ParseCIDRs("10.1.0.0/16")
+	proxy.TrustedProxies, _ = dalb.ParseCIDRs("10.2.0.1/32")
+	if got := send("192.0.2.1", "canary"); !stable[got] {
+		t.Fatal("a client that is not a group client named its group", got)
+	}
+	if got := send("10.1.2.3", "canary"); got != "canary" {
+		t.Fatal("a group client could not name its group", got)
+	}
+	if got := send("10.2.0.1", "canary"); got != "canary" {
+		t.Fatal("a trusted proxy could not name the group", got)
+	}
+	if got := send("10.1.2.3", "shadow"); !stable[got] {
+		t.Fatal("a request was sent to the shadow group", got)
+	}
+	// not even when the shadow group is given a weight
+	proxy.SetGroup(dalb.DefaultGroup, 1)
+	proxy.SetGroup("shadow", 100)
+	for idx := 0; idx < 10; idx++ {
+		if got := send("192.0.2.1", ""); !stable[got] {
+			t.Fatal("a request was sent to the shadow group", got)
+		}
+	}
+}
+
+// the requests that picked a group before it was deleted are still served by its worker nodes
+func TestGroupDeleteDrain(t *testing.T) {
+	proxy, _, done := affinityRoute(t, "/drain")
+	defer done()
+	proxy.GroupHeader = dalb.DefaultGroupHeader
+	proxy.GroupClients, _ = dalb.ParseCIDRs("192.0.2.0/24")
+	release := make(chan struct{})
+	worker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Header().Set("X-Node", "blue")
+	}))
+	defer worker.Close()
+	u, _ := url.Parse(worker.URL)
+	g, _ := proxy.SetGroup("blue", 0)
+	n := node.NewNode()
+	n.IP = net.ParseIP(u.Hostname())
+	n.Port, _ = strconv.Atoi(u.Port())
+	n.MaxTransactions = 1
+	g.Sched.SchedAddNode(n)
+
+	got := make(chan string, 2)
+	for idx := 0; idx < 2; idx++ {
+		go func() {
+			r := httptest.NewRequest("GET", "http://example.com/drain", nil)
+			r.Header.Set(dalb.DefaultGroupHeader, "blue")
+			w := httptest.NewRecorder()
+			proxy.Router.ServeHTTP(w, r)
+			got <- strconv.Itoa(w.Code) + " " + w.Header().Get("X-Node")
+		}()
+	}
+	// one request is in flight and the other one waits for the slot
+	for n.InFlight() != 1 || g.Sched.SchedWaiting() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := proxy.DeleteGroup("blue"); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	for idx := 0; idx < 2; idx++ {
+		if res := <-got; res != "200 blue" {
+			t.Fatal("request of the deleted group", res)
+		}
+	}
+	for cnt := 0; len(g.Sched.SchedNodes()) != 0; cnt++ {
+		if cnt == 100 {
+			t.Fatal("the drained group was not deleted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
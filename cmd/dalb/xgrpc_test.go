@@ -0,0 +1,151 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"dalb/internal/app/dalb"
+	"dalb/internal/node"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// a client that only speaks HTTP/2 over cleartext connections
+func h2cClient() *http.Client {
+	return &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}}
+}
+
+// gRPC-like calls from an h2c client through dalb to an h2c worker node: the stream is passed
+// through as it is written, and the grpc-status trailer is returned to the client and counted
+func TestGRPCOverH2C(t *testing.T) {
+	release := make(chan struct{})
+	worker := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Error("worker node request protocol", r.Proto)
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte{0, 0, 0, 0, 1, 'a'})
+		w.(http.Flusher).Flush()
+		if r.URL.Query().Get("stream") != "" {
+			<-release
+			w.Write([]byte{0, 0, 0, 0, 1, 'b'})
+		}
+		w.Header().Set("Grpc-Status", r.URL.Query().Get("status"))
+	}), &http2.Server{}))
+	defer worker.Close()
+	u, _ := url.Parse(worker.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+
+	proxy := dalb.DataPathInit("/grpc")
+	defer proxy.Sched.Delete()
+	n := node.NewNode()
+	n.IP = net.ParseIP(host)
+	n.Port, _ = strconv.Atoi(port)
+	n.MaxTransactions = 1
+	n.Protocol = dalb.ProtoH2C
+	proxy.Sched.SchedAddNode(n)
+	front := httptest.NewServer(h2c.NewHandler(proxy.Router, &http2.Server{}))
+	defer front.Close()
+	client := h2cClient()
+
+	call := func(query string) *http.Response {
+		r, _ := http.NewRequest("POST", front.URL+"/grpc?"+query, bytes.NewReader([]byte{0, 0, 0, 0, 0}))
+		r.Header.Set("Content-Type", "application/grpc")
+		r.Header.Set("TE", "trailers")
+		resp, err := client.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.ProtoMajor != 2 {
+			t.Error("client response protocol", resp.Proto)
+		}
+		return resp
+	}
+
+	// the first message of a stream reaches the client before the worker node writes the next one
+	resp := call("stream=1&status=0")
+	first := make([]byte, 6)
+	if _, err := io.ReadFull(resp.Body, first); err != nil || first[5] != 'a' {
+		t.Fatal("first stream message", first, err)
+	}
+	close(release)
+	rest, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if len(rest) != 6 || rest[5] != 'b' {
+		t.Error("second stream message", rest)
+	}
+	if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+		t.Error("grpc-status trailer", got)
+	}
+
+	// INTERNAL is a worker node error, NOT_FOUND is not
+	for _, status := range []string{"13", "5"} {
+		resp := call("status=" + status)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if got := resp.Trailer.Get("Grpc-Status"); got != status {
+			t.Error("grpc-status trailer", got, "want", status)
+		}
+	}
+	st := n.Stats()
+	if st.TransactionCount != 3 || st.ErrorCount != 1 {
+		t.Error("node transactions", st.TransactionCount, "errors", st.ErrorCount, "want 3 and 1")
+	}
+}
+
+// https and h2 worker nodes are checked with the TLS settings of dalb, and the https nodes that offer
+// HTTP/2 are sent HTTP/2 requests
+func TestTLSWorkerNodes(t *testing.T) {
+	worker := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proto", r.Proto)
+	}))
+	worker.EnableHTTP2 = true
+	worker.StartTLS()
+	defer worker.Close()
+	u, _ := url.Parse(worker.URL)
+	for _, proto := range []string{dalb.ProtoHTTPS, dalb.ProtoH2} {
+		proxy := dalb.DataPathInit("/tls-" + proto)
+		n := node.NewNode()
+		n.IP = net.ParseIP(u.Hostname())
+		n.Port, _ = strconv.Atoi(u.Port())
+		n.MaxTransactions = 1
+		n.Protocol = proto
+		proxy.Sched.SchedAddNode(n)
+		send := func() *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			proxy.Router.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/tls-"+proto, nil))
+			return w
+		}
+		// the self-signed certificate of the node is not trusted by default
+		if w := send(); w.Code != http.StatusBadGateway {
+			t.Fatal(proto, "node with an untrusted certificate", w.Code)
+		}
+		dalb.SetNodeTLSConfig(&tls.Config{InsecureSkipVerify: true})
+		if w := send(); w.Code != http.StatusOK || w.Header().Get("X-Proto") != "HTTP/2.0" {
+			t.Fatal(proto, "node", w.Code, w.Header().Get("X-Proto"))
+		}
+		dalb.SetNodeTLSConfig(nil)
+		proxy.Sched.Delete()
+	}
+}
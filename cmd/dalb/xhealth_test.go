@@ -0,0 +1,139 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"dalb/internal/app/dalb"
+	"dalb/internal/node"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// an OrcaLoadReport with cpu_utilization and a "queue" utilization
+func orcaReport(cpu, queue float64) string {
+	report := make([]byte, 9, 32)
+	report[0] = 1<<3 | 1
+	binary.LittleEndian.PutUint64(report[1:], math.Float64bits(cpu))
+	entry := []byte{1<<3 | 2, 5, 'q', 'u', 'e', 'u', 'e', 2<<3 | 1, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint64(entry[8:], math.Float64bits(queue))
+	report = append(report, 5<<3|2, byte(len(entry)))
+	return base64.RawStdEncoding.EncodeToString(append(report, entry...))
+}
+
+// gRPC health checks take the nodes that are not serving out of the schedule, and the load
+// reported by the worker nodes is recorded without being passed on to the client
+func TestGRPCHealthAndLoad(t *testing.T) {
+	worker := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Endpoint-Load-Metrics-Bin")
+		if r.URL.Path == "/grpc.health.v1.Health/Check" {
+			service := ""
+			if len(body) > 7 {
+				service = string(body[7:])
+			}
+			switch service {
+			case "", "pkg.Up":
+				w.Write([]byte{0, 0, 0, 0, 2, 1 << 3, 1}) // SERVING
+			case "pkg.Down":
+				w.Write([]byte{0, 0, 0, 0, 2, 1 << 3, 2}) // NOT_SERVING
+			default:
+				w.Header().Set("Grpc-Status", "5")
+				return
+			}
+			w.Header().Set("Grpc-Status", "0")
+			return
+		}
+		if r.URL.Query().Get("text") != "" {
+			w.Header().Set("Endpoint-Load-Metrics", "TEXT cpu_utilization=0.7, utilization.queue=0.1")
+		}
+		w.Write([]byte{0, 0, 0, 0, 0})
+		w.Header().Set("Grpc-Status", "0")
+		if r.URL.Query().Get("text") == "" {
+			w.Header().Set("Endpoint-Load-Metrics-Bin", orcaReport(0.5, 0.25))
+		}
+	}), &http2.Server{}))
+	defer worker.Close()
+	u, _ := url.Parse(worker.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+
+	proxy := dalb.DataPathInit("/health")
+	defer proxy.Sched.Delete()
+	nodes := make(map[string]*node.Node)
+	for _, service := range []string{"", "pkg.Up", "pkg.Down", "pkg.Unknown"} {
+		n := node.NewNode()
+		n.IP = net.ParseIP(host)
+		n.Port, _ = strconv.Atoi(port)
+		n.MaxTransactions = 1
+		n.Protocol = dalb.ProtoH2C
+		n.HealthCheck = dalb.HealthCheckGRPC
+		n.HealthService = service
+		proxy.Sched.SchedAddNode(n)
+		nodes[service] = n
+	}
+	dalb.CheckHealth()
+	for service, want := range map[string]bool{"": true, "pkg.Up": true, "pkg.Down": false, "pkg.Unknown": false} {
+		if nodes[service].Healthy() != want {
+			t.Error("service", service, "healthy", nodes[service].Healthy(), "want", want)
+		}
+	}
+	front := httptest.NewServer(h2c.NewHandler(proxy.Router, &http2.Server{}))
+	defer front.Close()
+	client := h2cClient()
+	for _, query := range []string{"", "text=1"} {
+		r, _ := http.NewRequest("POST", front.URL+"/health?"+query, bytes.NewReader([]byte{0, 0, 0, 0, 0}))
+		r.Header.Set("Content-Type", "application/grpc")
+		resp, err := client.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.Trailer.Get("Endpoint-Load-Metrics-Bin") != "" || resp.Header.Get("Endpoint-Load-Metrics") != "" {
+			t.Error("the load report was passed on to the client", resp.Header, resp.Trailer)
+		}
+		if resp.Trailer.Get("Grpc-Status") != "0" {
+			t.Error("grpc-status trailer", resp.Trailer)
+		}
+	}
+	var cnt, reports int64
+	for service, n := range nodes {
+		st := n.Stats()
+		cnt += st.TransactionCount
+		if st.TransactionCount != 0 && !n.Healthy() {
+			t.Error("service", service, "got requests while not healthy")
+		}
+		l := n.Load()
+		if l.Time.IsZero() {
+			continue
+		}
+		reports++
+		if !(l.CPU == 0.5 && l.Queue == 0.25) && !(l.CPU == 0.7 && l.Queue == 0.1) {
+			t.Error("service", service, "load", l)
+		}
+	}
+	if cnt != 2 || reports == 0 {
+		t.Error("transactions", cnt, "want 2, load reports", reports)
+	}
+
+	// a node that is serving again is scheduled again
+	nodes["pkg.Down"].HealthService = "pkg.Up"
+	dalb.CheckHealth()
+	if !nodes["pkg.Down"].Healthy() {
+		t.Error("node is not healthy after it is serving again")
+	}
+}
@@ -0,0 +1,126 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dalb/internal/app/dalb"
+	"dalb/internal/node"
+)
+
+func TestHedge(t *testing.T) {
+	proxy := dalb.DataPathInit("/hedge")
+	defer proxy.Sched.Delete()
+	// a slow worker node that notices when its request is cancelled, and a fast one
+	var cancelled int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(300 * time.Millisecond):
+		case <-r.Context().Done():
+			atomic.AddInt32(&cancelled, 1)
+			return
+		}
+		w.Header().Set("X-Node", "slow")
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Node", "fast")
+	}))
+	defer fast.Close()
+	nodes := make(map[string]*node.Node)
+	for name, worker := range map[string]*httptest.Server{"slow": slow, "fast": fast} {
+		u, _ := url.Parse(worker.URL)
+		host, port, _ := net.SplitHostPort(u.Host)
+		n := node.NewNode()
+		n.IP = net.ParseIP(host)
+		n.Port, _ = strconv.Atoi(port)
+		n.MaxTransactions = 1
+		proxy.Sched.SchedAddNode(n)
+		nodes[name] = n
+	}
+	ctrl := dalb.CtrlPathInit()
+	call := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ctrl.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+	send := func(method string) (string, time.Duration) {
+		start := time.Now()
+		w := httptest.NewRecorder()
+		proxy.Router.ServeHTTP(w, httptest.NewRequest(method, "http://example.com/hedge", nil))
+		if w.Code != http.StatusOK {
+			t.Fatal("request failed", w.Code)
+		}
+		d := time.Since(start)
+		// the cancelled request gives its slot back once it has returned
+		for cnt := 0; nodes["slow"].InFlight() != 0 && cnt < 100; cnt++ {
+			time.Sleep(5 * time.Millisecond)
+		}
+		return w.Header().Get("X-Node"), d
+	}
+	if w := call("PUT", "/hedge?path=/hedge", `{"delayMilliSec":50,"budgetPercent":100}`); w.Code != http.StatusOK {
+		t.Fatal("hedging was not set", w.Code, w.Body.String())
+	}
+
+	// every request the slow node gets is hedged to the fast node, which answers first
+	for idx := 0; idx < 10; idx++ {
+		if name, d := send("GET"); name != "fast" || d > 250*time.Millisecond {
+			t.Fatal("request was not hedged", name, d)
+		}
+	}
+	// a POST is not idempotent, it is not counted as a request that could be hedged
+	send("POST")
+	send("POST")
+	var stats dalb.HedgeStats
+	json.NewDecoder(call("GET", "/hedge?path=/hedge", "").Body).Decode(&stats)
+	if stats.Eligible != 10 || stats.Hedged == 0 || stats.Wins != stats.Hedged || stats.BudgetExhausted != 0 {
+		t.Fatal("hedge statistics", stats.Eligible, stats.Hedged, stats.Wins, stats.BudgetExhausted)
+	}
+	if len(stats.Groups) != 1 || stats.Groups[0].HedgeCount != stats.Hedged || stats.Groups[0].HedgeWins != stats.Wins {
+		t.Fatal("group hedge statistics", stats.Groups)
+	}
+	if st := nodes["fast"].Stats(); st.HedgeCount != stats.Hedged || st.HedgeWins != stats.Wins || nodes["slow"].Stats().HedgeCount != 0 {
+		t.Fatal("node hedge statistics", st.HedgeCount, st.HedgeWins)
+	}
+	// the slow requests were cancelled and their slots given back
+	for cnt := 0; int64(atomic.LoadInt32(&cancelled)) != stats.Hedged || nodes["slow"].InFlight() != 0; cnt++ {
+		if cnt == 100 {
+			t.Fatal("losing requests were not cancelled", atomic.LoadInt32(&cancelled), nodes["slow"].InFlight())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// with a 20% budget at most 2 of the 10 requests can be hedged
+	if w := call("PUT", "/hedge?path=/hedge", `{"delayMilliSec":50,"budgetPercent":20}`); w.Code != http.StatusOK {
+		t.Fatal("hedging was not set", w.Code, w.Body.String())
+	}
+	slowCnt := int64(0)
+	for idx := 0; idx < 10; idx++ {
+		if name, _ := send("GET"); name == "slow" {
+			slowCnt++
+		}
+	}
+	stats = dalb.HedgeStats{}
+	json.NewDecoder(call("GET", "/hedge?path=/hedge", "").Body).Decode(&stats)
+	if stats.Hedged > 2 || stats.BudgetExhausted == 0 || slowCnt != stats.BudgetExhausted {
+		t.Fatal("hedge budget was not applied", stats.Hedged, stats.BudgetExhausted, slowCnt)
+	}
+
+	if w := call("DELETE", "/hedge?path=/hedge", ""); w.Code != http.StatusOK {
+		t.Fatal("hedging was not turned off", w.Code)
+	}
+	if w := call("GET", "/hedge?path=/hedge", ""); w.Code != http.StatusNotFound {
+		t.Fatal("hedging is still on", w.Code)
+	}
+}
@@ -56,8 +56,10 @@ func TestIntegration(t *testing.T) {
 	min, max := proxy.Sched.TransactionTimeRange()
 	t.Log("Min transaction time", min)
 	t.Log("Max transaction time", max)
+	st := proxy.Sched.Stats()
+	t.Log("p99 transaction time", st.Latency.Percentile(0.99))
 	t.Log("\nWorker Nodes")
-	for n := range proxy.Sched.SchedNodeMap {
+	for _, n := range proxy.Sched.SchedNodes() {
 		t.Log("======================================")
 		t.Log("Node:", n.IP.String(), ":", n.Port)
 		t.Log("MaxTransactions", n.MaxTransactions)
@@ -0,0 +1,142 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"dalb/internal/app/dalb"
+	"dalb/internal/node"
+)
+
+// the load a worker node reports in the load header is recorded and removed, and a node that
+// answers 503 gets no new requests until its Retry-After is over
+func TestLoadHeaderAndBackoff(t *testing.T) {
+	worker := func(status int, header, value string) (*httptest.Server, *node.Node) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(header, value)
+			w.WriteHeader(status)
+		}))
+		u, _ := url.Parse(srv.URL)
+		host, port, _ := net.SplitHostPort(u.Host)
+		n := node.NewNode()
+		n.IP = net.ParseIP(host)
+		n.Port, _ = strconv.Atoi(port)
+		n.MaxTransactions = 1
+		return srv, n
+	}
+	busy, nBusy := worker(http.StatusOK, dalb.DefaultLoadHeader, "cpu=0.73,queue=12")
+	defer busy.Close()
+	full, nFull := worker(http.StatusServiceUnavailable, "Retry-After", "30")
+	defer full.Close()
+
+	proxy := dalb.DataPathInit("/load")
+	defer proxy.Sched.Delete()
+	proxy.Sched.SchedAddNode(nBusy)
+	proxy.Sched.SchedAddNode(nFull)
+	codes := map[int]int{}
+	for idx := 0; idx < 6; idx++ {
+		w := httptest.NewRecorder()
+		proxy.Router.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/load", nil))
+		codes[w.Code]++
+		if w.Header().Get(dalb.DefaultLoadHeader) != "" {
+			t.Error("the load header was passed on to the client")
+		}
+	}
+	// the node that answered 503 got one request only
+	if codes[http.StatusServiceUnavailable] != 1 || codes[http.StatusOK] != 5 {
+		t.Error("response codes", codes)
+	}
+	if until := nFull.Backoff(); until.IsZero() {
+		t.Error("the node that answered 503 is not backed off")
+	}
+	if l := nBusy.Load(); l.CPU != 0.73 || l.QueueDepth != 12 {
+		t.Error("load", l)
+	}
+}
+
+// a load report that carries some of the load fields leaves the others as they were, also when the
+// header and the ORCA report of a response carry different fields
+func TestLoadReportFields(t *testing.T) {
+	defer func(tc time.Duration) { node.LoadTimeConstant = tc }(node.LoadTimeConstant)
+	node.LoadTimeConstant = time.Millisecond
+	worker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(dalb.DefaultLoadHeader, r.URL.Query().Get("load"))
+		w.Header().Set("Endpoint-Load-Metrics", r.URL.Query().Get("orca"))
+	}))
+	defer worker.Close()
+	u, _ := url.Parse(worker.URL)
+	n := node.NewNode()
+	n.IP = net.ParseIP(u.Hostname())
+	n.Port, _ = strconv.Atoi(u.Port())
+	n.MaxTransactions = 1
+	proxy := dalb.DataPathInit("/loadfields")
+	defer proxy.Sched.Delete()
+	proxy.LoadHeader = dalb.DefaultLoadHeader
+	proxy.Sched.SchedAddNode(n)
+	send := func(load, orca string) node.Load {
+		// long enough for a report to replace the average of the fields it carries
+		time.Sleep(20 * time.Millisecond)
+		q := url.Values{"load": {load}, "orca": {orca}}
+		proxy.Router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/loadfields?"+q.Encode(), nil))
+		return n.Load()
+	}
+	if l := send("cpu=0.6,mem=0.4", ""); l.CPU != 0.6 || l.Memory != 0.4 || l.Has(node.LoadQueueDepth) {
+		t.Fatal("load", l)
+	}
+	if l := send("queue=12", ""); l.CPU != 0.6 || l.Memory != 0.4 || l.QueueDepth != 12 {
+		t.Fatal("a report of the queue changed the utilizations", l)
+	}
+	if l := send("queue=3", "TEXT cpu_utilization=0.9"); l.CPU < 0.89 || l.Memory != 0.4 || l.QueueDepth > 3.01 || l.Has(node.LoadQueue) {
+		t.Fatal("the header and the ORCA report of a response", l)
+	}
+	// a report without a known field is not a report
+	before := n.Load()
+	if l := send("disk=0.5", "JSON {}"); l != before {
+		t.Fatal("a report without a known field changed the load", l)
+	}
+}
+
+// only a 503, and a 429 when configured, backs a worker node off for its Retry-After
+func TestBackoffStatus(t *testing.T) {
+	status := http.StatusMovedPermanently
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	proxy := dalb.DataPathInit("/backoff")
+	defer proxy.Sched.Delete()
+	n := node.NewNode()
+	n.IP = net.ParseIP(host)
+	n.Port, _ = strconv.Atoi(port)
+	n.MaxTransactions = 1
+	proxy.Sched.SchedAddNode(n)
+	send := func() {
+		proxy.Router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/backoff", nil))
+	}
+
+	send()
+	if !n.Backoff().IsZero() {
+		t.Error("backed off by the Retry-After of a 301")
+	}
+	status = http.StatusTooManyRequests
+	send()
+	if !n.Backoff().IsZero() {
+		t.Error("backed off by a 429 without -backoff-429")
+	}
+	proxy.BackoffTooManyRequests = true
+	send()
+	if n.Backoff().IsZero() {
+		t.Error("not backed off by a 429 with -backoff-429")
+	}
+}
@@ -0,0 +1,95 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"dalb/internal/app/dalb"
+)
+
+func TestMirror(t *testing.T) {
+	proxy, nodes, done := affinityRoute(t, "/mirror")
+	defer done()
+	// a slow and failing shadow worker node
+	bodies := make(chan string, 20)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(dalb.MirrorHeader) == "1" {
+			bodies <- string(b)
+		}
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer shadow.Close()
+	u, _ := url.Parse(shadow.URL)
+	ctrl := dalb.CtrlPathInit()
+	call := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ctrl.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+	if w := call("PUT", "/mirror?path=/mirror", `{"percent":50}`); w.Code != http.StatusOK {
+		t.Fatal("mirroring was not set", w.Code, w.Body.String())
+	}
+	if w := call("POST", "/node", `{"path":"/mirror","group":"shadow","address":"`+u.Hostname()+`","port":`+u.Port()+`,"maxTransactions":5}`); w.Code != http.StatusOK {
+		t.Fatal("shadow node was not added", w.Code, w.Body.String())
+	}
+
+	for idx := 1; idx <= 10; idx++ {
+		start := time.Now()
+		w := httptest.NewRecorder()
+		proxy.Router.ServeHTTP(w, httptest.NewRequest("POST", "http://example.com/mirror", strings.NewReader("req-"+strconv.Itoa(idx))))
+		if w.Code != http.StatusOK || nodes[w.Header().Get("X-Node")] == nil {
+			t.Fatal("primary response", w.Code, w.Header())
+		}
+		if d := time.Since(start); d > 100*time.Millisecond {
+			t.Fatal("the primary request waited for the shadow node", d)
+		}
+	}
+	for idx := 2; idx <= 10; idx += 2 {
+		select {
+		case b := <-bodies:
+			if !strings.HasPrefix(b, "req-") {
+				t.Fatal("shadow body", b)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("request was not mirrored", idx)
+		}
+	}
+
+	var stats dalb.MirrorStats
+	for cnt := 0; stats.Shadow.TransactionCount != 5 && cnt < 100; cnt++ {
+		time.Sleep(10 * time.Millisecond)
+		stats = dalb.MirrorStats{}
+		json.NewDecoder(call("GET", "/mirror?path=/mirror", "").Body).Decode(&stats)
+	}
+	if stats.Mirrored != 5 || stats.Shadow.TransactionCount != 5 || stats.StatusCounts["5xx"] != 5 {
+		t.Fatal("shadow statistics", stats.Mirrored, stats.Shadow.TransactionCount, stats.StatusCounts)
+	}
+	if stats.Primary.TransactionCount != 10 || stats.Primary.ErrorCount != 0 {
+		t.Fatal("primary statistics", stats.Primary.TransactionCount, stats.Primary.ErrorCount)
+	}
+
+	// a request with a body larger than maxBodySize is not copied
+	call("PUT", "/mirror?path=/mirror", `{"percent":100,"maxBodySize":10}`)
+	proxy.Router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "http://example.com/mirror", strings.NewReader(strings.Repeat("x", 100))))
+	if _, _, skipped := proxy.Mirroring().Counts(); skipped != 1 {
+		t.Fatal("large body was copied", skipped)
+	}
+	if w := call("DELETE", "/mirror?path=/mirror", ""); w.Code != http.StatusOK || proxy.Mirroring() != nil {
+		t.Fatal("mirroring was not turned off", w.Code)
+	}
+	if w := call("GET", "/mirror?path=/mirror", ""); w.Code != http.StatusNotFound {
+		t.Fatal("mirroring is still on", w.Code)
+	}
+}
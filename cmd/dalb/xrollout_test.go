@@ -0,0 +1,220 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"dalb/internal/app/dalb"
+	"dalb/internal/node"
+)
+
+// runs a rollout of a canary worker node against the three stable nodes of an affinityRoute
+// while requests are sent to the route, returns the rollout when it is over
+func rollout(t *testing.T, path string, canary http.HandlerFunc, ro *dalb.Rollout) (*dalb.DataPathProxy, *dalb.Rollout) {
+	proxy, _, done := affinityRoute(t, path)
+	t.Cleanup(done)
+	worker := httptest.NewServer(canary)
+	t.Cleanup(worker.Close)
+	u, _ := url.Parse(worker.URL)
+	g, err := proxy.SetGroup("canary", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := node.NewNode()
+	n.IP = net.ParseIP(u.Hostname())
+	n.Port, _ = strconv.Atoi(u.Port())
+	n.MaxTransactions = 1
+	g.Sched.SchedAddNode(n)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			proxy.Router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com"+path, nil))
+		}
+	}()
+	defer wg.Wait()
+	defer close(stop)
+
+	if err := proxy.StartRollout(ro); err != nil {
+		t.Fatal(err)
+	}
+	for cnt := 0; ro.Status().State == dalb.RolloutProgressing && cnt < 500; cnt++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return proxy, ro
+}
+
+// returns the actions of the rollout decision log
+func rolloutActions(ro *dalb.Rollout) string {
+	var actions []string
+	for _, d := range ro.Status().Decisions {
+		if d.Action != dalb.RolloutHold {
+			actions = append(actions, d.Action)
+		}
+	}
+	return strings.Join(actions, ",")
+}
+
+func TestRolloutPromote(t *testing.T) {
+	ro := dalb.NewRollout("canary")
+	ro.Steps = []int{10, 50, 100}
+	ro.StepInterval = 30 * time.Millisecond
+	ro.MinRequests = 3
+	ro.MaxP99Ratio = 0
+	proxy, ro := rollout(t, "/promote", func(w http.ResponseWriter, r *http.Request) {}, ro)
+	if st := ro.Status(); st.State != dalb.RolloutPromoted || st.CanaryWeight != 100 {
+		t.Fatal("canary was not promoted", st.State, rolloutActions(ro))
+	}
+	if got := rolloutActions(ro); got != "start,step,promote" {
+		t.Fatal("decisions", got)
+	}
+	if proxy.Group("canary").Weight() != 100 || proxy.Group(dalb.DefaultGroup).Weight() != 0 {
+		t.Fatal("weights were not set", proxy.Group("canary").Weight(), proxy.Group(dalb.DefaultGroup).Weight())
+	}
+
+	// the state machine and decision log are in the control path
+	w := httptest.NewRecorder()
+	dalb.CtrlPathInit().ServeHTTP(w, httptest.NewRequest("GET", "/rollout?path=/promote", nil))
+	var stats dalb.RolloutStats
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	last := stats.Decisions[len(stats.Decisions)-1]
+	if stats.State != dalb.RolloutPromoted || last.Action != dalb.RolloutPromote || last.Canary.TransactionCount < 3 || last.Stable.TransactionCount == 0 {
+		t.Fatal("rollout stats", stats.State, last)
+	}
+}
+
+func TestRolloutRollback(t *testing.T) {
+	ro := dalb.NewRollout("canary")
+	ro.Steps = []int{50, 100}
+	ro.StepInterval = 30 * time.Millisecond
+	ro.MinRequests = 3
+	proxy, ro := rollout(t, "/rollback", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}, ro)
+	st := ro.Status()
+	if st.State != dalb.RolloutRolledBack || st.CanaryWeight != 0 || rolloutActions(ro) != "start,rollback" {
+		t.Fatal("canary was not rolled back", st.State, rolloutActions(ro))
+	}
+	if d := st.Decisions[len(st.Decisions)-1]; d.Canary.ErrorRate != 1 || d.Stable.ErrorRate != 0 {
+		t.Fatal("error rates", d.Canary, d.Stable)
+	}
+	if proxy.Group("canary").Weight() != 0 || proxy.Group(dalb.DefaultGroup).Weight() != 100 {
+		t.Fatal("weights were not restored", proxy.Group("canary").Weight(), proxy.Group(dalb.DefaultGroup).Weight())
+	}
+}
+
+func TestRolloutSlowCanary(t *testing.T) {
+	ro := dalb.NewRollout("canary")
+	ro.Steps = []int{50, 100}
+	ro.StepInterval = 100 * time.Millisecond
+	ro.MinRequests = 3
+	_, ro = rollout(t, "/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}, ro)
+	st := ro.Status()
+	if st.State != dalb.RolloutRolledBack || !strings.Contains(st.Decisions[len(st.Decisions)-1].Reason, "p99") {
+		t.Fatal("slow canary was not rolled back", st.State, st.Decisions)
+	}
+}
+
+func TestRolloutAbort(t *testing.T) {
+	proxy, _, done := affinityRoute(t, "/abort")
+	defer done()
+	ctrl := dalb.CtrlPathInit()
+	call := func(method, target, body string) int {
+		w := httptest.NewRecorder()
+		ctrl.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w.Code
+	}
+	if code := call("POST", "/rollout?path=/abort", `{}`); code != http.StatusBadRequest {
+		t.Fatal("rollout without a canary group", code)
+	}
+	proxy.SetGroup("canary", 0)
+	if code := call("POST", "/rollout?path=/abort", `{"steps":[50,20]}`); code != http.StatusBadRequest {
+		t.Fatal("rollout with decreasing steps", code)
+	}
+	if code := call("POST", "/rollout?path=/abort", `{"steps":[20,100],"stepIntervalSec":60}`); code != http.StatusOK {
+		t.Fatal("rollout was not started", code)
+	}
+	if code := call("POST", "/rollout?path=/abort", `{}`); code != http.StatusConflict {
+		t.Fatal("second rollout", code)
+	}
+	if proxy.Group("canary").Weight() != 20 || proxy.Group(dalb.DefaultGroup).Weight() != 80 {
+		t.Fatal("first step weights", proxy.Group("canary").Weight(), proxy.Group(dalb.DefaultGroup).Weight())
+	}
+	if code := call("DELETE", "/rollout?path=/abort", ""); code != http.StatusOK {
+		t.Fatal("rollout was not aborted", code)
+	}
+	if st := proxy.Rollout().Status(); st.State != dalb.RolloutAborted || proxy.Group("canary").Weight() != 0 {
+		t.Fatal("abort state", st.State, proxy.Group("canary").Weight())
+	}
+	if code := call("DELETE", "/rollout?path=/abort", ""); code != http.StatusNotFound {
+		t.Fatal("second abort", code)
+	}
+}
+
+// a canary that never gets enough requests is aborted instead of holding its step forever
+func TestRolloutMaxHolds(t *testing.T) {
+	ro := dalb.NewRollout("canary")
+	ro.Steps = []int{50, 100}
+	ro.StepInterval = 20 * time.Millisecond
+	ro.MinRequests = 1000000
+	ro.MaxHolds = 3
+	proxy, ro := rollout(t, "/holds", func(w http.ResponseWriter, r *http.Request) {}, ro)
+	st := ro.Status()
+	if st.State != dalb.RolloutAborted || len(st.Decisions) != 5 || rolloutActions(ro) != "start,abort" {
+		t.Fatal("starved canary was not aborted", st.State, st.Decisions)
+	}
+	if proxy.Group("canary").Weight() != 0 || proxy.Group(dalb.DefaultGroup).Weight() != 100 {
+		t.Fatal("weights were not restored", proxy.Group("canary").Weight(), proxy.Group(dalb.DefaultGroup).Weight())
+	}
+}
+
+// the decision log of a rollout holding without limit keeps its start and the last decisions
+func TestRolloutDecisionLog(t *testing.T) {
+	proxy, _, done := affinityRoute(t, "/decisions")
+	defer done()
+	proxy.SetGroup("canary", 0)
+	ro := dalb.NewRollout("canary")
+	ro.StepInterval = time.Millisecond
+	ro.MinRequests = 1000000
+	ro.MaxHolds = 0
+	if err := proxy.StartRollout(ro); err != nil {
+		t.Fatal(err)
+	}
+	for cnt := 0; len(ro.Status().Decisions) < dalb.MaxRolloutDecisions && cnt < 500; cnt++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := proxy.AbortRollout(); err != nil {
+		t.Fatal(err)
+	}
+	st := ro.Status()
+	if len(st.Decisions) != dalb.MaxRolloutDecisions {
+		t.Fatal("decision log has", len(st.Decisions), "decisions")
+	}
+	if first, last := st.Decisions[0], st.Decisions[len(st.Decisions)-1]; first.Action != dalb.RolloutStart || last.Action != dalb.RolloutAbort {
+		t.Fatal("decision log lost its start or end", first.Action, last.Action)
+	}
+}
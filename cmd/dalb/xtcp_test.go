@@ -0,0 +1,138 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"dalb/internal/app/dalb"
+	"dalb/internal/node"
+)
+
+// splice a client connection to an echo worker node through a TCP route
+func TestTCPRoute(t *testing.T) {
+	worker, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Close()
+	go func() {
+		for {
+			c, err := worker.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	tp := dalb.TCPPathInit("echo")
+	n := node.NewNode()
+	n.IP = net.ParseIP("127.0.0.1")
+	n.Port = worker.Addr().(*net.TCPAddr).Port
+	n.MaxTransactions = 1
+	tp.Sched.SchedAddNode(n)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tp.Serve(l)
+
+	for cnt := 0; cnt < 3; cnt++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Write([]byte("hello"))
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+			t.Fatal("no echo", string(buf), err)
+		}
+		// the connection holds the only slot of the node until it is closed
+		if n.InFlight() != 1 {
+			t.Error("connection is not counted as a transaction", n.InFlight())
+		}
+		c.(*net.TCPConn).CloseWrite()
+		if rest, _ := ioutil.ReadAll(c); len(rest) != 0 {
+			t.Error("unexpected data", string(rest))
+		}
+		c.Close()
+	}
+	tp.Close()
+	st := n.Stats()
+	if st.TransactionCount != 3 || st.BytesIn != 15 || st.BytesOut != 15 || n.InFlight() != 0 {
+		t.Fatal("node statistics are not correct", st.TransactionCount, st.BytesIn, st.BytesOut, n.InFlight())
+	}
+	tp.Sched.Delete()
+}
+
+// a connection without data in either direction is closed after the idle timeout and its slot released
+func TestTCPRouteIdleTimeout(t *testing.T) {
+	worker, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Close()
+	go func() {
+		for {
+			c, err := worker.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				// the worker node sends for a while, then hangs without closing the connection
+				for cnt := 0; cnt < 5; cnt++ {
+					c.Write([]byte("tick"))
+					time.Sleep(20 * time.Millisecond)
+				}
+				ioutil.ReadAll(c)
+				c.Close()
+			}()
+		}
+	}()
+
+	tp := dalb.TCPPathInit("idle")
+	tp.IdleTimeout = 50 * time.Millisecond
+	n := node.NewNode()
+	n.IP = net.ParseIP("127.0.0.1")
+	n.Port = worker.Addr().(*net.TCPAddr).Port
+	n.MaxTransactions = 1
+	tp.Sched.SchedAddNode(n)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tp.Serve(l)
+	defer tp.Sched.Delete()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	// the client sends nothing, the data from the worker node keeps the connection open
+	got, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal("the idle connection was not closed", err)
+	}
+	if string(got) != strings.Repeat("tick", 5) {
+		t.Error("the connection was closed while the worker node was sending", string(got))
+	}
+	for cnt := 0; n.InFlight() != 0; cnt++ {
+		if cnt == 100 {
+			t.Fatal("the slot of the idle connection was not released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	tp.Close()
+}
@@ -0,0 +1,198 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"dalb/internal/app/dalb"
+	"dalb/internal/node"
+)
+
+func TestTimeouts(t *testing.T) {
+	// a worker node that hangs before or in the middle of its response, or echoes the deadline it was sent
+	worker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Query().Get("hang") != "":
+		case r.URL.Query().Get("stall") != "":
+			w.Write([]byte("part"))
+			w.(http.Flusher).Flush()
+		default:
+			w.Header().Set("X-Deadline", r.Header.Get(dalb.DefaultDeadlineHeader))
+			return
+		}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer worker.Close()
+	u, _ := url.Parse(worker.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	proxy := dalb.DataPathInit("/timeout")
+	defer proxy.Sched.Delete()
+	n := node.NewNode()
+	n.IP = net.ParseIP(host)
+	n.Port, _ = strconv.Atoi(port)
+	n.MaxTransactions = 1
+	proxy.Sched.SchedAddNode(n)
+	front := httptest.NewServer(proxy.Router)
+	defer front.Close()
+
+	ctrl := dalb.CtrlPathInit()
+	call := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ctrl.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+	send := func(query string, header http.Header) (*http.Response, time.Duration) {
+		start := time.Now()
+		req, _ := http.NewRequest("GET", front.URL+"/timeout?"+query, nil)
+		for name := range header {
+			req.Header.Set(name, header.Get(name))
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		// the node slot is released once the request has ended
+		for cnt := 0; n.InFlight() != 0; cnt++ {
+			if cnt == 100 {
+				t.Fatal("node slot was not released", query)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		return resp, time.Since(start)
+	}
+	if w := call("PUT", "/timeout?path=/timeout", `{"firstByteMilliSec":100,"idleMilliSec":100}`); w.Code != http.StatusOK {
+		t.Fatal("timeouts were not set", w.Code, w.Body.String())
+	}
+
+	// a node that does not answer gets a 504 and its slot back
+	if resp, d := send("hang=1", nil); resp.StatusCode != http.StatusGatewayTimeout || d > time.Second {
+		t.Fatal("first byte timeout", resp.StatusCode, d)
+	}
+	if st := n.Stats(); st.TimeoutCount != 1 || st.ErrorCount != 1 {
+		t.Fatal("first byte timeout was not counted", st.TimeoutCount, st.ErrorCount)
+	}
+	// a node that stops in the middle of its response
+	if resp, d := send("stall=1", nil); resp.StatusCode != http.StatusOK || d > time.Second {
+		t.Fatal("idle timeout", resp.StatusCode, d)
+	}
+	if st := n.Stats(); st.TimeoutCount != 2 || st.ErrorCount != 2 {
+		t.Fatal("idle timeout was not counted", st.TimeoutCount, st.ErrorCount)
+	}
+	if resp, _ := send("", nil); resp.StatusCode != http.StatusOK || resp.Header.Get("X-Deadline") != "" {
+		t.Fatal("request after the timeouts", resp.StatusCode, resp.Header.Get("X-Deadline"))
+	}
+
+	// the client deadline is sent to the worker node with the time left
+	if w := call("PUT", "/timeout?path=/timeout", `{}`); w.Code != http.StatusOK {
+		t.Fatal("timeouts were not cleared", w.Code, w.Body.String())
+	}
+	resp, _ := send("", http.Header{dalb.DefaultDeadlineHeader: {"2000"}})
+	if ms, err := strconv.Atoi(resp.Header.Get("X-Deadline")); err != nil || ms <= 1000 || ms > 2000 {
+		t.Fatal("deadline sent to the worker node", resp.Header.Get("X-Deadline"))
+	}
+	// grpc-timeout is only used on gRPC calls
+	if resp, _ := send("", http.Header{"Grpc-Timeout": {"2S"}}); resp.Header.Get("X-Deadline") != "" {
+		t.Fatal("grpc-timeout of an HTTP request was used", resp.Header.Get("X-Deadline"))
+	}
+	if resp, d := send("hang=1", http.Header{dalb.DefaultDeadlineHeader: {"100"}}); resp.StatusCode != http.StatusGatewayTimeout || d > time.Second {
+		t.Fatal("client deadline", resp.StatusCode, d)
+	}
+	if resp, _ := send("", http.Header{dalb.DefaultDeadlineHeader: {"0"}}); resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatal("expired client deadline", resp.StatusCode)
+	}
+	// the route total timeout
+	if w := call("PUT", "/timeout?path=/timeout", `{"totalMilliSec":100}`); w.Code != http.StatusOK {
+		t.Fatal("timeouts were not set", w.Code, w.Body.String())
+	}
+	if resp, d := send("stall=1", nil); resp.StatusCode != http.StatusOK || d > time.Second {
+		t.Fatal("total timeout", resp.StatusCode, d)
+	}
+	// the client cannot give the worker node more time than the route total timeout
+	resp, _ = send("", http.Header{dalb.DefaultDeadlineHeader: {"99999999"}})
+	if ms, err := strconv.Atoi(resp.Header.Get("X-Deadline")); err != nil || ms > 100 {
+		t.Fatal("client deadline over the total timeout", resp.Header.Get("X-Deadline"))
+	}
+	if st := n.Stats(); st.TimeoutCount != 4 || st.ErrorCount != 4 {
+		t.Fatal("timeouts were not counted", st.TimeoutCount, st.ErrorCount)
+	}
+
+	var stats dalb.TimeoutStats
+	json.NewDecoder(call("GET", "/timeout?path=/timeout", "").Body).Decode(&stats)
+	if stats.TotalMilliSec != 100 || stats.DeadlineHeader != dalb.DefaultDeadlineHeader {
+		t.Fatal("timeout settings", stats)
+	}
+	want := map[string]int64{"connect": 0, "firstByte": 1, "idle": 1, "total": 1, "deadline": 2}
+	for kind, cnt := range want {
+		if stats.Counts[kind] != cnt {
+			t.Fatal("timeout counts", stats.Counts)
+		}
+	}
+	if w := call("PUT", "/timeout?path=/timeout", `{"idleMilliSec":-1}`); w.Code != http.StatusBadRequest {
+		t.Fatal("negative timeout was accepted", w.Code)
+	}
+}
+
+// a request waiting for a busy node slot gets a 504 at its deadline, and the wait ends when its client goes away
+func TestTimeoutWaitingForSlot(t *testing.T) {
+	worker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer worker.Close()
+	u, _ := url.Parse(worker.URL)
+	proxy := dalb.DataPathInit("/slotwait")
+	defer proxy.Sched.Delete()
+	n := node.NewNode()
+	n.IP = net.ParseIP(u.Hostname())
+	n.Port, _ = strconv.Atoi(u.Port())
+	n.MaxTransactions = 1
+	proxy.Sched.SchedAddNode(n)
+	// every slot is busy
+	if proxy.Sched.SchedGetNode() != n {
+		t.Fatal("the node slot was not taken")
+	}
+
+	start := time.Now()
+	r := httptest.NewRequest("GET", "http://example.com/slotwait", nil)
+	r.Header.Set(dalb.DefaultDeadlineHeader, "100")
+	w := httptest.NewRecorder()
+	proxy.Router.ServeHTTP(w, r)
+	if d := time.Since(start); w.Code != http.StatusGatewayTimeout || d < 100*time.Millisecond || d > time.Second {
+		t.Fatal("request waiting for a slot", w.Code, d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		proxy.Router.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/slotwait", nil).WithContext(ctx))
+		done <- w.Code
+	}()
+	for proxy.Sched.SchedWaiting() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the request kept waiting after its client went away")
+	}
+	if proxy.Sched.SchedWaiting() != 0 || n.InFlight() != 1 {
+		t.Fatal("waiting", proxy.Sched.SchedWaiting(), "in flight", n.InFlight())
+	}
+	proxy.Sched.SchedReScheduleNode(n)
+}
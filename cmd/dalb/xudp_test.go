@@ -0,0 +1,158 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"dalb/internal/app/dalb"
+	"dalb/internal/node"
+)
+
+// a UDP worker node that replies with its port number
+func udpWorker(t *testing.T) *net.UDPConn {
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			_, addr, err := c.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			c.WriteTo([]byte(strconv.Itoa(c.LocalAddr().(*net.UDPAddr).Port)), addr)
+		}
+	}()
+	return c
+}
+
+// send a datagram through the route, returns the port of the worker node that replied or "" for no reply
+func udpSend(t *testing.T, c *net.UDPConn) string {
+	c.Write([]byte("ping"))
+	c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	buf := make([]byte, 1500)
+	cnt, err := c.Read(buf)
+	if err != nil {
+		return ""
+	}
+	return string(buf[:cnt])
+}
+
+func TestUDPRoute(t *testing.T) {
+	for _, hash := range []bool{false, true} {
+		up := dalb.UDPPathInit("udp-" + strconv.FormatBool(hash))
+		up.IdleTimeout = 400 * time.Millisecond
+		up.HashFlows = hash
+		var nodes []*node.Node
+		for cnt := 0; cnt < 2; cnt++ {
+			w := udpWorker(t)
+			defer w.Close()
+			n := node.NewNode()
+			n.IP = net.ParseIP("127.0.0.1")
+			n.Port = w.LocalAddr().(*net.UDPAddr).Port
+			n.MaxTransactions = 1
+			up.Sched.SchedAddNode(n)
+			nodes = append(nodes, n)
+		}
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go up.Serve(conn)
+
+		var clients []*net.UDPConn
+		for cnt := 0; cnt < 3; cnt++ {
+			c, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			clients = append(clients, c)
+		}
+		// every datagram of a flow goes to the same worker node
+		first := udpSend(t, clients[0])
+		second := udpSend(t, clients[1])
+		if first == "" || second == "" {
+			t.Fatal("no reply", hash)
+		}
+		for cnt := 0; cnt < 3; cnt++ {
+			if got := udpSend(t, clients[0]); got != first {
+				t.Fatal("flow moved to another worker node", first, got)
+			}
+		}
+		if !hash {
+			// every flow holds a slot, the third client has to wait until a flow is idle
+			if first == second {
+				t.Fatal("both flows on one worker node with a single slot")
+			}
+			if got := udpSend(t, clients[2]); got != "" {
+				t.Fatal("flow got a worker node without a free slot", got)
+			}
+			time.Sleep(up.IdleTimeout + 300*time.Millisecond)
+			if got := udpSend(t, clients[2]); got == "" {
+				t.Fatal("idle flows did not release their slots")
+			}
+		}
+		up.Close()
+		var pin, pout int64
+		for _, n := range nodes {
+			st := n.Stats()
+			pin += st.PacketsIn
+			pout += st.PacketsOut
+		}
+		st := up.Sched.Stats()
+		if pin != st.PacketsIn-st.Drops || pout != pin || pin < 5 {
+			t.Fatal("packet counts are not correct", hash, pin, pout, st.PacketsIn, st.Drops)
+		}
+		up.Sched.Delete()
+	}
+}
+
+// a hashed flow whose worker node is down moves to the next node in the hash order
+func TestUDPHashUnhealthy(t *testing.T) {
+	up := dalb.UDPPathInit("udp-unhealthy")
+	up.HashFlows = true
+	defer up.Sched.Delete()
+	nodes := make(map[string]*node.Node)
+	for cnt := 0; cnt < 2; cnt++ {
+		w := udpWorker(t)
+		defer w.Close()
+		n := node.NewNode()
+		n.IP = net.ParseIP("127.0.0.1")
+		n.Port = w.LocalAddr().(*net.UDPAddr).Port
+		n.MaxTransactions = 1
+		up.Sched.SchedAddNode(n)
+		nodes[strconv.Itoa(n.Port)] = n
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go up.Serve(conn)
+	defer up.Close()
+	c, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	first := udpSend(t, c)
+	if nodes[first] == nil {
+		t.Fatal("no reply", first)
+	}
+	up.Sched.SchedSetHealthy(nodes[first], false)
+	second := udpSend(t, c)
+	if second == first || nodes[second] == nil {
+		t.Fatal("flow stayed on the unhealthy worker node", first, second)
+	}
+	up.Sched.SchedBackoff(nodes[second], time.Minute)
+	if got := udpSend(t, c); got != "" {
+		t.Fatal("flow went to a worker node that is down or backed off", got)
+	}
+}
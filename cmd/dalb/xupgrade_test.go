@@ -0,0 +1,103 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"dalb/internal/app/dalb"
+	"dalb/internal/node"
+)
+
+// open a WebSocket connection through dalb, returns the connection and the response status
+func wsDial(t *testing.T, addr string) (net.Conn, *bufio.Reader, int) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("GET /ws HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, br, resp.StatusCode
+}
+
+func TestUpgradeConnections(t *testing.T) {
+	// a worker node that switches to WebSocket, sends one text frame and waits for the client to close
+	worker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		brw.Write([]byte{0x81, 2, 'h', 'i'})
+		brw.Flush()
+		io.Copy(ioutil.Discard, brw)
+	}))
+	defer worker.Close()
+	u, _ := url.Parse(worker.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+
+	proxy := dalb.DataPathInit("/ws")
+	defer proxy.Sched.Delete()
+	n := node.NewNode()
+	n.IP = net.ParseIP(host)
+	n.Port, _ = strconv.Atoi(port)
+	n.MaxTransactions = 1
+	n.MaxConnections = 1
+	proxy.Sched.SchedAddNode(n)
+	front := httptest.NewServer(proxy.Router)
+	defer front.Close()
+	addr := front.Listener.Addr().String()
+
+	c, br, status := wsDial(t, addr)
+	defer c.Close()
+	if status != http.StatusSwitchingProtocols {
+		t.Fatal("connection was not upgraded", status)
+	}
+	frame := make([]byte, 4)
+	if _, err := io.ReadFull(br, frame); err != nil || string(frame[2:]) != "hi" {
+		t.Fatal("WebSocket frame was not proxied", frame, err)
+	}
+	// the upgraded connection uses a connection slot, not a transaction slot
+	if n.InFlight() != 0 || n.Connections() != 1 {
+		t.Fatal("upgraded connection is counted as a transaction", n.InFlight(), n.Connections())
+	}
+	if st := n.Stats(); st.TransactionCount != 1 || st.ConnectionCount != 0 {
+		t.Fatal("handshake is not the transaction", st.TransactionCount, st.ConnectionCount)
+	}
+	if _, _, status := wsDial(t, addr); status != http.StatusServiceUnavailable {
+		t.Fatal("connection limit was not applied", status)
+	}
+
+	// draining the node asks the client to reconnect
+	w := httptest.NewRecorder()
+	dalb.CtrlPathInit().ServeHTTP(w, httptest.NewRequest("DELETE", "/node/"+n.ID, nil))
+	if w.Code != http.StatusOK {
+		t.Fatal("node was not drained", w.Code)
+	}
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	closeFrame, _ := ioutil.ReadAll(br)
+	if len(closeFrame) < 4 || closeFrame[0] != 0x88 || int(closeFrame[2])<<8|int(closeFrame[3]) != 1012 {
+		t.Fatal("client did not get a close frame", closeFrame)
+	}
+	for cnt := 0; n.Connections() != 0 && cnt < 100; cnt++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := n.Stats(); n.Connections() != 0 || st.ConnectionCount != 1 || len(proxy.Sched.SchedNodes()) != 0 {
+		t.Fatal("connection statistics are not correct", n.Connections(), st.ConnectionCount)
+	}
+}
@@ -0,0 +1,255 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package accesslog
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//access log formats
+const (
+	FormatJSON     = "json"
+	FormatCombined = "combined"
+)
+
+//buffered log lines are written out at least this often
+const flushInterval = time.Second
+
+//The fields of an access log entry, in the order they are written
+var AllFields = []string{
+	"time",
+	"request_id",
+	"client_ip",
+	"method",
+	"url",
+	"proto",
+	"status",
+	"bytes_in",
+	"bytes_out",
+	"node",
+	"queue_wait_ms",
+	"upstream_ms",
+	"total_ms",
+	"retries",
+	"referer",
+	"user_agent",
+}
+
+//One proxied request
+type Entry struct {
+	Time      time.Time
+	RequestID string
+	ClientIP  string
+	Method    string
+	URL       string
+	Proto     string
+	Status    int
+	BytesIn   int64
+	BytesOut  int64
+	// the worker node the request was sent to, empty when there was none
+	Node      string
+	QueueWait time.Duration
+	Upstream  time.Duration
+	Total     time.Duration
+	Retries   int
+	Referer   string
+	UserAgent string
+}
+
+//returns the JSON value of an entry field
+func (e *Entry) jsonValue(field string) []byte {
+	switch field {
+	case "time":
+		return jsonString(e.Time.Format(time.RFC3339Nano))
+	case "request_id":
+		return jsonString(e.RequestID)
+	case "client_ip":
+		return jsonString(e.ClientIP)
+	case "method":
+		return jsonString(e.Method)
+	case "url":
+		return jsonString(e.URL)
+	case "proto":
+		return jsonString(e.Proto)
+	case "status":
+		return []byte(strconv.Itoa(e.Status))
+	case "bytes_in":
+		return []byte(strconv.FormatInt(e.BytesIn, 10))
+	case "bytes_out":
+		return []byte(strconv.FormatInt(e.BytesOut, 10))
+	case "node":
+		return jsonString(e.Node)
+	case "queue_wait_ms":
+		return milliSec(e.QueueWait)
+	case "upstream_ms":
+		return milliSec(e.Upstream)
+	case "total_ms":
+		return milliSec(e.Total)
+	case "retries":
+		return []byte(strconv.Itoa(e.Retries))
+	case "referer":
+		return jsonString(e.Referer)
+	case "user_agent":
+		return jsonString(e.UserAgent)
+	}
+	return []byte("null")
+}
+
+func jsonString(s string) []byte {
+	b, _ := json.Marshal(s)
+	return b
+}
+
+func milliSec(d time.Duration) []byte {
+	return strconv.AppendFloat(nil, float64(d)/float64(time.Millisecond), 'f', 3, 64)
+}
+
+//Controls what is logged
+type Config struct {
+	// FormatJSON or FormatCombined
+	Format string
+	// fraction (0.0 - 1.0) of the requests that are logged, 5xx responses are always logged
+	SampleRate float64
+	// the fields logged, all of them when empty. With FormatCombined the fields are appended
+	// to the combined log format line as key=value pairs.
+	Fields []string
+}
+
+//Writes access log entries
+type Logger struct {
+	config Config
+	lock   sync.Mutex
+	out    io.Writer
+	w      *bufio.Writer
+	rand   *rand.Rand
+	ticker *time.Ticker
+}
+
+//returns a Logger writing to out
+func New(out io.Writer, config Config) (*Logger, error) {
+	switch config.Format {
+	case "":
+		config.Format = FormatJSON
+	case FormatJSON, FormatCombined:
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", config.Format)
+	}
+	if len(config.Fields) == 0 && config.Format == FormatJSON {
+		config.Fields = AllFields
+	}
+	for _, f := range config.Fields {
+		if !validField(f) {
+			return nil, fmt.Errorf("unknown access log field %q", f)
+		}
+	}
+	l := &Logger{
+		config: config,
+		out:    out,
+		w:      bufio.NewWriter(out),
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		ticker: time.NewTicker(flushInterval),
+	}
+	go func(l *Logger) {
+		for range l.ticker.C {
+			l.lock.Lock()
+			l.w.Flush()
+			l.lock.Unlock()
+		}
+	}(l)
+	return l, nil
+}
+
+func validField(field string) bool {
+	for _, f := range AllFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+//returns the field list from a comma separated string
+func ParseFields(fields string) []string {
+	list := make([]string, 0)
+	for _, f := range strings.Split(fields, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			list = append(list, f)
+		}
+	}
+	return list
+}
+
+//write an entry, unless it is not sampled
+func (l *Logger) Log(e *Entry) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if e.Status < 500 && l.config.SampleRate < 1 && l.rand.Float64() >= l.config.SampleRate {
+		return
+	}
+	if l.config.Format == FormatCombined {
+		l.writeCombined(e)
+	} else {
+		l.writeJSON(e)
+	}
+}
+
+func (l *Logger) writeJSON(e *Entry) {
+	l.w.WriteByte('{')
+	for idx, f := range l.config.Fields {
+		if idx > 0 {
+			l.w.WriteByte(',')
+		}
+		l.w.WriteByte('"')
+		l.w.WriteString(f)
+		l.w.WriteString(`":`)
+		l.w.Write(e.jsonValue(f))
+	}
+	l.w.WriteString("}\n")
+}
+
+//Apache/NCSA combined log format, followed by the selected fields as key=value
+func (l *Logger) writeCombined(e *Entry) {
+	fmt.Fprintf(l.w, `%s - - [%s] "%s %s %s" %d %d %s %s`,
+		dash(e.ClientIP), e.Time.Format("02/Jan/2006:15:04:05 -0700"), e.Method, e.URL, e.Proto,
+		e.Status, e.BytesOut, strconv.Quote(e.Referer), strconv.Quote(e.UserAgent))
+	for _, f := range l.config.Fields {
+		l.w.WriteByte(' ')
+		l.w.WriteString(f)
+		l.w.WriteByte('=')
+		l.w.Write(e.jsonValue(f))
+	}
+	l.w.WriteByte('\n')
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+//flush the buffered entries and close the output if it is an io.Closer
+func (l *Logger) Close() error {
+	l.ticker.Stop()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	err := l.w.Flush()
+	if c, ok := l.out.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,92 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testEntry(status int) *Entry {
+	return &Entry{
+		Time:      time.Date(2019, 10, 2, 13, 55, 36, 0, time.UTC),
+		RequestID: "abc",
+		ClientIP:  "10.1.1.1",
+		Method:    "GET",
+		URL:       "/a?b=\"c\"",
+		Proto:     "HTTP/1.1",
+		Status:    status,
+		BytesIn:   10,
+		BytesOut:  2326,
+		Node:      "10.0.0.1:9000",
+		QueueWait: 1500 * time.Microsecond,
+		Upstream:  20 * time.Millisecond,
+		Total:     22 * time.Millisecond,
+		UserAgent: "curl/7.64",
+	}
+}
+
+func TestLogger_JSON(t *testing.T) {
+	out := &bytes.Buffer{}
+	l, err := New(out, Config{Format: FormatJSON, SampleRate: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Log(testEntry(200))
+	l.Close()
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatal("access log entry is not JSON", out.String())
+	}
+	if len(entry) != len(AllFields) || entry["url"] != `/a?b="c"` || entry["queue_wait_ms"] != 1.5 || entry["node"] != "10.0.0.1:9000" {
+		t.Fatal("access log entry is not correct", entry)
+	}
+}
+
+func TestLogger_Fields(t *testing.T) {
+	out := &bytes.Buffer{}
+	l, err := New(out, Config{Format: FormatJSON, SampleRate: 1, Fields: ParseFields("status, node")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Log(testEntry(200))
+	l.Close()
+	if out.String() != `{"status":200,"node":"10.0.0.1:9000"}`+"\n" {
+		t.Fatal("field selection not applied", out.String())
+	}
+	if _, err := New(out, Config{Fields: []string{"nope"}}); err == nil {
+		t.Fatal("unknown field accepted")
+	}
+	if _, err := New(out, Config{Format: "xml"}); err == nil {
+		t.Fatal("unknown format accepted")
+	}
+}
+
+func TestLogger_Combined(t *testing.T) {
+	out := &bytes.Buffer{}
+	l, err := New(out, Config{Format: FormatCombined, SampleRate: 1, Fields: []string{"total_ms"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Log(testEntry(200))
+	l.Close()
+	want := `10.1.1.1 - - [02/Oct/2019:13:55:36 +0000] "GET /a?b="c" HTTP/1.1" 200 2326 "" "curl/7.64" total_ms=22.000` + "\n"
+	if out.String() != want {
+		t.Fatal("combined log line is not correct", out.String())
+	}
+}
+
+func TestLogger_Sampling(t *testing.T) {
+	out := &bytes.Buffer{}
+	l, _ := New(out, Config{SampleRate: 0})
+	l.Log(testEntry(200))
+	l.Log(testEntry(503))
+	l.Close()
+	if strings.Count(out.String(), "\n") != 1 || !strings.Contains(out.String(), `"status":503`) {
+		t.Fatal("sampling did not keep only the error", out.String())
+	}
+}
@@ -0,0 +1,103 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package accesslog
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+//rotated files are renamed to <path>.<time in this format>
+const rotateTimeFormat = "20060102T150405.000000"
+
+//A file that is rotated when it grows past MaxSize bytes or is older than MaxAge.
+//Only the newest MaxBackups rotated files are kept. A zero limit is not enforced.
+type RotatingFile struct {
+	Path       string
+	MaxSize    int64
+	MaxAge     time.Duration
+	MaxBackups int
+
+	lock   sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+//open (append to) the file at path
+func OpenRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*RotatingFile, error) {
+	rf := &RotatingFile{
+		Path:       path,
+		MaxSize:    maxSize,
+		MaxAge:     maxAge,
+		MaxBackups: maxBackups,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f = f
+	rf.size = info.Size()
+	rf.opened = time.Now()
+	return nil
+}
+
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	if rf.size > 0 && ((rf.MaxSize > 0 && rf.size+int64(len(p)) > rf.MaxSize) ||
+		(rf.MaxAge > 0 && time.Since(rf.opened) >= rf.MaxAge)) {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+//rename the current file and start a new one
+func (rf *RotatingFile) rotate() error {
+	rf.f.Close()
+	if err := os.Rename(rf.Path, rf.Path+"."+time.Now().Format(rotateTimeFormat)); err != nil {
+		// keep appending to the file, the rotation is tried again with the next write
+		if oerr := rf.open(); oerr != nil {
+			return oerr
+		}
+		return err
+	}
+	if err := rf.open(); err != nil {
+		return err
+	}
+	if rf.MaxBackups > 0 {
+		backups, _ := filepath.Glob(rf.Path + ".*")
+		sort.Strings(backups)
+		for len(backups) > rf.MaxBackups {
+			os.Remove(backups[0])
+			backups = backups[1:]
+		}
+	}
+	return nil
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	return rf.f.Close()
+}
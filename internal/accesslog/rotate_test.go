@@ -0,0 +1,46 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package accesslog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dalb-accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	rf, err := OpenRotatingFile(path, 10, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		rf.Write([]byte("0123456789"))
+		time.Sleep(time.Millisecond)
+	}
+	rf.Close()
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Fatal("backups not limited", backups)
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "0123456789" {
+		t.Fatal("current file is not correct", string(data))
+	}
+
+	// rotate by age
+	rf, _ = OpenRotatingFile(path, 0, time.Millisecond, 0)
+	time.Sleep(2 * time.Millisecond)
+	rf.Write([]byte("x"))
+	rf.Close()
+	if data, _ := ioutil.ReadFile(path); string(data) != "x" {
+		t.Fatal("file was not rotated by age", string(data))
+	}
+}
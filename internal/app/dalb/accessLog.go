@@ -0,0 +1,119 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package dalb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"dalb/internal/accesslog"
+)
+
+//wraps the client http.ResponseWriter to record the status and number of bytes sent to the client
+type dataPathWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func newDataPathWriter(w http.ResponseWriter) *dataPathWriter {
+	return &dataPathWriter{ResponseWriter: w}
+}
+
+func (dw *dataPathWriter) WriteHeader(status int) {
+	if dw.status == 0 {
+		dw.status = status
+	}
+	dw.ResponseWriter.WriteHeader(status)
+}
+
+func (dw *dataPathWriter) Write(b []byte) (int, error) {
+	if dw.status == 0 {
+		dw.status = http.StatusOK
+	}
+	n, err := dw.ResponseWriter.Write(b)
+	dw.bytes += int64(n)
+	return n, err
+}
+
+func (dw *dataPathWriter) Flush() {
+	if f, ok := dw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (dw *dataPathWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := dw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection cannot be hijacked")
+	}
+	if dw.status == 0 {
+		dw.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+//used by http.ResponseController to reach the client http.ResponseWriter
+func (dw *dataPathWriter) Unwrap() http.ResponseWriter {
+	return dw.ResponseWriter
+}
+
+//wraps a request body to count the bytes received from the client
+type countingBody struct {
+	io.ReadCloser
+	bytes int64
+}
+
+//replace the request body with a countingBody
+func newCountingBody(r *http.Request) *countingBody {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	body := &countingBody{ReadCloser: r.Body}
+	r.Body = body
+	return body
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes += int64(n)
+	return n, err
+}
+
+//write the access log entry for a proxied request
+func (p *DataPathProxy) logAccess(dw *dataPathWriter, r *http.Request, body *countingBody, txn *transaction) {
+	e := accesslog.Entry{
+		Time:      txn.start,
+		RequestID: txn.id,
+		ClientIP:  txn.clientIP,
+		Method:    r.Method,
+		URL:       r.URL.RequestURI(),
+		Proto:     r.Proto,
+		Status:    dw.status,
+		BytesOut:  dw.bytes,
+		QueueWait: txn.queueWait,
+		Upstream:  txn.upstream,
+		Total:     time.Since(txn.start),
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+	}
+	if e.Status == 0 {
+		e.Status = http.StatusOK
+	}
+	if body != nil {
+		e.BytesIn = body.bytes
+	}
+	if txn.node != nil {
+		e.Node = fmt.Sprintf("%s:%d", txn.node.IP.String(), txn.node.Port)
+	}
+	if txn.attempts > 1 {
+		e.Retries = txn.attempts - 1
+	}
+	p.AccessLog.Log(&e)
+}
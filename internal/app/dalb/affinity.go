@@ -0,0 +1,206 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package dalb
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"dalb/internal/node"
+)
+
+//session affinity modes
+const (
+	AffinityCookie    = "cookie"     // dalb sets a signed cookie naming the worker node
+	AffinityAppCookie = "app-cookie" // the worker node is picked by a hash of a cookie set by the application
+	AffinityHeader    = "header"     // the worker node is picked by a hash of a request header
+)
+
+//the name of the dalb session cookie
+const DefaultAffinityCookie = "DALB_NODE"
+
+//Session affinity for a data path route: the requests of a session go to the same worker node
+//while it is healthy, for applications that keep the session state in the memory of the node.
+type Affinity struct {
+	Mode string
+	// the cookie or header name
+	Name string
+	// HMAC key the dalb cookies are signed with
+	Key []byte
+	// lifetime of the dalb cookie, 0 for a browser session
+	MaxAge time.Duration
+}
+
+//returns the Affinity for "cookie", "cookie:NAME", "app-cookie:NAME" or "header:NAME", nil for "".
+//The dalb cookies are signed with a random key, set Key to keep the sessions when dalb restarts.
+func ParseAffinity(spec string) (*Affinity, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	a := &Affinity{Mode: spec}
+	if idx := strings.IndexByte(spec, ':'); idx >= 0 {
+		a.Mode, a.Name = spec[:idx], spec[idx+1:]
+	}
+	switch a.Mode {
+	case AffinityCookie:
+		if a.Name == "" {
+			a.Name = DefaultAffinityCookie
+		}
+	case AffinityAppCookie, AffinityHeader:
+		if a.Name == "" {
+			return nil, errors.New(a.Mode + " affinity needs a name, e.g. " + a.Mode + ":SESSIONID")
+		}
+	default:
+		return nil, errors.New("invalid affinity mode " + a.Mode)
+	}
+	a.Key = make([]byte, 32)
+	if _, err := rand.Read(a.Key); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+//returns an error when the affinity cannot be used
+func (a *Affinity) valid() error {
+	switch a.Mode {
+	case AffinityCookie:
+		if len(a.Key) == 0 {
+			return errors.New("cookie affinity needs a key")
+		}
+	case AffinityAppCookie, AffinityHeader:
+	default:
+		return errors.New("invalid affinity mode " + a.Mode)
+	}
+	if a.Name == "" {
+		return errors.New(a.Mode + " affinity needs a name")
+	}
+	if a.MaxAge < 0 {
+		return errors.New("the affinity max age cannot be negative")
+	}
+	return nil
+}
+
+// Returns the session affinity of the route, nil when the requests of a client can go to any worker node
+func (p *DataPathProxy) Affinity() *Affinity {
+	a, _ := p.affinity.Load().(*Affinity)
+	return a
+}
+
+// Set the session affinity of the route, nil turns it off. The requests in progress keep the affinity
+// they started with.
+func (p *DataPathProxy) SetAffinity(a *Affinity) error {
+	if a != nil {
+		if err := a.valid(); err != nil {
+			return err
+		}
+	}
+	p.affinity.Store(a)
+	return nil
+}
+
+//returns the signed cookie value naming a worker node of a route
+func (a *Affinity) sign(route, id string) string {
+	mac := hmac.New(sha256.New, a.Key)
+	mac.Write([]byte(route + "\x00" + id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+//returns the worker node ID of a signed cookie value, "" when the signature is not valid
+func (a *Affinity) verify(route, value string) string {
+	idx := strings.LastIndexByte(value, '.')
+	if idx <= 0 {
+		return ""
+	}
+	id := value[:idx]
+	if !hmac.Equal([]byte(a.sign(route, id)), []byte(value)) {
+		return ""
+	}
+	return id
+}
+
+//returns true if a node can be given new requests
+func usable(n *node.Node) bool {
+	return n.Healthy() && n.Backoff().IsZero()
+}
+
+//returns the worker node of scheduler s the session of a request should go to and whether it is the node of
+//the session (AffinityHit), a node taking over from it (AffinityMiss) or the request has no
+//session yet (AffinityNew). The node is nil when the Scheduler should pick one.
+func (p *DataPathProxy) affinityNode(r *http.Request, s *node.Scheduler, a *Affinity) (*node.Node, node.AffinityResult) {
+	var key string
+	switch a.Mode {
+	case AffinityCookie:
+		c, err := r.Cookie(a.Name)
+		if err != nil {
+			return nil, node.AffinityNew
+		}
+		id := a.verify(p.path, c.Value)
+		if id == "" {
+			// forged, or signed with another key
+			return nil, node.AffinityNew
+		}
+		for _, n := range s.SchedNodes() {
+			if n.ID == id && usable(n) {
+				return n, node.AffinityHit
+			}
+		}
+		return nil, node.AffinityMiss
+	case AffinityAppCookie:
+		if c, err := r.Cookie(a.Name); err == nil {
+			key = c.Value
+		}
+	case AffinityHeader:
+		key = r.Header.Get(a.Name)
+	}
+	if key == "" {
+		return nil, node.AffinityNew
+	}
+	nodes := s.SchedNodes()
+	if n := rendezvousNode(key, nodes); n == nil || usable(n) {
+		return n, node.AffinityHit
+	}
+	// the sessions of a node that cannot be used all move to the same next node in the hash order
+	avail := nodes[:0]
+	for _, n := range nodes {
+		if usable(n) {
+			avail = append(avail, n)
+		}
+	}
+	return rendezvousNode(key, avail), node.AffinityMiss
+}
+
+//count the affinity result of a request that has been given node n. The client is given a
+//dalb cookie naming the node when the request was not already sent to the node of its cookie.
+func (p *DataPathProxy) updateAffinity(w http.ResponseWriter, r *http.Request, txn *transaction, n *node.Node, result node.AffinityResult, a *Affinity) {
+	if result == node.AffinityHit && n != txn.pinned {
+		result = node.AffinityMiss
+	}
+	txn.sched.UpdateAffinity(result)
+	txn.log = txn.log.WithField("affinity", affinityNames[result])
+	if a.Mode != AffinityCookie || result == node.AffinityHit {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     a.Name,
+		Value:    a.sign(p.path, n.ID),
+		Path:     "/",
+		MaxAge:   int(a.MaxAge / time.Second),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+//the names of the affinity results in logs and metrics
+var affinityNames = [...]string{
+	node.AffinityHit:  "hit",
+	node.AffinityMiss: "miss",
+	node.AffinityNew:  "new",
+}
@@ -0,0 +1,87 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package dalb
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// SESSION AFFINITY
+// the session affinity of a route, Mode is "" when it is off
+type AffinityConfig struct {
+	Path      string `json:"path"`
+	Mode      string `json:"mode"`
+	Name      string `json:"name"`
+	MaxAgeSec int64  `json:"maxAgeSec"`
+}
+
+// the session affinity to set, Key is the HMAC key of the dalb cookies
+type SetAffinity struct {
+	Mode      string `json:"mode"`
+	Name      string `json:"name"`
+	MaxAgeSec int64  `json:"maxAgeSec"`
+	Key       string `json:"key"`
+}
+
+//GET /affinity?path=<route>, the HTTP data path when path is not a route name
+func affinityGet(w http.ResponseWriter, r *http.Request) {
+	p := requestDataPath(w, r)
+	if p == nil {
+		return
+	}
+	st := AffinityConfig{Path: p.path}
+	if a := p.Affinity(); a != nil {
+		st.Mode = a.Mode
+		st.Name = a.Name
+		st.MaxAgeSec = int64(a.MaxAge / time.Second)
+	}
+	json.NewEncoder(w).Encode(st)
+}
+
+//PUT /affinity?path=<route>, set the session affinity of the route. Without a key the dalb cookies keep
+//the key they are signed with, or get a random one.
+func affinityPut(w http.ResponseWriter, r *http.Request) {
+	p := requestDataPath(w, r)
+	if p == nil {
+		return
+	}
+	set := &SetAffinity{}
+	if err := json.NewDecoder(r.Body).Decode(set); err != nil {
+		http.Error(w, "JSON format error", http.StatusBadRequest)
+		return
+	}
+	spec := set.Mode
+	if set.Name != "" {
+		spec += ":" + set.Name
+	}
+	if spec == "" {
+		http.Error(w, "affinity mode is missing", http.StatusBadRequest)
+		return
+	}
+	a, err := ParseAffinity(spec)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if set.Key != "" {
+		a.Key = []byte(set.Key)
+	} else if cur := p.Affinity(); cur != nil && cur.Mode == AffinityCookie {
+		a.Key = cur.Key
+	}
+	a.MaxAge = time.Duration(set.MaxAgeSec) * time.Second
+	if err := p.SetAffinity(a); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+//DELETE /affinity?path=<route>, the requests of a client can go to any worker node
+func affinityDelete(w http.ResponseWriter, r *http.Request) {
+	p := requestDataPath(w, r)
+	if p == nil {
+		return
+	}
+	p.SetAffinity(nil)
+}
@@ -0,0 +1,123 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package dalb
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"dalb/internal/node"
+
+	"github.com/gorilla/mux"
+)
+
+// NODE GROUPS
+// the node groups of a route with their statistics side by side, e.g. to compare a canary with the stable version
+type GroupStats struct {
+	Path   string      `json:"path"`
+	Header string      `json:"header,omitempty"`
+	Cookie string      `json:"cookie,omitempty"`
+	Groups []GroupStat `json:"groups"`
+}
+
+type GroupStat struct {
+	Name      string         `json:"name"`
+	Weight    int            `json:"weight"`
+	Share     float64        `json:"share"`
+	Nodes     int            `json:"nodes"`
+	ErrorRate float64        `json:"errorRate"`
+	Stats     schedulerStats `json:"stats"`
+}
+
+type SetGroup struct {
+	Weight int `json:"weight"`
+}
+
+//returns the scheduler of the path and group query parameters of a control path request,
+//nil after sending an error when there is no such group
+func requestScheduler(w http.ResponseWriter, r *http.Request) *node.Scheduler {
+	q := r.URL.Query()
+	s := routeGroupScheduler(q.Get("path"), q.Get("group"))
+	if s == nil {
+		http.Error(w, "group not found", http.StatusNotFound)
+	}
+	return s
+}
+
+//returns the HTTP route of the path query parameter of a control path request,
+//nil after sending an error when it is not an HTTP route
+func requestDataPath(w http.ResponseWriter, r *http.Request) *DataPathProxy {
+	p := routeDataPath(r.URL.Query().Get("path"))
+	if p == nil {
+		http.Error(w, "node groups are only supported on HTTP routes", http.StatusBadRequest)
+	}
+	return p
+}
+
+//GET /group?path=<route>, the HTTP data path when path is not a route name
+func groupStatsGet(w http.ResponseWriter, r *http.Request) {
+	p := requestDataPath(w, r)
+	if p == nil {
+		return
+	}
+	groups := p.Groups()
+	total := 0
+	for _, g := range groups {
+		total += g.Weight()
+	}
+	stats := GroupStats{
+		Path:   p.path,
+		Header: p.GroupHeader,
+		Cookie: p.GroupCookie,
+		Groups: make([]GroupStat, 0, len(groups)),
+	}
+	for _, g := range groups {
+		gs := GroupStat{
+			Name:   g.Name,
+			Weight: g.Weight(),
+			Nodes:  len(g.Sched.SchedNodes()),
+			Stats:  newSchedulerStats(g.Sched),
+		}
+		if total > 0 {
+			gs.Share = float64(gs.Weight) / float64(total)
+		}
+		if gs.Stats.TransactionCount > 0 {
+			gs.ErrorRate = float64(gs.Stats.ErrorCount) / float64(gs.Stats.TransactionCount)
+		}
+		stats.Groups = append(stats.Groups, gs)
+	}
+	json.NewEncoder(w).Encode(stats)
+}
+
+//PUT /group/{name}?path=<route>, set the traffic weight of a node group, the group is created when it does not exist
+func groupPut(w http.ResponseWriter, r *http.Request) {
+	p := requestDataPath(w, r)
+	if p == nil {
+		return
+	}
+	set := &SetGroup{}
+	if err := json.NewDecoder(r.Body).Decode(set); err != nil {
+		http.Error(w, "JSON format error", http.StatusBadRequest)
+		return
+	}
+	if _, err := p.SetGroup(mux.Vars(r)["name"], set.Weight); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+//DELETE /group/{name}?path=<route>, drain the worker nodes of a node group and delete it
+func groupDelete(w http.ResponseWriter, r *http.Request) {
+	p := requestDataPath(w, r)
+	if p == nil {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if p.Group(name) == nil {
+		http.Error(w, "group not found", http.StatusNotFound)
+		return
+	}
+	if err := p.DeleteGroup(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,121 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package dalb
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// HEDGING
+// the slow requests sent again to another node, and how many of the copies answered first
+type HedgeStats struct {
+	Path             string       `json:"path"`
+	Methods          []string     `json:"methods"`
+	DelayMilliSec    float64      `json:"delayMilliSec"`
+	Percentile       float64      `json:"percentile"`
+	MinDelayMilliSec float64      `json:"minDelayMilliSec"`
+	BudgetPercent    float64      `json:"budgetPercent"`
+	Eligible         int64        `json:"eligible"`
+	Hedged           int64        `json:"hedged"`
+	Wins             int64        `json:"wins"`
+	BudgetExhausted  int64        `json:"budgetExhausted"`
+	NoNode           int64        `json:"noNode"`
+	Groups           []HedgeGroup `json:"groups"`
+}
+
+// the hedge delay of a node group, 0 until the group has enough recent transaction times
+type HedgeGroup struct {
+	Name          string  `json:"name"`
+	DelayMilliSec float64 `json:"delayMilliSec"`
+	HedgeCount    int64   `json:"hedgeCount"`
+	HedgeWins     int64   `json:"hedgeWins"`
+}
+
+// the hedging to set, the defaults are used for the missing fields
+type SetHedge struct {
+	Methods          []string `json:"methods"`
+	DelayMilliSec    float64  `json:"delayMilliSec"`
+	Percentile       float64  `json:"percentile"`
+	MinDelayMilliSec *float64 `json:"minDelayMilliSec"`
+	BudgetPercent    float64  `json:"budgetPercent"`
+}
+
+//fractional milliseconds to a time.Duration
+func milliSecDuration(ms float64) time.Duration {
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+//GET /hedge?path=<route>, the HTTP data path when path is not a route name
+func hedgeGet(w http.ResponseWriter, r *http.Request) {
+	p := requestDataPath(w, r)
+	if p == nil {
+		return
+	}
+	h := p.Hedging()
+	if h == nil {
+		http.Error(w, "hedging is off", http.StatusNotFound)
+		return
+	}
+	stats := HedgeStats{
+		Path:             p.path,
+		Methods:          h.Methods,
+		DelayMilliSec:    milliSec(h.Delay),
+		Percentile:       h.Percentile,
+		MinDelayMilliSec: milliSec(h.MinDelay),
+		BudgetPercent:    h.BudgetPercent,
+		Groups:           make([]HedgeGroup, 0),
+	}
+	stats.Eligible, stats.Hedged, stats.Wins, stats.BudgetExhausted, stats.NoNode = h.Counts()
+	for _, g := range p.Groups() {
+		st := g.Sched.Stats()
+		stats.Groups = append(stats.Groups, HedgeGroup{
+			Name:          g.Name,
+			DelayMilliSec: milliSec(h.DelayFor(g.Sched)),
+			HedgeCount:    st.HedgeCount,
+			HedgeWins:     st.HedgeWins,
+		})
+	}
+	json.NewEncoder(w).Encode(stats)
+}
+
+//PUT /hedge?path=<route>, send the slow idempotent requests of the route again to another node
+func hedgePut(w http.ResponseWriter, r *http.Request) {
+	p := requestDataPath(w, r)
+	if p == nil {
+		return
+	}
+	set := &SetHedge{}
+	if err := json.NewDecoder(r.Body).Decode(set); err != nil {
+		http.Error(w, "JSON format error", http.StatusBadRequest)
+		return
+	}
+	h := NewHedge(DefaultHedgeBudget)
+	if set.Methods != nil {
+		h.Methods = set.Methods
+	}
+	h.Delay = milliSecDuration(set.DelayMilliSec)
+	if set.Percentile != 0 {
+		h.Percentile = set.Percentile
+	}
+	if set.MinDelayMilliSec != nil {
+		h.MinDelay = milliSecDuration(*set.MinDelayMilliSec)
+	}
+	if set.BudgetPercent != 0 {
+		h.BudgetPercent = set.BudgetPercent
+	}
+	if err := p.SetHedge(h); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+//DELETE /hedge?path=<route>, stop hedging the requests of the route
+func hedgeDelete(w http.ResponseWriter, r *http.Request) {
+	p := requestDataPath(w, r)
+	if p == nil {
+		return
+	}
+	p.SetHedge(nil)
+}
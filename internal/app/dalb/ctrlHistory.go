@@ -0,0 +1,128 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package dalb
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"dalb/internal/node"
+
+	"github.com/gorilla/mux"
+)
+
+//the history returned when the request does not specify from
+const defaultHistorySpan = time.Hour
+
+// PERFORMANCE HISTORY
+type HistoryPoint struct {
+	Time             time.Time `json:"time"`
+	StepSec          float64   `json:"stepSec"`
+	TransactionCount int64     `json:"transactionCount"`
+	ErrorCount       int64     `json:"errorCount"`
+	Slots            int       `json:"slots"`
+	InFlight         int       `json:"inFlight"`
+	P50MilliSec      float64   `json:"p50MilliSec"`
+	P90MilliSec      float64   `json:"p90MilliSec"`
+	P99MilliSec      float64   `json:"p99MilliSec"`
+	P999MilliSec     float64   `json:"p999MilliSec"`
+}
+
+type History struct {
+	From   time.Time      `json:"from"`
+	To     time.Time      `json:"to"`
+	Points []HistoryPoint `json:"points"`
+}
+
+//GET /scheduler/history?path=&group=&from=&to=&step=
+func schedHistoryGet(w http.ResponseWriter, r *http.Request) {
+	s := requestScheduler(w, r)
+	if s == nil {
+		return
+	}
+	historyGet(w, r, s.History)
+}
+
+//GET /node/{id}/history?from=&to=&step=
+func nodeHistoryGet(w http.ResponseWriter, r *http.Request) {
+	n := findNode(mux.Vars(r)["id"])
+	if n == nil {
+		http.Error(w, "node not found", http.StatusNotFound)
+		return
+	}
+	historyGet(w, r, n.History)
+}
+
+func historyGet(w http.ResponseWriter, r *http.Request, query func(from, to time.Time, step time.Duration) []node.HistoryPoint) {
+	from, to, step, err := historyParams(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hist := History{
+		From:   from,
+		To:     to,
+		Points: make([]HistoryPoint, 0),
+	}
+	for _, p := range query(from, to, step) {
+		hist.Points = append(hist.Points, HistoryPoint{
+			Time:             p.Time,
+			StepSec:          p.Step.Seconds(),
+			TransactionCount: p.TransactionCount,
+			ErrorCount:       p.ErrorCount,
+			Slots:            p.Slots,
+			InFlight:         p.InFlight,
+			P50MilliSec:      milliSec(p.Percentile(0.50)),
+			P90MilliSec:      milliSec(p.Percentile(0.90)),
+			P99MilliSec:      milliSec(p.Percentile(0.99)),
+			P999MilliSec:     milliSec(p.Percentile(0.999)),
+		})
+	}
+	json.NewEncoder(w).Encode(hist)
+}
+
+//from and to are RFC3339 times or unix seconds, step is a duration (10s, 5m) or seconds
+func historyParams(q url.Values) (from, to time.Time, step time.Duration, err error) {
+	to = time.Now()
+	if v := q.Get("to"); v != "" {
+		if to, err = parseTime(v); err != nil {
+			return
+		}
+	}
+	from = to.Add(-defaultHistorySpan)
+	if v := q.Get("from"); v != "" {
+		if from, err = parseTime(v); err != nil {
+			return
+		}
+	}
+	if v := q.Get("step"); v != "" {
+		if step, err = time.ParseDuration(v); err != nil {
+			secs, serr := strconv.ParseFloat(v, 64)
+			if serr != nil {
+				err = errors.New("invalid step")
+				return
+			}
+			step, err = time.Duration(secs*float64(time.Second)), nil
+		}
+	}
+	if !from.Before(to) || step < 0 {
+		err = errors.New("invalid history range")
+	}
+	return
+}
+
+func parseTime(v string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return t, errors.New("invalid time " + v)
+	}
+	return t, nil
+}
@@ -0,0 +1,225 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package dalb
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// MIRRORING
+// the requests copied to a shadow group and the shadow statistics next to the primary ones
+type MirrorStats struct {
+	Path         string           `json:"path"`
+	Group        string           `json:"group"`
+	Percent      float64          `json:"percent"`
+	MaxBodySize  int64            `json:"maxBodySize"`
+	TimeoutSec   float64          `json:"timeoutSec"`
+	Mirrored     int64            `json:"mirrored"`
+	Dropped      int64            `json:"dropped"`
+	Skipped      int64            `json:"skipped"`
+	Primary      schedulerStats   `json:"primary"`
+	Shadow       schedulerStats   `json:"shadow"`
+	StatusCounts map[string]int64 `json:"shadowStatusCounts"`
+	Diff         *DiffStats       `json:"diff,omitempty"`
+}
+
+// how many primary and shadow responses were compared and what did not match
+type DiffStats struct {
+	Headers          []string          `json:"headers"`
+	IgnorePointers   []string          `json:"ignorePointers"`
+	IgnorePatterns   []string          `json:"ignorePatterns"`
+	Compared         int64             `json:"compared"`
+	Matched          int64             `json:"matched"`
+	StatusMismatches int64             `json:"statusMismatches"`
+	HeaderMismatches int64             `json:"headerMismatches"`
+	BodyMismatches   int64             `json:"bodyMismatches"`
+	Samples          []DiffSampleStats `json:"samples,omitempty"`
+}
+
+// a mirrored request whose primary and shadow responses did not match
+type DiffSampleStats struct {
+	Time        time.Time         `json:"time"`
+	RequestID   string            `json:"requestId"`
+	Method      string            `json:"method"`
+	URL         string            `json:"url"`
+	RequestBody string            `json:"requestBody"`
+	Primary     DiffResponseStats `json:"primary"`
+	Shadow      DiffResponseStats `json:"shadow"`
+	Differences []string          `json:"differences"`
+}
+
+type DiffResponseStats struct {
+	Status    int         `json:"status"`
+	Headers   http.Header `json:"headers"`
+	Body      string      `json:"body"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+func diffResponseStats(dr DiffResponse) DiffResponseStats {
+	return DiffResponseStats{Status: dr.Status, Headers: dr.Header, Body: string(dr.Body), Truncated: dr.Truncated}
+}
+
+// the mirroring to set, the defaults are used for the missing fields
+type SetMirror struct {
+	Group       string   `json:"group"`
+	Percent     float64  `json:"percent"`
+	MaxBodySize int64    `json:"maxBodySize"`
+	TimeoutSec  float64  `json:"timeoutSec"`
+	Diff        *SetDiff `json:"diff"`
+}
+
+// the response comparison to set, nil for none
+type SetDiff struct {
+	Headers        []string `json:"headers"`
+	IgnorePointers []string `json:"ignorePointers"`
+	IgnorePatterns []string `json:"ignorePatterns"`
+	MaxSamples     *int     `json:"maxSamples"`
+}
+
+//returns the statistics of a response comparison, with its samples when samples is true
+func diffStats(d *ResponseDiff, samples bool) *DiffStats {
+	if d == nil {
+		return nil
+	}
+	stats := &DiffStats{
+		Headers:        d.Headers,
+		IgnorePointers: d.IgnorePointers,
+		IgnorePatterns: make([]string, 0, len(d.IgnorePatterns)),
+	}
+	if stats.IgnorePointers == nil {
+		stats.IgnorePointers = make([]string, 0)
+	}
+	for _, re := range d.IgnorePatterns {
+		stats.IgnorePatterns = append(stats.IgnorePatterns, re.String())
+	}
+	stats.Compared, stats.Matched, stats.StatusMismatches, stats.HeaderMismatches, stats.BodyMismatches = d.Counts()
+	if samples {
+		stats.Samples = make([]DiffSampleStats, 0)
+		for _, sample := range d.Samples() {
+			stats.Samples = append(stats.Samples, DiffSampleStats{
+				Time:        sample.Time,
+				RequestID:   sample.RequestID,
+				Method:      sample.Method,
+				URL:         sample.URL,
+				RequestBody: string(sample.RequestBody),
+				Primary:     diffResponseStats(sample.Primary),
+				Shadow:      diffResponseStats(sample.Shadow),
+				Differences: sample.Differences,
+			})
+		}
+	}
+	return stats
+}
+
+//GET /mirror?path=<route>, the HTTP data path when path is not a route name
+func mirrorGet(w http.ResponseWriter, r *http.Request) {
+	p := requestDataPath(w, r)
+	if p == nil {
+		return
+	}
+	m := p.Mirroring()
+	if m == nil {
+		http.Error(w, "mirroring is off", http.StatusNotFound)
+		return
+	}
+	stats := MirrorStats{
+		Path:         p.path,
+		Group:        m.Group,
+		Percent:      m.Percent,
+		MaxBodySize:  m.MaxBodySize,
+		TimeoutSec:   m.Timeout.Seconds(),
+		Primary:      newSchedulerStats(p.Sched),
+		StatusCounts: make(map[string]int64),
+		Diff:         diffStats(m.Diff, false),
+	}
+	stats.Mirrored, stats.Dropped, stats.Skipped = m.Counts()
+	if g := p.Group(m.Group); g != nil {
+		stats.Shadow = newSchedulerStats(g.Sched)
+		st := g.Sched.Stats()
+		for class := 1; class < len(st.StatusClassCount); class++ {
+			if st.StatusClassCount[class] != 0 {
+				stats.StatusCounts[strconv.Itoa(class)+"xx"] = st.StatusClassCount[class]
+			}
+		}
+	}
+	json.NewEncoder(w).Encode(stats)
+}
+
+//PUT /mirror?path=<route>, copy a percentage of the requests of the route to a shadow group
+func mirrorPut(w http.ResponseWriter, r *http.Request) {
+	p := requestDataPath(w, r)
+	if p == nil {
+		return
+	}
+	set := &SetMirror{}
+	if err := json.NewDecoder(r.Body).Decode(set); err != nil {
+		http.Error(w, "JSON format error", http.StatusBadRequest)
+		return
+	}
+	m := &Mirror{Group: set.Group, Percent: set.Percent, MaxBodySize: set.MaxBodySize, Timeout: time.Duration(set.TimeoutSec * float64(time.Second))}
+	if m.Group == "" {
+		m.Group = DefaultMirrorGroup
+	}
+	if m.MaxBodySize == 0 {
+		m.MaxBodySize = DefaultMirrorMaxBody
+	}
+	if m.Timeout == 0 {
+		m.Timeout = DefaultMirrorTimeout
+	}
+	if set.Diff != nil {
+		d, err := NewResponseDiff(set.Diff.Headers, set.Diff.IgnorePointers, set.Diff.IgnorePatterns)
+		if err != nil {
+			http.Error(w, "invalid ignore pattern: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if set.Diff.MaxSamples != nil {
+			d.MaxSamples = *set.Diff.MaxSamples
+		}
+		m.Diff = d
+	}
+	if err := p.SetMirror(m); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+//DELETE /mirror?path=<route>, stop mirroring the requests of the route
+func mirrorDelete(w http.ResponseWriter, r *http.Request) {
+	p := requestDataPath(w, r)
+	if p == nil {
+		return
+	}
+	p.SetMirror(nil)
+}
+
+//returns the response comparison of the route of a control path request,
+//nil after sending an error when the responses are not compared
+func requestDiff(w http.ResponseWriter, r *http.Request) *ResponseDiff {
+	p := requestDataPath(w, r)
+	if p == nil {
+		return nil
+	}
+	m := p.Mirroring()
+	if m == nil || m.Diff == nil {
+		http.Error(w, "the mirrored responses are not compared", http.StatusNotFound)
+		return nil
+	}
+	return m.Diff
+}
+
+//GET /mirror/diff?path=<route>, the response comparison counts and the samples of the mismatches
+func mirrorDiffGet(w http.ResponseWriter, r *http.Request) {
+	if d := requestDiff(w, r); d != nil {
+		json.NewEncoder(w).Encode(diffStats(d, true))
+	}
+}
+
+//DELETE /mirror/diff?path=<route>, clear the response comparison counts and samples
+func mirrorDiffDelete(w http.ResponseWriter, r *http.Request) {
+	if d := requestDiff(w, r); d != nil {
+		d.Reset()
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"dalb/internal/node"
+	"dalb/internal/proxyproto"
 
 	"github.com/gorilla/mux"
 )
@@ -27,16 +28,141 @@ var dalbRoutes = routes{
 		"/scheduler",
 		SchedStatsGet,
 	},
+	route{
+		"GET",
+		"/scheduler/history",
+		schedHistoryGet,
+	},
 	route{
 		"GET",
 		"/node",
 		nodeStatsGet,
 	},
+	route{
+		"GET",
+		"/node/{id}/history",
+		nodeHistoryGet,
+	},
 	route{
 		"POST",
 		"/node",
 		nodePost,
 	},
+	route{
+		"DELETE",
+		"/node/{id}",
+		nodeDelete,
+	},
+	route{
+		"GET",
+		"/group",
+		groupStatsGet,
+	},
+	route{
+		"PUT",
+		"/group/{name}",
+		groupPut,
+	},
+	route{
+		"DELETE",
+		"/group/{name}",
+		groupDelete,
+	},
+	route{
+		"GET",
+		"/rollout",
+		rolloutGet,
+	},
+	route{
+		"POST",
+		"/rollout",
+		rolloutPost,
+	},
+	route{
+		"DELETE",
+		"/rollout",
+		rolloutDelete,
+	},
+	route{
+		"GET",
+		"/mirror",
+		mirrorGet,
+	},
+	route{
+		"PUT",
+		"/mirror",
+		mirrorPut,
+	},
+	route{
+		"DELETE",
+		"/mirror",
+		mirrorDelete,
+	},
+	route{
+		"GET",
+		"/mirror/diff",
+		mirrorDiffGet,
+	},
+	route{
+		"DELETE",
+		"/mirror/diff",
+		mirrorDiffDelete,
+	},
+	route{
+		"GET",
+		"/hedge",
+		hedgeGet,
+	},
+	route{
+		"PUT",
+		"/hedge",
+		hedgePut,
+	},
+	route{
+		"DELETE",
+		"/hedge",
+		hedgeDelete,
+	},
+	route{
+		"GET",
+		"/timeout",
+		timeoutGet,
+	},
+	route{
+		"PUT",
+		"/timeout",
+		timeoutPut,
+	},
+	route{
+		"GET",
+		"/requestid",
+		requestIDGet,
+	},
+	route{
+		"PUT",
+		"/requestid",
+		requestIDPut,
+	},
+	route{
+		"GET",
+		"/affinity",
+		affinityGet,
+	},
+	route{
+		"PUT",
+		"/affinity",
+		affinityPut,
+	},
+	route{
+		"DELETE",
+		"/affinity",
+		affinityDelete,
+	},
+	route{
+		"GET",
+		"/metrics",
+		metricsGet,
+	},
 }
 
 func CtrlPathInit() (Router *mux.Router) {
@@ -64,47 +190,264 @@ type schedulerStats struct {
 	AverageTransactionTimeMilliSec float64 `json:"averageTransactionTimeMilliSec"`
 	MinimumTransactionTimeMilliSec float64 `json:"minimumTransactionTimeMilliSec"`
 	MaximumTransactionTimeMilliSec float64 `json:"maximumTransactionTimeMilliSec"`
+	ErrorCount                     int64   `json:"errorCount"`
+	ConnectionCount                int64   `json:"connectionCount"`
+	AverageConnectionTimeMilliSec  float64 `json:"averageConnectionTimeMilliSec"`
+	BytesIn                        int64   `json:"bytesIn"`
+	BytesOut                       int64   `json:"bytesOut"`
+	PacketsIn                      int64   `json:"packetsIn"`
+	PacketsOut                     int64   `json:"packetsOut"`
+	Drops                          int64   `json:"drops"`
+	HedgeCount                     int64   `json:"hedgeCount"`
+	HedgeWins                      int64   `json:"hedgeWins"`
+	TimeoutCount                   int64   `json:"timeoutCount"`
+	LatencyPercentiles
+	RecentStats
+	Affinity *AffinityStats `json:"affinity,omitempty"`
+}
+
+// how the requests with session affinity were routed
+type AffinityStats struct {
+	Hits     int64   `json:"hits"`
+	Misses   int64   `json:"misses"`
+	Sessions int64   `json:"newSessions"`
+	HitRate  float64 `json:"hitRate"`
+	MissRate float64 `json:"missRate"`
 }
 
+// returns the session affinity statistics of a scheduler, nil when none of its requests had any
+func affinityStats(s *node.Scheduler) *AffinityStats {
+	hits, misses, sessions := s.AffinityCounts()
+	total := hits + misses + sessions
+	if total == 0 {
+		return nil
+	}
+	return &AffinityStats{
+		Hits:     hits,
+		Misses:   misses,
+		Sessions: sessions,
+		HitRate:  float64(hits) / float64(total),
+		MissRate: float64(misses) / float64(total),
+	}
+}
+
+// latency percentiles and the raw histogram buckets they are computed from
+type LatencyPercentiles struct {
+	P50MilliSec    float64         `json:"p50MilliSec"`
+	P90MilliSec    float64         `json:"p90MilliSec"`
+	P99MilliSec    float64         `json:"p99MilliSec"`
+	P999MilliSec   float64         `json:"p999MilliSec"`
+	LatencyBuckets []LatencyBucket `json:"latencyBuckets"`
+}
+
+// number of transactions that took at most UpperBoundMilliSec
+type LatencyBucket struct {
+	UpperBoundMilliSec float64 `json:"upperBoundMilliSec"`
+	Count              int64   `json:"count"`
+}
+
+// fractional milliseconds for a time.Duration
+func milliSec(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// statistics for the recent past instead of the lifetime of the node or scheduler
+type RecentStats struct {
+	EWMATransactionTimeMilliSec float64       `json:"ewmaTransactionTimeMilliSec"`
+	Windows                     []WindowStats `json:"windows"`
+}
+
+type WindowStats struct {
+	WindowSec                      float64 `json:"windowSec"`
+	TransactionCount               int64   `json:"transactionCount"`
+	TransactionsPerSec             float64 `json:"transactionsPerSec"`
+	ErrorCount                     int64   `json:"errorCount"`
+	AverageTransactionTimeMilliSec float64 `json:"averageTransactionTimeMilliSec"`
+	MinimumTransactionTimeMilliSec float64 `json:"minimumTransactionTimeMilliSec"`
+	MaximumTransactionTimeMilliSec float64 `json:"maximumTransactionTimeMilliSec"`
+}
+
+func recentStats(st *node.Stats) RecentStats {
+	rs := RecentStats{
+		EWMATransactionTimeMilliSec: milliSec(st.EWMATransactionTime),
+		Windows:                     make([]WindowStats, 0, len(st.Windows)),
+	}
+	for _, ws := range st.Windows {
+		rs.Windows = append(rs.Windows, WindowStats{
+			WindowSec:                      ws.Window.Seconds(),
+			TransactionCount:               ws.TransactionCount,
+			TransactionsPerSec:             ws.TransactionsPerSecond(),
+			ErrorCount:                     ws.ErrorCount,
+			AverageTransactionTimeMilliSec: milliSec(ws.AverageTransactionTime()),
+			MinimumTransactionTimeMilliSec: milliSec(ws.MinTransactionTime),
+			MaximumTransactionTimeMilliSec: milliSec(ws.MaxTransactionTime),
+		})
+	}
+	return rs
+}
+
+func latencyPercentiles(h *node.Histogram) LatencyPercentiles {
+	lp := LatencyPercentiles{
+		P50MilliSec:    milliSec(h.Percentile(0.50)),
+		P90MilliSec:    milliSec(h.Percentile(0.90)),
+		P99MilliSec:    milliSec(h.Percentile(0.99)),
+		P999MilliSec:   milliSec(h.Percentile(0.999)),
+		LatencyBuckets: make([]LatencyBucket, 0),
+	}
+	for _, b := range h.Buckets() {
+		lp.LatencyBuckets = append(lp.LatencyBuckets, LatencyBucket{
+			UpperBoundMilliSec: milliSec(b.UpperBound),
+			Count:              b.Count,
+		})
+	}
+	return lp
+}
+
+//GET /scheduler?path=<route>&group=<group>, the HTTP data path when path is not a route name
 func SchedStatsGet(w http.ResponseWriter, r *http.Request) {
-	min, max := Proxy.Sched.TransactionTimeRange()
-	stat := schedulerStats{
-		Path:                           Proxy.path,
-		TransactionCount:               Proxy.Sched.TransactionCount(),
-		AverageTransactionTimeMilliSec: float64(Proxy.Sched.AverageTransactionTime() / time.Millisecond),
-		MinimumTransactionTimeMilliSec: float64(min / time.Millisecond),
-		MaximumTransactionTimeMilliSec: float64((max / time.Millisecond)),
+	s := requestScheduler(w, r)
+	if s == nil {
+		return
+	}
+	json.NewEncoder(w).Encode(newSchedulerStats(s))
+}
+
+//returns the statistics of a scheduler
+func newSchedulerStats(s *node.Scheduler) schedulerStats {
+	st := s.Stats()
+	return schedulerStats{
+		Path:                           s.Name,
+		TransactionCount:               st.TransactionCount,
+		AverageTransactionTimeMilliSec: float64(st.AverageTransactionTime() / time.Millisecond),
+		MinimumTransactionTimeMilliSec: float64(st.MinTransactionTime / time.Millisecond),
+		MaximumTransactionTimeMilliSec: float64((st.MaxTransactionTime / time.Millisecond)),
+		ErrorCount:                     st.ErrorCount,
+		ConnectionCount:                st.ConnectionCount,
+		AverageConnectionTimeMilliSec:  milliSec(st.AverageConnectionTime()),
+		BytesIn:                        st.BytesIn,
+		BytesOut:                       st.BytesOut,
+		PacketsIn:                      st.PacketsIn,
+		PacketsOut:                     st.PacketsOut,
+		Drops:                          st.Drops,
+		HedgeCount:                     st.HedgeCount,
+		HedgeWins:                      st.HedgeWins,
+		TimeoutCount:                   st.TimeoutCount,
+		LatencyPercentiles:             latencyPercentiles(&st.Latency),
+		RecentStats:                    recentStats(&st),
+		Affinity:                       affinityStats(s),
 	}
-	json.NewEncoder(w).Encode(stat)
 }
 
 type NodeStats struct {
 	Nodes []Nodes `json:"nodes"`
 }
 type Nodes struct {
+	ID                             string  `json:"id"`
 	Address                        string  `json:"address"`
 	Port                           int     `json:"port"`
 	MaxTransactions                int     `json:"maxTransactions"`
+	Protocol                       string  `json:"protocol"`
+	HealthCheck                    string  `json:"healthCheck,omitempty"`
+	HealthService                  string  `json:"healthService,omitempty"`
+	Healthy                        bool    `json:"healthy"`
+	Slots                          int     `json:"slots"`
+	BackoffSec                     float64 `json:"backoffSec,omitempty"`
 	TransactionCount               int64   `json:"transactionCount"`
 	AverageTransactionTimeMilliSec float64 `json:"averageTransactionTimeMilliSec"`
 	MinimumTransactionTimeMilliSec float64 `json:"minimumTransactionTimeMilliSec"`
 	MaximumTransactionTimeMilliSec float64 `json:"maximumTransactionTimeMilliSec"`
+	ErrorCount                     int64   `json:"errorCount"`
+	MaxConnections                 int     `json:"maxConnections"`
+	Connections                    int     `json:"connections"`
+	ConnectionCount                int64   `json:"connectionCount"`
+	AverageConnectionTimeMilliSec  float64 `json:"averageConnectionTimeMilliSec"`
+	BytesIn                        int64   `json:"bytesIn"`
+	BytesOut                       int64   `json:"bytesOut"`
+	PacketsIn                      int64   `json:"packetsIn"`
+	PacketsOut                     int64   `json:"packetsOut"`
+	Drops                          int64   `json:"drops"`
+	HedgeCount                     int64   `json:"hedgeCount"`
+	HedgeWins                      int64   `json:"hedgeWins"`
+	TimeoutCount                   int64   `json:"timeoutCount"`
+	LatencyPercentiles
+	RecentStats
+	Load *NodeLoad `json:"load,omitempty"`
+}
+
+//the last load reported by a worker node
+type NodeLoad struct {
+	CPUUtilization    float64 `json:"cpuUtilization"`
+	MemoryUtilization float64 `json:"memoryUtilization"`
+	QueueUtilization  float64 `json:"queueUtilization"`
+	QueueDepth        float64 `json:"queueDepth"`
+	AgeSec            float64 `json:"ageSec"`
+}
+
+//returns the last load reported by a worker node, nil when it has not sent a report
+func nodeLoad(n *node.Node) *NodeLoad {
+	l := n.Load()
+	if l.Time.IsZero() {
+		return nil
+	}
+	return &NodeLoad{
+		CPUUtilization:    l.CPU,
+		MemoryUtilization: l.Memory,
+		QueueUtilization:  l.Queue,
+		QueueDepth:        l.QueueDepth,
+		AgeSec:            time.Since(l.Time).Seconds(),
+	}
+}
+
+//returns how long a worker node stays backed off, 0 when it is not
+func backoffSec(n *node.Node) float64 {
+	if until := n.Backoff(); !until.IsZero() {
+		return time.Until(until).Seconds()
+	}
+	return 0
 }
 
+//GET /node?path=<route>&group=<group>, the HTTP data path when path is not a route name
 func nodeStatsGet(w http.ResponseWriter, r *http.Request) {
+	s := requestScheduler(w, r)
+	if s == nil {
+		return
+	}
 	stats := NodeStats{
 		Nodes: make([]Nodes, 0),
 	}
-	for n := range Proxy.Sched.SchedNodeMap {
-		min, max := n.TransactionTimeRange()
+	for _, n := range s.SchedNodes() {
+		st := n.Stats()
 		node := Nodes{
+			ID:                             n.ID,
 			Address:                        n.IP.String(),
 			Port:                           n.Port,
 			MaxTransactions:                n.MaxTransactions,
-			TransactionCount:               n.TransactionCount(),
-			AverageTransactionTimeMilliSec: float64(n.AverageTransactionTime() / time.Millisecond),
-			MinimumTransactionTimeMilliSec: float64(min / time.Millisecond),
-			MaximumTransactionTimeMilliSec: float64((max / time.Millisecond)),
+			Protocol:                       protocolName(n.Protocol),
+			HealthCheck:                    n.HealthCheck,
+			HealthService:                  n.HealthService,
+			Healthy:                        n.Healthy(),
+			Slots:                          n.Slots(),
+			BackoffSec:                     backoffSec(n),
+			TransactionCount:               st.TransactionCount,
+			AverageTransactionTimeMilliSec: float64(st.AverageTransactionTime() / time.Millisecond),
+			MinimumTransactionTimeMilliSec: float64(st.MinTransactionTime / time.Millisecond),
+			MaximumTransactionTimeMilliSec: float64((st.MaxTransactionTime / time.Millisecond)),
+			ErrorCount:                     st.ErrorCount,
+			MaxConnections:                 n.MaxConnections,
+			Connections:                    n.Connections(),
+			ConnectionCount:                st.ConnectionCount,
+			AverageConnectionTimeMilliSec:  milliSec(st.AverageConnectionTime()),
+			BytesIn:                        st.BytesIn,
+			BytesOut:                       st.BytesOut,
+			PacketsIn:                      st.PacketsIn,
+			PacketsOut:                     st.PacketsOut,
+			Drops:                          st.Drops,
+			HedgeCount:                     st.HedgeCount,
+			HedgeWins:                      st.HedgeWins,
+			TimeoutCount:                   st.TimeoutCount,
+			LatencyPercentiles:             latencyPercentiles(&st.Latency),
+			RecentStats:                    recentStats(&st),
+			Load:                           nodeLoad(n),
 		}
 		stats.Nodes = append(stats.Nodes, node)
 	}
@@ -112,13 +455,22 @@ func nodeStatsGet(w http.ResponseWriter, r *http.Request) {
 }
 
 type AddNode struct {
+	ID              string `json:"id,omitempty"`
 	Path            string `json:"path"`
 	Address         string `json:"address"`
 	Port            int    `json:"port"`
 	MaxTransactions int    `json:"maxTransactions"`
+	MaxConnections  int    `json:"maxConnections,omitempty"`
+	Protocol        string `json:"protocol,omitempty"`
+	ProxyProtocol   int    `json:"proxyProtocol,omitempty"`
+	HealthCheck     string `json:"healthCheck,omitempty"`
+	HealthService   string `json:"healthService,omitempty"`
+	Group           string `json:"group,omitempty"`
 }
 
-//Add a worker node to the <path> scheduler
+//Add a worker node to the <path> scheduler, the HTTP data path when path is not a route name.
+//A node added to a group that does not exist creates it with weight 0, so it only gets the
+//requests forced to it until it is given a weight.
 func nodePost(w http.ResponseWriter, r *http.Request) {
 	newNode := &AddNode{}
 	err := json.NewDecoder(r.Body).Decode(newNode)
@@ -131,9 +483,84 @@ func nodePost(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid IP address", http.StatusBadRequest)
 		return
 	}
+	if newNode.ProxyProtocol < 0 || newNode.ProxyProtocol > proxyproto.V2 {
+		http.Error(w, "invalid PROXY protocol version", http.StatusBadRequest)
+		return
+	}
+	if !validProtocol(newNode.Protocol) {
+		http.Error(w, "invalid protocol", http.StatusBadRequest)
+		return
+	}
+	if newNode.ProxyProtocol != 0 && (newNode.Protocol == ProtoH2 || newNode.Protocol == ProtoH2C) {
+		// HTTP/2 connections are shared by the requests of many clients
+		http.Error(w, "the PROXY protocol is not supported with "+newNode.Protocol, http.StatusBadRequest)
+		return
+	}
+	if err := validHealthCheck(newNode.HealthCheck, newNode.Protocol); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if newNode.ID != "" && findNode(newNode.ID) != nil {
+		http.Error(w, "node ID already in use", http.StatusConflict)
+		return
+	}
+	s := routeScheduler(newNode.Path)
+	if newNode.Group != "" && newNode.Group != DefaultGroup {
+		p := routeDataPath(newNode.Path)
+		if p == nil {
+			http.Error(w, "node groups are only supported on HTTP routes", http.StatusBadRequest)
+			return
+		}
+		g := p.Group(newNode.Group)
+		if g == nil {
+			if g, err = p.SetGroup(newNode.Group, 0); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		s = g.Sched
+	}
 	n := node.NewNode()
+	if newNode.ID != "" {
+		n.ID = newNode.ID
+	}
 	n.IP = ipList[0]
 	n.Port = newNode.Port
 	n.MaxTransactions = newNode.MaxTransactions
-	Proxy.Sched.SchedAddNode(n)
+	n.MaxConnections = newNode.MaxConnections
+	n.Protocol = newNode.Protocol
+	n.ProxyProtocol = newNode.ProxyProtocol
+	n.HealthCheck = newNode.HealthCheck
+	n.HealthService = newNode.HealthService
+	s.SchedAddNode(n)
+}
+
+//Drain a worker node: it gets no new requests and its upgraded connections are closed,
+//WebSocket clients are asked to reconnect. Requests in progress are completed.
+func nodeDelete(w http.ResponseWriter, r *http.Request) {
+	s, n := findRouteNode(mux.Vars(r)["id"])
+	if n == nil {
+		http.Error(w, "node not found", http.StatusNotFound)
+		return
+	}
+	s.SchedDeleteNode(n)
+	drainUpgrades(n)
+}
+
+//returns the worker node with ID id on any route, or nil
+func findNode(id string) *node.Node {
+	_, n := findRouteNode(id)
+	return n
+}
+
+//returns the worker node with ID id and the scheduler of its route, or nil
+func findRouteNode(id string) (*node.Scheduler, *node.Node) {
+	for _, s := range routeSchedulers() {
+		for _, n := range s.SchedNodes() {
+			if n.ID == id {
+				return s, n
+			}
+		}
+	}
+	return nil, nil
 }
@@ -0,0 +1,53 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package dalb
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// REQUEST ID
+// the request ID settings of a route
+type RequestIDStats struct {
+	Path   string `json:"path"`
+	Header string `json:"header"`
+	Trust  bool   `json:"trust"`
+}
+
+// the request ID settings to set
+type SetRequestID struct {
+	Header string `json:"header"`
+	Trust  bool   `json:"trust"`
+}
+
+//GET /requestid?path=<route>, the HTTP data path when path is not a route name
+func requestIDGet(w http.ResponseWriter, r *http.Request) {
+	p := requestDataPath(w, r)
+	if p == nil {
+		return
+	}
+	rc := p.RequestIDConfig()
+	json.NewEncoder(w).Encode(RequestIDStats{
+		Path:   p.path,
+		Header: rc.Header,
+		Trust:  rc.Trust,
+	})
+}
+
+//PUT /requestid?path=<route>, set the request ID header of the route and whether the client IDs are used
+func requestIDPut(w http.ResponseWriter, r *http.Request) {
+	p := requestDataPath(w, r)
+	if p == nil {
+		return
+	}
+	set := &SetRequestID{}
+	if err := json.NewDecoder(r.Body).Decode(set); err != nil {
+		http.Error(w, "JSON format error", http.StatusBadRequest)
+		return
+	}
+	if err := p.SetRequestIDConfig(RequestIDConfig{Header: set.Header, Trust: set.Trust}); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,168 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package dalb
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// ROLLOUT
+// a progressive rollout of a canary group, its state and decision log
+type RolloutStats struct {
+	Path                 string                 `json:"path"`
+	Canary               string                 `json:"canary"`
+	Stable               string                 `json:"stable"`
+	State                string                 `json:"state"`
+	Step                 int                    `json:"step"`
+	Steps                []int                  `json:"steps"`
+	CanaryWeight         int                    `json:"canaryWeight"`
+	StepIntervalSec      float64                `json:"stepIntervalSec"`
+	MaxErrorRateIncrease float64                `json:"maxErrorRateIncrease"`
+	MaxP99Ratio          float64                `json:"maxP99Ratio"`
+	MinRequests          int64                  `json:"minRequests"`
+	MaxHolds             int                    `json:"maxHolds"`
+	Started              time.Time              `json:"started"`
+	StepStarted          time.Time              `json:"stepStarted"`
+	Decisions            []RolloutDecisionStats `json:"decisions"`
+}
+
+type RolloutDecisionStats struct {
+	Time         time.Time        `json:"time"`
+	Step         int              `json:"step"`
+	CanaryWeight int              `json:"canaryWeight"`
+	Action       string           `json:"action"`
+	Reason       string           `json:"reason"`
+	Canary       GroupSampleStats `json:"canary"`
+	Stable       GroupSampleStats `json:"stable"`
+}
+
+// the statistics of a node group during a rollout step
+type GroupSampleStats struct {
+	TransactionCount int64   `json:"transactionCount"`
+	ErrorCount       int64   `json:"errorCount"`
+	ErrorRate        float64 `json:"errorRate"`
+	P99MilliSec      float64 `json:"p99MilliSec"`
+}
+
+// the rollout to start, the defaults are used for the missing fields
+type StartRollout struct {
+	Canary               string   `json:"canary"`
+	Stable               string   `json:"stable"`
+	Steps                []int    `json:"steps"`
+	StepIntervalSec      float64  `json:"stepIntervalSec"`
+	MaxErrorRateIncrease *float64 `json:"maxErrorRateIncrease"`
+	MaxP99Ratio          *float64 `json:"maxP99Ratio"`
+	MinRequests          *int64   `json:"minRequests"`
+	MaxHolds             *int     `json:"maxHolds"`
+}
+
+func groupSampleStats(gs GroupSample) GroupSampleStats {
+	return GroupSampleStats{
+		TransactionCount: gs.Requests,
+		ErrorCount:       gs.Errors,
+		ErrorRate:        gs.ErrorRate,
+		P99MilliSec:      milliSec(gs.P99),
+	}
+}
+
+//GET /rollout?path=<route>, the HTTP data path when path is not a route name
+func rolloutGet(w http.ResponseWriter, r *http.Request) {
+	p := requestDataPath(w, r)
+	if p == nil {
+		return
+	}
+	ro := p.Rollout()
+	if ro == nil {
+		http.Error(w, "no rollout", http.StatusNotFound)
+		return
+	}
+	st := ro.Status()
+	stats := RolloutStats{
+		Path:                 p.path,
+		Canary:               ro.Canary,
+		Stable:               ro.Stable,
+		State:                st.State,
+		Step:                 st.Step,
+		Steps:                ro.Steps,
+		CanaryWeight:         st.CanaryWeight,
+		StepIntervalSec:      ro.StepInterval.Seconds(),
+		MaxErrorRateIncrease: ro.MaxErrorRateIncrease,
+		MaxP99Ratio:          ro.MaxP99Ratio,
+		MinRequests:          ro.MinRequests,
+		MaxHolds:             ro.MaxHolds,
+		Started:              st.Started,
+		StepStarted:          st.StepStarted,
+		Decisions:            make([]RolloutDecisionStats, 0, len(st.Decisions)),
+	}
+	for _, d := range st.Decisions {
+		stats.Decisions = append(stats.Decisions, RolloutDecisionStats{
+			Time:         d.Time,
+			Step:         d.Step,
+			CanaryWeight: d.CanaryWeight,
+			Action:       d.Action,
+			Reason:       d.Reason,
+			Canary:       groupSampleStats(d.Canary),
+			Stable:       groupSampleStats(d.Stable),
+		})
+	}
+	json.NewEncoder(w).Encode(stats)
+}
+
+//POST /rollout?path=<route>, start a progressive rollout of a canary group
+func rolloutPost(w http.ResponseWriter, r *http.Request) {
+	p := requestDataPath(w, r)
+	if p == nil {
+		return
+	}
+	start := &StartRollout{}
+	if err := json.NewDecoder(r.Body).Decode(start); err != nil {
+		http.Error(w, "JSON format error", http.StatusBadRequest)
+		return
+	}
+	ro := NewRollout(DefaultCanaryGroup)
+	if start.Canary != "" {
+		ro.Canary = start.Canary
+	}
+	if start.Stable != "" {
+		ro.Stable = start.Stable
+	}
+	if start.Steps != nil {
+		ro.Steps = start.Steps
+	}
+	if start.StepIntervalSec != 0 {
+		ro.StepInterval = time.Duration(start.StepIntervalSec * float64(time.Second))
+	}
+	if start.MaxErrorRateIncrease != nil {
+		ro.MaxErrorRateIncrease = *start.MaxErrorRateIncrease
+	}
+	if start.MaxP99Ratio != nil {
+		ro.MaxP99Ratio = *start.MaxP99Ratio
+	}
+	if start.MinRequests != nil {
+		ro.MinRequests = *start.MinRequests
+	}
+	if start.MaxHolds != nil {
+		ro.MaxHolds = *start.MaxHolds
+	}
+	if err := p.validRollout(ro); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := p.StartRollout(ro); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+	}
+}
+
+//DELETE /rollout?path=<route>, abort the rollout in progress, the canary gets no more requests
+func rolloutDelete(w http.ResponseWriter, r *http.Request) {
+	p := requestDataPath(w, r)
+	if p == nil {
+		return
+	}
+	if err := p.AbortRollout(); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+	}
+}
@@ -0,0 +1,69 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package dalb
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// TIMEOUTS
+// the timeouts of a route and the number of its requests that timed out, by kind
+type TimeoutStats struct {
+	Path              string           `json:"path"`
+	ConnectMilliSec   float64          `json:"connectMilliSec"`
+	FirstByteMilliSec float64          `json:"firstByteMilliSec"`
+	IdleMilliSec      float64          `json:"idleMilliSec"`
+	TotalMilliSec     float64          `json:"totalMilliSec"`
+	DeadlineHeader    string           `json:"deadlineHeader"`
+	Counts            map[string]int64 `json:"counts"`
+}
+
+// the timeouts to set, 0 for none
+type SetTimeouts struct {
+	ConnectMilliSec   float64 `json:"connectMilliSec"`
+	FirstByteMilliSec float64 `json:"firstByteMilliSec"`
+	IdleMilliSec      float64 `json:"idleMilliSec"`
+	TotalMilliSec     float64 `json:"totalMilliSec"`
+}
+
+//GET /timeout?path=<route>, the HTTP data path when path is not a route name
+func timeoutGet(w http.ResponseWriter, r *http.Request) {
+	p := requestDataPath(w, r)
+	if p == nil {
+		return
+	}
+	to := p.Timeouts()
+	json.NewEncoder(w).Encode(TimeoutStats{
+		Path:              p.path,
+		ConnectMilliSec:   milliSec(to.Connect),
+		FirstByteMilliSec: milliSec(to.FirstByte),
+		IdleMilliSec:      milliSec(to.Idle),
+		TotalMilliSec:     milliSec(to.Total),
+		DeadlineHeader:    p.DeadlineHeader,
+		Counts:            p.TimeoutCounts(),
+	})
+}
+
+//PUT /timeout?path=<route>, set the timeouts of the route
+func timeoutPut(w http.ResponseWriter, r *http.Request) {
+	p := requestDataPath(w, r)
+	if p == nil {
+		return
+	}
+	set := &SetTimeouts{}
+	if err := json.NewDecoder(r.Body).Decode(set); err != nil {
+		http.Error(w, "JSON format error", http.StatusBadRequest)
+		return
+	}
+	to := Timeouts{
+		Connect:   milliSecDuration(set.ConnectMilliSec),
+		FirstByte: milliSecDuration(set.FirstByteMilliSec),
+		Idle:      milliSecDuration(set.IdleMilliSec),
+		Total:     milliSecDuration(set.TotalMilliSec),
+	}
+	if err := p.SetTimeouts(to); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
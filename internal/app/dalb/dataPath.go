@@ -4,12 +4,21 @@ Copyright (c) 2019 Dave Hammers
 package dalb
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"dalb/internal/accesslog"
 	"dalb/internal/node"
+	"dalb/internal/requestid"
+	"dalb/internal/trace"
 
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
@@ -20,20 +29,116 @@ type DataPathProxy struct {
 	Proxy  *httputil.ReverseProxy
 	Router *mux.Router
 	Sched  *node.Scheduler
+	// access log for the requests on the path, nil when access logging is off
+	AccessLog *accesslog.Logger
+	// the request ID header and whether the IDs sent by the clients are used
+	requestIDs atomic.Value // RequestIDConfig
+	// proxies that are trusted to report the client address in X-Forwarded-For
+	TrustedProxies []*net.IPNet
+	// send the worker node address as the Host header instead of the one sent by the client
+	RewriteHost bool
+	// response header the worker nodes report their load in, removed before the response reaches the client
+	LoadHeader string
+	// back a worker node off when it answers 429 Too Many Requests, like when it answers 503
+	BackoffTooManyRequests bool
+	// session affinity, nil when the requests of a client can go to any worker node
+	affinity atomic.Value // *Affinity
+	// request header and cookie that send a request to the node group they name, whatever its weight,
+	// empty to turn them off. They are only used on the requests of the trusted proxies and GroupClients.
+	GroupHeader string
+	GroupCookie string
+	// clients that can name the node group of their requests, e.g. the addresses of the testers
+	GroupClients []*net.IPNet
+	groupLock    sync.Mutex   // serializes group table writers
+	groups       atomic.Value // *groupTable
+	groupCursor  uint64       // next group calendar position
+	rolloutLock  sync.Mutex
+	rollout      *Rollout     // the last rollout of a canary group
+	mirror       atomic.Value // *Mirror, requests copied to a shadow group
+	hedge        atomic.Value // *Hedge, slow requests sent to a second node
+	// request header with the time in milliseconds the client is willing to wait, empty to ignore it
+	DeadlineHeader string
+	timeouts       atomic.Value // Timeouts
+	timeoutCounts  [len(timeoutKinds)]int64
 }
 
+const (
+	//how long a worker node that answers 503 without a Retry-After gets no new requests
+	DefaultNodeBackoff = 5 * time.Second
+	//the longest backoff a worker node can ask for with Retry-After
+	MaxNodeBackoff = time.Minute
+)
+
 var (
 	Proxy *DataPathProxy
 )
 
+type ctxKey int
+
+const txnKey ctxKey = 0
+
+//the state of one proxied request, carried in the request context
+type transaction struct {
+	start      time.Time
+	id         string // request ID
+	idHeader   string // the header the request ID is sent in
+	log        *log.Entry
+	clientIP   string
+	remoteAddr string
+	sched      *node.Scheduler // the scheduler of the node group the request goes to
+	node       *node.Node
+	pinned     *node.Node // the worker node of the client session
+	mirror     *mirrorRequest
+	hedge      *Hedge // the request is sent again to another node when it is slow to answer
+	status     int
+	attempts   int // round trips to worker nodes
+	queueWait  time.Duration
+	upstream   time.Duration
+	sent       time.Time // when the request was sent to the worker node
+	ended      bool      // the node slot has been released and the statistics recorded
+	// when the request has to be answered, the route total timeout or the client deadline, and what timed out
+	deadline     time.Time
+	deadlineKind string
+	timeout      string
+	// upgrade requests: the protocol asked for, the worker node connection and when it was upgraded
+	upgrade  string
+	backend  io.Closer
+	upgraded time.Time
+	// gRPC calls: the worker node response, how long it took to send the response headers and the grpc-status
+	grpc       bool
+	resp       *http.Response
+	headers    time.Duration
+	grpcStatus int
+}
+
+//returns the transaction for a proxied request
+func requestTransaction(r *http.Request) *transaction {
+	txn, _ := r.Context().Value(txnKey).(*transaction)
+	return txn
+}
+
 func DataPathInit(path string) *DataPathProxy {
 	//create a reverse Proxy that distributes the requests to the worker nodes
 	dpProxy := &DataPathProxy{
-		path: path,
+		path:           path,
+		LoadHeader:     DefaultLoadHeader,
+		DeadlineHeader: DefaultDeadlineHeader,
+	}
+	dpProxy.Proxy = &httputil.ReverseProxy{
+		Director:       dpProxy.dataPathDirector,
+		ModifyResponse: dpProxy.dataPathResponse,
+		ErrorHandler:   dpProxy.dataPathError,
 	}
-	dpProxy.Proxy = &httputil.ReverseProxy{Director: dpProxy.dataPathDirector}
+	dpProxy.Proxy.Transport = &hedgingTransport{p: dpProxy, base: &timeoutTransport{p: dpProxy, base: &tracingTransport{base: newNodeTransport()}}}
+	dpProxy.timeouts.Store(Timeouts{})
+	dpProxy.requestIDs.Store(RequestIDConfig{Header: requestid.DefaultHeader, Trust: true})
 	//allocate a load balancer scheduler for the data path
 	dpProxy.Sched = node.NewScheduler(0)
+	dpProxy.Sched.Name = path
+	dpProxy.Sched.RestoreHistory()
+	registerRoute(path, dpProxy.Sched)
+	registerDataPath(path, dpProxy)
+	dpProxy.groups.Store(newGroupTable([]*Group{{Name: DefaultGroup, Sched: dpProxy.Sched, weight: DefaultGroupWeight}}))
 	//load any pre-configured worker node definitions
 	//TODO
 
@@ -43,28 +148,365 @@ func DataPathInit(path string) *DataPathProxy {
 	return dpProxy
 }
 
-//direct the request to the next available worker node
-//STUB - work is done in dataPathForward
+//How the requests of a route are identified
+type RequestIDConfig struct {
+	// header that carries the request ID to the worker node and back to the client
+	Header string
+	// use a valid request ID sent by the client instead of generating a new one
+	Trust bool
+}
+
+// Returns the request ID settings of the route
+func (p *DataPathProxy) RequestIDConfig() RequestIDConfig {
+	return p.requestIDs.Load().(RequestIDConfig)
+}
+
+// Set the request ID settings of the route, the requests in progress keep the header they started with
+func (p *DataPathProxy) SetRequestIDConfig(rc RequestIDConfig) error {
+	if rc.Header == "" {
+		return errors.New("the request ID header cannot be empty")
+	}
+	p.requestIDs.Store(rc)
+	return nil
+}
+
+//returns the request ID sent by the client if it is trusted, or a new one
+func (p *DataPathProxy) requestID(r *http.Request, rc RequestIDConfig) string {
+	if rc.Trust {
+		if id := r.Header.Get(rc.Header); requestid.Valid(id) {
+			return id
+		}
+	}
+	return requestid.New()
+}
+
+//direct the request to the worker node picked by dataPathForward
 func (p *DataPathProxy) dataPathDirector(r *http.Request) {
+	txn := requestTransaction(r)
+	if txn == nil || txn.node == nil {
+		return
+	}
+	r.URL.Scheme = nodeScheme(txn.node)
+	r.URL.Host = net.JoinHostPort(txn.node.IP.String(), strconv.Itoa(txn.node.Port))
+	p.setForwardedHeaders(r)
+	p.setDeadlineHeaders(r, txn)
+	if p.RewriteHost {
+		r.Host = r.URL.Host
+	}
 }
 
-func (p *DataPathProxy) dataPathForward(w http.ResponseWriter, r *http.Request) {
-	n := p.Sched.SchedGetNode()
-	if n != nil {
-		r.URL.Host = fmt.Sprintf("%s:%d", n.IP.String(), n.Port)
+//record the worker node response status and load report
+func (p *DataPathProxy) dataPathResponse(resp *http.Response) error {
+	if txn := requestTransaction(resp.Request); txn != nil {
+		txn.status = resp.StatusCode
+		txn.resp = resp
+		txn.headers = time.Since(txn.sent)
+		if l, ok := takeLoadReport(resp.Header); ok {
+			txn.node.UpdateLoad(l)
+		}
+		if p.LoadHeader != "" {
+			if l, ok := parseLoadHeader(resp.Header.Get(p.LoadHeader)); ok {
+				txn.node.UpdateLoad(l)
+			}
+			resp.Header.Del(p.LoadHeader)
+		}
+		if mr := txn.mirror; mr != nil && mr.m.Diff != nil {
+			mr.primary = captureResponse(resp, mr.m.MaxBodySize)
+		}
+		if d, ok := nodeBackoff(resp, p.BackoffTooManyRequests); ok {
+			txn.log.WithField("node", txn.node.ID).WithField("backoff", d.String()).Warn("Worker node asked to be left alone")
+			txn.sched.SchedBackoff(txn.node, d)
+		}
+		if resp.StatusCode == http.StatusSwitchingProtocols && txn.upgrade != "" {
+			// the handshake is the transaction, the connection is counted apart from here on
+			p.endTransaction(txn)
+			txn.upgraded = time.Now()
+			txn.backend, _ = resp.Body.(io.Closer)
+		} else {
+			resp.Body = &loadReportBody{ReadCloser: resp.Body, resp: resp, node: txn.node}
+		}
+	}
+	// the client gets the request ID dalb used, not one the worker node made up
+	if txn := requestTransaction(resp.Request); txn != nil {
+		resp.Header.Del(txn.idHeader)
 	} else {
-		r.URL.Host = ""
-		log.Error("Cannot get a worker node for request")
+		resp.Header.Del(p.RequestIDConfig().Header)
+	}
+	return nil
+}
+
+//returns how long a worker node should get no new requests after a 503 response (and a 429 when tooMany
+//is set): the Retry-After it sent, or DefaultNodeBackoff without one. The Retry-After of any other
+//response is not about the node, e.g. a 301. ok is false when the node can be used.
+func nodeBackoff(resp *http.Response, tooMany bool) (d time.Duration, ok bool) {
+	if resp.StatusCode != http.StatusServiceUnavailable && (!tooMany || resp.StatusCode != http.StatusTooManyRequests) {
+		return 0, false
 	}
-	tStart := time.Now()
+	if v := resp.Header.Get("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil {
+			d, ok = time.Duration(secs)*time.Second, secs > 0
+		} else if t, err := http.ParseTime(v); err == nil {
+			d = time.Until(t)
+			ok = d > 0
+		}
+	}
+	if !ok {
+		d, ok = DefaultNodeBackoff, true
+	}
+	if d > MaxNodeBackoff {
+		d = MaxNodeBackoff
+	}
+	return d, ok
+}
+
+//the worker node could not be reached or did not return a response
+func (p *DataPathProxy) dataPathError(w http.ResponseWriter, r *http.Request, err error) {
+	entry := log.NewEntry(log.StandardLogger())
+	status := http.StatusBadGateway
+	if txn := requestTransaction(r); txn != nil {
+		if txn.timedOut(r.Context()) {
+			status = http.StatusGatewayTimeout
+		}
+		txn.status = status
+		entry = txn.log
+	}
+	entry.WithError(err).Error("Worker node request failed")
+	w.WriteHeader(status)
+}
+
+//returns the next worker node, waiting for a free slot if all of them are in use.
+//Returns nil when ctx is done before a slot is free.
+func (p *DataPathProxy) dataPathSchedule(ctx context.Context, txn *transaction) *node.Node {
+	ctx, span := trace.StartSpan(ctx, "node.select", trace.KindInternal)
+	defer span.Finish()
+	span.SetAttribute("dalb.request_id", txn.id)
+	if txn.upgrade != "" {
+		// upgrade requests do not wait for a free slot, a node without a free connection slot is skipped
+		n := txn.sched.SchedTryGetConnNode()
+		if n == nil {
+			span.SetAttribute("dalb.node.available", false)
+			return nil
+		}
+		span.SetAttribute("dalb.node.id", n.ID)
+		return n
+	}
+	if txn.pinned != nil {
+		if txn.sched.SchedGetThisNodeContext(ctx, txn.pinned) {
+			span.SetAttribute("dalb.node.id", txn.pinned.ID)
+			span.SetAttribute("dalb.affinity", true)
+			return txn.pinned
+		}
+		if ctx.Err() != nil {
+			span.SetAttribute("dalb.node.available", false)
+			return nil
+		}
+		// the node of the session is gone, any other node takes over
+		txn.pinned = nil
+	}
+	n := txn.sched.SchedTryGetNode()
+	if n == nil {
+		_, wait := trace.StartSpan(ctx, "scheduler.wait", trace.KindInternal)
+		wait.SetAttribute("dalb.request_id", txn.id)
+		n = txn.sched.SchedGetNodeContext(ctx)
+		wait.Finish()
+	}
+	if n == nil {
+		span.SetAttribute("dalb.node.available", false)
+		return nil
+	}
+	span.SetAttribute("dalb.node.id", n.ID)
+	span.SetAttribute("net.peer.ip", n.IP.String())
+	span.SetAttribute("net.peer.port", n.Port)
+	return n
+}
+
+func (p *DataPathProxy) dataPathForward(w http.ResponseWriter, r *http.Request) {
+	rc := p.RequestIDConfig()
+	txn := &transaction{start: time.Now(), id: p.requestID(r, rc), idHeader: rc.Header, clientIP: p.clientIP(r), remoteAddr: r.RemoteAddr}
+	txn.log = log.WithField("request_id", txn.id)
+	// forward the request ID to the worker node and echo it to the client
+	r.Header.Set(rc.Header, txn.id)
+	w.Header().Set(rc.Header, txn.id)
+	ctx, span := trace.StartServerSpan(r.Context(), "dalb.request", r.Header.Get(trace.TraceparentHeader), r.Header.Get(trace.TracestateHeader))
+	defer span.Finish()
+	span.SetAttribute("http.method", r.Method)
+	span.SetAttribute("http.target", r.URL.RequestURI())
+	span.SetAttribute("http.route", p.path)
+	span.SetAttribute("dalb.request_id", txn.id)
+	span.SetAttribute("http.client_ip", txn.clientIP)
+	if p.AccessLog != nil {
+		dw, body := newDataPathWriter(w), newCountingBody(r)
+		w = dw
+		defer p.logAccess(dw, r, body, txn)
+	}
+	if isUpgrade(r.Header) {
+		txn.upgrade = r.Header.Get("Upgrade")
+		w = &upgradeWriter{ResponseWriter: w, txn: txn}
+		span.SetAttribute("http.upgrade", txn.upgrade)
+	}
+	if isGRPC(r) {
+		txn.grpc, txn.grpcStatus = true, -1
+		span.SetAttribute("rpc.system", "grpc")
+	}
+	g := p.pickGroup(r)
+	txn.sched = g.Sched
+	if g.Name != DefaultGroup {
+		span.SetAttribute("dalb.group", g.Name)
+		txn.log = txn.log.WithField("group", g.Name)
+	}
+	if txn.upgrade == "" {
+		// an upgraded connection stays open for as long as the client wants
+		txn.deadline, txn.deadlineKind = p.requestDeadline(r, txn.start)
+	}
+	if !txn.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, txn.deadline)
+		defer cancel()
+		if !time.Now().Before(txn.deadline) {
+			p.deadlineExpired(w, txn, span)
+			return
+		}
+	}
+	a := p.Affinity()
+	sticky := a != nil && txn.upgrade == ""
+	result := node.AffinityNew
+	if sticky {
+		txn.pinned, result = p.affinityNode(r, txn.sched, a)
+	}
+	n := p.dataPathSchedule(ctx, txn)
+	if n == nil && ctx.Err() == nil && p.Group(g.Name) != g {
+		// the group was deleted after the request picked it, a current group takes the request
+		g = p.pickGroup(r)
+		txn.sched, txn.pinned = g.Sched, nil
+		n = p.dataPathSchedule(ctx, txn)
+	}
+	txn.queueWait = time.Since(txn.start)
+	if n == nil && ctx.Err() == context.DeadlineExceeded && !txn.deadline.IsZero() {
+		// the request ran out of time waiting for a free node slot
+		p.deadlineExpired(w, txn, span)
+		return
+	}
+	if n == nil && r.Context().Err() != nil {
+		txn.log.Warn("Client went away while waiting for a worker node")
+		w.WriteHeader(499)
+		span.SetAttribute("http.status_code", 499)
+		return
+	}
+	if n == nil {
+		txn.log.Error("Cannot get a worker node for request")
+		http.Error(w, "no worker node available", http.StatusServiceUnavailable)
+		span.SetAttribute("http.status_code", http.StatusServiceUnavailable)
+		return
+	}
+	if !txn.deadline.IsZero() && !time.Now().Before(txn.deadline) {
+		// the request ran out of time waiting for a free node slot
+		txn.sched.SchedReScheduleNode(n)
+		p.deadlineExpired(w, txn, span)
+		return
+	}
+	txn.node = n
+	defer func() {
+		if e := recover(); e != nil {
+			// the reverse proxy aborts the response when the worker node response cannot be copied,
+			// the node slot is released all the same
+			if !txn.ended {
+				txn.timedOut(ctx)
+				p.endTransaction(txn)
+				p.logTimeout(txn, span)
+			}
+			panic(e)
+		}
+	}()
+	if sticky {
+		p.updateAffinity(w, r, txn, n, result, a)
+	}
+	if h := p.Hedging(); h != nil && txn.upgrade == "" && txn.pinned == nil && h.hedgeable(r) {
+		txn.hedge = h
+	}
+	mr := p.mirrorRequest(r, txn)
+	txn.mirror = mr
+	r = r.WithContext(context.WithValue(ctx, txnKey, txn))
+	txn.sent = time.Now()
 	p.Proxy.ServeHTTP(w, r)
+	if txn.grpc && txn.resp != nil {
+		// the body has been copied so the trailers are known
+		if code, ok := grpcStatus(txn.resp); ok {
+			txn.grpcStatus = code
+			span.SetAttribute("rpc.grpc.status_code", code)
+		}
+	}
+	if !txn.ended {
+		txn.timedOut(ctx)
+		p.endTransaction(txn)
+		p.logTimeout(txn, span)
+	}
+	if mr != nil {
+		p.sendMirror(mr, r, txn, span)
+	}
+	if txn.upgrade != "" {
+		if !txn.upgraded.IsZero() {
+			dur := time.Since(txn.upgraded)
+			n.UpdateConnection(dur)
+			txn.sched.UpdateConnection(dur)
+		}
+		txn.sched.SchedReleaseConnection(n)
+	}
+	span.SetAttribute("http.status_code", txn.status)
+}
+
+//the worker node has answered the request
+func (p *DataPathProxy) endTransaction(txn *transaction) {
+	n := txn.node
+	txn.ended = true
 	// make the node available for another request
-	p.Sched.SchedReScheduleNode(n)
+	txn.sched.SchedReScheduleNode(n)
 	// compute how long the worker node took to complete the transaction
-	tDur := time.Since(tStart)
+	tDur := time.Since(txn.sent)
+	txn.upstream = tDur
+	status := txn.status
+	if txn.grpc {
+		// a gRPC stream can stay open for as long as the client wants. It holds the node slot
+		// until it ends, but the time the node took to answer is the time to the response headers.
+		if txn.resp != nil {
+			tDur = txn.headers
+		}
+		if txn.grpcStatus >= 0 {
+			status = grpcHTTPStatus(txn.grpcStatus)
+		}
+	}
+	if txn.timeout != "" {
+		n.UpdateTimeout()
+		txn.sched.UpdateTimeout()
+		if status/100 != 5 {
+			// the response had started, the timeout is the error
+			n.UpdateError()
+			txn.sched.UpdateError()
+		}
+	}
 	//update node stats
 	n.UpdateTime(tDur)
 	//update scheduler stats
-	p.Sched.UpdateTime(tDur)
+	txn.sched.UpdateTime(tDur)
+	n.UpdateStatus(status)
+	txn.sched.UpdateStatus(status)
+}
+
+//the request ran out of time before it could be sent to a worker node
+func (p *DataPathProxy) deadlineExpired(w http.ResponseWriter, txn *transaction, span *trace.Span) {
+	txn.timeout = txn.deadlineKind
+	p.countTimeout(txn.timeout)
+	txn.log.WithField("timeout", txn.timeout).Warn("Request timed out before it was sent to a worker node")
+	http.Error(w, "request timed out", http.StatusGatewayTimeout)
+	span.SetAttribute("dalb.timeout", txn.timeout)
+	span.SetAttribute("http.status_code", http.StatusGatewayTimeout)
+}
 
+//count and log a request that timed out at the worker node
+func (p *DataPathProxy) logTimeout(txn *transaction, span *trace.Span) {
+	if txn.timeout == "" {
+		return
+	}
+	p.countTimeout(txn.timeout)
+	span.SetAttribute("dalb.timeout", txn.timeout)
+	txn.log.WithField("node", txn.node.ID).WithField("timeout", txn.timeout).Warn("Worker node request timed out")
 }
@@ -0,0 +1,358 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package dalb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//response diffing defaults
+const (
+	DefaultDiffSamples = 20
+	// bytes of the request and response bodies kept in a sample
+	DiffSampleBodySize = 4096
+	// differences listed for a sample
+	maxDiffs = 20
+)
+
+//the headers compared when none are configured
+var DefaultDiffHeaders = []string{"Content-Type"}
+
+//the headers whose values are replaced by DiffRedacted in samples, they carry credentials and sessions
+var DiffRedactHeaders = []string{"Set-Cookie", "Authorization", "Proxy-Authorization", "WWW-Authenticate", "Proxy-Authenticate"}
+
+//the value of a redacted sample header
+const DiffRedacted = "REDACTED"
+
+//Comparison of the primary and shadow responses of mirrored requests: the status, the selected headers
+//and the body. JSON bodies are compared field by field, other bodies byte by byte. The mismatches
+//are counted and the last MaxSamples of them are kept with their request.
+type ResponseDiff struct {
+	Headers []string
+	// JSON pointers (RFC 6901) of the fields that are not compared
+	IgnorePointers []string
+	// JSON fields with a matching pointer are not compared, matching text is removed from the header
+	// values and the bodies that are not JSON before they are compared
+	IgnorePatterns []*regexp.Regexp
+	MaxSamples     int
+
+	compared int64
+	matched  int64
+	status   int64 // mismatches by what did not match, a response can count for several of them
+	header   int64
+	body     int64
+
+	lock    sync.Mutex
+	samples []DiffSample
+}
+
+//A mirrored request whose primary and shadow responses did not match
+type DiffSample struct {
+	Time        time.Time
+	RequestID   string
+	Method      string
+	URL         string
+	RequestBody []byte
+	Primary     DiffResponse
+	Shadow      DiffResponse
+	// what did not match: "status", "header <name>", "body" or the JSON pointer of a field
+	Differences []string
+}
+
+//a response as it was compared, the body is truncated to DiffSampleBodySize in samples
+type DiffResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+	// the body was larger than the mirror MaxBodySize and was not compared
+	Truncated bool
+}
+
+//returns a ResponseDiff comparing headers, ignoring the JSON fields at pointers and the text
+//or JSON fields matching patterns
+func NewResponseDiff(headers, pointers, patterns []string) (*ResponseDiff, error) {
+	d := &ResponseDiff{Headers: headers, IgnorePointers: pointers, MaxSamples: DefaultDiffSamples}
+	if d.Headers == nil {
+		d.Headers = append([]string(nil), DefaultDiffHeaders...)
+	}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		d.IgnorePatterns = append(d.IgnorePatterns, re)
+	}
+	return d, nil
+}
+
+// Returns the number of compared responses, those that matched and the mismatches of the status,
+// the headers and the body
+func (d *ResponseDiff) Counts() (compared, matched, status, header, body int64) {
+	return atomic.LoadInt64(&d.compared), atomic.LoadInt64(&d.matched),
+		atomic.LoadInt64(&d.status), atomic.LoadInt64(&d.header), atomic.LoadInt64(&d.body)
+}
+
+// Returns the kept mismatches, the most recent last
+func (d *ResponseDiff) Samples() []DiffSample {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]DiffSample(nil), d.samples...)
+}
+
+// Clear the counts and the samples
+func (d *ResponseDiff) Reset() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, cnt := range []*int64{&d.compared, &d.matched, &d.status, &d.header, &d.body} {
+		atomic.StoreInt64(cnt, 0)
+	}
+	d.samples = nil
+}
+
+//a primary response being copied to the client
+type responseCapture struct {
+	status int
+	header http.Header
+	body   *mirrorBody
+}
+
+//capture a primary response as it is sent to the client, the body is replaced with a mirrorBody
+func captureResponse(resp *http.Response, max int64) *responseCapture {
+	rc := &responseCapture{status: resp.StatusCode, header: resp.Header.Clone()}
+	if resp.Body != nil && resp.Body != http.NoBody {
+		rc.body = &mirrorBody{ReadCloser: resp.Body, max: max}
+		resp.Body = rc.body
+	}
+	return rc
+}
+
+//returns the captured response
+func (rc *responseCapture) response() DiffResponse {
+	dr := DiffResponse{Status: rc.status, Header: rc.header}
+	if rc.body != nil {
+		dr.Body, dr.Truncated = rc.body.buf.Bytes(), rc.body.tooLarge || !rc.body.eof
+	}
+	return dr
+}
+
+//reads a shadow response, the body is read to the end and kept up to max bytes
+func readResponse(resp *http.Response, max int64) DiffResponse {
+	dr := DiffResponse{Status: resp.StatusCode, Header: resp.Header}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, max+1))
+	if int64(len(body)) > max {
+		dr.Truncated = true
+		io.Copy(ioutil.Discard, resp.Body)
+	} else {
+		dr.Body = body
+	}
+	return dr
+}
+
+//compare the primary and shadow responses of a mirrored request and keep a sample when they do not match
+func (d *ResponseDiff) compare(r *http.Request, reqBody []byte, id string, primary, shadow DiffResponse) {
+	atomic.AddInt64(&d.compared, 1)
+	var diffs []string
+	if primary.Status != shadow.Status {
+		atomic.AddInt64(&d.status, 1)
+		diffs = append(diffs, "status")
+	}
+	headers := false
+	for _, name := range d.Headers {
+		if d.scrub(strings.Join(primary.Header.Values(name), ", ")) != d.scrub(strings.Join(shadow.Header.Values(name), ", ")) {
+			headers = true
+			diffs = append(diffs, "header "+http.CanonicalHeaderKey(name))
+		}
+	}
+	if headers {
+		atomic.AddInt64(&d.header, 1)
+	}
+	if !primary.Truncated && !shadow.Truncated {
+		if bodyDiffs := d.bodyDiffs(primary, shadow); len(bodyDiffs) > 0 {
+			atomic.AddInt64(&d.body, 1)
+			diffs = append(diffs, bodyDiffs...)
+		}
+	}
+	if len(diffs) == 0 {
+		atomic.AddInt64(&d.matched, 1)
+		return
+	}
+	if len(diffs) > maxDiffs {
+		diffs = diffs[:maxDiffs]
+	}
+	sample := DiffSample{
+		Time:        time.Now(),
+		RequestID:   id,
+		Method:      r.Method,
+		URL:         r.URL.RequestURI(),
+		RequestBody: truncate(reqBody),
+		Primary:     primary,
+		Shadow:      shadow,
+		Differences: diffs,
+	}
+	sample.Primary.Body, sample.Shadow.Body = truncate(primary.Body), truncate(shadow.Body)
+	sample.Primary.Header, sample.Shadow.Header = redact(primary.Header), redact(shadow.Header)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.MaxSamples <= 0 {
+		return
+	}
+	if len(d.samples) >= d.MaxSamples {
+		d.samples = append(d.samples[:0:0], d.samples[len(d.samples)-d.MaxSamples+1:]...)
+	}
+	d.samples = append(d.samples, sample)
+}
+
+//returns a copy of a header with the values of the DiffRedactHeaders replaced
+func redact(h http.Header) http.Header {
+	h = h.Clone()
+	for _, name := range DiffRedactHeaders {
+		if values := h.Values(name); len(values) > 0 {
+			redacted := make([]string, len(values))
+			for idx := range redacted {
+				redacted[idx] = DiffRedacted
+			}
+			h[http.CanonicalHeaderKey(name)] = redacted
+		}
+	}
+	return h
+}
+
+//returns a copy of the first DiffSampleBodySize bytes of a body
+func truncate(b []byte) []byte {
+	if len(b) > DiffSampleBodySize {
+		b = b[:DiffSampleBodySize]
+	}
+	return append([]byte(nil), b...)
+}
+
+//remove the text matching the ignore patterns
+func (d *ResponseDiff) scrub(s string) string {
+	for _, re := range d.IgnorePatterns {
+		s = re.ReplaceAllString(s, "")
+	}
+	return s
+}
+
+//returns the differences between two response bodies
+func (d *ResponseDiff) bodyDiffs(primary, shadow DiffResponse) []string {
+	pBody, sBody := decodedBody(primary), decodedBody(shadow)
+	if isJSON(primary.Header) && isJSON(shadow.Header) {
+		var pValue, sValue interface{}
+		if json.Unmarshal(pBody, &pValue) == nil && json.Unmarshal(sBody, &sValue) == nil {
+			var diffs []string
+			d.jsonDiffs("", pValue, sValue, &diffs)
+			return diffs
+		}
+	}
+	if d.scrub(string(pBody)) != d.scrub(string(sBody)) {
+		return []string{"body"}
+	}
+	return nil
+}
+
+//returns the body of a response without its gzip content encoding
+func decodedBody(dr DiffResponse) []byte {
+	if !strings.EqualFold(dr.Header.Get("Content-Encoding"), "gzip") {
+		return dr.Body
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(dr.Body))
+	if err != nil {
+		return dr.Body
+	}
+	body, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return dr.Body
+	}
+	return body
+}
+
+func isJSON(h http.Header) bool {
+	return strings.Contains(strings.ToLower(h.Get("Content-Type")), "json")
+}
+
+//returns true when the JSON field at ptr is not compared
+func (d *ResponseDiff) ignored(ptr string) bool {
+	for _, p := range d.IgnorePointers {
+		if p == ptr {
+			return true
+		}
+	}
+	for _, re := range d.IgnorePatterns {
+		if ptr != "" && re.MatchString(ptr) {
+			return true
+		}
+	}
+	return false
+}
+
+//add the JSON pointers of the fields of a and b that are different to diffs
+func (d *ResponseDiff) jsonDiffs(ptr string, a, b interface{}, diffs *[]string) {
+	if len(*diffs) > maxDiffs || d.ignored(ptr) {
+		return
+	}
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(av)+len(bv))
+		for k := range av {
+			keys = append(keys, k)
+		}
+		for k := range bv {
+			if _, ok := av[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			d.jsonDiffs(ptr+"/"+pointerEscaper.Replace(k), av[k], bv[k], diffs)
+		}
+		return
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		for idx := 0; idx < len(av) || idx < len(bv); idx++ {
+			var ae, be interface{}
+			if idx < len(av) {
+				ae = av[idx]
+			}
+			if idx < len(bv) {
+				be = bv[idx]
+			}
+			d.jsonDiffs(ptr+"/"+strconv.Itoa(idx), ae, be, diffs)
+		}
+		return
+	case string:
+		if bv, ok := b.(string); ok && d.scrub(av) == d.scrub(bv) {
+			return
+		}
+	default:
+		if a == b {
+			return
+		}
+	}
+	if ptr == "" {
+		ptr = "body"
+	}
+	*diffs = append(*diffs, ptr)
+}
+
+//escapes a JSON object key for a JSON pointer
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
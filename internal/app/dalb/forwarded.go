@@ -0,0 +1,147 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package dalb
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+//parse a comma separated list of CIDRs, a plain IP address is a single host
+func ParseCIDRs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+//returns true if ip is the address of a trusted proxy
+func (p *DataPathProxy) trusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range p.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//returns the IP address of the peer that sent the request
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+//returns the IP address of the client that sent the request.
+//X-Forwarded-For is walked from the right as long as the addresses belong to trusted proxies,
+//the first address that is not trusted is the client.
+func (p *DataPathProxy) clientIP(r *http.Request) string {
+	client := remoteIP(r)
+	if !p.trusted(net.ParseIP(client)) {
+		return client
+	}
+	chain := forwardedFor(r.Header)
+	for idx := len(chain) - 1; idx >= 0; idx-- {
+		ip := net.ParseIP(chain[idx])
+		if ip == nil {
+			break
+		}
+		client = chain[idx]
+		if !p.trusted(ip) {
+			break
+		}
+	}
+	return client
+}
+
+//returns the addresses in all the X-Forwarded-For headers of a request
+func forwardedFor(h http.Header) []string {
+	var chain []string
+	for _, v := range h.Values("X-Forwarded-For") {
+		for _, ip := range strings.Split(v, ",") {
+			if ip = strings.TrimSpace(ip); ip != "" {
+				chain = append(chain, ip)
+			}
+		}
+	}
+	return chain
+}
+
+//set the X-Forwarded-* and Forwarded headers of a request to a worker node.
+//Headers set by the peer are only kept when the peer is a trusted proxy.
+func (p *DataPathProxy) setForwardedHeaders(r *http.Request) {
+	peer := remoteIP(r)
+	trusted := p.trusted(net.ParseIP(peer))
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	if !trusted {
+		r.Header.Del("X-Forwarded-For")
+		r.Header.Del("X-Forwarded-Proto")
+		r.Header.Del("X-Forwarded-Host")
+		r.Header.Del("Forwarded")
+	} else if chain := forwardedFor(r.Header); len(chain) > 0 {
+		// ReverseProxy appends the peer address
+		r.Header.Set("X-Forwarded-For", strings.Join(chain, ", "))
+	}
+	if r.Header.Get("X-Forwarded-Proto") == "" {
+		r.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if r.Header.Get("X-Forwarded-Host") == "" {
+		r.Header.Set("X-Forwarded-Host", r.Host)
+	}
+	fwd := fmt.Sprintf("for=%s;host=%s;proto=%s", forwardedNode(peer), forwardedValue(r.Host), proto)
+	if prior := strings.Join(r.Header.Values("Forwarded"), ", "); prior != "" {
+		fwd = prior + ", " + fwd
+	}
+	r.Header.Set("Forwarded", fwd)
+}
+
+//format an IP address as an RFC 7239 node, IPv6 addresses are bracketed and quoted
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return forwardedValue(ip)
+}
+
+//quote an RFC 7239 value when it is not a token
+func forwardedValue(v string) string {
+	for idx := 0; idx < len(v); idx++ {
+		c := v[idx]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+		}
+	}
+	return v
+}
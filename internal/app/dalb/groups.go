@@ -0,0 +1,296 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package dalb
+
+import (
+	"errors"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"dalb/internal/node"
+)
+
+//the node group of a route that is created with it, its Scheduler is the Scheduler of the route
+const DefaultGroup = "default"
+
+//the traffic weight of the default group
+const DefaultGroupWeight = 100
+
+//how long a deleted group has to finish the requests that picked it before its scheduler is deleted
+var GroupDrainTimeout = 30 * time.Second
+
+//the largest traffic weight of a group, the calendar of the groups gets up to this many entries per group
+const MaxGroupWeight = 10000
+
+//request header and cookie that send a request to the node group they name, when they are turned on
+const (
+	DefaultGroupHeader = "X-Dalb-Group"
+	DefaultGroupCookie = "dalb_group"
+)
+
+//A named group of worker nodes of a route, e.g. the stable and canary versions of an application.
+//Each group has its own Scheduler, so its statistics are kept apart from the other groups, and gets
+//a share of the requests of the route proportional to its weight.
+type Group struct {
+	Name  string
+	Sched *node.Scheduler
+	// traffic weight, 0 for a group that only gets the requests forced to it
+	weight int32
+}
+
+// Returns the traffic weight of the group
+func (g *Group) Weight() int {
+	return int(atomic.LoadInt32(&g.weight))
+}
+
+//the node groups of a route and the Weighted Round Robin calendar their requests are split with
+type groupTable struct {
+	groups   []*Group
+	calendar []*Group
+}
+
+//build a group table, the calendar has each group weight/gcd times, spread with smooth weighted round robin
+func newGroupTable(groups []*Group) *groupTable {
+	t := &groupTable{groups: groups}
+	div, total := 0, 0
+	for _, g := range groups {
+		w := g.Weight()
+		div = gcd(div, w)
+		total += w
+	}
+	if total == 0 {
+		return t
+	}
+	total /= div
+	current := make([]int, len(groups))
+	t.calendar = make([]*Group, 0, total)
+	for len(t.calendar) < total {
+		best := -1
+		for idx, g := range groups {
+			current[idx] += g.Weight() / div
+			if best < 0 || current[idx] > current[best] {
+				best = idx
+			}
+		}
+		current[best] -= total
+		t.calendar = append(t.calendar, groups[best])
+	}
+	return t
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+//returns the group with that name, or nil
+func (t *groupTable) group(name string) *Group {
+	for _, g := range t.groups {
+		if g.Name == name {
+			return g
+		}
+	}
+	return nil
+}
+
+// Returns the node groups of the route, the default group first
+func (p *DataPathProxy) Groups() []*Group {
+	return p.groups.Load().(*groupTable).groups
+}
+
+// Returns the node group with that name, or nil
+func (p *DataPathProxy) Group(name string) *Group {
+	return p.groups.Load().(*groupTable).group(name)
+}
+
+// Set the traffic weight of a node group of the route, the group is created when it does not exist
+func (p *DataPathProxy) SetGroup(name string, weight int) (*Group, error) {
+	if name == "" {
+		return nil, errors.New("group name is missing")
+	}
+	if weight < 0 || weight > MaxGroupWeight {
+		return nil, errors.New("the group weight must be between 0 and " + strconv.Itoa(MaxGroupWeight))
+	}
+	p.groupLock.Lock()
+	defer p.groupLock.Unlock()
+	t := p.groups.Load().(*groupTable)
+	g := t.group(name)
+	groups := t.groups
+	if g == nil {
+		sched := node.NewScheduler(0)
+		sched.Name = p.path + "@" + name
+		sched.RestoreHistory()
+		registerRoute(sched.Name, sched)
+		g = &Group{Name: name, Sched: sched}
+		groups = append(groups[:len(groups):len(groups)], g)
+	}
+	atomic.StoreInt32(&g.weight, int32(weight))
+	p.groups.Store(newGroupTable(groups))
+	return g, nil
+}
+
+// Delete a node group of the route: it gets no new requests and its scheduler is deleted once the
+// requests that already picked it are done, or after GroupDrainTimeout. The default group cannot be deleted.
+func (p *DataPathProxy) DeleteGroup(name string) error {
+	if name == DefaultGroup {
+		return errors.New("the default group cannot be deleted")
+	}
+	p.groupLock.Lock()
+	t := p.groups.Load().(*groupTable)
+	g := t.group(name)
+	if g == nil {
+		p.groupLock.Unlock()
+		return errors.New("group not found")
+	}
+	groups := make([]*Group, 0, len(t.groups)-1)
+	for _, cur := range t.groups {
+		if cur != g {
+			groups = append(groups, cur)
+		}
+	}
+	p.groups.Store(newGroupTable(groups))
+	p.groupLock.Unlock()
+
+	unregisterRoute(g.Sched.Name)
+	go g.drain(GroupDrainTimeout)
+	return nil
+}
+
+//wait for the requests of a deleted group to finish, then delete its worker nodes and its scheduler
+func (g *Group) drain(timeout time.Duration) {
+	nodes := g.Sched.SchedNodes()
+	for _, n := range nodes {
+		drainUpgrades(n)
+	}
+	end := time.Now().Add(timeout)
+	for time.Now().Before(end) && g.busy(nodes) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, n := range nodes {
+		g.Sched.SchedDeleteNode(n)
+	}
+	g.Sched.Delete()
+}
+
+//returns true while requests are waiting for or using the worker nodes of the group
+func (g *Group) busy(nodes []*node.Node) bool {
+	if g.Sched.SchedWaiting() > 0 {
+		return true
+	}
+	for _, n := range nodes {
+		if n.InFlight() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+//returns the node group a request goes to: the group named by the group header or cookie, the group
+//of the session of the request, or else a group picked by weight. Groups without worker nodes and
+//the shadow group of the mirroring are skipped for the default group.
+func (p *DataPathProxy) pickGroup(r *http.Request) *Group {
+	t := p.groups.Load().(*groupTable)
+	if len(t.groups) == 1 {
+		return t.groups[0]
+	}
+	shadow := ""
+	if m := p.Mirroring(); m != nil {
+		shadow = m.Group
+	}
+	if name := p.forcedGroup(r); name != "" && name != shadow {
+		if g := t.group(name); g != nil {
+			return g
+		}
+	}
+	var g *Group
+	if a := p.Affinity(); a != nil {
+		g = p.affinityGroup(r, t, a)
+	}
+	if g == nil && len(t.calendar) > 0 {
+		g = t.calendar[(atomic.AddUint64(&p.groupCursor, 1)-1)%uint64(len(t.calendar))]
+	}
+	if g == nil || g.Name == shadow || g.Sched.SchedSlots() == 0 {
+		g = t.groups[0]
+	}
+	return g
+}
+
+//returns the group named by the group header or cookie of a request, "" when there is none or the
+//request is not from a trusted proxy or one of the GroupClients
+func (p *DataPathProxy) forcedGroup(r *http.Request) string {
+	if p.GroupHeader == "" && p.GroupCookie == "" || !p.groupClient(r) {
+		return ""
+	}
+	if p.GroupHeader != "" {
+		if name := r.Header.Get(p.GroupHeader); name != "" {
+			return name
+		}
+	}
+	if p.GroupCookie != "" {
+		if c, err := r.Cookie(p.GroupCookie); err == nil {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+//returns true if the request can name its node group: it comes from a trusted proxy or from one of the GroupClients
+func (p *DataPathProxy) groupClient(r *http.Request) bool {
+	if p.trusted(net.ParseIP(remoteIP(r))) {
+		return true
+	}
+	ip := net.ParseIP(p.clientIP(r))
+	if ip == nil {
+		return false
+	}
+	for _, n := range p.GroupClients {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//returns the group of the session of a request so it keeps going to the same group when the split
+//is not changed, nil when the request has no session
+func (p *DataPathProxy) affinityGroup(r *http.Request, t *groupTable, a *Affinity) *Group {
+	var key string
+	switch a.Mode {
+	case AffinityCookie:
+		c, err := r.Cookie(a.Name)
+		if err != nil {
+			return nil
+		}
+		id := a.verify(p.path, c.Value)
+		if id == "" {
+			return nil
+		}
+		for _, g := range t.groups {
+			for _, n := range g.Sched.SchedNodes() {
+				if n.ID == id {
+					return g
+				}
+			}
+		}
+		return nil
+	case AffinityAppCookie:
+		if c, err := r.Cookie(a.Name); err == nil {
+			key = c.Value
+		}
+	case AffinityHeader:
+		key = r.Header.Get(a.Name)
+	}
+	if key == "" || len(t.calendar) == 0 {
+		return nil
+	}
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return t.calendar[h.Sum64()%uint64(len(t.calendar))]
+}
@@ -0,0 +1,143 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package dalb
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//returns true if the request is a gRPC call
+func isGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+//returns the grpc-status of a gRPC response. It is a trailer, or a header when the worker node
+//answered without a body (trailers-only). The trailers are only known once the body has been read.
+func grpcStatus(resp *http.Response) (int, bool) {
+	v := resp.Trailer.Get("Grpc-Status")
+	if v == "" {
+		v = resp.Header.Get("Grpc-Status")
+	}
+	code, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, false
+	}
+	return code, true
+}
+
+//maps a gRPC status code to the HTTP status counted in the node statistics, so failed calls are
+//counted as errors like 5xx responses and calls rejected because of the client like 4xx responses
+func grpcHTTPStatus(code int) int {
+	switch code {
+	case 0: // OK
+		return http.StatusOK
+	case 1: // CANCELLED
+		return 499
+	case 3, 9, 11: // INVALID_ARGUMENT, FAILED_PRECONDITION, OUT_OF_RANGE
+		return http.StatusBadRequest
+	case 4: // DEADLINE_EXCEEDED
+		return http.StatusGatewayTimeout
+	case 5: // NOT_FOUND
+		return http.StatusNotFound
+	case 6, 10: // ALREADY_EXISTS, ABORTED
+		return http.StatusConflict
+	case 7: // PERMISSION_DENIED
+		return http.StatusForbidden
+	case 8: // RESOURCE_EXHAUSTED
+		return http.StatusTooManyRequests
+	case 12: // UNIMPLEMENTED
+		return http.StatusNotImplemented
+	case 14: // UNAVAILABLE
+		return http.StatusServiceUnavailable
+	case 16: // UNAUTHENTICATED
+		return http.StatusUnauthorized
+	}
+	// UNKNOWN, INTERNAL, DATA_LOSS and codes gRPC does not define
+	return http.StatusInternalServerError
+}
+
+//returns a gRPC length-prefixed message: an uncompressed flag byte, the length and the message
+func grpcMessage(msg []byte) []byte {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+//returns the first message of a gRPC body, compressed messages are not supported
+func readGRPCMessage(body []byte) ([]byte, error) {
+	if len(body) < 5 {
+		return nil, errors.New("gRPC message too short")
+	}
+	if body[0] != 0 {
+		return nil, errors.New("compressed gRPC message")
+	}
+	size := binary.BigEndian.Uint32(body[1:])
+	if uint64(len(body)-5) < uint64(size) {
+		return nil, errors.New("gRPC message truncated")
+	}
+	return body[5 : 5+size], nil
+}
+
+//protocol buffers wire types
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+//returns a length-delimited protocol buffers field
+func protoBytesField(num int, b []byte) []byte {
+	field := make([]byte, 2*binary.MaxVarintLen64, 2*binary.MaxVarintLen64+len(b))
+	cnt := binary.PutUvarint(field, uint64(num)<<3|protoBytes)
+	cnt += binary.PutUvarint(field[cnt:], uint64(len(b)))
+	return append(field[:cnt], b...)
+}
+
+//calls fn for every field of a protocol buffers message. v is the value of varint and fixed
+//fields, data the value of length-delimited fields.
+func protoFields(msg []byte, fn func(num, typ int, v uint64, data []byte)) error {
+	for len(msg) > 0 {
+		key, cnt := binary.Uvarint(msg)
+		if cnt <= 0 {
+			return errors.New("invalid protobuf field")
+		}
+		msg = msg[cnt:]
+		num, typ := int(key>>3), int(key&7)
+		var v uint64
+		var data []byte
+		switch typ {
+		case protoVarint:
+			v, cnt = binary.Uvarint(msg)
+			if cnt <= 0 {
+				return errors.New("invalid protobuf varint")
+			}
+			msg = msg[cnt:]
+		case protoFixed64:
+			if len(msg) < 8 {
+				return errors.New("invalid protobuf fixed64")
+			}
+			v, msg = binary.LittleEndian.Uint64(msg), msg[8:]
+		case protoFixed32:
+			if len(msg) < 4 {
+				return errors.New("invalid protobuf fixed32")
+			}
+			v, msg = uint64(binary.LittleEndian.Uint32(msg)), msg[4:]
+		case protoBytes:
+			size, cnt := binary.Uvarint(msg)
+			if cnt <= 0 || uint64(len(msg)-cnt) < size {
+				return errors.New("invalid protobuf length")
+			}
+			data, msg = msg[cnt:cnt+int(size)], msg[cnt+int(size):]
+		default:
+			return errors.New("unsupported protobuf wire type")
+		}
+		fn(num, typ, v, data)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package dalb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"dalb/internal/node"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//how often the worker nodes with a health check are checked
+const DefaultHealthInterval = 10 * time.Second
+
+//how long a worker node has to answer a health check
+const DefaultHealthTimeout = 2 * time.Second
+
+//the health checks a worker node can be given
+const (
+	HealthCheckGRPC = "grpc" // grpc.health.v1.Health/Check
+)
+
+//grpc.health.v1.HealthCheckResponse.ServingStatus
+const grpcServing = 1
+
+//sends the health checks, with the same transports as the requests
+var healthTransport = newNodeTransport()
+
+//returns an error if a node cannot be given the health check
+func validHealthCheck(check, proto string) error {
+	switch check {
+	case "":
+		return nil
+	case HealthCheckGRPC:
+		if proto != ProtoH2 && proto != ProtoH2C {
+			return errors.New("gRPC health checks need an h2 or h2c worker node")
+		}
+		return nil
+	}
+	return errors.New("invalid health check")
+}
+
+//check the health of the worker nodes every interval, DefaultHealthInterval when 0
+func StartHealthChecks(interval time.Duration) {
+	if interval == 0 {
+		interval = DefaultHealthInterval
+	}
+	go func() {
+		for range time.Tick(interval) {
+			CheckHealth()
+		}
+	}()
+}
+
+//check the health of every worker node that has a health check, on every route. A node that fails
+//gets no new requests until it passes again.
+func CheckHealth() {
+	var wg sync.WaitGroup
+	for _, s := range routeSchedulers() {
+		for _, n := range s.SchedNodes() {
+			if n.HealthCheck == "" {
+				continue
+			}
+			wg.Add(1)
+			go func(s *node.Scheduler, n *node.Node) {
+				defer wg.Done()
+				err := grpcHealthCheck(n)
+				if !s.SchedSetHealthy(n, err == nil) {
+					return
+				}
+				entry := log.WithField("route", s.Name).WithField("node", n.ID)
+				if err != nil {
+					entry.WithError(err).Warn("Worker node is not healthy")
+				} else {
+					entry.Info("Worker node is healthy")
+				}
+			}(s, n)
+		}
+	}
+	wg.Wait()
+}
+
+//returns nil if the node reports that it (or its HealthService) is serving
+func grpcHealthCheck(n *node.Node) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultHealthTimeout)
+	defer cancel()
+	// grpc.health.v1.HealthCheckRequest{service}
+	var msg []byte
+	if n.HealthService != "" {
+		msg = protoBytesField(1, []byte(n.HealthService))
+	}
+	url := nodeScheme(n) + "://" + net.JoinHostPort(n.IP.String(), strconv.Itoa(n.Port)) + "/grpc.health.v1.Health/Check"
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(grpcMessage(msg)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := healthTransport.forNode(n).RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check HTTP status %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if l, ok := takeLoadReport(resp.Trailer); ok {
+		n.UpdateLoad(l)
+	}
+	if code, ok := grpcStatus(resp); !ok {
+		return errors.New("health check without grpc-status")
+	} else if code != 0 {
+		return fmt.Errorf("health check grpc-status %d %q", code, resp.Trailer.Get("Grpc-Message"))
+	}
+	msg, err = readGRPCMessage(body)
+	if err != nil {
+		return err
+	}
+	// grpc.health.v1.HealthCheckResponse{status}
+	status := uint64(0)
+	err = protoFields(msg, func(num, typ int, v uint64, data []byte) {
+		if num == 1 && typ == protoVarint {
+			status = v
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if status != grpcServing {
+		return fmt.Errorf("health check serving status %d", status)
+	}
+	return nil
+}
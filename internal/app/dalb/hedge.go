@@ -0,0 +1,348 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package dalb
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dalb/internal/node"
+)
+
+//hedging defaults
+const (
+	DefaultHedgePercentile = 0.95
+	DefaultHedgeBudget     = 10 // percent of extra requests
+	DefaultHedgeMinDelay   = 5 * time.Millisecond
+	// the hedge delay is the percentile of the transaction times of the last HedgeWindow
+	HedgeWindow = 10 * time.Second
+	// transaction times needed before a hedge delay is computed
+	HedgeMinSamples = 20
+	// a hedge costs hedgeToken, every eligible request earns BudgetPercent/100 of one, up to hedgeBurst
+	hedgeToken = 1000000
+	hedgeBurst = 10 * hedgeToken
+)
+
+//the methods of the requests that are hedged when none are configured
+var DefaultHedgeMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+
+//Hedging of slow idempotent requests: a request that has not been answered after Delay, or the
+//Percentile of the recent transaction times of its node group, is sent again to another worker node.
+//The first response is used and the other request is cancelled. The hedges are paid for with a budget
+//so they add at most BudgetPercent of extra requests.
+type Hedge struct {
+	Methods []string
+	// how long to wait for the first response, 0 for the Percentile of the recent transaction times
+	Delay      time.Duration
+	Percentile float64
+	MinDelay   time.Duration
+	// percent of the eligible requests that can be hedged
+	BudgetPercent float64
+
+	tokens   int64
+	eligible int64 // requests that could be hedged
+	hedged   int64 // hedges sent
+	wins     int64 // hedges that answered first
+	budget   int64 // hedges not sent because the budget was spent
+	noNode   int64 // hedges not sent because no other node had a free slot
+
+	lock   sync.Mutex
+	delays map[*node.Scheduler]*hedgeDelay
+}
+
+//the hedge delay of a node group
+type hedgeDelay struct {
+	at    time.Time
+	prev  node.Histogram // transaction times when the delay was computed
+	delay time.Duration
+}
+
+//returns a Hedge with a BudgetPercent budget and the default settings
+func NewHedge(budget float64) *Hedge {
+	return &Hedge{
+		Methods:       append([]string(nil), DefaultHedgeMethods...),
+		Percentile:    DefaultHedgePercentile,
+		MinDelay:      DefaultHedgeMinDelay,
+		BudgetPercent: budget,
+	}
+}
+
+//returns an error when the hedge settings cannot be used
+func (h *Hedge) valid() error {
+	if len(h.Methods) == 0 {
+		return errors.New("no methods to hedge")
+	}
+	if h.Delay < 0 || h.MinDelay < 0 {
+		return errors.New("invalid hedge delay")
+	}
+	if h.Delay == 0 && (h.Percentile <= 0 || h.Percentile >= 1 || math.IsNaN(h.Percentile)) {
+		return errors.New("the hedge percentile must be between 0 and 1")
+	}
+	if h.BudgetPercent <= 0 || h.BudgetPercent > 100 || math.IsNaN(h.BudgetPercent) {
+		return errors.New("the hedge budget must be between 0 and 100 percent")
+	}
+	return nil
+}
+
+// Returns the number of requests that could be hedged, the hedges sent, those that answered first and
+// the hedges not sent because the budget was spent or no other node had a free slot
+func (h *Hedge) Counts() (eligible, hedged, wins, budget, noNode int64) {
+	return atomic.LoadInt64(&h.eligible), atomic.LoadInt64(&h.hedged), atomic.LoadInt64(&h.wins),
+		atomic.LoadInt64(&h.budget), atomic.LoadInt64(&h.noNode)
+}
+
+//returns true when a request can be hedged: an idempotent method without a body
+func (h *Hedge) hedgeable(r *http.Request) bool {
+	if r.Body != nil && r.Body != http.NoBody {
+		return false
+	}
+	for _, m := range h.Methods {
+		if m == r.Method {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns how long a request of the node group of s waits for its response before it is hedged,
+// 0 when the group does not have enough recent transaction times yet
+func (h *Hedge) DelayFor(s *node.Scheduler) time.Duration {
+	if h.Delay > 0 {
+		return h.Delay
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.delays == nil {
+		h.delays = make(map[*node.Scheduler]*hedgeDelay)
+	}
+	hd := h.delays[s]
+	if hd == nil {
+		hd = &hedgeDelay{}
+		h.delays[s] = hd
+	}
+	if time.Since(hd.at) < HedgeWindow {
+		return hd.delay
+	}
+	// without enough new transaction times the last delay is kept and the window grows
+	hd.at = time.Now()
+	cur := s.Stats().Latency
+	recent := cur
+	recent.Sub(&hd.prev)
+	if recent.Count() >= HedgeMinSamples {
+		hd.delay = recent.Percentile(h.Percentile)
+		if hd.delay < h.MinDelay {
+			hd.delay = h.MinDelay
+		}
+		hd.prev = cur
+	}
+	return hd.delay
+}
+
+//adds the budget earned by an eligible request
+func (h *Hedge) earn() {
+	earned := int64(h.BudgetPercent * hedgeToken / 100)
+	for {
+		cur := atomic.LoadInt64(&h.tokens)
+		next := cur + earned
+		if next > hedgeBurst {
+			next = hedgeBurst
+		}
+		if next == cur || atomic.CompareAndSwapInt64(&h.tokens, cur, next) {
+			return
+		}
+	}
+}
+
+//spends the budget of a hedge, returns false when there is not enough left
+func (h *Hedge) spend() bool {
+	for {
+		cur := atomic.LoadInt64(&h.tokens)
+		if cur < hedgeToken {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&h.tokens, cur, cur-hedgeToken) {
+			return true
+		}
+	}
+}
+
+// Returns the hedging of the route, nil when it is off
+func (p *DataPathProxy) Hedging() *Hedge {
+	h, _ := p.hedge.Load().(*Hedge)
+	return h
+}
+
+// Hedge the slow requests of the route, nil turns hedging off
+func (p *DataPathProxy) SetHedge(h *Hedge) error {
+	if h != nil {
+		if err := h.valid(); err != nil {
+			return err
+		}
+	}
+	p.hedge.Store(h)
+	return nil
+}
+
+//sends a request that is slow to answer to a second worker node when the transaction asks for it
+type hedgingTransport struct {
+	p    *DataPathProxy
+	base http.RoundTripper
+}
+
+//the outcome of one of the requests of a hedged transaction
+type hedgeResult struct {
+	resp   *http.Response
+	err    error
+	txn    *transaction
+	cancel context.CancelFunc
+}
+
+func (t *hedgingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	txn := requestTransaction(r)
+	if txn == nil || txn.hedge == nil {
+		return t.base.RoundTrip(r)
+	}
+	h := txn.hedge
+	atomic.AddInt64(&h.eligible, 1)
+	h.earn()
+	delay := h.DelayFor(txn.sched)
+	if delay <= 0 {
+		return t.base.RoundTrip(r)
+	}
+	// the request is copied before it is sent, the transport adds headers to it
+	hreq := r.Clone(r.Context())
+	results := make(chan hedgeResult, 2)
+	primary, cancelPrimary := t.start(r, txn, txn.node, results)
+	timer := time.NewTimer(delay)
+	select {
+	case res := <-results:
+		timer.Stop()
+		return t.finish(r, txn, res, nil)
+	case <-timer.C:
+	}
+	n := txn.sched.SchedTryGetOtherNode(txn.node)
+	if n == nil {
+		atomic.AddInt64(&h.noNode, 1)
+		return t.finish(r, txn, <-results, nil)
+	}
+	if !h.spend() {
+		txn.sched.SchedReScheduleNode(n)
+		atomic.AddInt64(&h.budget, 1)
+		return t.finish(r, txn, <-results, nil)
+	}
+	atomic.AddInt64(&h.hedged, 1)
+	txn.log.WithField("node", n.ID).WithField("delay", delay.String()).Debug("Hedging slow request")
+	hreq.URL.Scheme = nodeScheme(n)
+	hreq.URL.Host = net.JoinHostPort(n.IP.String(), strconv.Itoa(n.Port))
+	if t.p.RewriteHost {
+		hreq.Host = hreq.URL.Host
+	}
+	hedge, cancelHedge := t.start(hreq, txn, n, results)
+	first := <-results
+	if first.err != nil {
+		// a failed request does not win when the other one can still answer
+		second := <-results
+		if second.err == nil {
+			first, second = second, first
+		}
+		t.lose(txn, second, true)
+		return t.finish(r, txn, first, hedge)
+	}
+	// the other request is cancelled, its node slot is released once it has returned
+	if first.txn == primary {
+		cancelHedge()
+	} else {
+		cancelPrimary()
+	}
+	go func() {
+		t.lose(txn, <-results, false)
+	}()
+	return t.finish(r, txn, first, hedge)
+}
+
+//sends a request of a hedged transaction to node n with its own transaction and context
+func (t *hedgingTransport) start(r *http.Request, txn *transaction, n *node.Node, results chan<- hedgeResult) (*transaction, context.CancelFunc) {
+	atxn := &transaction{
+		start:      txn.start,
+		id:         txn.id,
+		idHeader:   txn.idHeader,
+		log:        txn.log,
+		clientIP:   txn.clientIP,
+		remoteAddr: txn.remoteAddr,
+		sched:      txn.sched,
+		node:       n,
+		attempts:   txn.attempts,
+		sent:       time.Now(),
+	}
+	txn.attempts++
+	ctx, cancel := context.WithCancel(r.Context())
+	r = r.WithContext(context.WithValue(ctx, txnKey, atxn))
+	go func() {
+		resp, err := t.base.RoundTrip(r)
+		results <- hedgeResult{resp: resp, err: err, txn: atxn, cancel: cancel}
+	}()
+	return atxn, cancel
+}
+
+//the request of res answered first, or is the last to fail. The transaction is given its node.
+func (t *hedgingTransport) finish(r *http.Request, txn *transaction, res hedgeResult, hedge *transaction) (*http.Response, error) {
+	txn.timeout = res.txn.timeout
+	if hedge != nil {
+		won := res.txn == hedge && res.err == nil
+		if won {
+			atomic.AddInt64(&txn.hedge.wins, 1)
+		}
+		hedge.node.UpdateHedge(won)
+		txn.sched.UpdateHedge(won)
+		if res.txn == hedge {
+			// the primary node slot is released by lose, the hedge node slot with the transaction
+			txn.node, txn.sent = hedge.node, hedge.sent
+			txn.log = txn.log.WithField("hedge", hedge.node.ID)
+		}
+	}
+	if res.err != nil {
+		res.cancel()
+		return nil, res.err
+	}
+	// the response is handled as the response to the request the reverse proxy sent
+	res.resp.Request = r
+	res.resp.Body = &hedgeBody{ReadCloser: res.resp.Body, cancel: res.cancel}
+	return res.resp, nil
+}
+
+//cancels the request of res and makes its node available again. A request that failed is counted as
+//an error of its node, the transaction only counts the error of the request it returns.
+func (t *hedgingTransport) lose(txn *transaction, res hedgeResult, failed bool) {
+	res.cancel()
+	if res.resp != nil {
+		res.resp.Body.Close()
+	}
+	if failed && res.err != nil {
+		res.txn.node.UpdateError()
+		if res.txn.timeout != "" {
+			res.txn.node.UpdateTimeout()
+		}
+	}
+	txn.sched.SchedReScheduleNode(res.txn.node)
+}
+
+//the body of the response that answered first, its request is cancelled when the body is closed
+type hedgeBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *hedgeBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
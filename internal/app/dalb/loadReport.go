@@ -0,0 +1,187 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package dalb
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"dalb/internal/node"
+)
+
+// LOAD REPORTS
+// Worker nodes can report their own load with their responses, as a header or a trailer, in the
+// ORCA (Open Request Cost Aggregation) format used by gRPC and Envoy:
+//	endpoint-load-metrics-bin: <base64 xds.data.orca.v3.OrcaLoadReport>
+//	endpoint-load-metrics: TEXT cpu_utilization=0.3, mem_utilization=0.5, utilization.queue=0.2
+//	endpoint-load-metrics: JSON {"cpu_utilization": 0.3, "utilization": {"queue": 0.2}}
+//	endpoint-load-metrics: BIN <base64 xds.data.orca.v3.OrcaLoadReport>
+// The queue utilization is the named utilization "queue". Worker nodes can also send the
+// shorter dalb load header (DataPathProxy.LoadHeader) with comma separated name=value pairs:
+//	X-Dalb-Load: cpu=0.73,mem=0.5,queue=12
+// where cpu and mem are utilizations and queue is the number of requests waiting on the node.
+// The reports are meant for dalb, they are not passed on to the client.
+
+const (
+	loadReportHeader    = "Endpoint-Load-Metrics"
+	loadReportBinHeader = "Endpoint-Load-Metrics-Bin"
+	// the default DataPathProxy.LoadHeader
+	DefaultLoadHeader = "X-Dalb-Load"
+)
+
+//returns the load report in h and deletes it, ok is false when there is none, it is not valid or it has no known field
+func takeLoadReport(h http.Header) (l node.Load, ok bool) {
+	if v := h.Get(loadReportBinHeader); v != "" {
+		l, ok = orcaBinary(v)
+	} else if v := h.Get(loadReportHeader); v != "" {
+		switch format := strings.SplitN(strings.TrimSpace(v), " ", 2); {
+		case len(format) < 2:
+		case format[0] == "TEXT":
+			l, ok = orcaText(format[1])
+		case format[0] == "JSON":
+			l, ok = orcaJSON(format[1])
+		case format[0] == "BIN":
+			l, ok = orcaBinary(format[1])
+		}
+	}
+	h.Del(loadReportBinHeader)
+	h.Del(loadReportHeader)
+	return l, ok
+}
+
+//parses a dalb load header value, ok is false when there is none, it is not valid or it has no known field
+func parseLoadHeader(v string) (l node.Load, ok bool) {
+	if v == "" {
+		return l, false
+	}
+	for _, pair := range strings.Split(v, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 {
+			return node.Load{}, false
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+		if err != nil || value < 0 {
+			return node.Load{}, false
+		}
+		switch strings.ToLower(strings.TrimSpace(kv[0])) {
+		case "cpu":
+			l.CPU, l.Fields = value, l.Fields|node.LoadCPU
+		case "mem":
+			l.Memory, l.Fields = value, l.Fields|node.LoadMemory
+		case "queue":
+			l.QueueDepth, l.Fields = value, l.Fields|node.LoadQueueDepth
+		}
+	}
+	return l, l.Fields != 0
+}
+
+//decodes a base64 OrcaLoadReport, gRPC binary metadata may be sent without padding. The encoding leaves
+//out the fields that are 0, a utilization of exactly 0 is taken as not reported.
+func orcaBinary(v string) (node.Load, bool) {
+	v = strings.TrimSpace(v)
+	b, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(v, "="))
+	if err != nil {
+		return node.Load{}, false
+	}
+	var l node.Load
+	err = protoFields(b, func(num, typ int, v uint64, data []byte) {
+		switch {
+		case num == 1 && typ == protoFixed64: // cpu_utilization
+			l.CPU, l.Fields = math.Float64frombits(v), l.Fields|node.LoadCPU
+		case num == 2 && typ == protoFixed64: // mem_utilization
+			l.Memory, l.Fields = math.Float64frombits(v), l.Fields|node.LoadMemory
+		case num == 5 && typ == protoBytes: // utilization map entry
+			var name string
+			var value float64
+			protoFields(data, func(num, typ int, v uint64, data []byte) {
+				if num == 1 && typ == protoBytes {
+					name = string(data)
+				} else if num == 2 && typ == protoFixed64 {
+					value = math.Float64frombits(v)
+				}
+			})
+			if name == "queue" {
+				l.Queue, l.Fields = value, l.Fields|node.LoadQueue
+			}
+		}
+	})
+	return l, err == nil && l.Fields != 0
+}
+
+//parses comma separated name=value pairs
+func orcaText(v string) (node.Load, bool) {
+	var l node.Load
+	for _, pair := range strings.Split(v, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 {
+			return node.Load{}, false
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+		if err != nil {
+			return node.Load{}, false
+		}
+		switch strings.TrimSpace(kv[0]) {
+		case "cpu_utilization":
+			l.CPU, l.Fields = value, l.Fields|node.LoadCPU
+		case "mem_utilization":
+			l.Memory, l.Fields = value, l.Fields|node.LoadMemory
+		case "utilization.queue":
+			l.Queue, l.Fields = value, l.Fields|node.LoadQueue
+		}
+	}
+	return l, l.Fields != 0
+}
+
+//parses an OrcaLoadReport in the protobuf JSON mapping, with either field name style
+func orcaJSON(v string) (node.Load, bool) {
+	var report struct {
+		CPU         *float64           `json:"cpu_utilization"`
+		CPUCamel    *float64           `json:"cpuUtilization"`
+		Memory      *float64           `json:"mem_utilization"`
+		MemoryCamel *float64           `json:"memUtilization"`
+		Utilization map[string]float64 `json:"utilization"`
+	}
+	if err := json.Unmarshal([]byte(v), &report); err != nil {
+		return node.Load{}, false
+	}
+	if report.CPU == nil {
+		report.CPU = report.CPUCamel
+	}
+	if report.Memory == nil {
+		report.Memory = report.MemoryCamel
+	}
+	var l node.Load
+	if report.CPU != nil {
+		l.CPU, l.Fields = *report.CPU, node.LoadCPU
+	}
+	if report.Memory != nil {
+		l.Memory, l.Fields = *report.Memory, l.Fields|node.LoadMemory
+	}
+	if queue, ok := report.Utilization["queue"]; ok {
+		l.Queue, l.Fields = queue, l.Fields|node.LoadQueue
+	}
+	return l, l.Fields != 0
+}
+
+//a worker node response body, the load report trailers are recorded and removed at the end of the body
+type loadReportBody struct {
+	io.ReadCloser
+	resp *http.Response
+	node *node.Node
+}
+
+func (b *loadReportBody) Read(p []byte) (int, error) {
+	cnt, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		if l, ok := takeLoadReport(b.resp.Trailer); ok {
+			b.node.UpdateLoad(l)
+		}
+	}
+	return cnt, err
+}
@@ -0,0 +1,342 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package dalb
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"dalb/internal/node"
+)
+
+// PROMETHEUS METRICS
+// GET /metrics returns the scheduler and worker node statistics in the Prometheus text exposition format.
+// Labels are limited to the route, the worker node and the HTTP status class so the number of series
+// only grows with the number of configured worker nodes.
+
+//the latency histogram buckets exported to Prometheus, in seconds
+var metricsLatencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type metricsWriter struct {
+	*bufio.Writer
+}
+
+//write the HELP and TYPE lines of a metric family
+func (mw metricsWriter) family(name, typ, help string) {
+	fmt.Fprintf(mw, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+//write one sample. labels are name, value pairs.
+func (mw metricsWriter) sample(name string, value float64, labels ...string) {
+	mw.WriteString(name)
+	if len(labels) > 0 {
+		mw.WriteByte('{')
+		for idx := 0; idx+1 < len(labels); idx += 2 {
+			if idx > 0 {
+				mw.WriteByte(',')
+			}
+			fmt.Fprintf(mw, `%s="%s"`, labels[idx], labelEscaper.Replace(labels[idx+1]))
+		}
+		mw.WriteByte('}')
+	}
+	fmt.Fprintf(mw, " %g\n", value)
+}
+
+//write a latency histogram as cumulative Prometheus buckets
+func (mw metricsWriter) histogram(name string, st *node.Stats, labels ...string) {
+	buckets := st.Latency.Buckets()
+	idx := 0
+	cnt := int64(0)
+	for _, le := range metricsLatencyBuckets {
+		for idx < len(buckets) && buckets[idx].UpperBound.Seconds() <= le {
+			cnt += buckets[idx].Count
+			idx++
+		}
+		mw.sample(name+"_bucket", float64(cnt), append(labels, "le", fmt.Sprint(le))...)
+	}
+	mw.sample(name+"_bucket", float64(st.Latency.Count()), append(labels, "le", "+Inf")...)
+	mw.sample(name+"_sum", st.TransactionTime.Seconds(), labels...)
+	mw.sample(name+"_count", float64(st.TransactionCount), labels...)
+}
+
+//the statistics of one worker node, read once so every metric of the node is from the same instant
+type nodeMetrics struct {
+	n      *node.Node
+	labels []string
+	st     node.Stats
+}
+
+//a scheduler and the labels identifying it
+type schedMetrics struct {
+	s      *node.Scheduler
+	labels []string
+	st     node.Stats
+	nodes  []nodeMetrics
+}
+
+//returns the schedulers exported by /metrics
+func metricsSchedulers() []schedMetrics {
+	scheds := make([]schedMetrics, 0)
+	for _, s := range routeSchedulers() {
+		scheds = append(scheds, newSchedMetrics(s))
+	}
+	return scheds
+}
+
+func newSchedMetrics(s *node.Scheduler) schedMetrics {
+	sm := schedMetrics{
+		s:      s,
+		labels: []string{"route", s.Name},
+		st:     s.Stats(),
+	}
+	for _, n := range s.SchedNodes() {
+		sm.nodes = append(sm.nodes, nodeMetrics{
+			n:      n,
+			labels: []string{"route", s.Name, "node", fmt.Sprintf("%s:%d", n.IP.String(), n.Port), "id", n.ID},
+			st:     n.Stats(),
+		})
+	}
+	return sm
+}
+
+func metricsGet(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	mw := metricsWriter{bufio.NewWriter(w)}
+	defer mw.Flush()
+	scheds := metricsSchedulers()
+
+	mw.family("dalb_requests_total", "counter", "Requests forwarded to a worker node by HTTP status class.")
+	for _, sm := range scheds {
+		for _, nm := range sm.nodes {
+			for class := 1; class < len(nm.st.StatusClassCount); class++ {
+				mw.sample("dalb_requests_total", float64(nm.st.StatusClassCount[class]), append(nm.labels, "code", fmt.Sprintf("%dxx", class))...)
+			}
+		}
+	}
+	mw.family("dalb_errors_total", "counter", "Requests that failed or returned a 5xx status.")
+	for _, sm := range scheds {
+		for _, nm := range sm.nodes {
+			mw.sample("dalb_errors_total", float64(nm.st.ErrorCount), nm.labels...)
+		}
+	}
+	mw.family("dalb_received_bytes_total", "counter", "Bytes received from the clients of TCP connections and UDP flows.")
+	for _, sm := range scheds {
+		for _, nm := range sm.nodes {
+			mw.sample("dalb_received_bytes_total", float64(nm.st.BytesIn), nm.labels...)
+		}
+	}
+	mw.family("dalb_sent_bytes_total", "counter", "Bytes sent to the clients of TCP connections and UDP flows.")
+	for _, sm := range scheds {
+		for _, nm := range sm.nodes {
+			mw.sample("dalb_sent_bytes_total", float64(nm.st.BytesOut), nm.labels...)
+		}
+	}
+	mw.family("dalb_received_packets_total", "counter", "Datagrams received from the clients of UDP flows.")
+	for _, sm := range scheds {
+		for _, nm := range sm.nodes {
+			mw.sample("dalb_received_packets_total", float64(nm.st.PacketsIn), nm.labels...)
+		}
+	}
+	mw.family("dalb_sent_packets_total", "counter", "Datagrams sent to the clients of UDP flows.")
+	for _, sm := range scheds {
+		for _, nm := range sm.nodes {
+			mw.sample("dalb_sent_packets_total", float64(nm.st.PacketsOut), nm.labels...)
+		}
+	}
+	mw.family("dalb_dropped_packets_total", "counter", "Datagrams of UDP flows that could not be delivered.")
+	for _, sm := range scheds {
+		for _, nm := range sm.nodes {
+			mw.sample("dalb_dropped_packets_total", float64(nm.st.Drops), nm.labels...)
+		}
+		mw.sample("dalb_dropped_packets_total", float64(sm.st.Drops), sm.labels...)
+	}
+	mw.family("dalb_request_duration_seconds", "histogram", "Time taken by the worker nodes to complete requests.")
+	for _, sm := range scheds {
+		for _, nm := range sm.nodes {
+			mw.histogram("dalb_request_duration_seconds", &nm.st, nm.labels...)
+		}
+	}
+	mw.family("dalb_route_request_duration_seconds", "histogram", "Time taken to complete requests on a route.")
+	for _, sm := range scheds {
+		mw.histogram("dalb_route_request_duration_seconds", &sm.st, sm.labels...)
+	}
+	mw.family("dalb_in_flight_requests", "gauge", "Requests currently being processed by a worker node.")
+	for _, sm := range scheds {
+		for _, nm := range sm.nodes {
+			mw.sample("dalb_in_flight_requests", float64(nm.n.InFlight()), nm.labels...)
+		}
+	}
+	mw.family("dalb_open_connections", "gauge", "Upgraded (e.g. WebSocket) connections currently open to a worker node.")
+	for _, sm := range scheds {
+		for _, nm := range sm.nodes {
+			mw.sample("dalb_open_connections", float64(nm.n.Connections()), nm.labels...)
+		}
+	}
+	mw.family("dalb_connections_total", "counter", "Upgraded connections to a worker node that have closed.")
+	for _, sm := range scheds {
+		for _, nm := range sm.nodes {
+			mw.sample("dalb_connections_total", float64(nm.st.ConnectionCount), nm.labels...)
+		}
+	}
+	mw.family("dalb_connection_duration_seconds_total", "counter", "Total time the closed upgraded connections to a worker node were open.")
+	for _, sm := range scheds {
+		for _, nm := range sm.nodes {
+			mw.sample("dalb_connection_duration_seconds_total", nm.st.ConnectionTime.Seconds(), nm.labels...)
+		}
+	}
+	mw.family("dalb_node_slots", "gauge", "Calendar slots (maximum concurrent requests) given to a worker node.")
+	for _, sm := range scheds {
+		for _, nm := range sm.nodes {
+			mw.sample("dalb_node_slots", float64(nm.n.Slots()), nm.labels...)
+		}
+	}
+	mw.family("dalb_ewma_request_duration_seconds", "gauge", "Moving average of the recent request durations of a worker node.")
+	for _, sm := range scheds {
+		for _, nm := range sm.nodes {
+			mw.sample("dalb_ewma_request_duration_seconds", nm.st.EWMATransactionTime.Seconds(), nm.labels...)
+		}
+	}
+	mw.family("dalb_node_healthy", "gauge", "1 when a worker node passed its last health check, or has none.")
+	for _, sm := range scheds {
+		for _, nm := range sm.nodes {
+			healthy := 0.0
+			if nm.n.Healthy() {
+				healthy = 1
+			}
+			mw.sample("dalb_node_healthy", healthy, nm.labels...)
+		}
+	}
+	mw.family("dalb_node_cpu_utilization", "gauge", "CPU utilization last reported by a worker node.")
+	for _, sm := range scheds {
+		for _, nm := range sm.nodes {
+			if l := nm.n.Load(); !l.Time.IsZero() && l.Has(node.LoadCPU) {
+				mw.sample("dalb_node_cpu_utilization", l.CPU, nm.labels...)
+			}
+		}
+	}
+	mw.family("dalb_node_memory_utilization", "gauge", "Memory utilization last reported by a worker node.")
+	for _, sm := range scheds {
+		for _, nm := range sm.nodes {
+			if l := nm.n.Load(); !l.Time.IsZero() && l.Has(node.LoadMemory) {
+				mw.sample("dalb_node_memory_utilization", l.Memory, nm.labels...)
+			}
+		}
+	}
+	mw.family("dalb_node_queue_utilization", "gauge", "Queue utilization last reported by a worker node.")
+	for _, sm := range scheds {
+		for _, nm := range sm.nodes {
+			if l := nm.n.Load(); !l.Time.IsZero() && l.Has(node.LoadQueue) {
+				mw.sample("dalb_node_queue_utilization", l.Queue, nm.labels...)
+			}
+		}
+	}
+	mw.family("dalb_node_queue_depth", "gauge", "Smoothed queue depth reported by a worker node.")
+	for _, sm := range scheds {
+		for _, nm := range sm.nodes {
+			if l := nm.n.Load(); !l.Time.IsZero() && l.Has(node.LoadQueueDepth) {
+				mw.sample("dalb_node_queue_depth", l.QueueDepth, nm.labels...)
+			}
+		}
+	}
+	mw.family("dalb_node_backed_off", "gauge", "1 when a worker node gets no new requests because it answered 503 or Retry-After.")
+	for _, sm := range scheds {
+		for _, nm := range sm.nodes {
+			backedOff := 0.0
+			if !nm.n.Backoff().IsZero() {
+				backedOff = 1
+			}
+			mw.sample("dalb_node_backed_off", backedOff, nm.labels...)
+		}
+	}
+	mw.family("dalb_scheduler_nodes", "gauge", "Worker nodes in the schedule of a route.")
+	for _, sm := range scheds {
+		mw.sample("dalb_scheduler_nodes", float64(len(sm.nodes)), sm.labels...)
+	}
+	mw.family("dalb_scheduler_queue_depth", "gauge", "Requests waiting for a free worker node slot.")
+	for _, sm := range scheds {
+		mw.sample("dalb_scheduler_queue_depth", float64(sm.s.SchedWaiting()), sm.labels...)
+	}
+	mw.family("dalb_affinity_requests_total", "counter", "Requests with session affinity by result: hit (the node of the session), miss (failed over to another node) or new (no session yet).")
+	for _, sm := range scheds {
+		hits, misses, sessions := sm.s.AffinityCounts()
+		if hits+misses+sessions == 0 {
+			continue
+		}
+		mw.sample("dalb_affinity_requests_total", float64(hits), append(sm.labels, "result", "hit")...)
+		mw.sample("dalb_affinity_requests_total", float64(misses), append(sm.labels, "result", "miss")...)
+		mw.sample("dalb_affinity_requests_total", float64(sessions), append(sm.labels, "result", "new")...)
+	}
+	mw.family("dalb_mirror_requests_total", "counter", "Requests copied to a shadow group by result: mirrored, dropped (no free shadow node slot) or skipped (the body was too large or not read).")
+	for _, p := range routeDataPaths() {
+		m := p.Mirroring()
+		if m == nil {
+			continue
+		}
+		labels := []string{"route", p.path, "group", m.Group}
+		mirrored, dropped, skipped := m.Counts()
+		mw.sample("dalb_mirror_requests_total", float64(mirrored), append(labels, "result", "mirrored")...)
+		mw.sample("dalb_mirror_requests_total", float64(dropped), append(labels, "result", "dropped")...)
+		mw.sample("dalb_mirror_requests_total", float64(skipped), append(labels, "result", "skipped")...)
+	}
+	mw.family("dalb_mirror_responses_compared_total", "counter", "Shadow responses compared with the primary response by result: match, or the status, header or body did not match.")
+	for _, p := range routeDataPaths() {
+		m := p.Mirroring()
+		if m == nil || m.Diff == nil {
+			continue
+		}
+		labels := []string{"route", p.path, "group", m.Group}
+		_, matched, status, header, body := m.Diff.Counts()
+		mw.sample("dalb_mirror_responses_compared_total", float64(matched), append(labels, "result", "match")...)
+		mw.sample("dalb_mirror_responses_compared_total", float64(status), append(labels, "result", "status")...)
+		mw.sample("dalb_mirror_responses_compared_total", float64(header), append(labels, "result", "header")...)
+		mw.sample("dalb_mirror_responses_compared_total", float64(body), append(labels, "result", "body")...)
+	}
+	mw.family("dalb_timeouts_total", "counter", "Requests to a worker node that timed out, they are also counted as errors.")
+	for _, sm := range scheds {
+		for _, nm := range sm.nodes {
+			mw.sample("dalb_timeouts_total", float64(nm.st.TimeoutCount), nm.labels...)
+		}
+	}
+	mw.family("dalb_route_timeouts_total", "counter", "Requests of a route that timed out by kind: connect, firstByte, idle, total or deadline (sent by the client).")
+	for _, p := range routeDataPaths() {
+		counts := p.TimeoutCounts()
+		for _, kind := range timeoutKinds {
+			mw.sample("dalb_route_timeouts_total", float64(counts[kind]), "route", p.path, "kind", kind)
+		}
+	}
+	mw.family("dalb_hedge_requests_total", "counter", "Hedged copies of slow requests sent to a worker node.")
+	for _, sm := range scheds {
+		for _, nm := range sm.nodes {
+			if nm.st.HedgeCount != 0 {
+				mw.sample("dalb_hedge_requests_total", float64(nm.st.HedgeCount), nm.labels...)
+			}
+		}
+	}
+	mw.family("dalb_hedge_wins_total", "counter", "Hedged copies of slow requests that a worker node answered first.")
+	for _, sm := range scheds {
+		for _, nm := range sm.nodes {
+			if nm.st.HedgeCount != 0 {
+				mw.sample("dalb_hedge_wins_total", float64(nm.st.HedgeWins), nm.labels...)
+			}
+		}
+	}
+	mw.family("dalb_hedge_skipped_total", "counter", "Slow requests that were not hedged by reason: budget (the hedge budget was spent) or node (no other node had a free slot).")
+	for _, p := range routeDataPaths() {
+		h := p.Hedging()
+		if h == nil {
+			continue
+		}
+		_, _, _, budget, noNode := h.Counts()
+		mw.sample("dalb_hedge_skipped_total", float64(budget), "route", p.path, "reason", "budget")
+		mw.sample("dalb_hedge_skipped_total", float64(noNode), "route", p.path, "reason", "node")
+	}
+	mw.family("dalb_scheduler_rebalances_total", "counter", "Scheduler rebalance passes.")
+	for _, sm := range scheds {
+		mw.sample("dalb_scheduler_rebalances_total", float64(sm.s.RebalanceCount()), sm.labels...)
+	}
+}
@@ -0,0 +1,272 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package dalb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"dalb/internal/trace"
+)
+
+//mirroring defaults
+const (
+	DefaultMirrorGroup   = "shadow"
+	DefaultMirrorMaxBody = 1 << 20 // bytes of request body copied to the shadow pool
+	DefaultMirrorTimeout = 30 * time.Second
+	// request header that tells a shadow worker node the request is a copy
+	MirrorHeader = "X-Dalb-Mirror"
+)
+
+//Mirroring of a share of the requests of a route to a shadow node group, e.g. to test a new worker
+//build with production traffic. The copies are sent after the client has its response and the shadow
+//responses are discarded. A copy is dropped when the shadow nodes have no free slot, so the shadow
+//group never slows the route down; its statistics are those of the group scheduler.
+type Mirror struct {
+	Group string
+	// percent of the requests that are copied
+	Percent float64
+	// requests with a larger body are not copied
+	MaxBodySize int64
+	// how long a shadow node has to answer
+	Timeout time.Duration
+	// comparison of the primary and shadow responses, nil to discard the shadow responses unread
+	Diff *ResponseDiff
+
+	seq      uint64 // requests seen
+	mirrored int64  // copies sent
+	dropped  int64  // copies dropped because the shadow nodes had no free slot
+	skipped  int64  // copies skipped because the body was too large or not read to the end
+}
+
+//returns the Mirror for "GROUP:PERCENT" or "PERCENT" (to the shadow group), nil for ""
+func ParseMirror(spec string) (*Mirror, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	m := &Mirror{Group: DefaultMirrorGroup, MaxBodySize: DefaultMirrorMaxBody, Timeout: DefaultMirrorTimeout}
+	pct := spec
+	if idx := strings.LastIndexByte(spec, ':'); idx >= 0 {
+		m.Group, pct = spec[:idx], spec[idx+1:]
+	}
+	var err error
+	if m.Percent, err = strconv.ParseFloat(strings.TrimSuffix(pct, "%"), 64); err != nil {
+		return nil, errors.New("invalid mirror percentage " + pct)
+	}
+	if err := m.valid(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+//returns an error when the mirror settings cannot be used
+func (m *Mirror) valid() error {
+	if m.Group == "" || m.Group == DefaultGroup {
+		return errors.New("requests must be mirrored to a node group other than the default group")
+	}
+	if m.Percent < 0 || m.Percent > 100 || math.IsNaN(m.Percent) {
+		return errors.New("the mirror percentage must be between 0 and 100")
+	}
+	if m.MaxBodySize < 0 || m.Timeout <= 0 {
+		return errors.New("invalid mirror body size or timeout")
+	}
+	return nil
+}
+
+//returns true when the next request is to be copied. The copies are spread evenly over the requests.
+func (m *Mirror) sampled() bool {
+	seq := atomic.AddUint64(&m.seq, 1)
+	return math.Floor(float64(seq)*m.Percent/100) > math.Floor(float64(seq-1)*m.Percent/100)
+}
+
+// Returns the number of requests copied to the shadow group, dropped because the shadow nodes had
+// no free slot and skipped because the request body could not be copied
+func (m *Mirror) Counts() (mirrored, dropped, skipped int64) {
+	return atomic.LoadInt64(&m.mirrored), atomic.LoadInt64(&m.dropped), atomic.LoadInt64(&m.skipped)
+}
+
+// Returns the mirroring of the route, nil when it is off
+func (p *DataPathProxy) Mirroring() *Mirror {
+	m, _ := p.mirror.Load().(*Mirror)
+	return m
+}
+
+// Mirror requests of the route to a shadow group, nil turns mirroring off. The group is created with
+// weight 0 when it does not exist, so it only gets the copies.
+func (p *DataPathProxy) SetMirror(m *Mirror) error {
+	if m != nil {
+		if err := m.valid(); err != nil {
+			return err
+		}
+		if p.Group(m.Group) == nil {
+			if _, err := p.SetGroup(m.Group, 0); err != nil {
+				return err
+			}
+		}
+	}
+	p.mirror.Store(m)
+	return nil
+}
+
+//keeps a copy of a request or response body, up to max bytes, as it is read
+type mirrorBody struct {
+	io.ReadCloser
+	buf      bytes.Buffer
+	max      int64
+	eof      bool
+	tooLarge bool
+}
+
+func (b *mirrorBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.tooLarge {
+		if int64(b.buf.Len()+n) > b.max {
+			b.tooLarge = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+//a request to be copied to the shadow group once the client has its response
+type mirrorRequest struct {
+	m       *Mirror
+	g       *Group
+	body    *mirrorBody
+	reqBody []byte
+	primary *responseCapture // the primary response, when the responses are compared
+}
+
+//returns the mirror request for a request picked for mirroring, nil when it is not.
+//The request body is replaced with a mirrorBody.
+func (p *DataPathProxy) mirrorRequest(r *http.Request, txn *transaction) *mirrorRequest {
+	m := p.Mirroring()
+	if m == nil || txn.upgrade != "" || !m.sampled() {
+		return nil
+	}
+	g := p.Group(m.Group)
+	if g == nil || g.Sched == txn.sched {
+		return nil
+	}
+	mr := &mirrorRequest{m: m, g: g}
+	if r.Body != nil && r.Body != http.NoBody {
+		mr.body = &mirrorBody{ReadCloser: r.Body, max: m.MaxBodySize}
+		r.Body = mr.body
+	}
+	return mr
+}
+
+//send the copy of a request to a shadow worker node. The node slot is claimed without waiting
+//and the copy is sent by another goroutine.
+func (p *DataPathProxy) sendMirror(mr *mirrorRequest, r *http.Request, txn *transaction, span *trace.Span) {
+	var body []byte
+	if mr.body != nil {
+		if !mr.body.eof || mr.body.tooLarge {
+			atomic.AddInt64(&mr.m.skipped, 1)
+			return
+		}
+		body = mr.body.buf.Bytes()
+	}
+	mr.reqBody = body
+	n := mr.g.Sched.SchedTryGetNode()
+	if n == nil {
+		atomic.AddInt64(&mr.m.dropped, 1)
+		return
+	}
+	atomic.AddInt64(&mr.m.mirrored, 1)
+	req, _ := http.NewRequest(r.Method, nodeScheme(n)+"://"+net.JoinHostPort(n.IP.String(), strconv.Itoa(n.Port))+r.URL.RequestURI(), bytes.NewReader(body))
+	req.Header = mirrorHeaders(r.Header)
+	req.Header.Set(MirrorHeader, "1")
+	req.Host, req.RemoteAddr, req.TLS = r.Host, r.RemoteAddr, r.TLS
+	if p.RewriteHost {
+		req.Host = req.URL.Host
+	}
+	p.setForwardedHeaders(req)
+	if prior := req.Header.Get("X-Forwarded-For"); prior != "" {
+		req.Header.Set("X-Forwarded-For", prior+", "+remoteIP(r))
+	} else {
+		req.Header.Set("X-Forwarded-For", remoteIP(r))
+	}
+	mtxn := &transaction{
+		start:    time.Now(),
+		id:       txn.id,
+		idHeader: txn.idHeader,
+		log:      txn.log.WithField("mirror", mr.g.Name),
+		sched:    mr.g.Sched,
+		node:     n,
+	}
+	go p.mirrorForward(mr, req, mtxn, span)
+}
+
+//returns the headers of a copied request without the hop-by-hop headers
+func mirrorHeaders(h http.Header) http.Header {
+	h = h.Clone()
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			h.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range []string{"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Transfer-Encoding", "Upgrade"} {
+		h.Del(name)
+	}
+	if te := h.Get("Te"); te != "" && te != "trailers" {
+		h.Del("Te")
+	}
+	return h
+}
+
+//send a copied request and record the shadow node statistics, the response is discarded
+func (p *DataPathProxy) mirrorForward(mr *mirrorRequest, req *http.Request, txn *transaction, parent *trace.Span) {
+	ctx, cancel := context.WithTimeout(trace.ContextWithSpan(context.Background(), parent), mr.m.Timeout)
+	defer cancel()
+	ctx, span := trace.StartSpan(ctx, "mirror", trace.KindInternal)
+	defer span.Finish()
+	span.SetAttribute("dalb.request_id", txn.id)
+	span.SetAttribute("dalb.group", mr.g.Name)
+	span.SetAttribute("dalb.node.id", txn.node.ID)
+	txn.sent = time.Now()
+	txn.status = http.StatusBadGateway
+	if isGRPC(req) {
+		txn.grpc, txn.grpcStatus = true, -1
+	}
+	resp, err := p.Proxy.Transport.RoundTrip(req.WithContext(context.WithValue(ctx, txnKey, txn)))
+	if err != nil {
+		span.SetError(err)
+		txn.log.WithError(err).Debug("Shadow worker node request failed")
+	} else {
+		txn.status = resp.StatusCode
+		txn.resp = resp
+		txn.headers = time.Since(txn.sent)
+		var shadow DiffResponse
+		if mr.m.Diff != nil && mr.primary != nil {
+			shadow = readResponse(resp, mr.m.MaxBodySize)
+		} else {
+			io.Copy(ioutil.Discard, resp.Body)
+		}
+		resp.Body.Close()
+		if code, ok := grpcStatus(resp); ok && txn.grpc {
+			txn.grpcStatus = code
+		}
+		if mr.m.Diff != nil && mr.primary != nil {
+			mr.m.Diff.compare(req, mr.reqBody, txn.id, mr.primary.response(), shadow)
+		}
+	}
+	span.SetAttribute("http.status_code", txn.status)
+	p.endTransaction(txn)
+}
@@ -0,0 +1,364 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package dalb
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"dalb/internal/node"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//rollout defaults
+const (
+	DefaultRolloutStepInterval  = 5 * time.Minute
+	DefaultMaxErrorRateIncrease = 0.01 // 1 percentage point over the stable error rate
+	DefaultMaxP99Ratio          = 1.5
+	DefaultRolloutMinRequests   = 100
+	DefaultRolloutMaxHolds      = 12 // an hour with the default step interval
+	DefaultCanaryGroup          = "canary"
+	//the decision log keeps the first decision and the last MaxRolloutDecisions-1
+	MaxRolloutDecisions = 100
+)
+
+//the canary weights (percent of the requests) of a rollout
+var DefaultRolloutSteps = []int{1, 5, 25, 50, 100}
+
+//rollout states
+const (
+	RolloutProgressing = "progressing" // the canary weight is being stepped up
+	RolloutPromoted    = "promoted"    // the canary gets all of the requests
+	RolloutRolledBack  = "rolledBack"  // the canary was worse than stable and gets no requests
+	RolloutAborted     = "aborted"     // stopped from the control path, the canary gets no requests
+)
+
+//rollout decisions
+const (
+	RolloutStart    = "start"
+	RolloutStep     = "step"
+	RolloutHold     = "hold"
+	RolloutPromote  = "promote"
+	RolloutRollback = "rollback"
+	RolloutAbort    = "abort"
+)
+
+//A progressive rollout of the canary node group of a route. The canary weight is stepped up every
+//StepInterval while the canary error rate and p99 transaction time measured during the step are
+//not worse than the stable ones by more than the thresholds. The canary is promoted after the last
+//step and rolled back as soon as a step fails.
+type Rollout struct {
+	Canary string
+	Stable string
+	// canary weights in percent, increasing; the stable group gets the rest
+	Steps        []int
+	StepInterval time.Duration
+	// how much higher than the stable error rate the canary error rate may be, e.g. 0.01
+	MaxErrorRateIncrease float64
+	// how many times the stable p99 the canary p99 may be, 0 to not compare them
+	MaxP99Ratio float64
+	// canary requests needed to judge a step, the step is extended until it has them
+	MinRequests int64
+	// times a step can be extended, the rollout is aborted after that. 0 extends it until it has MinRequests.
+	MaxHolds int
+
+	p           *DataPathProxy
+	lock        sync.Mutex
+	state       string
+	step        int
+	holds       int
+	started     time.Time
+	stepStarted time.Time
+	canaryBase  node.Stats
+	stableBase  node.Stats
+	decisions   []RolloutDecision
+	done        chan struct{}
+}
+
+//A rollout state change and the group statistics of the step it was made on
+type RolloutDecision struct {
+	Time         time.Time
+	Step         int
+	CanaryWeight int
+	Action       string
+	Reason       string
+	Canary       GroupSample
+	Stable       GroupSample
+}
+
+//the statistics of a node group during a rollout step
+type GroupSample struct {
+	Requests  int64
+	Errors    int64
+	ErrorRate float64
+	P99       time.Duration
+}
+
+//the progress of a rollout
+type RolloutStatus struct {
+	State        string
+	Step         int
+	CanaryWeight int
+	Started      time.Time
+	StepStarted  time.Time
+	Decisions    []RolloutDecision
+}
+
+//returns a rollout of group canary with the default steps and thresholds
+func NewRollout(canary string) *Rollout {
+	return &Rollout{
+		Canary:               canary,
+		Stable:               DefaultGroup,
+		Steps:                append([]int(nil), DefaultRolloutSteps...),
+		StepInterval:         DefaultRolloutStepInterval,
+		MaxErrorRateIncrease: DefaultMaxErrorRateIncrease,
+		MaxP99Ratio:          DefaultMaxP99Ratio,
+		MinRequests:          DefaultRolloutMinRequests,
+		MaxHolds:             DefaultRolloutMaxHolds,
+	}
+}
+
+// Returns the last rollout of the route, nil when there has not been one
+func (p *DataPathProxy) Rollout() *Rollout {
+	p.rolloutLock.Lock()
+	defer p.rolloutLock.Unlock()
+	return p.rollout
+}
+
+// Start a rollout on the route: the canary group gets the weight of the first step.
+// Only one rollout can be in progress on a route.
+func (p *DataPathProxy) StartRollout(ro *Rollout) error {
+	if err := p.validRollout(ro); err != nil {
+		return err
+	}
+	p.rolloutLock.Lock()
+	defer p.rolloutLock.Unlock()
+	if p.rollout != nil && p.rollout.Status().State == RolloutProgressing {
+		return errors.New("a rollout is already in progress")
+	}
+	ro.p = p
+	ro.done = make(chan struct{})
+	ro.state = RolloutProgressing
+	ro.started = time.Now()
+	ro.lock.Lock()
+	ro.setWeight(ro.Steps[0])
+	ro.startStep(0)
+	ro.decide(RolloutStart, fmt.Sprintf("%s gets %d%% of the requests", ro.Canary, ro.Steps[0]), GroupSample{}, GroupSample{})
+	ro.lock.Unlock()
+	p.rollout = ro
+	go ro.run()
+	return nil
+}
+
+//returns an error when a rollout cannot be started on the route
+func (p *DataPathProxy) validRollout(ro *Rollout) error {
+	if ro.Canary == "" || ro.Stable == "" || ro.Canary == ro.Stable {
+		return errors.New("the canary and stable groups must be different groups")
+	}
+	if p.Group(ro.Canary) == nil {
+		return errors.New("canary group not found")
+	}
+	if p.Group(ro.Stable) == nil {
+		return errors.New("stable group not found")
+	}
+	if len(ro.Steps) == 0 {
+		return errors.New("a rollout needs at least one step")
+	}
+	for idx, w := range ro.Steps {
+		if w <= 0 || w > 100 || (idx > 0 && w <= ro.Steps[idx-1]) {
+			return errors.New("the steps must be increasing weights between 1 and 100")
+		}
+	}
+	if ro.StepInterval <= 0 {
+		return errors.New("invalid step interval")
+	}
+	if ro.MaxErrorRateIncrease < 0 || ro.MaxP99Ratio < 0 || ro.MinRequests < 0 || ro.MaxHolds < 0 {
+		return errors.New("invalid rollout threshold")
+	}
+	return nil
+}
+
+// Stop the rollout in progress on the route, the canary gets no more requests
+func (p *DataPathProxy) AbortRollout() error {
+	ro := p.Rollout()
+	if ro == nil {
+		return errors.New("no rollout in progress")
+	}
+	ro.lock.Lock()
+	defer ro.lock.Unlock()
+	if ro.state != RolloutProgressing {
+		return errors.New("no rollout in progress")
+	}
+	canary, stable := ro.samples()
+	ro.finish(RolloutAborted, 0, RolloutAbort, "aborted from the control path", canary, stable)
+	return nil
+}
+
+// Returns the progress of the rollout
+func (ro *Rollout) Status() RolloutStatus {
+	ro.lock.Lock()
+	defer ro.lock.Unlock()
+	return RolloutStatus{
+		State:        ro.state,
+		Step:         ro.step,
+		CanaryWeight: ro.weight(),
+		Started:      ro.started,
+		StepStarted:  ro.stepStarted,
+		Decisions:    append([]RolloutDecision(nil), ro.decisions...),
+	}
+}
+
+//returns the canary weight of the rollout state
+func (ro *Rollout) weight() int {
+	switch ro.state {
+	case RolloutPromoted:
+		return 100
+	case RolloutRolledBack, RolloutAborted:
+		return 0
+	}
+	return ro.Steps[ro.step]
+}
+
+//judge the step every StepInterval until the rollout is over
+func (ro *Rollout) run() {
+	timer := time.NewTimer(ro.StepInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ro.done:
+			return
+		case <-timer.C:
+		}
+		if !ro.evaluate() {
+			return
+		}
+		timer.Reset(ro.StepInterval)
+	}
+}
+
+//compare the canary with stable for the current step and move to the next state, returns false
+//when the rollout is over
+func (ro *Rollout) evaluate() bool {
+	ro.lock.Lock()
+	defer ro.lock.Unlock()
+	if ro.state != RolloutProgressing {
+		return false
+	}
+	if ro.p.Group(ro.Canary) == nil || ro.p.Group(ro.Stable) == nil {
+		ro.finish(RolloutAborted, 0, RolloutAbort, "the canary or stable group was deleted", GroupSample{}, GroupSample{})
+		return false
+	}
+	canary, stable := ro.samples()
+	if canary.Requests < ro.MinRequests {
+		if ro.MaxHolds > 0 && ro.holds >= ro.MaxHolds {
+			ro.finish(RolloutAborted, 0, RolloutAbort, fmt.Sprintf("%d canary requests after %d step intervals, %d are needed",
+				canary.Requests, ro.holds+1, ro.MinRequests), canary, stable)
+			return false
+		}
+		ro.holds++
+		ro.decide(RolloutHold, fmt.Sprintf("%d canary requests, %d are needed", canary.Requests, ro.MinRequests), canary, stable)
+		return true
+	}
+	if canary.ErrorRate-stable.ErrorRate > ro.MaxErrorRateIncrease {
+		ro.finish(RolloutRolledBack, 0, RolloutRollback, fmt.Sprintf("canary error rate %.4f is over the stable error rate %.4f + %.4f",
+			canary.ErrorRate, stable.ErrorRate, ro.MaxErrorRateIncrease), canary, stable)
+		return false
+	}
+	if ro.MaxP99Ratio > 0 && stable.P99 > 0 && float64(canary.P99) > ro.MaxP99Ratio*float64(stable.P99) {
+		ro.finish(RolloutRolledBack, 0, RolloutRollback, fmt.Sprintf("canary p99 %v is over %.2f times the stable p99 %v",
+			canary.P99, ro.MaxP99Ratio, stable.P99), canary, stable)
+		return false
+	}
+	next := ro.step + 1
+	if next >= len(ro.Steps) || ro.Steps[next] == 100 {
+		ro.finish(RolloutPromoted, 100, RolloutPromote, ro.Canary+" gets all of the requests", canary, stable)
+		return false
+	}
+	ro.setWeight(ro.Steps[next])
+	ro.startStep(next)
+	ro.decide(RolloutStep, fmt.Sprintf("%s gets %d%% of the requests", ro.Canary, ro.Steps[next]), canary, stable)
+	return true
+}
+
+//returns the statistics of the canary and stable groups since the start of the step
+func (ro *Rollout) samples() (canary, stable GroupSample) {
+	if g := ro.p.Group(ro.Canary); g != nil {
+		canary = groupSample(g.Sched, &ro.canaryBase)
+	}
+	if g := ro.p.Group(ro.Stable); g != nil {
+		stable = groupSample(g.Sched, &ro.stableBase)
+	}
+	return
+}
+
+func groupSample(s *node.Scheduler, base *node.Stats) GroupSample {
+	st := s.Stats()
+	st.Latency.Sub(&base.Latency)
+	gs := GroupSample{
+		Requests: st.TransactionCount - base.TransactionCount,
+		Errors:   st.ErrorCount - base.ErrorCount,
+		P99:      st.Latency.Percentile(0.99),
+	}
+	if gs.Requests > 0 {
+		gs.ErrorRate = float64(gs.Errors) / float64(gs.Requests)
+	}
+	return gs
+}
+
+//start measuring a step. Must be called with ro.lock held.
+func (ro *Rollout) startStep(step int) {
+	ro.step = step
+	ro.holds = 0
+	ro.stepStarted = time.Now()
+	if g := ro.p.Group(ro.Canary); g != nil {
+		ro.canaryBase = g.Sched.Stats()
+	}
+	if g := ro.p.Group(ro.Stable); g != nil {
+		ro.stableBase = g.Sched.Stats()
+	}
+}
+
+//give the canary group weight percent of the requests and the stable group the rest
+func (ro *Rollout) setWeight(weight int) {
+	ro.p.SetGroup(ro.Canary, weight)
+	ro.p.SetGroup(ro.Stable, 100-weight)
+}
+
+//end the rollout. Must be called with ro.lock held.
+func (ro *Rollout) finish(state string, weight int, action, reason string, canary, stable GroupSample) {
+	if ro.p.Group(ro.Canary) != nil && ro.p.Group(ro.Stable) != nil {
+		ro.setWeight(weight)
+	}
+	ro.state = state
+	ro.decide(action, reason, canary, stable)
+	close(ro.done)
+}
+
+//add a decision to the log. Must be called with ro.lock held.
+func (ro *Rollout) decide(action, reason string, canary, stable GroupSample) {
+	d := RolloutDecision{
+		Time:         time.Now(),
+		Step:         ro.step,
+		CanaryWeight: ro.weight(),
+		Action:       action,
+		Reason:       reason,
+		Canary:       canary,
+		Stable:       stable,
+	}
+	if len(ro.decisions) >= MaxRolloutDecisions {
+		// keep the start of the rollout
+		copy(ro.decisions[1:], ro.decisions[2:])
+		ro.decisions = ro.decisions[:len(ro.decisions)-1]
+	}
+	ro.decisions = append(ro.decisions, d)
+	entry := log.WithField("route", ro.p.path).WithField("canary", ro.Canary).WithField("rollout", action)
+	if action == RolloutRollback || action == RolloutAbort {
+		entry.Warn(reason)
+	} else {
+		entry.Info(reason)
+	}
+}
@@ -0,0 +1,114 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package dalb
+
+import (
+	"sync"
+
+	"dalb/internal/node"
+)
+
+//the schedulers of the data path routes (HTTP, TCP, UDP and the node groups of HTTP routes)
+//by route name, used by the control path
+var (
+	routeLock   sync.RWMutex
+	routeScheds = map[string]*node.Scheduler{}
+	routeNames  []string
+	dataPaths   = map[string]*DataPathProxy{}
+)
+
+//make the scheduler of a route available to the control path
+func registerRoute(name string, s *node.Scheduler) {
+	routeLock.Lock()
+	defer routeLock.Unlock()
+	if _, ok := routeScheds[name]; !ok {
+		routeNames = append(routeNames, name)
+	}
+	routeScheds[name] = s
+}
+
+//remove a route from the control path
+func unregisterRoute(name string) {
+	routeLock.Lock()
+	defer routeLock.Unlock()
+	delete(routeScheds, name)
+	for idx, cur := range routeNames {
+		if cur == name {
+			routeNames = append(routeNames[:idx:idx], routeNames[idx+1:]...)
+			break
+		}
+	}
+}
+
+//make an HTTP route available to the control path, for its node groups
+func registerDataPath(name string, p *DataPathProxy) {
+	routeLock.Lock()
+	defer routeLock.Unlock()
+	dataPaths[name] = p
+}
+
+//returns the HTTP route with that name, the HTTP data path when there is no route with that name
+//and nil when it is not an HTTP route
+func routeDataPath(name string) *DataPathProxy {
+	routeLock.RLock()
+	p := dataPaths[name]
+	_, isRoute := routeScheds[name]
+	routeLock.RUnlock()
+	if p == nil && !isRoute {
+		p = Proxy
+	}
+	return p
+}
+
+//returns every HTTP route in the order they were registered
+func routeDataPaths() []*DataPathProxy {
+	routeLock.RLock()
+	defer routeLock.RUnlock()
+	paths := make([]*DataPathProxy, 0, len(dataPaths))
+	for _, name := range routeNames {
+		if p := dataPaths[name]; p != nil {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+//returns the scheduler of a node group of a route, nil when the route has no such group.
+//The default group is the scheduler of the route.
+func routeGroupScheduler(name, group string) *node.Scheduler {
+	if group == "" || group == DefaultGroup {
+		return routeScheduler(name)
+	}
+	p := routeDataPath(name)
+	if p == nil {
+		return nil
+	}
+	if g := p.Group(group); g != nil {
+		return g.Sched
+	}
+	return nil
+}
+
+//returns the scheduler of a route. The HTTP data path is used when there is no route with that name
+//so worker nodes added with any other path go to the HTTP data path, as they always have.
+func routeScheduler(name string) *node.Scheduler {
+	routeLock.RLock()
+	s := routeScheds[name]
+	routeLock.RUnlock()
+	if s == nil && Proxy != nil {
+		s = Proxy.Sched
+	}
+	return s
+}
+
+//returns the scheduler of every route in the order they were registered
+func routeSchedulers() []*node.Scheduler {
+	routeLock.RLock()
+	defer routeLock.RUnlock()
+	scheds := make([]*node.Scheduler, 0, len(routeNames))
+	for _, name := range routeNames {
+		scheds = append(scheds, routeScheds[name])
+	}
+	return scheds
+}
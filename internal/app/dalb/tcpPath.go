@@ -0,0 +1,207 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package dalb
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dalb/internal/node"
+	"dalb/internal/proxyproto"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//how long a connection to a worker node may take to open
+const DefaultTCPDialTimeout = 10 * time.Second
+
+//how long a connection is kept without data in either direction
+const DefaultTCPIdleTimeout = 5 * time.Minute
+
+//A layer-4 route: every client connection is spliced to a worker node picked by the Scheduler.
+//A connection is one transaction, MaxTransactions limits the connections open to a node.
+type TCPPathProxy struct {
+	Name  string
+	Sched *node.Scheduler
+	// DefaultTCPDialTimeout when 0
+	DialTimeout time.Duration
+	// DefaultTCPIdleTimeout when 0
+	IdleTimeout time.Duration
+	listener    net.Listener
+	conns       sync.WaitGroup
+}
+
+func TCPPathInit(name string) *TCPPathProxy {
+	tp := &TCPPathProxy{
+		Name: name,
+	}
+	tp.Sched = node.NewScheduler(0)
+	tp.Sched.Name = name
+	tp.Sched.RestoreHistory()
+	registerRoute(name, tp.Sched)
+	return tp
+}
+
+//accept client connections on l until it is closed
+func (tp *TCPPathProxy) Serve(l net.Listener) error {
+	tp.listener = l
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		tp.conns.Add(1)
+		go func() {
+			defer tp.conns.Done()
+			tp.tcpPathForward(c)
+		}()
+	}
+}
+
+//stop accepting connections and wait for the open ones to finish
+func (tp *TCPPathProxy) Close() error {
+	var err error
+	if tp.listener != nil {
+		err = tp.listener.Close()
+	}
+	tp.conns.Wait()
+	return err
+}
+
+func (tp *TCPPathProxy) tcpPathForward(client net.Conn) {
+	defer client.Close()
+	entry := log.WithField("route", tp.Name).WithField("client", client.RemoteAddr().String())
+	n := tp.Sched.SchedGetNode()
+	if n == nil {
+		entry.Error("Cannot get a worker node for connection")
+		return
+	}
+	// make the node available for another connection
+	defer tp.Sched.SchedReScheduleNode(n)
+	tStart := time.Now()
+	upstream, err := tp.dial(n, client)
+	if err != nil {
+		entry.WithError(err).Error("Worker node connection failed")
+		n.UpdateError()
+		tp.Sched.UpdateError()
+		return
+	}
+	defer upstream.Close()
+	idle := tp.IdleTimeout
+	if idle == 0 {
+		idle = DefaultTCPIdleTimeout
+	}
+	in, out := splice(client, upstream, idle)
+	tDur := time.Since(tStart)
+	n.UpdateTime(tDur)
+	tp.Sched.UpdateTime(tDur)
+	n.UpdateBytes(in, out)
+	tp.Sched.UpdateBytes(in, out)
+}
+
+//open a connection to the worker node, sending a PROXY protocol header if the node expects one
+func (tp *TCPPathProxy) dial(n *node.Node, client net.Conn) (net.Conn, error) {
+	timeout := tp.DialTimeout
+	if timeout == 0 {
+		timeout = DefaultTCPDialTimeout
+	}
+	c, err := net.DialTimeout("tcp", net.JoinHostPort(n.IP.String(), strconv.Itoa(n.Port)), timeout)
+	if err != nil {
+		return nil, err
+	}
+	if n.ProxyProtocol != 0 {
+		h := &proxyproto.Header{Version: n.ProxyProtocol}
+		src, ok1 := client.RemoteAddr().(*net.TCPAddr)
+		dst, ok2 := client.LocalAddr().(*net.TCPAddr)
+		if ok1 && ok2 && (src.IP.To4() == nil) == (dst.IP.To4() == nil) {
+			h.Source, h.Destination = src, dst
+		}
+		if _, err := h.WriteTo(c); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+//copy the bytes in both directions until both sides are done, returns the bytes received from a and sent to a.
+//A side that is done sending is half closed so the other side can still reply. When a copy fails, or there
+//has been no data in either direction for idle, both connections are closed so neither copy is left waiting.
+func splice(a, b net.Conn, idle time.Duration) (in, out int64) {
+	act := &activity{idle: idle, last: time.Now().UnixNano()}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var err error
+		if out, err = act.copy(a, b); err != nil {
+			a.Close()
+			b.Close()
+			return
+		}
+		closeWrite(a)
+	}()
+	in, err := act.copy(b, a)
+	if err != nil {
+		a.Close()
+		b.Close()
+	} else {
+		closeWrite(b)
+	}
+	wg.Wait()
+	return
+}
+
+//the last time data was received in either direction of a spliced connection
+type activity struct {
+	idle time.Duration
+	last int64 // unix nano
+}
+
+//copy from src to dst until src is done (nil error) or the connection has been idle for too long. The read
+//deadline is refreshed with each read, it does not expire while data flows in the other direction.
+func (act *activity) copy(dst, src net.Conn) (int64, error) {
+	buf := make([]byte, 32*1024)
+	var written int64
+	for {
+		src.SetReadDeadline(time.Unix(0, atomic.LoadInt64(&act.last)).Add(act.idle))
+		nr, rerr := src.Read(buf)
+		if nr > 0 {
+			atomic.StoreInt64(&act.last, time.Now().UnixNano())
+			dst.SetWriteDeadline(time.Now().Add(act.idle))
+			nw, werr := dst.Write(buf[:nr])
+			written += int64(nw)
+			if werr != nil {
+				return written, werr
+			}
+		}
+		if rerr == io.EOF {
+			return written, nil
+		}
+		if rerr != nil {
+			if ne, ok := rerr.(net.Error); ok && ne.Timeout() && time.Since(time.Unix(0, atomic.LoadInt64(&act.last))) < act.idle {
+				// the other direction was active, wait again
+				continue
+			}
+			return written, rerr
+		}
+	}
+}
+
+//half close a connection so the other side sees EOF but can still send its reply
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		c.Close()
+	}
+}
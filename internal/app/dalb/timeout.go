@@ -0,0 +1,338 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package dalb
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//what timed out
+const (
+	TimeoutConnect   = "connect"   // getting a connection to the worker node
+	TimeoutFirstByte = "firstByte" // the worker node response after the request was sent
+	TimeoutIdle      = "idle"      // the next part of the response body
+	TimeoutTotal     = "total"     // the whole request
+	TimeoutDeadline  = "deadline"  // the deadline sent by the client
+)
+
+//the timeout kinds in the order they are counted
+var timeoutKinds = [...]string{TimeoutConnect, TimeoutFirstByte, TimeoutIdle, TimeoutTotal, TimeoutDeadline}
+
+//request header with the time in milliseconds a client is willing to wait, it is sent to the worker
+//node with the time that is left
+const DefaultDeadlineHeader = "X-Request-Deadline"
+
+//The timeouts of the requests of a route, 0 for none. Connect and FirstByte apply to each request
+//sent to a worker node, Idle to each read of a response body and Total to the whole request from the
+//time it arrived, including the time it waited for a free node slot.
+type Timeouts struct {
+	Connect   time.Duration
+	FirstByte time.Duration
+	Idle      time.Duration
+	Total     time.Duration
+}
+
+//returns an error when the timeouts cannot be used
+func (to Timeouts) valid() error {
+	if to.Connect < 0 || to.FirstByte < 0 || to.Idle < 0 || to.Total < 0 {
+		return errors.New("timeouts cannot be negative")
+	}
+	return nil
+}
+
+// Returns the timeouts of the route
+func (p *DataPathProxy) Timeouts() Timeouts {
+	to, _ := p.timeouts.Load().(Timeouts)
+	return to
+}
+
+// Set the timeouts of the route, the requests in progress keep the timeouts they started with
+func (p *DataPathProxy) SetTimeouts(to Timeouts) error {
+	if err := to.valid(); err != nil {
+		return err
+	}
+	p.timeouts.Store(to)
+	return nil
+}
+
+// Returns the number of requests of the route that timed out, by kind
+func (p *DataPathProxy) TimeoutCounts() map[string]int64 {
+	counts := make(map[string]int64, len(timeoutKinds))
+	for idx, kind := range timeoutKinds {
+		counts[kind] = atomic.LoadInt64(&p.timeoutCounts[idx])
+	}
+	return counts
+}
+
+//count a request of the route that timed out
+func (p *DataPathProxy) countTimeout(kind string) {
+	for idx := range timeoutKinds {
+		if timeoutKinds[idx] == kind {
+			atomic.AddInt64(&p.timeoutCounts[idx], 1)
+		}
+	}
+}
+
+//returns when a request has to be answered, the route Total timeout or the client deadline if it is
+//sooner, and which of them it is. The deadline is zero when there is none.
+func (p *DataPathProxy) requestDeadline(r *http.Request, start time.Time) (deadline time.Time, kind string) {
+	if to := p.Timeouts(); to.Total > 0 {
+		deadline, kind = start.Add(to.Total), TimeoutTotal
+	}
+	if budget, ok := p.clientBudget(r); ok {
+		if cd := start.Add(budget); deadline.IsZero() || cd.Before(deadline) {
+			deadline, kind = cd, TimeoutDeadline
+		}
+	}
+	return deadline, kind
+}
+
+//returns the time the client is willing to wait from the grpc-timeout of a gRPC call or the deadline
+//header, at most the route total timeout
+func (p *DataPathProxy) clientBudget(r *http.Request) (time.Duration, bool) {
+	budget, ok := time.Duration(0), false
+	if isGRPC(r) {
+		if v := r.Header.Get("Grpc-Timeout"); v != "" {
+			budget, ok = parseGRPCTimeout(v)
+		}
+	}
+	if !ok && p.DeadlineHeader != "" {
+		if v := r.Header.Get(p.DeadlineHeader); v != "" {
+			if ms, err := strconv.ParseInt(v, 10, 64); err == nil && ms >= 0 && ms <= math.MaxInt64/int64(time.Millisecond) {
+				budget, ok = time.Duration(ms)*time.Millisecond, true
+			}
+		}
+	}
+	if to := p.Timeouts(); ok && to.Total > 0 && budget > to.Total {
+		budget = to.Total
+	}
+	return budget, ok
+}
+
+//the grpc-timeout units
+var grpcTimeoutUnits = []struct {
+	unit byte
+	d    time.Duration
+}{
+	{'n', time.Nanosecond},
+	{'u', time.Microsecond},
+	{'m', time.Millisecond},
+	{'S', time.Second},
+	{'M', time.Minute},
+	{'H', time.Hour},
+}
+
+//returns the duration of a grpc-timeout header, at most 8 digits and a unit
+func parseGRPCTimeout(v string) (time.Duration, bool) {
+	if len(v) < 2 || len(v) > 9 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	for _, u := range grpcTimeoutUnits {
+		if u.unit == v[len(v)-1] {
+			return time.Duration(n) * u.d, true
+		}
+	}
+	return 0, false
+}
+
+//returns the grpc-timeout header for a duration, rounded up to the smallest unit that fits 8 digits
+func grpcTimeout(d time.Duration) string {
+	if d <= 0 {
+		return "0n"
+	}
+	for _, u := range grpcTimeoutUnits {
+		if n := (d + u.d - 1) / u.d; n < 1e8 {
+			return strconv.FormatInt(int64(n), 10) + string(u.unit)
+		}
+	}
+	return "99999999H"
+}
+
+//send the time that is left until the request deadline to the worker node. The deadline headers
+//of the client are removed when they were not used, so the client cannot set the worker node budget.
+func (p *DataPathProxy) setDeadlineHeaders(r *http.Request, txn *transaction) {
+	if !txn.grpc || txn.deadline.IsZero() {
+		r.Header.Del("Grpc-Timeout")
+	}
+	if txn.deadline.IsZero() {
+		if p.DeadlineHeader != "" {
+			r.Header.Del(p.DeadlineHeader)
+		}
+		return
+	}
+	left := time.Until(txn.deadline)
+	if txn.grpc {
+		r.Header.Set("Grpc-Timeout", grpcTimeout(left))
+	}
+	if p.DeadlineHeader != "" {
+		if left < 0 {
+			left = 0
+		}
+		r.Header.Set(p.DeadlineHeader, strconv.FormatInt(int64(left/time.Millisecond), 10))
+	}
+}
+
+//returns true when the request timed out. The request deadline is what timed out when the request
+//context ran out of time.
+func (txn *transaction) timedOut(ctx context.Context) bool {
+	if txn.timeout == "" && ctx.Err() == context.DeadlineExceeded {
+		txn.timeout = txn.deadlineKind
+	}
+	return txn.timeout != ""
+}
+
+//the error of a request to a worker node that timed out
+type timeoutError struct {
+	kind string
+	err  error
+}
+
+func (e *timeoutError) Error() string {
+	return e.kind + " timeout: " + e.err.Error()
+}
+
+func (e *timeoutError) Unwrap() error {
+	return e.err
+}
+
+func (e *timeoutError) Timeout() bool {
+	return true
+}
+
+//cancels a request to a worker node when the phase it is in takes too long.
+//The timer is created once and reset for every phase, a body Read does not allocate.
+type phaseTimer struct {
+	lock     sync.Mutex
+	timer    *time.Timer
+	kind     string    // the phase being timed, "" when the timer is stopped
+	deadline time.Time // when the phase being timed takes too long
+	fired    string    // the phase that took too long
+	cancel   context.CancelFunc
+}
+
+//start timing a phase, "" or a zero duration stops the timer
+func (pt *phaseTimer) set(kind string, d time.Duration) {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	if pt.fired != "" {
+		return
+	}
+	if kind == "" || d <= 0 {
+		if pt.kind != "" {
+			pt.timer.Stop()
+			pt.kind = ""
+		}
+		return
+	}
+	pt.kind = kind
+	pt.deadline = time.Now().Add(d)
+	if pt.timer == nil {
+		pt.timer = time.AfterFunc(d, pt.expire)
+	} else {
+		pt.timer.Reset(d)
+	}
+}
+
+func (pt *phaseTimer) expire() {
+	pt.lock.Lock()
+	// a timer of a phase that was stopped or reset may still fire, it is before the deadline of the current phase
+	if pt.kind == "" || pt.fired != "" || time.Now().Before(pt.deadline) {
+		pt.lock.Unlock()
+		return
+	}
+	pt.fired = pt.kind
+	pt.lock.Unlock()
+	pt.cancel()
+}
+
+//returns the phase that took too long, "" when none did
+func (pt *phaseTimer) timedOut() string {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	return pt.fired
+}
+
+//applies the connect, first byte and idle timeouts of the route to the requests sent to the worker nodes
+type timeoutTransport struct {
+	p    *DataPathProxy
+	base http.RoundTripper
+}
+
+func (t *timeoutTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	to := t.p.Timeouts()
+	if to.Connect == 0 && to.FirstByte == 0 && to.Idle == 0 {
+		return t.base.RoundTrip(r)
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	pt := &phaseTimer{cancel: cancel}
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn:              func(httptrace.GotConnInfo) { pt.set("", 0) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { pt.set(TimeoutFirstByte, to.FirstByte) },
+		GotFirstResponseByte: func() { pt.set("", 0) },
+	})
+	pt.set(TimeoutConnect, to.Connect)
+	resp, err := t.base.RoundTrip(r.WithContext(ctx))
+	if err != nil {
+		pt.set("", 0)
+		cancel()
+		if kind := pt.timedOut(); kind != "" {
+			if txn := requestTransaction(r); txn != nil {
+				txn.timeout = kind
+			}
+			return nil, &timeoutError{kind: kind, err: err}
+		}
+		return nil, err
+	}
+	pt.set("", 0)
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// the upgraded connection is not timed, it ends with the request context
+		return resp, nil
+	}
+	resp.Body = &timeoutBody{ReadCloser: resp.Body, pt: pt, idle: to.Idle, resp: resp}
+	return resp, nil
+}
+
+//a response body that has to keep coming, its request is cancelled when the body is closed
+type timeoutBody struct {
+	io.ReadCloser
+	pt   *phaseTimer
+	idle time.Duration
+	resp *http.Response
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	b.pt.set(TimeoutIdle, b.idle)
+	n, err := b.ReadCloser.Read(p)
+	b.pt.set("", 0)
+	if err != nil && err != io.EOF {
+		if kind := b.pt.timedOut(); kind != "" {
+			// the response may have been handed to another request by then, e.g. a hedge that won
+			if txn := requestTransaction(b.resp.Request); txn != nil {
+				txn.timeout = kind
+			}
+			err = &timeoutError{kind: kind, err: err}
+		}
+	}
+	return n, err
+}
+
+func (b *timeoutBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.pt.set("", 0)
+	b.pt.cancel()
+	return err
+}
@@ -0,0 +1,46 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package dalb
+
+import (
+	"net/http"
+
+	"dalb/internal/trace"
+)
+
+//wraps the worker node transport with a client span for every round trip.
+//The span context is sent to the worker node in the W3C traceparent and tracestate headers.
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	txn := requestTransaction(r)
+	if txn != nil {
+		txn.attempts++
+	}
+	_, span := trace.StartSpan(r.Context(), "upstream", trace.KindClient)
+	if span == nil {
+		return t.base.RoundTrip(r)
+	}
+	defer span.Finish()
+	sc := span.SpanContext()
+	r.Header.Set(trace.TraceparentHeader, sc.Traceparent())
+	if sc.TraceState != "" {
+		r.Header.Set(trace.TracestateHeader, sc.TraceState)
+	}
+	span.SetAttribute("http.method", r.Method)
+	span.SetAttribute("http.url", r.URL.String())
+	if txn != nil {
+		span.SetAttribute("dalb.attempt", txn.attempts)
+		span.SetAttribute("dalb.request_id", txn.id)
+	}
+	resp, err := t.base.RoundTrip(r)
+	if err != nil {
+		span.SetError(err)
+		return resp, err
+	}
+	span.SetAttribute("http.status_code", resp.StatusCode)
+	return resp, nil
+}
@@ -0,0 +1,211 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package dalb
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"dalb/internal/node"
+	"dalb/internal/proxyproto"
+
+	"golang.org/x/net/http2"
+)
+
+//the protocols a worker node can be sent requests with
+const (
+	ProtoHTTP  = "http"  // HTTP/1.1
+	ProtoHTTPS = "https" // HTTP/1.1 or HTTP/2 over TLS, as negotiated with ALPN
+	ProtoH2    = "h2"    // HTTP/2 over TLS
+	ProtoH2C   = "h2c"   // HTTP/2 over cleartext TCP, with prior knowledge
+)
+
+//returns true if proto is a protocol a worker node can be sent requests with, "" is ProtoHTTP
+func validProtocol(proto string) bool {
+	switch proto {
+	case "", ProtoHTTP, ProtoHTTPS, ProtoH2, ProtoH2C:
+		return true
+	}
+	return false
+}
+
+//returns the protocol a worker node is sent requests with
+func protocolName(proto string) string {
+	if proto == "" {
+		return ProtoHTTP
+	}
+	return proto
+}
+
+//returns the URL scheme of the requests sent to a worker node
+func nodeScheme(n *node.Node) string {
+	switch n.Protocol {
+	case ProtoHTTPS, ProtoH2:
+		return "https"
+	}
+	return "http"
+}
+
+//sends a request to its worker node with the transport the node needs
+type nodeTransport struct {
+	base http.RoundTripper
+	// for worker nodes that expect a PROXY protocol header
+	proxyProto http.RoundTripper
+	// for worker nodes that only speak HTTP/2
+	h2, h2c http.RoundTripper
+}
+
+func newNodeTransport() *nodeTransport {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	return &nodeTransport{
+		base:       newHTTPTransport(dialer.DialContext),
+		proxyProto: newProxyProtoTransport(),
+		h2:         newH2Transport(),
+		h2c:        newH2CTransport(),
+	}
+}
+
+func (t *nodeTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	txn := requestTransaction(r)
+	if txn == nil || txn.node == nil {
+		return t.base.RoundTrip(r)
+	}
+	return t.forNode(txn.node).RoundTrip(r)
+}
+
+//returns the transport for the requests sent to a worker node
+func (t *nodeTransport) forNode(n *node.Node) http.RoundTripper {
+	switch {
+	case n.Protocol == ProtoH2:
+		return t.h2
+	case n.Protocol == ProtoH2C:
+		return t.h2c
+	case n.ProxyProtocol != 0:
+		return t.proxyProto
+	}
+	return t.base
+}
+
+//the TLS settings the worker nodes are checked with, nil for the Go defaults
+var nodeTLS atomic.Value
+
+// Set the TLS settings the https and h2 worker nodes are checked with, e.g. InsecureSkipVerify for
+// nodes with self-signed certificates. The connections opened from then on use them.
+func SetNodeTLSConfig(cfg *tls.Config) {
+	nodeTLS.Store(cfg)
+}
+
+//returns the TLS settings of a connection to a worker node offering protos with ALPN
+func nodeTLSConfig(addr string, protos ...string) *tls.Config {
+	cfg, _ := nodeTLS.Load().(*tls.Config)
+	if cfg == nil {
+		cfg = &tls.Config{}
+	} else {
+		cfg = cfg.Clone()
+	}
+	cfg.NextProtos = protos
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	return cfg
+}
+
+//returns a transport for HTTP/1.1 worker nodes, and HTTP/2 over TLS when the node offers it, that opens
+//its connections with dial. The worker nodes are dialed directly, not through the proxy of the environment.
+func newHTTPTransport(dial func(ctx context.Context, network, addr string) (net.Conn, error)) *http.Transport {
+	return &http.Transport{
+		DialContext: dial,
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			c, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			tc := tls.Client(c, nodeTLSConfig(addr, http2.NextProtoTLS, "http/1.1"))
+			hctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+			if err := tc.HandshakeContext(hctx); err != nil {
+				c.Close()
+				return nil, err
+			}
+			return tc, nil
+		},
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+//returns a transport that sends HTTP/2 requests over TLS, with the same TLS settings as the other transports
+func newH2Transport() *http2.Transport {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	return &http2.Transport{
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			td := &tls.Dialer{NetDialer: dialer, Config: nodeTLSConfig(addr, http2.NextProtoTLS)}
+			return td.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+//returns a transport that sends HTTP/2 requests over cleartext connections (h2c with prior knowledge)
+func newH2CTransport() *http2.Transport {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+//returns a transport that starts every connection with a PROXY protocol header. The header
+//describes the client of one request so connections are not reused.
+func newProxyProtoTransport() *http.Transport {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	t := newHTTPTransport(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		txn, _ := ctx.Value(txnKey).(*transaction)
+		if txn == nil || txn.node == nil {
+			return c, nil
+		}
+		h := proxyHeader(ctx, txn)
+		if _, err := h.WriteTo(c); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return c, nil
+	})
+	t.DisableKeepAlives = true
+	return t
+}
+
+//returns the PROXY protocol header for the client connection of a transaction
+func proxyHeader(ctx context.Context, txn *transaction) *proxyproto.Header {
+	h := &proxyproto.Header{Version: txn.node.ProxyProtocol}
+	ip := net.ParseIP(txn.clientIP)
+	if ip == nil {
+		return h
+	}
+	h.Source = &net.TCPAddr{IP: ip}
+	// the client port is only known when the client is the peer
+	if host, port, err := net.SplitHostPort(txn.remoteAddr); err == nil && host == txn.clientIP {
+		h.Source.Port, _ = strconv.Atoi(port)
+	}
+	if local, ok := ctx.Value(http.LocalAddrContextKey).(*net.TCPAddr); ok && (local.IP.To4() == nil) == (ip.To4() == nil) {
+		h.Destination = local
+	} else if ip.To4() != nil {
+		h.Destination = &net.TCPAddr{IP: net.IPv4zero}
+	} else {
+		h.Destination = &net.TCPAddr{IP: net.IPv6unspecified}
+	}
+	return h
+}
@@ -0,0 +1,270 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package dalb
+
+import (
+	"errors"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dalb/internal/node"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//how long a flow is kept without datagrams in either direction
+const DefaultUDPIdleTimeout = 30 * time.Second
+
+//the largest UDP datagram
+const maxDatagram = 64 * 1024
+
+//A UDP route: the datagrams of a client address (a flow) are sent to one worker node and the
+//replies of that node are sent back to the client until the flow has been idle for IdleTimeout.
+//With the Scheduler every flow holds a slot of its node, MaxTransactions limits the flows of a node.
+//With HashFlows the node is picked by a hash of the flow 5-tuple and slots are not used.
+type UDPPathProxy struct {
+	Name  string
+	Sched *node.Scheduler
+	// DefaultUDPIdleTimeout when 0
+	IdleTimeout time.Duration
+	HashFlows   bool
+	conn        net.PacketConn
+	lock        sync.Mutex
+	flows       map[string]*udpFlow
+	closed      bool
+	done        chan struct{}
+	// flows whose reply goroutines are still running
+	active sync.WaitGroup
+}
+
+//the datagrams between a client and a worker node
+type udpFlow struct {
+	client   net.Addr
+	node     *node.Node
+	upstream *net.UDPConn
+	start    time.Time
+	slot     bool  // the flow holds a Scheduler slot
+	last     int64 // unix nano of the last datagram in either direction
+	// counters not yet added to the node statistics
+	pin, in, pout, out, drops int64
+}
+
+func UDPPathInit(name string) *UDPPathProxy {
+	up := &UDPPathProxy{
+		Name:  name,
+		flows: make(map[string]*udpFlow),
+		done:  make(chan struct{}),
+	}
+	up.Sched = node.NewScheduler(0)
+	up.Sched.Name = name
+	up.Sched.RestoreHistory()
+	registerRoute(name, up.Sched)
+	return up
+}
+
+//read client datagrams from conn until it is closed
+func (up *UDPPathProxy) Serve(conn net.PacketConn) error {
+	up.conn = conn
+	if up.IdleTimeout == 0 {
+		up.IdleTimeout = DefaultUDPIdleTimeout
+	}
+	go up.expire()
+	buf := make([]byte, maxDatagram)
+	for {
+		cnt, client, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+		up.udpPathForward(buf[:cnt], client)
+	}
+}
+
+//stop reading datagrams and close all of the flows
+func (up *UDPPathProxy) Close() error {
+	var err error
+	if up.conn != nil {
+		err = up.conn.Close()
+	}
+	close(up.done)
+	up.lock.Lock()
+	up.closed = true
+	for key, f := range up.flows {
+		up.closeFlow(key, f)
+	}
+	up.lock.Unlock()
+	up.active.Wait()
+	return err
+}
+
+func (up *UDPPathProxy) udpPathForward(datagram []byte, client net.Addr) {
+	f := up.flow(client)
+	if f == nil {
+		up.Sched.UpdatePackets(1, int64(len(datagram)), 0, 0, 1)
+		return
+	}
+	atomic.StoreInt64(&f.last, time.Now().UnixNano())
+	atomic.AddInt64(&f.pin, 1)
+	atomic.AddInt64(&f.in, int64(len(datagram)))
+	if _, err := f.upstream.Write(datagram); err != nil {
+		atomic.AddInt64(&f.drops, 1)
+	}
+}
+
+//returns the flow of a client, a new flow is opened to a worker node for a new client and for a
+//client whose worker node is unhealthy or backed off. nil is returned when there is no worker node available.
+func (up *UDPPathProxy) flow(client net.Addr) *udpFlow {
+	key := client.String()
+	up.lock.Lock()
+	defer up.lock.Unlock()
+	f := up.flows[key]
+	if f != nil && !up.closed && !usable(f.node) {
+		up.closeFlow(key, f)
+		f = nil
+	}
+	if f != nil || up.closed {
+		return f
+	}
+	now := time.Now()
+	f = &udpFlow{client: client, start: now, last: now.UnixNano()}
+	if up.HashFlows {
+		f.node = up.hashNode(client)
+	} else {
+		f.node = up.Sched.SchedTryGetNode()
+		f.slot = f.node != nil
+	}
+	if f.node == nil {
+		return nil
+	}
+	addr := &net.UDPAddr{IP: f.node.IP, Port: f.node.Port}
+	upstream, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		log.WithField("route", up.Name).WithError(err).Error("Worker node connection failed")
+		f.node.UpdateError()
+		up.Sched.UpdateError()
+		if f.slot {
+			up.Sched.SchedReScheduleNode(f.node)
+		}
+		return nil
+	}
+	f.upstream = upstream
+	up.flows[key] = f
+	up.active.Add(1)
+	go up.reply(f)
+	return f
+}
+
+//send the worker node datagrams back to the client until the flow is closed
+func (up *UDPPathProxy) reply(f *udpFlow) {
+	defer up.active.Done()
+	buf := make([]byte, maxDatagram)
+	for {
+		cnt, err := f.upstream.Read(buf)
+		if err != nil {
+			if isClosed(err) {
+				return
+			}
+			// ICMP port unreachable and similar: the datagram is lost, the flow stays open
+			atomic.AddInt64(&f.drops, 1)
+			continue
+		}
+		atomic.StoreInt64(&f.last, time.Now().UnixNano())
+		if _, err := up.conn.WriteTo(buf[:cnt], f.client); err != nil {
+			atomic.AddInt64(&f.drops, 1)
+			continue
+		}
+		atomic.AddInt64(&f.pout, 1)
+		atomic.AddInt64(&f.out, int64(cnt))
+	}
+}
+
+//returns true when the error is from a connection that has been closed
+func isClosed(err error) bool {
+	return errors.Is(err, net.ErrClosed)
+}
+
+//close the flows that have been idle for IdleTimeout and add the counters of the others to the statistics
+func (up *UDPPathProxy) expire() {
+	ticker := time.NewTicker(up.IdleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-up.done:
+			return
+		case now := <-ticker.C:
+			idle := now.Add(-up.IdleTimeout).UnixNano()
+			up.lock.Lock()
+			for key, f := range up.flows {
+				if atomic.LoadInt64(&f.last) < idle {
+					up.closeFlow(key, f)
+				} else {
+					up.flushFlow(f)
+				}
+			}
+			up.lock.Unlock()
+		}
+	}
+}
+
+//add the flow counters to the node and Scheduler statistics
+func (up *UDPPathProxy) flushFlow(f *udpFlow) {
+	pin, in := atomic.SwapInt64(&f.pin, 0), atomic.SwapInt64(&f.in, 0)
+	pout, out := atomic.SwapInt64(&f.pout, 0), atomic.SwapInt64(&f.out, 0)
+	drops := atomic.SwapInt64(&f.drops, 0)
+	if pin|pout|drops == 0 {
+		return
+	}
+	f.node.UpdatePackets(pin, in, pout, out, drops)
+	up.Sched.UpdatePackets(pin, in, pout, out, drops)
+}
+
+//close a flow, the flow lifetime is its transaction time. Called with the lock held.
+func (up *UDPPathProxy) closeFlow(key string, f *udpFlow) {
+	delete(up.flows, key)
+	f.upstream.Close()
+	up.flushFlow(f)
+	tDur := time.Since(f.start)
+	f.node.UpdateTime(tDur)
+	up.Sched.UpdateTime(tDur)
+	if f.slot {
+		// make the node available for another flow
+		up.Sched.SchedReScheduleNode(f.node)
+	}
+}
+
+//returns the worker node for a client by rendezvous hashing of the flow 5-tuple, so only the flows of
+//a node move when the node is added or removed. The flows of a node that is unhealthy or backed off go
+//to the next node in the hash order.
+func (up *UDPPathProxy) hashNode(client net.Addr) *node.Node {
+	tuple := "udp " + client.String() + " " + up.conn.LocalAddr().String()
+	nodes := up.Sched.SchedNodes()
+	avail := nodes[:0]
+	for _, n := range nodes {
+		if usable(n) {
+			avail = append(avail, n)
+		}
+	}
+	return rendezvousNode(tuple, avail)
+}
+
+//returns the node with the highest hash of key and the node address (rendezvous hashing)
+func rendezvousNode(key string, nodes []*node.Node) *node.Node {
+	var best *node.Node
+	var bestScore uint64
+	for _, n := range nodes {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte(n.IP.String() + ":" + strconv.Itoa(n.Port)))
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = n, score
+		}
+	}
+	return best
+}
@@ -0,0 +1,210 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package dalb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"dalb/internal/node"
+)
+
+//WebSocket close status sent to the clients of a drained worker node, the client should reconnect
+const wsCloseServiceRestart = 1012
+
+//returns true if a request asks to upgrade the connection to another protocol (e.g. WebSocket)
+func isUpgrade(h http.Header) bool {
+	if h.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range h.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//the upgraded connections of every worker node, so they can be closed when the node is drained
+var upgrades = struct {
+	lock  sync.Mutex
+	conns map[*node.Node]map[*upgradeConn]struct{}
+}{conns: make(map[*node.Node]map[*upgradeConn]struct{})}
+
+//close the upgraded connections of a worker node. WebSocket clients are sent a close frame
+//asking them to reconnect, they then get one of the other worker nodes.
+func drainUpgrades(n *node.Node) int {
+	upgrades.lock.Lock()
+	conns := make([]*upgradeConn, 0, len(upgrades.conns[n]))
+	for c := range upgrades.conns[n] {
+		conns = append(conns, c)
+	}
+	upgrades.lock.Unlock()
+	for _, c := range conns {
+		c.drain()
+	}
+	return len(conns)
+}
+
+//wraps the client http.ResponseWriter of an upgrade request to keep track of the connection
+//ReverseProxy hijacks once the worker node has switched protocols
+type upgradeWriter struct {
+	http.ResponseWriter
+	txn *transaction
+}
+
+func (uw *upgradeWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := uw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection cannot be hijacked")
+	}
+	conn, brw, err := h.Hijack()
+	if err != nil || uw.txn.node == nil || uw.txn.backend == nil {
+		return conn, brw, err
+	}
+	uc := &upgradeConn{
+		Conn:    conn,
+		node:    uw.txn.node,
+		backend: uw.txn.backend,
+		ws:      strings.EqualFold(uw.txn.upgrade, "websocket"),
+	}
+	upgrades.lock.Lock()
+	if upgrades.conns[uc.node] == nil {
+		upgrades.conns[uc.node] = make(map[*upgradeConn]struct{})
+	}
+	upgrades.conns[uc.node][uc] = struct{}{}
+	upgrades.lock.Unlock()
+	return uc, brw, nil
+}
+
+func (uw *upgradeWriter) Flush() {
+	if f, ok := uw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+//used by http.ResponseController to reach the client http.ResponseWriter
+func (uw *upgradeWriter) Unwrap() http.ResponseWriter {
+	return uw.ResponseWriter
+}
+
+//an upgraded client connection
+type upgradeConn struct {
+	net.Conn
+	node    *node.Node
+	backend io.Closer // the worker node connection
+	ws      bool
+	lock    sync.Mutex
+	frames  wsFrames
+	drained bool
+	closed  bool
+}
+
+func (uc *upgradeConn) Write(b []byte) (int, error) {
+	uc.lock.Lock()
+	defer uc.lock.Unlock()
+	n, err := uc.Conn.Write(b)
+	if uc.ws {
+		uc.frames.write(b[:n])
+	}
+	return n, err
+}
+
+//close the worker node side of the connection, ReverseProxy then closes the client side
+func (uc *upgradeConn) drain() {
+	uc.lock.Lock()
+	uc.drained = true
+	uc.lock.Unlock()
+	uc.backend.Close()
+}
+
+func (uc *upgradeConn) Close() error {
+	uc.lock.Lock()
+	if uc.closed {
+		uc.lock.Unlock()
+		return nil
+	}
+	uc.closed = true
+	// a close frame can only be sent between the frames written by the worker node
+	if uc.drained && uc.ws && uc.frames.boundary() {
+		uc.Conn.Write(wsCloseFrame(wsCloseServiceRestart, "worker node draining"))
+	}
+	uc.lock.Unlock()
+	upgrades.lock.Lock()
+	delete(upgrades.conns[uc.node], uc)
+	if len(upgrades.conns[uc.node]) == 0 {
+		delete(upgrades.conns, uc.node)
+	}
+	upgrades.lock.Unlock()
+	return uc.Conn.Close()
+}
+
+//returns an unmasked (server to client) WebSocket close frame
+func wsCloseFrame(status uint16, reason string) []byte {
+	frame := []byte{0x88, byte(2 + len(reason)), 0, 0}
+	binary.BigEndian.PutUint16(frame[2:], status)
+	return append(frame, reason...)
+}
+
+//follows the WebSocket frames written to a client to know where one frame ends and the next starts
+type wsFrames struct {
+	hdr     [14]byte
+	hlen    int    // header bytes seen
+	payload uint64 // payload bytes left in the current frame
+}
+
+func (f *wsFrames) write(b []byte) {
+	for len(b) > 0 {
+		if f.payload > 0 {
+			cnt := uint64(len(b))
+			if cnt > f.payload {
+				cnt = f.payload
+			}
+			f.payload -= cnt
+			b = b[cnt:]
+			continue
+		}
+		f.hdr[f.hlen] = b[0]
+		f.hlen++
+		b = b[1:]
+		if f.hlen < 2 {
+			continue
+		}
+		need := 2
+		switch f.hdr[1] & 0x7f {
+		case 126:
+			need += 2
+		case 127:
+			need += 8
+		}
+		if f.hdr[1]&0x80 != 0 {
+			need += 4 // masking key
+		}
+		if f.hlen < need {
+			continue
+		}
+		switch size := f.hdr[1] & 0x7f; size {
+		case 126:
+			f.payload = uint64(binary.BigEndian.Uint16(f.hdr[2:]))
+		case 127:
+			f.payload = binary.BigEndian.Uint64(f.hdr[2:])
+		default:
+			f.payload = uint64(size)
+		}
+		f.hlen = 0
+	}
+}
+
+//returns true when no frame is partially written
+func (f *wsFrames) boundary() bool {
+	return f.hlen == 0 && f.payload == 0
+}
@@ -6,36 +6,47 @@ package cors
 // Copyright (c) 2019 by Extreme Networks Inc.
 
 import (
-	"crypto/tls"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"net"
 	"net/http"
 	"os"
 )
 
 func StartCORSHandler(port string, Router *mux.Router) {
-	headersOk := handlers.AllowedHeaders([]string{
-		"*",
-		"Authorization",
-		"X-Requested-With",
-		"Content-Type",
-	})
-	originsOk := handlers.AllowedOrigins([]string{"*"})
-	methodsOk := handlers.AllowedMethods([]string{
-		"GET",
-		"HEAD",
-		"PATCH",
-		"POST",
-		"PUT",
-		"DELETE",
-		"OPTIONS"})
+	log.Fatal(http.ListenAndServe(":"+port, corsHandler(Router)))
+}
 
-	log.Fatal(http.ListenAndServe(":"+port,
-		handlers.CORS(headersOk, originsOk, methodsOk)(Router)))
+// same as StartCORSHandler, on a listener that is already open
+func ServeCORSHandler(l net.Listener, Router *mux.Router) {
+	log.Fatal(http.Serve(l, corsHandler(Router)))
 }
 
-func StartCORSHandlerHTTPS(port string, Router *mux.Router) {
+// same as ServeCORSHandler, also accepting HTTP/2 over cleartext (h2c) connections
+func ServeCORSHandlerH2C(l net.Listener, Router *mux.Router) {
+	log.Fatal(http.Serve(l, h2c.NewHandler(corsHandler(Router), &http2.Server{})))
+}
+
+// same as StartCORSHandlerHTTPS, on a listener that is already open
+func ServeCORSHandlerHTTPS(l net.Listener, Router *mux.Router) {
+	log.Fatal(serveTLS(l, corsHandler(Router)))
+}
+
+// serve HTTPS on l with the certificates of CertKeys
+func serveTLS(l net.Listener, h http.Handler) error {
+	certificate, privkey, err := CertKeys()
+	defer os.Remove(certificate) // clean up
+	defer os.Remove(privkey)     // clean up
+	if err != nil {
+		log.Fatal("Cannot locate certificates for HTTPS")
+	}
+	return http.ServeTLS(l, h, certificate, privkey)
+}
+
+func corsHandler(Router *mux.Router) http.Handler {
 	headersOk := handlers.AllowedHeaders([]string{
 		"*",
 		"Authorization",
@@ -51,18 +62,13 @@ func StartCORSHandlerHTTPS(port string, Router *mux.Router) {
 		"PUT",
 		"DELETE",
 		"OPTIONS"})
+	return handlers.CORS(headersOk, originsOk, methodsOk)(Router)
+}
 
-	// Disable security check for HTTPS
-	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-
-	// get certificates for HTTPS
-	certificate, privkey, err := CertKeys()
-	defer os.Remove(certificate) // clean up
-	defer os.Remove(privkey)     // clean up
+func StartCORSHandlerHTTPS(port string, Router *mux.Router) {
+	l, err := net.Listen("tcp", ":"+port)
 	if err != nil {
-		log.Fatal("Cannot locate certificates for HTTPS")
+		log.Fatal(err)
 	}
-	log.Fatal(http.ListenAndServeTLS(":"+port,
-		certificate, privkey,
-		handlers.CORS(headersOk, originsOk, methodsOk)(Router)))
+	log.Fatal(serveTLS(l, corsHandler(Router)))
 }
@@ -0,0 +1,164 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package node
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+//
+// The channel Scheduler that was replaced by the copy-on-write Scheduler, kept as the reference
+// the benchmarks are compared with. Every node slot is an entry in a buffered channel and the
+// statistics are updated by a goroutine per node and per Scheduler.
+//
+
+type chanNode struct {
+	MaxTransactions int
+	statsChan       chan time.Duration
+	stat            struct {
+		totalTransactions    int64
+		totalTransactionTime time.Duration
+		minTransactionTime   time.Duration
+		maxTransactionTime   time.Duration
+	}
+}
+
+func newChanNode() *chanNode {
+	n := &chanNode{statsChan: make(chan time.Duration, 1000)}
+	go func(n *chanNode) {
+		for duration := range n.statsChan {
+			n.stat.totalTransactions++
+			n.stat.totalTransactionTime += duration
+			if n.stat.minTransactionTime == 0 || n.stat.minTransactionTime > duration {
+				n.stat.minTransactionTime = duration
+			}
+			if n.stat.maxTransactionTime < duration {
+				n.stat.maxTransactionTime = duration
+			}
+		}
+	}(n)
+	return n
+}
+
+func (n *chanNode) UpdateTime(duration time.Duration) {
+	n.statsChan <- duration
+}
+
+func (n *chanNode) Delete() {
+	close(n.statsChan)
+}
+
+type chanScheduler struct {
+	nodeMap     map[*chanNode]bool
+	lock        sync.Mutex
+	nodeChannel chan *chanNode
+	statsChan   chan time.Duration
+	stat        struct {
+		totalTransactions    int64
+		totalTransactionTime time.Duration
+	}
+}
+
+func newChanScheduler(schedLen int) *chanScheduler {
+	if schedLen == 0 {
+		schedLen = DefaultScheduleLen
+	}
+	s := &chanScheduler{
+		nodeMap:     make(map[*chanNode]bool),
+		statsChan:   make(chan time.Duration, 1000),
+		nodeChannel: make(chan *chanNode, schedLen),
+	}
+	go func(s *chanScheduler) {
+		for duration := range s.statsChan {
+			s.stat.totalTransactions++
+			s.stat.totalTransactionTime += duration
+		}
+	}(s)
+	return s
+}
+
+func (s *chanScheduler) Delete() {
+	close(s.statsChan)
+	close(s.nodeChannel)
+}
+
+func (s *chanScheduler) SchedAddNode(n *chanNode) {
+	s.lock.Lock()
+	s.nodeMap[n] = true
+	s.lock.Unlock()
+	for idx := 0; idx < n.MaxTransactions; idx++ {
+		s.nodeChannel <- n
+	}
+}
+
+// the map is read without the lock, as the channel Scheduler did. The benchmarks never delete a node.
+func (s *chanScheduler) SchedGetNode() *chanNode {
+	for n := range s.nodeChannel {
+		if s.nodeMap[n] {
+			return n
+		}
+	}
+	return nil
+}
+
+func (s *chanScheduler) SchedReScheduleNode(n *chanNode) {
+	s.nodeChannel <- n
+}
+
+func (s *chanScheduler) UpdateTime(duration time.Duration) {
+	s.statsChan <- duration
+}
+
+// returns a channel Scheduler with the nodes of the Scheduler benchmarks
+func benchChanScheduler() (*chanScheduler, func()) {
+	s := newChanScheduler(0)
+	nodes := make([]*chanNode, 0, 10)
+	for i := 0; i < 10; i++ {
+		n := newChanNode()
+		n.MaxTransactions = 100
+		s.SchedAddNode(n)
+		nodes = append(nodes, n)
+	}
+	return s, func() {
+		s.Delete()
+		for _, n := range nodes {
+			n.Delete()
+		}
+	}
+}
+
+// BenchmarkScheduler_HotPath with the channel Scheduler
+func BenchmarkChanScheduler_HotPath(b *testing.B) {
+	s, done := benchChanScheduler()
+	defer done()
+	b.ReportAllocs()
+	b.ResetTimer()
+	tStart := time.Now()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n := s.SchedGetNode()
+			s.SchedReScheduleNode(n)
+			n.UpdateTime(time.Microsecond)
+			s.UpdateTime(time.Microsecond)
+		}
+	})
+	b.ReportMetric(float64(b.N)/time.Since(tStart).Seconds(), "req/s")
+}
+
+// BenchmarkScheduler_GetNode with the channel Scheduler
+func BenchmarkChanScheduler_GetNode(b *testing.B) {
+	s, done := benchChanScheduler()
+	defer done()
+	b.ReportAllocs()
+	b.ResetTimer()
+	tStart := time.Now()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			s.SchedReScheduleNode(s.SchedGetNode())
+		}
+	})
+	b.ReportMetric(float64(b.N)/time.Since(tStart).Seconds(), "req/s")
+}
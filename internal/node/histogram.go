@@ -0,0 +1,126 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package node
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+const (
+	//each power of 2 range of durations is split into histSubBuckets linear buckets,
+	//which bounds the error of a percentile to 1/histSubBuckets (6.25%)
+	histSubBits    = 4
+	histSubBuckets = 1 << histSubBits
+	//durations longer than 2^histMaxBits nanoseconds (~73 minutes) are counted in the last bucket
+	histMaxBits = 42
+	histBuckets = (histMaxBits-histSubBits+1)*histSubBuckets + histSubBuckets
+)
+
+//A log-linear latency histogram in the style of HDR Histogram.
+//Histograms with the same layout can be merged by adding their buckets.
+type Histogram struct {
+	counts [histBuckets]int64
+}
+
+//A histogram bucket. Count transactions took at most UpperBound.
+type Bucket struct {
+	UpperBound time.Duration
+	Count      int64
+}
+
+//returns the bucket index for a duration
+func histIndex(duration time.Duration) int {
+	v := uint64(duration)
+	if duration < 0 {
+		v = 0
+	}
+	if v < histSubBuckets {
+		return int(v)
+	}
+	shift := bits.Len64(v) - 1 - histSubBits
+	if shift > histMaxBits-histSubBits {
+		return histBuckets - 1
+	}
+	sub := (v >> uint(shift)) & (histSubBuckets - 1)
+	return (shift+1)*histSubBuckets + int(sub)
+}
+
+//returns the lowest and highest duration counted in a bucket
+func histBounds(idx int) (time.Duration, time.Duration) {
+	if idx < histSubBuckets {
+		return time.Duration(idx), time.Duration(idx)
+	}
+	shift := uint(idx/histSubBuckets - 1)
+	sub := uint64(idx % histSubBuckets)
+	low := (histSubBuckets + sub) << shift
+	high := (histSubBuckets+sub+1)<<shift - 1
+	return time.Duration(low), time.Duration(high)
+}
+
+// count one transaction duration
+func (h *Histogram) Record(duration time.Duration) {
+	h.counts[histIndex(duration)]++
+}
+
+// add the buckets of another histogram to this one
+func (h *Histogram) Merge(o *Histogram) {
+	for idx := range h.counts {
+		h.counts[idx] += o.counts[idx]
+	}
+}
+
+// remove the buckets of an earlier snapshot of this histogram, leaving the durations counted since.
+// Buckets that were reset in between are set to 0.
+func (h *Histogram) Sub(o *Histogram) {
+	for idx := range h.counts {
+		h.counts[idx] -= o.counts[idx]
+		if h.counts[idx] < 0 {
+			h.counts[idx] = 0
+		}
+	}
+}
+
+// returns the number of durations counted by the histogram
+func (h *Histogram) Count() (cnt int64) {
+	for _, c := range h.counts {
+		cnt += c
+	}
+	return
+}
+
+// returns the duration below which the q fraction (0.0 - 1.0) of the transactions completed.
+// The value is the midpoint of the bucket holding the percentile.
+func (h *Histogram) Percentile(q float64) time.Duration {
+	total := h.Count()
+	if total == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(total)))
+	if rank < 1 {
+		rank = 1
+	}
+	seen := int64(0)
+	for idx, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			low, high := histBounds(idx)
+			return low + (high-low)/2
+		}
+	}
+	return 0
+}
+
+// returns the non empty buckets in increasing duration order
+func (h *Histogram) Buckets() []Bucket {
+	buckets := make([]Bucket, 0)
+	for idx, c := range h.counts {
+		if c != 0 {
+			_, high := histBounds(idx)
+			buckets = append(buckets, Bucket{UpperBound: high, Count: c})
+		}
+	}
+	return buckets
+}
@@ -0,0 +1,69 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package node
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistogram_Index(t *testing.T) {
+	for _, d := range []time.Duration{0, 1, 15, 16, 17, 31, 32, 1000, time.Millisecond, 1234567, time.Second, time.Hour} {
+		low, high := histBounds(histIndex(d))
+		if d < low || d > high {
+			t.Fatal("duration", d, "is not inside its bucket", low, high)
+		}
+	}
+	if histIndex(1000*time.Hour) != histBuckets-1 {
+		t.Fatal("long durations are not counted in the last bucket")
+	}
+}
+
+func TestHistogram_Percentile(t *testing.T) {
+	h := Histogram{}
+	for i := 1; i <= 1000; i++ {
+		h.Record(time.Duration(i) * time.Microsecond)
+	}
+	for _, q := range []float64{0.5, 0.9, 0.99, 0.999} {
+		want := time.Duration(q*1000) * time.Microsecond
+		got := h.Percentile(q)
+		if got < want-want/histSubBuckets || got > want+want/histSubBuckets {
+			t.Fatal("percentile", q, "is", got, "expected about", want)
+		}
+	}
+}
+
+func TestHistogram_Merge(t *testing.T) {
+	a, b := Histogram{}, Histogram{}
+	a.Record(time.Millisecond)
+	b.Record(time.Millisecond)
+	b.Record(time.Second)
+	a.Merge(&b)
+	if a.Count() != 3 {
+		t.Fatal("merged histogram count is not correct")
+	}
+	buckets := a.Buckets()
+	if len(buckets) != 2 || buckets[0].Count != 2 || buckets[1].Count != 1 {
+		t.Fatal("merged histogram buckets are not correct", buckets)
+	}
+	if buckets[0].UpperBound < time.Millisecond || buckets[1].UpperBound < time.Second {
+		t.Fatal("bucket upper bounds are not correct", buckets)
+	}
+}
+
+func TestHistogram_Sub(t *testing.T) {
+	before, h := Histogram{}, Histogram{}
+	before.Record(time.Millisecond)
+	h.Merge(&before)
+	h.Record(time.Second)
+	h.Record(time.Second)
+	h.Sub(&before)
+	if h.Count() != 2 || h.Percentile(0.5) < time.Second-time.Second/histSubBuckets {
+		t.Fatal("histogram difference is not correct", h.Buckets())
+	}
+	h.Sub(&before)
+	if h.Count() != 2 {
+		t.Fatal("bucket counts went negative", h.Buckets())
+	}
+}
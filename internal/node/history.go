@@ -0,0 +1,234 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package node
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	//how often the node and Scheduler statistics are sampled into their history
+	DefaultHistoryResolution = 10 * time.Second
+	//how long samples are kept at DefaultHistoryResolution before they are downsampled
+	DefaultHistoryRawRetention = time.Hour
+	//resolution of the downsampled history
+	DefaultHistoryDownsample = 5 * time.Minute
+	//how long the downsampled history is kept
+	DefaultHistoryRetention = 7 * 24 * time.Hour
+)
+
+//Controls the sampling and retention of the performance history
+type HistoryConfig struct {
+	Resolution   time.Duration
+	RawRetention time.Duration
+	Downsample   time.Duration
+	Retention    time.Duration
+}
+
+//The history settings used by new Schedulers
+var History = HistoryConfig{
+	Resolution:   DefaultHistoryResolution,
+	RawRetention: DefaultHistoryRawRetention,
+	Downsample:   DefaultHistoryDownsample,
+	Retention:    DefaultHistoryRetention,
+}
+
+//One point of performance history. The counts are for the Step starting at Time.
+type HistoryPoint struct {
+	Time             time.Time
+	Step             time.Duration
+	TransactionCount int64
+	ErrorCount       int64
+	// calendar slots (MaxTransactions) and transactions in flight at the end of the step
+	Slots    int
+	InFlight int
+	latency  sparseHistogram
+}
+
+// returns the latency percentile q (0.0 - 1.0) for the transactions in the point
+func (p *HistoryPoint) Percentile(q float64) time.Duration {
+	h := Histogram{}
+	p.latency.addTo(&h)
+	return h.Percentile(q)
+}
+
+//add a later point to this one
+func (p *HistoryPoint) merge(o *HistoryPoint) {
+	p.TransactionCount += o.TransactionCount
+	p.ErrorCount += o.ErrorCount
+	p.Slots = o.Slots
+	p.InFlight = o.InFlight
+	p.latency = p.latency.merge(o.latency)
+}
+
+//the non empty buckets of a Histogram, most points only use a few dozen of the buckets
+type sparseHistogram []sparseBucket
+
+type sparseBucket struct {
+	idx   int32
+	count int64
+}
+
+//returns the buckets of cur that were added since prev
+func histogramDelta(cur, prev *Histogram) sparseHistogram {
+	sh := sparseHistogram{}
+	for idx := range cur.counts {
+		if c := cur.counts[idx] - prev.counts[idx]; c > 0 {
+			sh = append(sh, sparseBucket{idx: int32(idx), count: c})
+		}
+	}
+	return sh
+}
+
+func (sh sparseHistogram) addTo(h *Histogram) {
+	for _, b := range sh {
+		h.counts[b.idx] += b.count
+	}
+}
+
+//returns a new sparse histogram with the buckets of both
+func (sh sparseHistogram) merge(o sparseHistogram) sparseHistogram {
+	merged := make(sparseHistogram, 0, len(sh)+len(o))
+	i, j := 0, 0
+	for i < len(sh) || j < len(o) {
+		switch {
+		case j == len(o) || (i < len(sh) && sh[i].idx < o[j].idx):
+			merged = append(merged, sh[i])
+			i++
+		case i == len(sh) || o[j].idx < sh[i].idx:
+			merged = append(merged, o[j])
+			j++
+		default:
+			merged = append(merged, sparseBucket{idx: sh[i].idx, count: sh[i].count + o[j].count})
+			i++
+			j++
+		}
+	}
+	return merged
+}
+
+//A time series of the performance of a node or Scheduler.
+//Recent points are kept at the sampling resolution, older points are downsampled.
+type history struct {
+	lock   sync.Mutex
+	config HistoryConfig
+	raw    []HistoryPoint
+	coarse []HistoryPoint
+	// the cumulative statistics at the previous sample
+	prev   Stats
+	primed bool
+}
+
+func (h *history) init(config HistoryConfig) {
+	if config.Resolution <= 0 {
+		config.Resolution = DefaultHistoryResolution
+	}
+	h.config = config
+}
+
+//add a point for the statistics accumulated since the previous sample, the new point is returned
+func (h *history) sample(t time.Time, st *Stats, slots, inFlight int) HistoryPoint {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	p := HistoryPoint{
+		Time:     t.Add(-h.config.Resolution),
+		Step:     h.config.Resolution,
+		Slots:    slots,
+		InFlight: inFlight,
+	}
+	if !h.primed || st.TransactionCount < h.prev.TransactionCount || st.ErrorCount < h.prev.ErrorCount {
+		// first sample or the statistics were Reset, everything counted so far is new
+		h.prev = Stats{}
+	}
+	p.TransactionCount = st.TransactionCount - h.prev.TransactionCount
+	p.ErrorCount = st.ErrorCount - h.prev.ErrorCount
+	p.latency = histogramDelta(&st.Latency, &h.prev.Latency)
+	h.prev = *st
+	h.primed = true
+	h.raw = append(h.raw, p)
+	h.expire(t)
+	return p
+}
+
+//add history saved before a restart. It is older than any point sampled since.
+func (h *history) restore(points []HistoryPoint, now time.Time) {
+	if len(points) == 0 {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	raw := make([]HistoryPoint, 0, len(points)+len(h.raw))
+	for _, p := range points {
+		if p.Step > h.config.Resolution {
+			// already downsampled
+			h.coarse = append(h.coarse, p)
+		} else {
+			raw = append(raw, p)
+		}
+	}
+	h.raw = append(raw, h.raw...)
+	h.expire(now)
+}
+
+//downsample the raw points older than RawRetention and drop the points older than Retention
+func (h *history) expire(now time.Time) {
+	cnt := 0
+	for _, p := range h.raw {
+		if now.Sub(p.Time) <= h.config.RawRetention {
+			break
+		}
+		step := h.config.Downsample
+		if step < p.Step {
+			step = p.Step
+		}
+		start := p.Time.Truncate(step)
+		if last := len(h.coarse) - 1; last >= 0 && h.coarse[last].Time.Equal(start) {
+			h.coarse[last].merge(&p)
+		} else {
+			p.Time = start
+			p.Step = step
+			h.coarse = append(h.coarse, p)
+		}
+		cnt++
+	}
+	h.raw = append(h.raw[:0], h.raw[cnt:]...)
+	cnt = 0
+	for _, p := range h.coarse {
+		if now.Sub(p.Time) <= h.config.Retention {
+			break
+		}
+		cnt++
+	}
+	h.coarse = append(h.coarse[:0], h.coarse[cnt:]...)
+}
+
+//returns the history between from and to merged into points of step duration.
+//A step of 0 returns the points as they are stored. Steps without samples are omitted.
+func (h *history) query(from, to time.Time, step time.Duration) []HistoryPoint {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	points := make([]HistoryPoint, 0)
+	for _, tier := range [][]HistoryPoint{h.coarse, h.raw} {
+		for idx := range tier {
+			p := tier[idx]
+			if p.Time.Before(from) || !p.Time.Before(to) {
+				continue
+			}
+			if step > 0 {
+				start := from.Add(p.Time.Sub(from) / step * step)
+				if last := len(points) - 1; last >= 0 && points[last].Time.Equal(start) {
+					points[last].merge(&p)
+					continue
+				}
+				p.Time = start
+				if p.Step < step {
+					p.Step = step
+				}
+			}
+			points = append(points, p)
+		}
+	}
+	return points
+}
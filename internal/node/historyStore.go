@@ -0,0 +1,363 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package node
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	//history is appended to a new segment file every HistorySegmentDuration
+	HistorySegmentDuration = 15 * time.Minute
+	historySegmentPrefix   = "history-"
+	historySegmentSuffix   = ".log"
+	//a segment that has been downsampled
+	historyCompactSuffix = ".compact"
+	//a segment being compacted, segments() skips it and a leftover from a crash is deleted at open time
+	historyTempPrefix = "tmp-"
+)
+
+//Persists the performance history of nodes and Schedulers in append-only segment files
+//so it survives a restart. Segments older than HistoryConfig.RawRetention are compacted
+//(rewritten downsampled) and segments older than HistoryConfig.Retention are deleted.
+type HistoryStore struct {
+	lock     sync.Mutex
+	dir      string
+	config   HistoryConfig
+	segment  *os.File
+	segStart time.Time
+	// history read from the segments at open time, waiting for its node or Scheduler to reappear
+	loaded map[string][]HistoryPoint
+	ticker *time.Ticker
+}
+
+//the history store used by Schedulers, nil when history is only kept in memory
+var (
+	historyStoreLock sync.RWMutex
+	historyStore     *HistoryStore
+)
+
+//returns the history store used by Schedulers, nil when history is only kept in memory
+func currentHistoryStore() *HistoryStore {
+	historyStoreLock.RLock()
+	defer historyStoreLock.RUnlock()
+	return historyStore
+}
+
+//one HistoryPoint in a segment file
+type storedPoint struct {
+	Key      string     `json:"k"`
+	Time     int64      `json:"t"`
+	Step     int64      `json:"s"`
+	Count    int64      `json:"c"`
+	Errors   int64      `json:"e"`
+	Slots    int        `json:"sl"`
+	InFlight int        `json:"f"`
+	Latency  [][2]int64 `json:"l"`
+}
+
+func newStoredPoint(key string, p *HistoryPoint) storedPoint {
+	sp := storedPoint{
+		Key:      key,
+		Time:     p.Time.UnixNano(),
+		Step:     int64(p.Step),
+		Count:    p.TransactionCount,
+		Errors:   p.ErrorCount,
+		Slots:    p.Slots,
+		InFlight: p.InFlight,
+		Latency:  make([][2]int64, 0, len(p.latency)),
+	}
+	for _, b := range p.latency {
+		sp.Latency = append(sp.Latency, [2]int64{int64(b.idx), b.count})
+	}
+	return sp
+}
+
+func (sp *storedPoint) point() HistoryPoint {
+	p := HistoryPoint{
+		Time:             time.Unix(0, sp.Time),
+		Step:             time.Duration(sp.Step),
+		TransactionCount: sp.Count,
+		ErrorCount:       sp.Errors,
+		Slots:            sp.Slots,
+		InFlight:         sp.InFlight,
+	}
+	for _, b := range sp.Latency {
+		if b[0] >= 0 && b[0] < histBuckets {
+			p.latency = append(p.latency, sparseBucket{idx: int32(b[0]), count: b[1]})
+		}
+	}
+	return p
+}
+
+//Open the history store in dir and load the history it holds.
+//Schedulers and nodes created afterwards persist their history to it.
+func OpenHistoryStore(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	hs := &HistoryStore{
+		dir:    dir,
+		config: History,
+		loaded: make(map[string][]HistoryPoint),
+		ticker: time.NewTicker(HistorySegmentDuration),
+	}
+	hs.removeTemp()
+	hs.maintain(time.Now())
+	if err := hs.load(); err != nil {
+		return err
+	}
+	go func(hs *HistoryStore) {
+		for t := range hs.ticker.C {
+			hs.lock.Lock()
+			hs.maintain(t)
+			hs.lock.Unlock()
+		}
+	}(hs)
+	historyStoreLock.Lock()
+	historyStore = hs
+	historyStoreLock.Unlock()
+	return nil
+}
+
+//Close the history store, history is only kept in memory afterwards
+func CloseHistoryStore() {
+	historyStoreLock.Lock()
+	hs := historyStore
+	historyStore = nil
+	historyStoreLock.Unlock()
+	if hs == nil {
+		return
+	}
+	hs.ticker.Stop()
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	if hs.segment != nil {
+		hs.segment.Close()
+		hs.segment = nil
+	}
+}
+
+//the key a node's history is stored under. A node that reappears with the same address, port and ID gets its history back.
+func nodeHistoryKey(n *Node) string {
+	return fmt.Sprintf("node/%s:%d/%s", n.IP.String(), n.Port, n.ID)
+}
+
+func schedHistoryKey(s *Scheduler) string {
+	return "scheduler/" + s.Name
+}
+
+//returns the segment files in time order
+func (hs *HistoryStore) segments() ([]string, error) {
+	files, err := ioutil.ReadDir(hs.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name(), historySegmentPrefix) {
+			continue
+		}
+		if strings.HasSuffix(f.Name(), historySegmentSuffix) || strings.HasSuffix(f.Name(), historyCompactSuffix) {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+//delete the segments a crash left half compacted, the segment they were compacting from is still there
+func (hs *HistoryStore) removeTemp() {
+	files, err := ioutil.ReadDir(hs.dir)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), historyTempPrefix+historySegmentPrefix) {
+			os.Remove(filepath.Join(hs.dir, f.Name()))
+		}
+	}
+}
+
+//returns the start time of a segment from its file name
+func segmentStart(name string) (time.Time, bool) {
+	ts := strings.TrimPrefix(name, historySegmentPrefix)
+	if idx := strings.Index(ts, "."); idx > 0 {
+		ts = ts[:idx]
+	}
+	secs, err := strconv.ParseInt(ts, 10, 64)
+	return time.Unix(secs, 0), err == nil
+}
+
+//read all of the points in a segment file
+func (hs *HistoryStore) readSegment(name string) ([]storedPoint, error) {
+	f, err := os.Open(filepath.Join(hs.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	points := make([]storedPoint, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		sp := storedPoint{}
+		if err := json.Unmarshal(scanner.Bytes(), &sp); err != nil {
+			// a partial record from a crash, skip it
+			continue
+		}
+		points = append(points, sp)
+	}
+	return points, scanner.Err()
+}
+
+//load the history of every segment
+func (hs *HistoryStore) load() error {
+	names, err := hs.segments()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		points, err := hs.readSegment(name)
+		if err != nil {
+			return err
+		}
+		for idx := range points {
+			hs.loaded[points[idx].Key] = append(hs.loaded[points[idx].Key], points[idx].point())
+		}
+	}
+	return nil
+}
+
+//returns the loaded history for key, it is only returned once
+func (hs *HistoryStore) restore(key string) []HistoryPoint {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	points := hs.loaded[key]
+	delete(hs.loaded, key)
+	return points
+}
+
+//append a point to the current segment
+func (hs *HistoryStore) append(key string, p *HistoryPoint) {
+	line, err := json.Marshal(newStoredPoint(key, p))
+	if err != nil {
+		return
+	}
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	// the point belongs to the segment covering the start of its step
+	if hs.segment == nil || p.Time.Sub(hs.segStart) >= HistorySegmentDuration {
+		if err := hs.roll(p.Time); err != nil {
+			log.WithError(err).Error("Cannot create history segment")
+			return
+		}
+	}
+	if _, err := hs.segment.Write(append(line, '\n')); err != nil {
+		log.WithError(err).Error("Cannot write history segment")
+	}
+}
+
+//close the current segment and start a new one
+func (hs *HistoryStore) roll(now time.Time) error {
+	if hs.segment != nil {
+		hs.segment.Close()
+		hs.segment = nil
+	}
+	hs.segStart = now.Truncate(HistorySegmentDuration)
+	name := fmt.Sprintf("%s%012d%s", historySegmentPrefix, hs.segStart.Unix(), historySegmentSuffix)
+	f, err := os.OpenFile(filepath.Join(hs.dir, name), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	hs.segment = f
+	return nil
+}
+
+//delete the segments past the retention and compact the segments past the raw retention.
+//Must be called with hs.lock held.
+func (hs *HistoryStore) maintain(now time.Time) {
+	names, err := hs.segments()
+	if err != nil {
+		log.WithError(err).Error("Cannot read history segments")
+		return
+	}
+	for _, name := range names {
+		start, ok := segmentStart(name)
+		if !ok {
+			continue
+		}
+		end := start.Add(HistorySegmentDuration)
+		switch {
+		case now.Sub(end) > hs.config.Retention:
+			os.Remove(filepath.Join(hs.dir, name))
+		case now.Sub(end) > hs.config.RawRetention && strings.HasSuffix(name, historySegmentSuffix):
+			if err := hs.compact(name); err != nil {
+				log.WithError(err).Error("Cannot compact history segment ", name)
+			}
+		}
+	}
+}
+
+//rewrite a segment with its points downsampled to HistoryConfig.Downsample
+func (hs *HistoryStore) compact(name string) error {
+	points, err := hs.readSegment(name)
+	if err != nil {
+		return err
+	}
+	merged := make(map[string]*HistoryPoint)
+	keys := make([]string, 0)
+	for idx := range points {
+		p := points[idx].point()
+		step := hs.config.Downsample
+		if step < p.Step {
+			step = p.Step
+		}
+		start := p.Time.Truncate(step)
+		key := points[idx].Key + "@" + strconv.FormatInt(start.UnixNano(), 10)
+		if m, ok := merged[key]; ok {
+			m.merge(&p)
+			continue
+		}
+		p.Time = start
+		p.Step = step
+		merged[key] = &p
+		keys = append(keys, key)
+	}
+	tmp := filepath.Join(hs.dir, historyTempPrefix+name)
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, key := range keys {
+		line, _ := json.Marshal(newStoredPoint(key[:strings.LastIndex(key, "@")], merged[key]))
+		w.Write(append(line, '\n'))
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	compacted := strings.TrimSuffix(name, historySegmentSuffix) + historyCompactSuffix
+	if err = os.Rename(tmp, filepath.Join(hs.dir, compacted)); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(hs.dir, name))
+}
@@ -0,0 +1,146 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package node
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistoryStore_Restart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dalb-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := OpenHistoryStore(dir); err != nil {
+		t.Fatal("cannot open history store", err)
+	}
+	s := NewScheduler(0)
+	s.Name = "/"
+	n := NewNode()
+	n.ID = "w1"
+	n.IP = net.IPv4(10, 0, 0, 1)
+	n.Port = 9000
+	n.MaxTransactions = 4
+	s.SchedAddNode(n)
+	n.UpdateTime(time.Millisecond)
+	n.UpdateTime(2 * time.Millisecond)
+	s.sampleHistory(time.Now())
+	s.Delete()
+	CloseHistoryStore()
+
+	// restart with the same node address, port and ID
+	if err := OpenHistoryStore(dir); err != nil {
+		t.Fatal("cannot reopen history store", err)
+	}
+	defer CloseHistoryStore()
+	s = NewScheduler(0)
+	defer s.Delete()
+	s.Name = "/"
+	s.RestoreHistory()
+	if len(s.History(time.Now().Add(-time.Hour), time.Now(), 0)) != 1 {
+		t.Fatal("scheduler history was not restored")
+	}
+	other := NewNode()
+	other.ID = "w2"
+	other.IP = n.IP
+	other.Port = n.Port
+	s.SchedAddNode(other)
+	if len(other.History(time.Now().Add(-time.Hour), time.Now(), 0)) != 0 {
+		t.Fatal("history restored to a node with a different ID")
+	}
+	again := NewNode()
+	again.ID = "w1"
+	again.IP = n.IP
+	again.Port = n.Port
+	s.SchedAddNode(again)
+	points := again.History(time.Now().Add(-time.Hour), time.Now(), 0)
+	if len(points) != 1 || points[0].TransactionCount != 2 || points[0].Slots != 4 {
+		t.Fatal("node history was not restored", points)
+	}
+	if p := points[0].Percentile(1); p < 1900*time.Microsecond || p > 2100*time.Microsecond {
+		t.Fatal("restored latency is not correct", p)
+	}
+}
+
+func TestHistoryStore_Maintain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dalb-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hs := &HistoryStore{
+		dir: dir,
+		config: HistoryConfig{
+			Resolution:   10 * time.Second,
+			RawRetention: time.Hour,
+			Downsample:   5 * time.Minute,
+			Retention:    24 * time.Hour,
+		},
+		loaded: make(map[string][]HistoryPoint),
+	}
+	start := time.Unix(1600000200, 0).Truncate(HistorySegmentDuration)
+	// 15 minutes of 10 second points fill one segment
+	for i := 0; i < 90; i++ {
+		hs.append("node/a", &HistoryPoint{Time: start.Add(time.Duration(i) * 10 * time.Second), Step: 10 * time.Second, TransactionCount: 1})
+	}
+	hs.segment.Close()
+	hs.segment = nil
+
+	// past the raw retention the segment is downsampled
+	hs.maintain(start.Add(2 * time.Hour))
+	names, _ := hs.segments()
+	if len(names) != 1 || !strings.HasSuffix(names[0], historyCompactSuffix) {
+		t.Fatal("segment was not compacted", names)
+	}
+	points, _ := hs.readSegment(names[0])
+	if len(points) != 3 || points[0].Count != 30 || points[0].Step != int64(5*time.Minute) {
+		t.Fatal("compacted segment is not correct", points)
+	}
+	// past the retention the segment is deleted
+	hs.maintain(start.Add(25 * time.Hour))
+	if names, _ = hs.segments(); len(names) != 0 {
+		t.Fatal("segment was not deleted", names)
+	}
+}
+
+func TestHistoryStore_CompactLeftover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dalb-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hs := &HistoryStore{dir: dir, loaded: make(map[string][]HistoryPoint)}
+	hs.append("node/a", &HistoryPoint{Time: time.Now(), Step: 10 * time.Second, TransactionCount: 1})
+	hs.segment.Close()
+	names, _ := hs.segments()
+	if len(names) != 1 {
+		t.Fatal("segment was not written", names)
+	}
+	// a crash during compaction leaves a copy of the segment behind
+	data, _ := ioutil.ReadFile(filepath.Join(dir, names[0]))
+	tmp := filepath.Join(dir, historyTempPrefix+names[0])
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if names, _ = hs.segments(); len(names) != 1 {
+		t.Fatal("the compaction leftover is read as a segment", names)
+	}
+	if err := OpenHistoryStore(dir); err != nil {
+		t.Fatal("cannot open history store", err)
+	}
+	defer CloseHistoryStore()
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Fatal("the compaction leftover was not deleted")
+	}
+	if points := currentHistoryStore().restore("node/a"); len(points) != 1 {
+		t.Fatal("history was not loaded once", points)
+	}
+}
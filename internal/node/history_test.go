@@ -0,0 +1,60 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package node
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistory_SampleQuery(t *testing.T) {
+	h := history{}
+	h.init(HistoryConfig{
+		Resolution:   10 * time.Second,
+		RawRetention: time.Minute,
+		Downsample:   time.Minute,
+		Retention:    10 * time.Minute,
+	})
+	start := time.Unix(1600000020, 0) // on a minute boundary
+	st := Stats{}
+	for i := 1; i <= 60; i++ {
+		// one transaction per second, the error count grows every sample
+		for j := 0; j < 10; j++ {
+			st.TransactionCount++
+			st.Latency.Record(time.Duration(i) * time.Millisecond)
+		}
+		st.ErrorCount++
+		h.sample(start.Add(time.Duration(i)*10*time.Second), &st, 5, 1)
+	}
+	now := start.Add(600 * time.Second)
+	// the last minute is kept at full resolution
+	if len(h.raw) != 6 {
+		t.Fatal("raw history length is not correct", len(h.raw))
+	}
+	// the other 9 minutes are downsampled to 1 minute points
+	if len(h.coarse) != 9 || h.coarse[0].TransactionCount != 60 || h.coarse[0].Step != time.Minute {
+		t.Fatal("downsampled history is not correct", len(h.coarse), h.coarse[0])
+	}
+	points := h.query(start, now, 5*time.Minute)
+	if len(points) != 2 {
+		t.Fatal("query returned the wrong number of points", len(points))
+	}
+	if points[0].TransactionCount != 300 || points[0].ErrorCount != 30 || points[0].Slots != 5 {
+		t.Fatal("query point is not correct", points[0])
+	}
+	p50 := points[1].Percentile(0.5)
+	if p50 < 42*time.Millisecond || p50 > 48*time.Millisecond {
+		t.Fatal("query point percentile is not correct", p50)
+	}
+	// a Reset of the statistics starts counting from zero
+	h.sample(now.Add(10*time.Second), &Stats{TransactionCount: 3}, 5, 1)
+	if h.raw[len(h.raw)-1].TransactionCount != 3 {
+		t.Fatal("sample after a reset is not correct")
+	}
+	// everything expires after the retention
+	h.expire(now.Add(time.Hour))
+	if len(h.raw)+len(h.coarse) != 0 {
+		t.Fatal("history did not expire")
+	}
+}
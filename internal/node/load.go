@@ -0,0 +1,148 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package node
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//time constant of the moving average the load reports of a node are smoothed with
+var LoadTimeConstant = 10 * time.Second
+
+//the fields of a load report
+type LoadField uint8
+
+const (
+	LoadCPU LoadField = 1 << iota
+	LoadMemory
+	LoadQueue
+	LoadQueueDepth
+	// every field
+	LoadAll = LoadCPU | LoadMemory | LoadQueue | LoadQueueDepth
+)
+
+//A load report sent by a worker node with its responses. Utilizations are fractions of the
+//node capacity, 1 is fully used. They are measured by the node itself, unlike the transaction
+//times which are measured by dalb.
+type Load struct {
+	CPU    float64
+	Memory float64
+	Queue  float64
+	// requests waiting on the node
+	QueueDepth float64
+	// when the last report was received, zero when the node has not sent one
+	Time time.Time
+	// the fields the report carries, 0 when it carries all of them. The fields of an average
+	// are the ones the node has reported.
+	Fields LoadField
+}
+
+//returns true if the report carries field f
+func (l Load) Has(f LoadField) bool {
+	return l.Fields == 0 || l.Fields&f != 0
+}
+
+//the smoothed load reports of a node
+type nodeLoad struct {
+	lock sync.Mutex
+	avg  Load
+	// when each field was last reported, in LoadField bit order
+	times [4]time.Time
+}
+
+// After a worker node response carried a load report, add the fields it carries to the moving average of
+// the node load. A field is smoothed over the time since it was last reported, the fields a report does
+// not carry keep their average.
+func (n *Node) UpdateLoad(l Load) {
+	if l.Time.IsZero() {
+		l.Time = time.Now()
+	}
+	if l.Fields == 0 {
+		l.Fields = LoadAll
+	}
+	n.load.lock.Lock()
+	defer n.load.lock.Unlock()
+	avg := &n.load.avg
+	fields := [...]struct {
+		avg   *float64
+		value float64
+	}{
+		{&avg.CPU, l.CPU},
+		{&avg.Memory, l.Memory},
+		{&avg.Queue, l.Queue},
+		{&avg.QueueDepth, l.QueueDepth},
+	}
+	for idx, f := range fields {
+		if l.Fields&(1<<idx) == 0 {
+			continue
+		}
+		last := &n.load.times[idx]
+		if last.IsZero() {
+			// the first report of a field is its average
+			*f.avg = f.value
+		} else if elapsed := l.Time.Sub(*last); elapsed > 0 {
+			*f.avg += (1 - math.Exp(-float64(elapsed)/float64(LoadTimeConstant))) * (f.value - *f.avg)
+		}
+		if l.Time.After(*last) {
+			*last = l.Time
+		}
+	}
+	avg.Fields |= l.Fields
+	if l.Time.After(avg.Time) {
+		avg.Time = l.Time
+	}
+}
+
+// returns the moving average of the load reported by the node, the Time of the last report is zero when there is none
+func (n *Node) Load() Load {
+	n.load.lock.Lock()
+	defer n.load.lock.Unlock()
+	return n.load.avg
+}
+
+// returns true unless the last health check of the node failed
+func (n *Node) Healthy() bool {
+	return atomic.LoadInt32(&n.down) == 0
+}
+
+//record the result of a health check, returns true if the node health changed
+func (n *Node) setHealthy(healthy bool) bool {
+	down := int32(1)
+	if healthy {
+		down = 0
+	}
+	return atomic.SwapInt32(&n.down, down) != down
+}
+
+// returns the time until which the node gets no new requests because it asked to be left alone
+// (503 or Retry-After), zero when it is not backed off
+func (n *Node) Backoff() time.Time {
+	until := atomic.LoadInt64(&n.backoff)
+	if until == 0 || time.Now().UnixNano() >= until {
+		return time.Time{}
+	}
+	return time.Unix(0, until)
+}
+
+//returns true if the node is backed off at the moment
+func (n *Node) backedOff() bool {
+	until := atomic.LoadInt64(&n.backoff)
+	if until == 0 {
+		return false
+	}
+	if time.Now().UnixNano() < until {
+		return true
+	}
+	// the backoff is over, later calls do not need to read the clock
+	atomic.CompareAndSwapInt64(&n.backoff, until, 0)
+	return false
+}
+
+//returns true if the node can be given new requests: it is healthy and not backed off
+func (n *Node) available() bool {
+	return atomic.LoadInt32(&n.down) == 0 && !n.backedOff()
+}
@@ -4,53 +4,189 @@ Copyright (c) 2019 Dave Hammers
 package node
 
 import (
+	"math"
 	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+//used to give every node a unique ID
+var nodeIDs uint64
+
 type Node struct {
+	ID              string
 	IP              net.IP
 	Port            int
 	MaxTransactions int
-	statsChan       chan time.Duration
-	stat            struct {
-		totalTransactions    int64
-		totalTransactionTime time.Duration
-		minTransactionTime   time.Duration
-		maxTransactionTime   time.Duration
-	}
+	Protocol        string // how requests are sent to the node: "http" (the default), "https", "h2" or "h2c"
+	ProxyProtocol   int    // PROXY protocol version sent on new connections to the node, 0 for none
+	HealthCheck     string // how the node health is checked: "grpc", "" for not at all
+	HealthService   string // the gRPC service checked, "" for the whole server
+	MaxConnections  int    // upgraded (e.g. WebSocket) connections allowed at the same time, 0 for no limit
+	inFlight        int32  // transactions currently using the node
+	maxSlots        int32  // MaxTransactions as seen by the Scheduler
+	conns           int32  // upgraded connections currently open
+	maxConns        int32  // MaxConnections as seen by the Scheduler
+	down            int32  // 1 when the last health check failed
+	backoff         int64  // unix nano time until which the node gets no new requests
+	slowFactor      uint64 // float64 bits of the latency factor of the last rebalance, 0 for 1
+	waiters         int32  // requests waiting for a slot of this node (session affinity)
+	notifyLock      sync.Mutex
+	notify          chan struct{} // closed to wake the requests waiting for a slot of this node
+	stat            transactionStats
+	hist            history
+	load            nodeLoad
 }
 
 // Returns a new *Node with the ID initialized to a unique number.
 func NewNode() *Node {
 	n := &Node{
-		statsChan: make(chan time.Duration, 1000),
+		ID: strconv.FormatUint(atomic.AddUint64(&nodeIDs, 1), 10),
 	}
-	// this go routine listens on a node channel for transaction durations
-	// it offloads any node statistics updates from the main program path
-	go func(n *Node) {
-		for duration := range n.statsChan {
-			n.stat.totalTransactions++
-			n.stat.totalTransactionTime += duration
-			if n.stat.minTransactionTime == 0 || n.stat.minTransactionTime > duration {
-				n.stat.minTransactionTime = duration
-			}
-			if n.stat.maxTransactionTime < duration {
-				n.stat.maxTransactionTime = duration
-			}
-		}
-	}(n)
+	n.stat.init()
+	n.hist.init(History)
 	return n
 }
 
-//delete a Node by closing its active structures
-func (n *Node) Delete() {
-	close(n.statsChan)
+//returns the fraction of its slots the node was given by the last rebalance for its transaction time
+func (n *Node) latencyFactor() float64 {
+	if bits := atomic.LoadUint64(&n.slowFactor); bits != 0 {
+		return math.Float64frombits(bits)
+	}
+	return 1
+}
+
+func (n *Node) setLatencyFactor(f float64) {
+	atomic.StoreUint64(&n.slowFactor, math.Float64bits(f))
 }
 
 // After a transaction is complete, update the node with the time.Duration it took to process the transaction
 func (n *Node) UpdateTime(duration time.Duration) {
-	n.statsChan <- duration
+	n.stat.update(duration)
+}
+
+// After a transaction completes, count its HTTP response status for the node. 5xx responses are counted as errors.
+func (n *Node) UpdateStatus(status int) {
+	n.stat.updateStatus(status)
+}
+
+// After a transaction fails, count the error for the node
+func (n *Node) UpdateError() {
+	n.stat.updateError()
+}
+
+// After a stream transaction completes, count the bytes received from and sent to the client for the node
+func (n *Node) UpdateBytes(in, out int64) {
+	n.stat.updateBytes(in, out)
+}
+
+// After an upgraded connection closes, add its duration to the node connection statistics
+func (n *Node) UpdateConnection(duration time.Duration) {
+	n.stat.updateConn(duration)
+}
+
+// Count the datagrams and bytes received from and sent to the clients of the node, and the datagrams dropped
+func (n *Node) UpdatePackets(packetsIn, bytesIn, packetsOut, bytesOut, drops int64) {
+	n.stat.updatePackets(packetsIn, bytesIn, packetsOut, bytesOut, drops)
+}
+
+// After a hedged copy of a slow request has been sent to the node, count it and whether the node answered first
+func (n *Node) UpdateHedge(won bool) {
+	n.stat.updateHedge(won)
+}
+
+// After a transaction times out, count the timeout for the node. The error is counted separately.
+func (n *Node) UpdateTimeout() {
+	n.stat.updateTimeout()
+}
+
+// returns the node performance history between from and to, merged into points of step duration
+func (n *Node) History(from, to time.Time, step time.Duration) []HistoryPoint {
+	return n.hist.query(from, to, step)
+}
+
+//claim one of the node's transaction slots, returns false if they are all in use or the node is not available
+func (n *Node) acquire() bool {
+	if !n.available() {
+		return false
+	}
+	for {
+		cur := atomic.LoadInt32(&n.inFlight)
+		if cur >= atomic.LoadInt32(&n.maxSlots) {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&n.inFlight, cur, cur+1) {
+			return true
+		}
+	}
+}
+
+//return a transaction slot claimed by acquire
+func (n *Node) release() {
+	atomic.AddInt32(&n.inFlight, -1)
+}
+
+//returns a channel that is closed the next time the requests waiting for a slot of the node should look again
+func (n *Node) released() <-chan struct{} {
+	n.notifyLock.Lock()
+	defer n.notifyLock.Unlock()
+	if n.notify == nil {
+		n.notify = make(chan struct{})
+	}
+	return n.notify
+}
+
+//wake the requests waiting for a slot of the node, e.g. a slot was released or the node cannot be used any more
+func (n *Node) wakeWaiters() {
+	if atomic.LoadInt32(&n.waiters) == 0 {
+		return
+	}
+	n.notifyLock.Lock()
+	defer n.notifyLock.Unlock()
+	if n.notify != nil {
+		close(n.notify)
+		n.notify = nil
+	}
+}
+
+//claim a connection slot, fails when MaxConnections connections are already open
+func (n *Node) acquireConn() bool {
+	for {
+		cur := atomic.LoadInt32(&n.conns)
+		if max := atomic.LoadInt32(&n.maxConns); max > 0 && cur >= max {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&n.conns, cur, cur+1) {
+			return true
+		}
+	}
+}
+
+//return a connection slot claimed by acquireConn
+func (n *Node) releaseConn() {
+	atomic.AddInt32(&n.conns, -1)
+}
+
+// Returns the number of upgraded connections currently open to a node
+func (n *Node) Connections() int {
+	return int(atomic.LoadInt32(&n.conns))
+}
+
+//number of calendar entries and concurrent transactions the Scheduler allows for the node
+func (n *Node) slotLimit() int {
+	return int(atomic.LoadInt32(&n.maxSlots))
+}
+
+// Returns the number of calendar slots the Scheduler gives the node
+func (n *Node) Slots() int {
+	return n.slotLimit()
+}
+
+// Returns the number of transactions currently being processed by a node
+func (n *Node) InFlight() int {
+	return int(atomic.LoadInt32(&n.inFlight))
 }
 
 //
@@ -59,31 +195,31 @@ func (n *Node) UpdateTime(duration time.Duration) {
 
 // Initialize the node statistics
 func (n *Node) Reset() {
-	n.stat.totalTransactions = 0
-	n.stat.totalTransactionTime = 0
-	n.stat.minTransactionTime = 0
-	n.stat.maxTransactionTime = 0
+	n.stat.reset()
+}
+
+// returns a consistent snapshot of the node statistics
+func (n *Node) Stats() Stats {
+	return n.stat.snapshot()
 }
 
 // returns the average transaction time for this node
 func (n *Node) AverageTransactionTime() time.Duration {
-	if n.stat.totalTransactions == 0 {
-		return 0
-	}
-	return time.Duration(n.stat.totalTransactionTime.Nanoseconds() / n.stat.totalTransactions)
+	return n.stat.snapshot().AverageTransactionTime()
 }
 
 // Returns the number of transactions processed by a node
 func (n *Node) TransactionCount() int64 {
-	return n.stat.totalTransactions
+	return n.stat.snapshot().TransactionCount
 }
 
 // returns the total time.Duration for all transactions processed by a node
 func (n *Node) TransactionTime() time.Duration {
-	return n.stat.totalTransactionTime
+	return n.stat.snapshot().TransactionTime
 }
 
 // returns the minimum and maximum time.Duration for all transactions processed by a node
 func (n *Node) TransactionTimeRange() (time.Duration, time.Duration) {
-	return n.stat.minTransactionTime, n.stat.maxTransactionTime
+	st := n.stat.snapshot()
+	return st.MinTransactionTime, st.MaxTransactionTime
 }
@@ -67,3 +67,44 @@ func TestNode_Reset(t *testing.T) {
 	}
 
 }
+
+func TestNode_UpdateLoad(t *testing.T) {
+	n := NewNode()
+	if !n.Load().Time.IsZero() {
+		t.Fatal("a new node has a load report")
+	}
+	start := time.Now()
+	n.UpdateLoad(Load{CPU: 1, QueueDepth: 10, Time: start})
+	if l := n.Load(); l.CPU != 1 || l.QueueDepth != 10 {
+		t.Fatal("the first report is not the load", l)
+	}
+	// a report right after the last one barely moves the average, one much later replaces it
+	n.UpdateLoad(Load{Time: start.Add(time.Millisecond)})
+	if l := n.Load(); l.CPU < 0.99 || l.QueueDepth < 9.9 {
+		t.Fatal("the load is not smoothed", l)
+	}
+	n.UpdateLoad(Load{Time: start.Add(100 * LoadTimeConstant)})
+	if l := n.Load(); l.CPU > 0.01 || l.QueueDepth > 0.1 {
+		t.Fatal("the load does not follow the reports", l)
+	}
+}
+
+func TestNode_UpdateLoadFields(t *testing.T) {
+	n := NewNode()
+	start := time.Now()
+	n.UpdateLoad(Load{QueueDepth: 10, Time: start, Fields: LoadQueueDepth})
+	if l := n.Load(); l.Fields != LoadQueueDepth || l.Has(LoadCPU) || l.QueueDepth != 10 {
+		t.Fatal("the fields of the first report", l)
+	}
+	// the first report of a field is its average, whenever it comes
+	n.UpdateLoad(Load{CPU: 0.5, Time: start.Add(time.Millisecond), Fields: LoadCPU})
+	if l := n.Load(); l.CPU != 0.5 || l.QueueDepth != 10 || l.Fields != LoadCPU|LoadQueueDepth {
+		t.Fatal("the fields of the second report", l)
+	}
+	// a field is smoothed over the time since it was reported, not since the last report
+	n.UpdateLoad(Load{QueueDepth: 0, Time: start.Add(100 * LoadTimeConstant), Fields: LoadQueueDepth})
+	n.UpdateLoad(Load{CPU: 1, Time: start.Add(100*LoadTimeConstant + time.Millisecond), Fields: LoadCPU})
+	if l := n.Load(); l.QueueDepth > 0.1 || l.CPU < 0.99 || l.Time != start.Add(100*LoadTimeConstant+time.Millisecond) {
+		t.Fatal("the fields are not smoothed apart", l)
+	}
+}
@@ -0,0 +1,76 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package node
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	//a node reporting a CPU or queue utilization above LoadTarget is given fewer calendar slots,
+	//down to MinSlotFraction of its MaxTransactions when it is fully used
+	LoadTarget      = 0.8
+	MinSlotFraction = 0.1
+	//load reports older than LoadMaxAge are not used by the rebalancer
+	LoadMaxAge = time.Minute
+	//a node whose recent transaction time is more than LatencyTolerance times the median
+	//of the nodes is given fewer calendar slots
+	LatencyTolerance = 2.0
+)
+
+//returns the median of the recent transaction times of the nodes that have any
+func medianTransactionTime(nodes []*Node) time.Duration {
+	times := make([]time.Duration, 0, len(nodes))
+	for _, n := range nodes {
+		if ewma := n.Stats().EWMATransactionTime; ewma > 0 {
+			times = append(times, ewma)
+		}
+	}
+	if len(times) == 0 {
+		return 0
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return times[len(times)/2]
+}
+
+//returns the fraction of its MaxTransactions a node should be given for the load it reports,
+//1 when it keeps up or its last report is too old
+func loadFactor(n *Node) float64 {
+	l := n.Load()
+	if l.Time.IsZero() || time.Since(l.Time) >= LoadMaxAge {
+		return 1
+	}
+	load := math.Max(l.CPU, l.Queue)
+	if n.MaxTransactions > 0 {
+		// a queue as long as the node's slots is a node that is fully used
+		load = math.Max(load, l.QueueDepth/float64(n.MaxTransactions))
+	}
+	if load > LoadTarget {
+		return 1 - (load-LoadTarget)/(1-LoadTarget)
+	}
+	return 1
+}
+
+//returns the fraction of its MaxTransactions a node should be given for its recent transaction
+//time, 1 unless it is much slower than the median of the nodes
+func latencyFactor(n *Node, median time.Duration) float64 {
+	if ewma := n.Stats().EWMATransactionTime; median > 0 && float64(ewma) > LatencyTolerance*float64(median) {
+		return LatencyTolerance * float64(median) / float64(ewma)
+	}
+	return 1
+}
+
+//returns the calendar slots a node should be given: MaxTransactions when it keeps up, fewer when
+//it reports that it is saturated or is much slower than the other nodes. The latency factor is
+//the one found by the last full rebalance.
+func rebalanceSlots(n *Node) int {
+	factor := math.Max(loadFactor(n)*n.latencyFactor(), MinSlotFraction)
+	slots := int(math.Round(float64(n.MaxTransactions) * factor))
+	if slots < 1 && n.MaxTransactions > 0 {
+		slots = 1
+	}
+	return slots
+}
@@ -4,33 +4,52 @@ Copyright (c) 2019 Dave Hammers
 package node
 
 import (
+	"context"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	//Schedule length determines how many node transactions can be Scheduled at a time.
-	//E.g. node.MaxTransactions * number of worker nodes = Schedule len
+	//Schedule length determines how many requests can wait for a worker node slot before
+	//wake ups start to coalesce. E.g. node.MaxTransactions * number of worker nodes = Schedule len
 	DefaultScheduleLen = 1000
 	//The Schedule rebalancer examines the performance of the worker nodes periodically.
 	DefaultRebalanceMinutes = 15
+	//The load reported by the worker nodes changes faster, it is applied on its own shorter interval.
+	DefaultLoadRebalanceSeconds = 5
 )
 
-type SchedNodeMapType map[*Node]bool
-type SchedChannel chan *Node
+//how often the rebalancer runs, for the Schedulers created afterwards
+var RebalanceInterval = time.Minute * DefaultRebalanceMinutes
+
+//how often the load reported by the worker nodes is applied to their slots, for the Schedulers created afterwards
+var LoadRebalanceInterval = time.Second * DefaultLoadRebalanceSeconds
+
+//schedTable is an immutable snapshot of the nodes in a Scheduler and their Weighted Round Robin calendar.
+//It is never modified once published, changes build a new table (copy-on-write).
+type schedTable struct {
+	nodes    []*Node
+	calendar []*Node
+}
+
 type Scheduler struct {
-	SchedNodeMap    SchedNodeMapType
-	lock            sync.Mutex
-	nodeChannel     SchedChannel
-	statsChan       chan time.Duration
+	// identifies the Scheduler in the persisted history
+	Name            string
+	table           atomic.Value // *schedTable
+	lock            sync.Mutex   // serializes table writers
+	cursor          uint64       // next calendar position
+	waiters         int32        // requests waiting for a free node slot
+	pinned          int32        // requests waiting for a slot of a given node
+	rebalances      int64        // number of rebalance passes
+	affinity        [3]int64     // session affinity results, by AffinityResult
+	wakeup          chan struct{}
+	done            chan struct{}
 	rebalanceTicker *time.Ticker
-
-	stat struct {
-		totalTransactions    int64
-		totalTransactionTime time.Duration
-		minTransactionTime   time.Duration
-		maxTransactionTime   time.Duration
-	}
+	loadTicker      *time.Ticker
+	historyTicker   *time.Ticker
+	stat            transactionStats
+	hist            history
 }
 
 //Return a new Scheduler used to Schedule traffic to Nodes
@@ -38,30 +57,38 @@ func NewScheduler(SchedLen int) *Scheduler {
 	if SchedLen == 0 {
 		SchedLen = DefaultScheduleLen
 	}
+	rebalance := RebalanceInterval
+	if rebalance <= 0 {
+		rebalance = time.Minute * DefaultRebalanceMinutes
+	}
+	loadRebalance := LoadRebalanceInterval
+	if loadRebalance <= 0 {
+		loadRebalance = time.Second * DefaultLoadRebalanceSeconds
+	}
 	s := &Scheduler{
-		SchedNodeMap:    make(SchedNodeMapType),
-		lock:            sync.Mutex{},
-		statsChan:       make(chan time.Duration, 1000),
-		nodeChannel:     make(SchedChannel, SchedLen),
-		rebalanceTicker: time.NewTicker(time.Minute * time.Duration(DefaultRebalanceMinutes)),
-	}
-	// this go routine listens on a Scheduler channel for transaction durations
-	// it offloads any Scheduler statistics updates from the main program path
+		wakeup:          make(chan struct{}, SchedLen),
+		done:            make(chan struct{}),
+		rebalanceTicker: time.NewTicker(rebalance),
+		loadTicker:      time.NewTicker(loadRebalance),
+	}
+	s.table.Store(&schedTable{})
+	s.stat.init()
+	s.hist.init(History)
+	// a Resolution that is not positive falls back to the default
+	s.historyTicker = time.NewTicker(s.hist.config.Resolution)
 	go func(s *Scheduler) {
-		for duration := range s.statsChan {
-			s.stat.totalTransactions++
-			s.stat.totalTransactionTime += duration
-			if s.stat.minTransactionTime == 0 || s.stat.minTransactionTime > duration {
-				s.stat.minTransactionTime = duration
-			}
-			if s.stat.maxTransactionTime < duration {
-				s.stat.maxTransactionTime = duration
-			}
+		for range s.rebalanceTicker.C {
+			s.SchedRebalance()
 		}
 	}(s)
 	go func(s *Scheduler) {
-		for range s.rebalanceTicker.C {
-			s.SchedRebalance()
+		for range s.loadTicker.C {
+			s.SchedRebalanceLoad()
+		}
+	}(s)
+	go func(s *Scheduler) {
+		for t := range s.historyTicker.C {
+			s.sampleHistory(t)
 		}
 	}(s)
 
@@ -70,61 +97,412 @@ func NewScheduler(SchedLen int) *Scheduler {
 
 //delete a Scheduler by closing it's active channels
 func (s *Scheduler) Delete() {
-	// stop the rebalancer ticker
+	// stop the rebalancer and history tickers
 	s.rebalanceTicker.Stop()
-	// close the channel used to update the statistics
-	close(s.statsChan)
-	// close the channel used to Schedule worker nodes
-	close(s.nodeChannel)
-	// init the Schedule map to release any references to *Node(s)
-	s.SchedNodeMap = nil
+	s.loadTicker.Stop()
+	s.historyTicker.Stop()
+	// release any requests waiting for a worker node
+	close(s.done)
+	// publish an empty table to release any references to *Node(s)
+	s.lock.Lock()
+	s.table.Store(&schedTable{})
+	s.lock.Unlock()
+}
+
+//returns the current node table
+func (s *Scheduler) load() *schedTable {
+	return s.table.Load().(*schedTable)
+}
+
+//publish a new node table built from nodes. Must be called with s.lock held.
+func (s *Scheduler) publish(nodes []*Node) {
+	s.table.Store(&schedTable{
+		nodes:    nodes,
+		calendar: buildCalendar(nodes),
+	})
+	// the new table may have free slots, or no longer have the node a request is waiting for
+	s.wake(int(atomic.LoadInt32(&s.waiters)))
+	for _, n := range nodes {
+		n.wakeWaiters()
+	}
+}
+
+//build a Weighted Round Robin calendar where each node appears n.MaxTransactions times.
+//Smooth weighted round robin is used so the entries for a node are spread across the calendar
+//instead of being scheduled back to back.
+func buildCalendar(nodes []*Node) []*Node {
+	total := 0
+	for _, n := range nodes {
+		total += n.slotLimit()
+	}
+	calendar := make([]*Node, 0, total)
+	current := make([]int, len(nodes))
+	for len(calendar) < total {
+		best := -1
+		for idx, n := range nodes {
+			current[idx] += n.slotLimit()
+			if best < 0 || current[idx] > current[best] {
+				best = idx
+			}
+		}
+		current[best] -= total
+		calendar = append(calendar, nodes[best])
+	}
+	return calendar
+}
+
+//returns true if at least one node of the table can be given new requests
+func (t *schedTable) available() bool {
+	for _, n := range t.nodes {
+		if n.available() {
+			return true
+		}
+	}
+	return false
+}
+
+//wake up to cnt requests waiting for a free node slot
+func (s *Scheduler) wake(cnt int) {
+	for idx := 0; idx < cnt; idx++ {
+		select {
+		case s.wakeup <- struct{}{}:
+		default:
+			return
+		}
+	}
 }
 
-//add node to the distribution Schedule n.MaxTransactions times
-// initially this will cause the node to be Scheduled back to back. Over time, as transactions are processed
-// this will distribute itself into the Schedule with the other nodes.
+//add node to the distribution Schedule n.MaxTransactions times.
+//The node's entries are spread across the calendar with the entries of the other nodes.
 func (s *Scheduler) SchedAddNode(n *Node) {
+	atomic.StoreInt32(&n.maxSlots, int32(n.MaxTransactions))
+	atomic.StoreInt32(&n.maxConns, int32(n.MaxConnections))
+	if hs := currentHistoryStore(); hs != nil {
+		n.hist.restore(hs.restore(nodeHistoryKey(n)), time.Now())
+	}
 	s.lock.Lock()
-	s.SchedNodeMap[n] = true
-	s.lock.Unlock()
-	for idx := 0; idx < n.MaxTransactions; idx++ {
-		s.nodeChannel <- n
+	defer s.lock.Unlock()
+	old := s.load().nodes
+	for _, cur := range old {
+		if cur == n {
+			s.publish(old)
+			return
+		}
 	}
+	nodes := make([]*Node, 0, len(old)+1)
+	nodes = append(nodes, old...)
+	s.publish(append(nodes, n))
 }
 
-//returns the next *Node that should be used for a reverse proxy request
+//returns the next *Node that should be used for a reverse proxy request.
+//If every node slot is in use the call waits until a node is re-scheduled.
+//nil is returned when the Scheduler has no healthy nodes that are not backed off, or has been deleted.
 func (s *Scheduler) SchedGetNode() *Node {
-	// get the next worker node to be used
-	for n := range s.nodeChannel {
-		// check to verify the node is still valid.
-		// it can be deleted if the node is removed from service or the Scheduler is rebalanced.
-		_, ok := s.SchedNodeMap[n]
+	return s.SchedGetNodeContext(context.Background())
+}
+
+//SchedGetNode that stops waiting for a free node slot when ctx is done, e.g. at the deadline of the
+//request or when its client went away. nil is returned then.
+func (s *Scheduler) SchedGetNodeContext(ctx context.Context) *Node {
+	for {
+		t := s.load()
+		if len(t.calendar) == 0 {
+			return nil
+		}
+		if n := s.next(t); n != nil {
+			return n
+		}
+		if !t.available() {
+			return nil
+		}
+		// every slot is busy, register as a waiter and check again so a release
+		// between the first scan and the registration is not missed
+		atomic.AddInt32(&s.waiters, 1)
+		n := s.next(s.load())
+		if n == nil {
+			select {
+			case <-s.wakeup:
+			case <-s.done:
+				atomic.AddInt32(&s.waiters, -1)
+				return nil
+			case <-ctx.Done():
+				atomic.AddInt32(&s.waiters, -1)
+				return nil
+			}
+		}
+		atomic.AddInt32(&s.waiters, -1)
+		if n != nil {
+			return n
+		}
+	}
+}
+
+//returns the next *Node with a free slot, or nil when every slot is in use. The call never waits.
+func (s *Scheduler) SchedTryGetNode() *Node {
+	return s.next(s.load())
+}
+
+//walk the calendar once looking for a node with a free slot
+func (s *Scheduler) next(t *schedTable) *Node {
+	calLen := uint64(len(t.calendar))
+	if calLen == 0 {
+		return nil
+	}
+	for idx := uint64(0); idx < calLen; idx++ {
+		n := t.calendar[atomic.AddUint64(&s.cursor, 1)%calLen]
+		if n.acquire() {
+			return n
+		}
+	}
+	return nil
+}
+
+//returns the next *Node other than n with a free slot, for a second copy of a request already sent
+//to n. Returns nil when no other node has a free slot. The call never waits.
+func (s *Scheduler) SchedTryGetOtherNode(n *Node) *Node {
+	t := s.load()
+	calLen := uint64(len(t.calendar))
+	for idx := uint64(0); idx < calLen; idx++ {
+		o := t.calendar[atomic.AddUint64(&s.cursor, 1)%calLen]
+		if o != n && o.acquire() {
+			return o
+		}
+	}
+	return nil
+}
+
+//claims a slot of node n for a request that has to go to that node (session affinity). Waits while
+//every slot of the node is in use, it is woken by the node itself and does not take the wake ups of
+//the other requests. Returns false when the node is no longer in the Schedule, is not available
+//(unhealthy or backed off) or the Scheduler has been deleted.
+func (s *Scheduler) SchedGetThisNode(n *Node) bool {
+	return s.SchedGetThisNodeContext(context.Background(), n)
+}
+
+//SchedGetThisNode that stops waiting for a free slot of n when ctx is done, false is returned then
+func (s *Scheduler) SchedGetThisNodeContext(ctx context.Context, n *Node) bool {
+	for {
+		if !s.load().has(n) || !n.available() {
+			return false
+		}
+		if n.acquire() {
+			return true
+		}
+		// register as a waiter and check again so a release between the first check and the
+		// registration is not missed
+		atomic.AddInt32(&n.waiters, 1)
+		atomic.AddInt32(&s.pinned, 1)
+		released := n.released()
+		ok := n.acquire()
+		if !ok {
+			select {
+			case <-released:
+			case <-s.done:
+				atomic.AddInt32(&n.waiters, -1)
+				atomic.AddInt32(&s.pinned, -1)
+				return false
+			case <-ctx.Done():
+				atomic.AddInt32(&n.waiters, -1)
+				atomic.AddInt32(&s.pinned, -1)
+				return false
+			}
+		}
+		atomic.AddInt32(&n.waiters, -1)
+		atomic.AddInt32(&s.pinned, -1)
 		if ok {
+			return true
+		}
+	}
+}
+
+//returns true if n is one of the nodes of the table
+func (t *schedTable) has(n *Node) bool {
+	for _, cur := range t.nodes {
+		if cur == n {
+			return true
+		}
+	}
+	return false
+}
+
+//returns the next node with both a free transaction slot and a free connection slot, for a
+//request that asks to upgrade the connection. Does not wait, nil is returned when there is none.
+func (s *Scheduler) SchedTryGetConnNode() *Node {
+	t := s.load()
+	calLen := uint64(len(t.calendar))
+	for idx := uint64(0); idx < calLen; idx++ {
+		n := t.calendar[atomic.AddUint64(&s.cursor, 1)%calLen]
+		if !n.acquireConn() {
+			continue
+		}
+		if n.acquire() {
 			return n
 		}
-		// fall thru means the node has been deleted and should not be used anymore
-		// get the next one
+		n.releaseConn()
 	}
 	return nil
 }
 
-//re-adds the *Node to the end of the Schedule
+//returns the connection slot claimed by SchedTryGetConnNode. The transaction slot is returned
+//separately with SchedReScheduleNode, usually as soon as the connection has been upgraded.
+func (s *Scheduler) SchedReleaseConnection(n *Node) {
+	n.releaseConn()
+}
+
+//makes the node slot used by a request available to the Schedule again
 func (s *Scheduler) SchedReScheduleNode(n *Node) {
-	s.nodeChannel <- n
+	n.release()
+	n.wakeWaiters()
+	if atomic.LoadInt32(&s.waiters) > 0 {
+		s.wake(1)
+	}
 }
 
-//deletes a node from the Scheduler map. This will eventually remove the node from the nodeChannel
+//deletes a node from the Scheduler. Requests already using the node are not affected.
 func (s *Scheduler) SchedDeleteNode(n *Node) {
 	s.lock.Lock()
-	delete(s.SchedNodeMap, n)
-	s.lock.Unlock()
+	defer s.lock.Unlock()
+	old := s.load().nodes
+	nodes := make([]*Node, 0, len(old))
+	for _, cur := range old {
+		if cur != n {
+			nodes = append(nodes, cur)
+		}
+	}
+	s.publish(nodes)
+	// the requests waiting for a slot of the node go to another node
+	n.wakeWaiters()
+}
+
+//record the result of a health check of a node. A node that is not healthy keeps its calendar
+//entries but is skipped until it is healthy again. Returns true if the node health changed.
+func (s *Scheduler) SchedSetHealthy(n *Node, healthy bool) bool {
+	changed := n.setHealthy(healthy)
+	if !changed {
+		return false
+	}
+	if !healthy {
+		// the requests waiting for a slot of the node go to another node
+		n.wakeWaiters()
+	}
+	if waiters := int(atomic.LoadInt32(&s.waiters)); waiters > 0 {
+		// a healthy node has free slots, when a node goes down the waiters check
+		// whether there is any healthy node left to wait for
+		if healthy && waiters > n.slotLimit() {
+			waiters = n.slotLimit()
+		}
+		s.wake(waiters)
+	}
+	return true
+}
+
+//give a node no new requests for d, because it answered 503 or asked to Retry-After.
+//A longer backoff that is already running is kept.
+func (s *Scheduler) SchedBackoff(n *Node, d time.Duration) {
+	until := time.Now().Add(d).UnixNano()
+	for {
+		cur := atomic.LoadInt64(&n.backoff)
+		if cur >= until {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&n.backoff, cur, until) {
+			break
+		}
+	}
+	// the requests waiting for a slot of the node go to another node
+	n.wakeWaiters()
+	// the requests waiting for a slot can use the node again once the backoff is over
+	time.AfterFunc(d, func() {
+		if waiters := int(atomic.LoadInt32(&s.waiters)); waiters > 0 {
+			s.wake(waiters)
+		}
+	})
+}
+
+//returns the nodes currently in the Schedule
+func (s *Scheduler) SchedNodes() []*Node {
+	nodes := s.load().nodes
+	return append(make([]*Node, 0, len(nodes)), nodes...)
+}
+
+//returns the number of requests waiting for a free node slot
+func (s *Scheduler) SchedWaiting() int {
+	return int(atomic.LoadInt32(&s.waiters) + atomic.LoadInt32(&s.pinned))
+}
+
+//add a point to the performance history of the Scheduler and each of its nodes
+func (s *Scheduler) sampleHistory(t time.Time) {
+	inFlight := 0
+	hs := currentHistoryStore()
+	for _, n := range s.load().nodes {
+		st := n.Stats()
+		p := n.hist.sample(t, &st, n.slotLimit(), n.InFlight())
+		inFlight += n.InFlight()
+		if hs != nil {
+			hs.append(nodeHistoryKey(n), &p)
+		}
+	}
+	st := s.Stats()
+	p := s.hist.sample(t, &st, s.SchedSlots(), inFlight)
+	if hs != nil {
+		hs.append(schedHistoryKey(s), &p)
+	}
+}
+
+//add the persisted history of the Scheduler, call after the Name is set
+func (s *Scheduler) RestoreHistory() {
+	if hs := currentHistoryStore(); hs != nil {
+		s.hist.restore(hs.restore(schedHistoryKey(s)), time.Now())
+	}
 }
 
 //Periodically examine the the performance of each worker node to see if some nodes are
 //out performing others. For the nodes that are underperforming shift the workloads to other
-//faster nodes by deleting the slower node and re-adding it with a lower MaxTransactions value.
+//faster nodes by giving the slower node fewer calendar slots than its MaxTransactions value.
+//A node gets its slots back once it performs as well as the others again.
 func (s *Scheduler) SchedRebalance() {
-	//TODO
+	atomic.AddInt64(&s.rebalances, 1)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	nodes := s.load().nodes
+	median := medianTransactionTime(nodes)
+	for _, n := range nodes {
+		n.setLatencyFactor(latencyFactor(n, median))
+	}
+	s.applySlots(nodes)
+}
+
+//Apply the load the worker nodes reported since the last rebalance to their calendar slots. A saturated
+//node gets fewer slots and gets them back once it keeps up again. The transaction times are not
+//examined, the slots a slow node lost at the last rebalance stay lost.
+func (s *Scheduler) SchedRebalanceLoad() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.applySlots(s.load().nodes)
+}
+
+//give each node the slots it should have now, must be called with s.lock held
+func (s *Scheduler) applySlots(nodes []*Node) {
+	changed := false
+	for _, n := range nodes {
+		slots := int32(rebalanceSlots(n))
+		if atomic.SwapInt32(&n.maxSlots, slots) != slots {
+			changed = true
+		}
+	}
+	if changed {
+		s.publish(nodes)
+	}
+}
+
+//returns the number of times the Scheduler has been rebalanced
+func (s *Scheduler) RebalanceCount() int64 {
+	return atomic.LoadInt64(&s.rebalances)
+}
+
+//returns the number of calendar slots in the Schedule
+func (s *Scheduler) SchedSlots() int {
+	return len(s.load().calendar)
 }
 
 //
@@ -133,36 +511,96 @@ func (s *Scheduler) SchedRebalance() {
 
 // After a transaction is complete, update the Scheduler with the time.Duration it took to process the transaction
 func (s *Scheduler) UpdateTime(duration time.Duration) {
-	s.statsChan <- duration
+	s.stat.update(duration)
+}
+
+// returns the Scheduler performance history between from and to, merged into points of step duration
+func (s *Scheduler) History(from, to time.Time, step time.Duration) []HistoryPoint {
+	return s.hist.query(from, to, step)
+}
+
+// After a transaction completes, count its HTTP response status for the Scheduler. 5xx responses are counted as errors.
+func (s *Scheduler) UpdateStatus(status int) {
+	s.stat.updateStatus(status)
+}
+
+// After a transaction fails, count the error for the Scheduler
+func (s *Scheduler) UpdateError() {
+	s.stat.updateError()
+}
+
+// After a stream transaction completes, count the bytes received from and sent to the client for the Scheduler
+func (s *Scheduler) UpdateBytes(in, out int64) {
+	s.stat.updateBytes(in, out)
+}
+
+// After an upgraded connection closes, add its duration to the Scheduler connection statistics
+func (s *Scheduler) UpdateConnection(duration time.Duration) {
+	s.stat.updateConn(duration)
+}
+
+// Count the datagrams and bytes received from and sent to the clients of the Scheduler, and the datagrams dropped
+func (s *Scheduler) UpdatePackets(packetsIn, bytesIn, packetsOut, bytesOut, drops int64) {
+	s.stat.updatePackets(packetsIn, bytesIn, packetsOut, bytesOut, drops)
+}
+
+// After a hedged copy of a slow request has been sent, count it and whether it answered first for the Scheduler
+func (s *Scheduler) UpdateHedge(won bool) {
+	s.stat.updateHedge(won)
+}
+
+// After a transaction times out, count the timeout for the Scheduler. The error is counted separately.
+func (s *Scheduler) UpdateTimeout() {
+	s.stat.updateTimeout()
+}
+
+//The result of looking up the worker node of a session
+type AffinityResult int
+
+const (
+	AffinityHit  AffinityResult = iota // the request went to the node of its session
+	AffinityMiss                       // the node of the session is gone, the request went to another node
+	AffinityNew                        // the request had no session yet
+)
+
+// After a request with session affinity has been given a node, count the result for the Scheduler
+func (s *Scheduler) UpdateAffinity(result AffinityResult) {
+	atomic.AddInt64(&s.affinity[result], 1)
+}
+
+// returns the number of requests that went to the node of their session, the number that had to
+// fail over to another node and the number that started a new session
+func (s *Scheduler) AffinityCounts() (hits, misses, sessions int64) {
+	return atomic.LoadInt64(&s.affinity[AffinityHit]), atomic.LoadInt64(&s.affinity[AffinityMiss]), atomic.LoadInt64(&s.affinity[AffinityNew])
 }
 
 // Initialize the Scheduler statistics
 func (s *Scheduler) Reset() {
-	s.stat.totalTransactions = 0
-	s.stat.totalTransactionTime = 0
-	s.stat.minTransactionTime = 0
-	s.stat.maxTransactionTime = 0
+	s.stat.reset()
+}
+
+// returns a consistent snapshot of the Scheduler statistics
+func (s *Scheduler) Stats() Stats {
+	return s.stat.snapshot()
 }
 
 // returns the average transaction time for this Scheduler
 func (s *Scheduler) AverageTransactionTime() time.Duration {
-	if s.stat.totalTransactions == 0 {
-		return 0
-	}
-	return time.Duration(s.stat.totalTransactionTime.Nanoseconds() / s.stat.totalTransactions)
+	return s.stat.snapshot().AverageTransactionTime()
 }
 
 // Returns the number of transactions processed by a Scheduler
 func (s *Scheduler) TransactionCount() int64 {
-	return s.stat.totalTransactions
+	return s.stat.snapshot().TransactionCount
 }
 
 // returns the total time.Duration for all transactions processed by a Scheduler
 func (s *Scheduler) TransactionTime() time.Duration {
-	return s.stat.totalTransactionTime
+	return s.stat.snapshot().TransactionTime
 }
 
 // returns the minimum and maximum time.Duration for all transactions processed by a Scheduler
 func (s *Scheduler) TransactionTimeRange() (time.Duration, time.Duration) {
-	return s.stat.minTransactionTime, s.stat.maxTransactionTime
+	st := s.stat.snapshot()
+	return st.MinTransactionTime, st.MaxTransactionTime
 }
@@ -4,6 +4,7 @@ Copyright (c) 2019 Dave Hammers
 package node
 
 import (
+	"context"
 	"testing"
 	"time"
 )
@@ -20,6 +21,17 @@ func TestNewScheduler(t *testing.T) {
 	}
 }
 
+func TestNewScheduler_HistoryResolution(t *testing.T) {
+	saved := History
+	defer func() { History = saved }()
+	History.Resolution = 0
+	s := NewScheduler(0)
+	defer s.Delete()
+	if s.hist.config.Resolution != DefaultHistoryResolution {
+		t.Fatal("a resolution of 0 did not fall back to the default", s.hist.config.Resolution)
+	}
+}
+
 func TestScheduler_SchedAddNode(t *testing.T) {
 	tSched = NewScheduler(0)
 	for i := 0; i < 5; i++ {
@@ -27,28 +39,156 @@ func TestScheduler_SchedAddNode(t *testing.T) {
 		n.MaxTransactions = 1
 		tSched.SchedAddNode(n)
 	}
-	if len(tSched.SchedNodeMap) != 5 {
+	if len(tSched.SchedNodes()) != 5 {
 		t.Fatal("Scheduler Node count is not correct")
 	}
 }
 
 func TestScheduler_SchedGetNode(t *testing.T) {
-	t.Log("Node channel len", len(tSched.nodeChannel))
+	t.Log("Calendar len", len(tSched.load().calendar))
 	n := tSched.SchedGetNode()
-	if len(tSched.nodeChannel) != 4 {
-		t.Fatal("Scheduler channel is not correct")
+	if n.InFlight() != 1 {
+		t.Fatal("Node slot was not claimed")
+	}
+	// every node has a single slot so the next 4 requests must get the other nodes
+	others := map[*Node]bool{}
+	for i := 0; i < 4; i++ {
+		others[tSched.SchedGetNode()] = true
+	}
+	if len(others) != 4 || others[n] {
+		t.Fatal("Scheduler returned a node without a free slot")
+	}
+	for o := range others {
+		tSched.SchedReScheduleNode(o)
 	}
 	tSched.SchedReScheduleNode(n)
-	if len(tSched.nodeChannel) != 5 {
-		t.Fatal("Scheduler channel is not correct")
+	if n.InFlight() != 0 {
+		t.Fatal("Node slot was not released")
+	}
+}
+
+func TestScheduler_SchedGetNodeWait(t *testing.T) {
+	s := NewScheduler(0)
+	defer s.Delete()
+	n := NewNode()
+	n.MaxTransactions = 1
+	s.SchedAddNode(n)
+	s.SchedGetNode()
+	got := make(chan *Node)
+	go func() {
+		got <- s.SchedGetNode()
+	}()
+	for s.SchedWaiting() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	s.SchedReScheduleNode(n)
+	if <-got != n {
+		t.Fatal("waiting request did not get the re-scheduled node")
+	}
+}
+
+func TestScheduler_SchedAddNodeWakes(t *testing.T) {
+	s := NewScheduler(0)
+	defer s.Delete()
+	n1 := NewNode()
+	n1.MaxTransactions = 1
+	s.SchedAddNode(n1)
+	s.SchedGetNode()
+	// every request blocks on the full Scheduler until a node with enough slots is added
+	got := make(chan *Node)
+	for i := 0; i < 4; i++ {
+		go func() {
+			got <- s.SchedGetNode()
+		}()
+	}
+	for s.SchedWaiting() != 4 {
+		time.Sleep(time.Millisecond)
+	}
+	n2 := NewNode()
+	n2.MaxTransactions = 4
+	s.SchedAddNode(n2)
+	for i := 0; i < 4; i++ {
+		select {
+		case n := <-got:
+			if n != n2 {
+				t.Fatal("waiting request got a node without a free slot")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("waiting requests were not woken up when a node was added")
+		}
+	}
+}
+
+func TestScheduler_SchedTryGetConnNode(t *testing.T) {
+	s := NewScheduler(0)
+	defer s.Delete()
+	a, b := NewNode(), NewNode()
+	a.MaxTransactions, a.MaxConnections = 2, 1
+	b.MaxTransactions = 2
+	s.SchedAddNode(a)
+	s.SchedAddNode(b)
+	// a connection only holds its transaction slot until it is upgraded
+	got := map[*Node]int{}
+	for i := 0; i < 4; i++ {
+		n := s.SchedTryGetConnNode()
+		if n == nil {
+			t.Fatal("no node for a connection")
+		}
+		s.SchedReScheduleNode(n)
+		got[n]++
+	}
+	if got[a] != 1 || got[b] != 3 || a.Connections() != 1 || b.Connections() != 3 {
+		t.Fatal("connection limit was not applied", got[a], got[b])
+	}
+	s.SchedReleaseConnection(a)
+	if a.Connections() != 0 || a.InFlight() != 0 {
+		t.Fatal("connection slot was not released")
+	}
+}
+
+func TestScheduler_SchedTryGetOtherNode(t *testing.T) {
+	s := NewScheduler(0)
+	defer s.Delete()
+	a, b := NewNode(), NewNode()
+	a.MaxTransactions, b.MaxTransactions = 2, 1
+	s.SchedAddNode(a)
+	s.SchedAddNode(b)
+	if o := s.SchedTryGetOtherNode(a); o != b {
+		t.Fatal("did not get the other node", o)
+	}
+	// a has free slots but it is the node to avoid
+	if o := s.SchedTryGetOtherNode(a); o != nil || a.InFlight() != 0 {
+		t.Fatal("got a node without a free slot or the node to avoid", o)
+	}
+	s.SchedReScheduleNode(b)
+}
+
+func TestScheduler_Calendar(t *testing.T) {
+	s := NewScheduler(0)
+	defer s.Delete()
+	a, b := NewNode(), NewNode()
+	a.MaxTransactions = 3
+	b.MaxTransactions = 1
+	s.SchedAddNode(a)
+	s.SchedAddNode(b)
+	cal := s.load().calendar
+	if len(cal) != 4 {
+		t.Fatal("calendar length is not the sum of MaxTransactions", len(cal))
+	}
+	cnt := map[*Node]int{}
+	for _, n := range cal {
+		cnt[n]++
+	}
+	if cnt[a] != 3 || cnt[b] != 1 {
+		t.Fatal("calendar weights are not correct")
 	}
 }
 
 func TestScheduler_SchedDeleteNode(t *testing.T) {
-	for n := range tSched.SchedNodeMap {
+	for _, n := range tSched.SchedNodes() {
 		tSched.SchedDeleteNode(n)
 	}
-	if len(tSched.SchedNodeMap) != 0 {
+	if len(tSched.SchedNodes()) != 0 {
 		t.Fatal("Scheduler Node count is not correct after delete")
 	}
 }
@@ -98,4 +238,262 @@ func TestSched_Reset(t *testing.T) {
 }
 func TestScheduler_Delete(t *testing.T) {
 	tSched.Delete()
+	if tSched.SchedGetNode() != nil {
+		t.Fatal("deleted Scheduler returned a node")
+	}
+}
+
+// the data path hot path: get a node, re-schedule it and record the transaction time
+func BenchmarkScheduler_HotPath(b *testing.B) {
+	s := NewScheduler(0)
+	defer s.Delete()
+	for i := 0; i < 10; i++ {
+		n := NewNode()
+		n.MaxTransactions = 100
+		s.SchedAddNode(n)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	tStart := time.Now()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n := s.SchedGetNode()
+			s.SchedReScheduleNode(n)
+			n.UpdateTime(time.Microsecond)
+			s.UpdateTime(time.Microsecond)
+		}
+	})
+	b.ReportMetric(float64(b.N)/time.Since(tStart).Seconds(), "req/s")
+}
+
+// the Scheduler alone: get a node and re-schedule it
+func BenchmarkScheduler_GetNode(b *testing.B) {
+	s := NewScheduler(0)
+	defer s.Delete()
+	for i := 0; i < 10; i++ {
+		n := NewNode()
+		n.MaxTransactions = 100
+		s.SchedAddNode(n)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	tStart := time.Now()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			s.SchedReScheduleNode(s.SchedGetNode())
+		}
+	})
+	b.ReportMetric(float64(b.N)/time.Since(tStart).Seconds(), "req/s")
+}
+
+func TestScheduler_SchedSetHealthy(t *testing.T) {
+	s := NewScheduler(0)
+	defer s.Delete()
+	n1, n2 := NewNode(), NewNode()
+	n1.MaxTransactions, n2.MaxTransactions = 1, 1
+	s.SchedAddNode(n1)
+	s.SchedAddNode(n2)
+	if !s.SchedSetHealthy(n1, false) || s.SchedSetHealthy(n1, false) {
+		t.Fatal("SchedSetHealthy should only report a change of health")
+	}
+	for idx := 0; idx < 4; idx++ {
+		n := s.SchedTryGetNode()
+		if n != n2 {
+			t.Fatal("got", n, "want the healthy node")
+		}
+		s.SchedReScheduleNode(n)
+	}
+	s.SchedSetHealthy(n2, false)
+	// no healthy node to wait for
+	if n := s.SchedGetNode(); n != nil {
+		t.Fatal("got", n, "with every node down")
+	}
+	s.SchedSetHealthy(n1, true)
+	if n := s.SchedGetNode(); n != n1 || !n1.Healthy() || n2.Healthy() {
+		t.Fatal("got", n, "want the node that is healthy again")
+	}
+}
+
+func TestScheduler_SchedBackoff(t *testing.T) {
+	s := NewScheduler(0)
+	defer s.Delete()
+	n1, n2 := NewNode(), NewNode()
+	n1.MaxTransactions, n2.MaxTransactions = 1, 1
+	s.SchedAddNode(n1)
+	s.SchedAddNode(n2)
+	s.SchedBackoff(n1, 50*time.Millisecond)
+	if n1.Backoff().IsZero() {
+		t.Fatal("node is not backed off")
+	}
+	for idx := 0; idx < 4; idx++ {
+		n := s.SchedTryGetNode()
+		if n != n2 {
+			t.Fatal("got", n, "want the node that is not backed off")
+		}
+		s.SchedReScheduleNode(n)
+	}
+	// a waiting request gets the node when its backoff is over
+	n := s.SchedGetNode()
+	if n != n2 {
+		t.Fatal("got", n)
+	}
+	if n := s.SchedGetNode(); n != n1 || !n1.Backoff().IsZero() {
+		t.Fatal("got", n, "want the node at the end of its backoff")
+	}
+}
+
+func TestScheduler_SchedRebalance(t *testing.T) {
+	s := NewScheduler(0)
+	defer s.Delete()
+	n1, n2 := NewNode(), NewNode()
+	n1.MaxTransactions, n2.MaxTransactions = 10, 10
+	s.SchedAddNode(n1)
+	s.SchedAddNode(n2)
+	n1.UpdateLoad(Load{CPU: 0.9})
+	n2.UpdateLoad(Load{CPU: 0.5, QueueDepth: 2})
+	s.SchedRebalance()
+	if n1.Slots() != 5 || n2.Slots() != 10 || s.SchedSlots() != 15 {
+		t.Fatal("a saturated node keeps its slots", n1.Slots(), n2.Slots(), s.SchedSlots())
+	}
+	// a queue as long as the node slots is a node that is fully used
+	n2.UpdateLoad(Load{QueueDepth: 100, Time: time.Now().Add(time.Hour)})
+	s.SchedRebalance()
+	if n2.Slots() != 1 {
+		t.Fatal("a node with a long queue keeps its slots", n2.Slots())
+	}
+	// the slots come back when the node is not saturated any more
+	n1.UpdateLoad(Load{CPU: 0.2, Time: time.Now().Add(time.Hour)})
+	s.SchedRebalance()
+	if n1.Slots() != 10 || s.RebalanceCount() != 3 {
+		t.Fatal("slots are not given back", n1.Slots())
+	}
+}
+
+func TestScheduler_SchedRebalanceLoad(t *testing.T) {
+	s := NewScheduler(0)
+	defer s.Delete()
+	n1, n2 := NewNode(), NewNode()
+	n1.MaxTransactions, n2.MaxTransactions = 10, 10
+	s.SchedAddNode(n1)
+	s.SchedAddNode(n2)
+	// the last full rebalance found n2 slow
+	n2.setLatencyFactor(0.5)
+	n1.UpdateLoad(Load{CPU: 0.9})
+	s.SchedRebalanceLoad()
+	if n1.Slots() != 5 || n2.Slots() != 5 || s.RebalanceCount() != 0 {
+		t.Fatal("the load was not applied", n1.Slots(), n2.Slots(), s.RebalanceCount())
+	}
+	n1.UpdateLoad(Load{CPU: 0.2, Time: time.Now().Add(time.Hour)})
+	s.SchedRebalanceLoad()
+	if n1.Slots() != 10 || n2.Slots() != 5 {
+		t.Fatal("slots are not given back", n1.Slots(), n2.Slots())
+	}
+}
+
+func TestScheduler_SchedGetThisNode(t *testing.T) {
+	s := NewScheduler(0)
+	defer s.Delete()
+	n1, n2 := NewNode(), NewNode()
+	n1.MaxTransactions, n2.MaxTransactions = 1, 1
+	s.SchedAddNode(n1)
+	s.SchedAddNode(n2)
+	if !s.SchedGetThisNode(n1) {
+		t.Fatal("the free node was not given")
+	}
+	// waits for the slot of its node, not for any slot
+	got := make(chan bool)
+	go func() { got <- s.SchedGetThisNode(n1) }()
+	time.Sleep(10 * time.Millisecond)
+	s.SchedReScheduleNode(s.SchedGetNode())
+	select {
+	case <-got:
+		t.Fatal("got a slot of another node")
+	case <-time.After(10 * time.Millisecond):
+	}
+	s.SchedReScheduleNode(n1)
+	if !<-got {
+		t.Fatal("the node slot was not given when it was released")
+	}
+	s.SchedDeleteNode(n1)
+	if s.SchedGetThisNode(n1) {
+		t.Fatal("a deleted node was given")
+	}
+}
+
+func TestScheduler_SchedGetThisNodeWaiters(t *testing.T) {
+	s := NewScheduler(0)
+	defer s.Delete()
+	n1, n2 := NewNode(), NewNode()
+	n1.MaxTransactions, n2.MaxTransactions = 1, 1
+	s.SchedAddNode(n1)
+	s.SchedAddNode(n2)
+	s.SchedGetThisNode(n1)
+	s.SchedGetThisNode(n2)
+	// requests pinned to n1 and a request that can use any node wait at the same time
+	pinned := make(chan bool, 3)
+	for i := 0; i < 3; i++ {
+		go func() { pinned <- s.SchedGetThisNode(n1) }()
+	}
+	got := make(chan *Node, 1)
+	go func() { got <- s.SchedGetNode() }()
+	for s.SchedWaiting() != 4 {
+		time.Sleep(time.Millisecond)
+	}
+	// the slot of n2 goes to the request that can use it
+	s.SchedReScheduleNode(n2)
+	select {
+	case n := <-got:
+		if n != n2 {
+			t.Fatal("got", n, "want the released node")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the released slot was taken by the requests waiting for another node")
+	}
+	// each slot of n1 goes to one of the requests waiting for it
+	for i := 0; i < 2; i++ {
+		s.SchedReScheduleNode(n1)
+		select {
+		case ok := <-pinned:
+			if !ok {
+				t.Fatal("the pinned request did not get its node")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("the pinned request was not woken up by its node")
+		}
+	}
+	// the last one goes to another node when n1 is deleted
+	s.SchedDeleteNode(n1)
+	select {
+	case ok := <-pinned:
+		if ok {
+			t.Fatal("got a slot of a deleted node")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the pinned request was not woken up when its node was deleted")
+	}
+}
+
+func TestScheduler_SchedGetNodeContext(t *testing.T) {
+	s := NewScheduler(0)
+	defer s.Delete()
+	n := NewNode()
+	n.MaxTransactions = 1
+	s.SchedAddNode(n)
+	s.SchedGetNode()
+	// the waits end when the context is done, the waiters are gone and the slot is not taken
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if got := s.SchedGetNodeContext(ctx); got != nil {
+		t.Fatal("got a node while every slot is busy", got)
+	}
+	if s.SchedGetThisNodeContext(ctx, n) {
+		t.Fatal("got the busy node")
+	}
+	if s.SchedWaiting() != 0 || n.InFlight() != 1 {
+		t.Fatal("waiting", s.SchedWaiting(), "in flight", n.InFlight())
+	}
+	s.SchedReScheduleNode(n)
+	if s.SchedGetNodeContext(context.Background()) != n {
+		t.Fatal("the released slot was not given")
+	}
 }
@@ -0,0 +1,288 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package node
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//A point in time snapshot of the transaction statistics for a node or Scheduler.
+//All fields are read at the same instant.
+type Stats struct {
+	TransactionCount   int64
+	TransactionTime    time.Duration
+	MinTransactionTime time.Duration
+	MaxTransactionTime time.Duration
+	ErrorCount         int64
+	// bytes received from and sent to the clients of stream (TCP) and datagram (UDP) transactions
+	BytesIn  int64
+	BytesOut int64
+	// upgraded (e.g. WebSocket) connections that have closed and the total time they were open.
+	// They are not counted as transactions.
+	ConnectionCount int64
+	ConnectionTime  time.Duration
+	// datagrams received from and sent to the clients, and datagrams that could not be delivered
+	PacketsIn  int64
+	PacketsOut int64
+	Drops      int64
+	// hedged copies of slow requests sent to the node (or by the Scheduler) and those that answered first
+	HedgeCount int64
+	HedgeWins  int64
+	// transactions that took longer than a timeout or the client deadline, they are also counted as errors
+	TimeoutCount int64
+	// number of responses per HTTP status class, indexed by status / 100 (1xx - 5xx)
+	StatusClassCount [6]int64
+	Latency          Histogram
+	// statistics for each of the StatWindows
+	Windows [len(StatWindows)]WindowStats
+	// exponentially weighted moving average of the recent transaction times
+	EWMATransactionTime time.Duration
+}
+
+// returns the average time the upgraded connections in the snapshot were open
+func (st Stats) AverageConnectionTime() time.Duration {
+	if st.ConnectionCount == 0 {
+		return 0
+	}
+	return time.Duration(st.ConnectionTime.Nanoseconds() / st.ConnectionCount)
+}
+
+// returns the average transaction time for the snapshot
+func (st Stats) AverageTransactionTime() time.Duration {
+	if st.TransactionCount == 0 {
+		return 0
+	}
+	return time.Duration(st.TransactionTime.Nanoseconds() / st.TransactionCount)
+}
+
+//transaction statistics split into shards so concurrent updates from different CPUs
+//do not contend on the same lock or cache line
+type transactionStats struct {
+	shards []statShard
+	mask   uint32
+	next   uint32
+	// sync.Pool keeps a per-P cache, a goroutine usually gets the shard last used on its CPU
+	pool sync.Pool
+}
+
+type statShard struct {
+	lock  sync.Mutex
+	count int64
+	total time.Duration
+	min   time.Duration
+	max   time.Duration
+	errs  int64
+	in    int64
+	out   int64
+	conns int64
+	ctime time.Duration
+	pin   int64
+	pout  int64
+	drops int64
+	hedge int64
+	wins  int64
+	touts int64
+	class [6]int64
+	hist  Histogram
+	ring  windowRing
+	_     [64]byte // keep shards on separate cache lines
+}
+
+//initialize the shards, one per CPU rounded up to a power of 2
+func (t *transactionStats) init() {
+	cnt := 1
+	for cnt < runtime.GOMAXPROCS(0) {
+		cnt <<= 1
+	}
+	t.shards = make([]statShard, cnt)
+	t.mask = uint32(cnt - 1)
+	t.pool.New = func() interface{} {
+		return &t.shards[atomic.AddUint32(&t.next, 1)&t.mask]
+	}
+}
+
+//add a transaction duration to the statistics
+func (t *transactionStats) update(duration time.Duration) {
+	epoch := epochFunc()
+	sh := t.pool.Get().(*statShard)
+	sh.lock.Lock()
+	sh.count++
+	sh.total += duration
+	if sh.min == 0 || sh.min > duration {
+		sh.min = duration
+	}
+	if sh.max < duration {
+		sh.max = duration
+	}
+	sh.hist.Record(duration)
+	sh.ring.update(epoch, duration)
+	sh.lock.Unlock()
+	t.pool.Put(sh)
+}
+
+//count a failed transaction
+func (t *transactionStats) updateError() {
+	epoch := epochFunc()
+	sh := t.pool.Get().(*statShard)
+	sh.lock.Lock()
+	sh.errs++
+	sh.ring.updateError(epoch)
+	sh.lock.Unlock()
+	t.pool.Put(sh)
+}
+
+//count the bytes received from and sent to the client of a transaction
+func (t *transactionStats) updateBytes(in, out int64) {
+	sh := t.pool.Get().(*statShard)
+	sh.lock.Lock()
+	sh.in += in
+	sh.out += out
+	sh.lock.Unlock()
+	t.pool.Put(sh)
+}
+
+//add the duration of an upgraded connection
+func (t *transactionStats) updateConn(duration time.Duration) {
+	sh := t.pool.Get().(*statShard)
+	sh.lock.Lock()
+	sh.conns++
+	sh.ctime += duration
+	sh.lock.Unlock()
+	t.pool.Put(sh)
+}
+
+//count the datagrams and bytes received from and sent to the clients, and the datagrams dropped
+func (t *transactionStats) updatePackets(pin, in, pout, out, drops int64) {
+	sh := t.pool.Get().(*statShard)
+	sh.lock.Lock()
+	sh.pin += pin
+	sh.in += in
+	sh.pout += pout
+	sh.out += out
+	sh.drops += drops
+	sh.lock.Unlock()
+	t.pool.Put(sh)
+}
+
+//count a hedged request and whether it answered before the request it was a copy of
+func (t *transactionStats) updateHedge(won bool) {
+	sh := t.pool.Get().(*statShard)
+	sh.lock.Lock()
+	sh.hedge++
+	if won {
+		sh.wins++
+	}
+	sh.lock.Unlock()
+	t.pool.Put(sh)
+}
+
+//count a transaction that timed out
+func (t *transactionStats) updateTimeout() {
+	sh := t.pool.Get().(*statShard)
+	sh.lock.Lock()
+	sh.touts++
+	sh.lock.Unlock()
+	t.pool.Put(sh)
+}
+
+//count a response status, 5xx responses are also counted as errors
+func (t *transactionStats) updateStatus(status int) {
+	class := status / 100
+	if class < 1 || class > 5 {
+		return
+	}
+	epoch := epochFunc()
+	sh := t.pool.Get().(*statShard)
+	sh.lock.Lock()
+	sh.class[class]++
+	if class == 5 {
+		sh.errs++
+		sh.ring.updateError(epoch)
+	}
+	sh.lock.Unlock()
+	t.pool.Put(sh)
+}
+
+//lock every shard so no update is in progress while the shards are read or cleared
+func (t *transactionStats) lockAll() {
+	for idx := range t.shards {
+		t.shards[idx].lock.Lock()
+	}
+}
+
+func (t *transactionStats) unlockAll() {
+	for idx := range t.shards {
+		t.shards[idx].lock.Unlock()
+	}
+}
+
+//merge the shards into a consistent snapshot
+func (t *transactionStats) snapshot() (st Stats) {
+	epoch := epochFunc()
+	ring := windowRing{}
+	t.lockAll()
+	defer t.unlockAll()
+	for idx := range t.shards {
+		sh := &t.shards[idx]
+		st.TransactionCount += sh.count
+		st.TransactionTime += sh.total
+		if sh.min != 0 && (st.MinTransactionTime == 0 || st.MinTransactionTime > sh.min) {
+			st.MinTransactionTime = sh.min
+		}
+		if st.MaxTransactionTime < sh.max {
+			st.MaxTransactionTime = sh.max
+		}
+		st.ErrorCount += sh.errs
+		st.BytesIn += sh.in
+		st.BytesOut += sh.out
+		st.ConnectionCount += sh.conns
+		st.ConnectionTime += sh.ctime
+		st.PacketsIn += sh.pin
+		st.PacketsOut += sh.pout
+		st.Drops += sh.drops
+		st.HedgeCount += sh.hedge
+		st.HedgeWins += sh.wins
+		st.TimeoutCount += sh.touts
+		for class := range sh.class {
+			st.StatusClassCount[class] += sh.class[class]
+		}
+		st.Latency.Merge(&sh.hist)
+		ring.merge(&sh.ring, epoch)
+	}
+	for idx, window := range StatWindows {
+		st.Windows[idx] = ring.window(window, epoch)
+	}
+	st.EWMATransactionTime = ring.ewma(epoch)
+	return
+}
+
+//clear all of the shards at the same instant
+func (t *transactionStats) reset() {
+	t.lockAll()
+	defer t.unlockAll()
+	for idx := range t.shards {
+		sh := &t.shards[idx]
+		sh.count = 0
+		sh.total = 0
+		sh.min = 0
+		sh.max = 0
+		sh.errs = 0
+		sh.in = 0
+		sh.out = 0
+		sh.conns = 0
+		sh.ctime = 0
+		sh.pin = 0
+		sh.pout = 0
+		sh.drops = 0
+		sh.hedge = 0
+		sh.wins = 0
+		sh.touts = 0
+		sh.class = [6]int64{}
+		sh.hist = Histogram{}
+		sh.ring = windowRing{}
+	}
+}
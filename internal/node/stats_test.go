@@ -0,0 +1,127 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package node
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTransactionStats_Concurrent(t *testing.T) {
+	var st transactionStats
+	st.init()
+	wg := sync.WaitGroup{}
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 1; i <= 1000; i++ {
+				st.update(time.Duration(i))
+			}
+		}()
+	}
+	// snapshots taken while updating must always be self consistent
+	for i := 0; i < 100; i++ {
+		snap := st.snapshot()
+		if snap.TransactionCount > 0 && (snap.MinTransactionTime < 1 || snap.MaxTransactionTime > 1000) {
+			t.Fatal("snapshot min/max is not consistent", snap)
+		}
+	}
+	wg.Wait()
+	snap := st.snapshot()
+	if snap.TransactionCount != 8000 {
+		t.Fatal("transaction count is not correct", snap.TransactionCount)
+	}
+	if snap.TransactionTime != 8*500500 {
+		t.Fatal("transaction time is not correct", snap.TransactionTime)
+	}
+	if snap.MinTransactionTime != 1 || snap.MaxTransactionTime != 1000 {
+		t.Fatal("transaction min/max not set correctly", snap)
+	}
+	if snap.Latency.Count() != 8000 {
+		t.Fatal("latency histogram count is not correct", snap.Latency.Count())
+	}
+	if snap.Windows[0].TransactionCount != 8000 {
+		t.Fatal("window transaction count is not correct", snap.Windows[0].TransactionCount)
+	}
+	st.reset()
+	snap = st.snapshot()
+	if snap.TransactionCount != 0 || snap.Latency.Count() != 0 || snap.Windows[2].TransactionCount != 0 {
+		t.Fatal("statistics are not zero after reset")
+	}
+}
+
+func TestTransactionStats_Status(t *testing.T) {
+	var st transactionStats
+	st.init()
+	for _, status := range []int{200, 204, 302, 404, 500, 503, 0, 99, 600} {
+		st.updateStatus(status)
+	}
+	snap := st.snapshot()
+	if snap.StatusClassCount != [6]int64{0, 0, 2, 1, 1, 2} {
+		t.Fatal("status class counts are not correct", snap.StatusClassCount)
+	}
+	if snap.ErrorCount != 2 || snap.Windows[0].ErrorCount != 2 {
+		t.Fatal("5xx responses are not counted as errors", snap.ErrorCount)
+	}
+}
+
+func TestTransactionStats_Bytes(t *testing.T) {
+	var st transactionStats
+	st.init()
+	st.updateBytes(10, 100)
+	st.updateBytes(5, 0)
+	if snap := st.snapshot(); snap.BytesIn != 15 || snap.BytesOut != 100 {
+		t.Fatal("byte counts are not correct", snap.BytesIn, snap.BytesOut)
+	}
+	st.updatePackets(2, 20, 1, 10, 3)
+	if snap := st.snapshot(); snap.PacketsIn != 2 || snap.BytesIn != 35 || snap.PacketsOut != 1 || snap.BytesOut != 110 || snap.Drops != 3 {
+		t.Fatal("packet counts are not correct", snap.PacketsIn, snap.PacketsOut, snap.Drops)
+	}
+	st.reset()
+	if snap := st.snapshot(); snap.BytesIn != 0 || snap.BytesOut != 0 || snap.PacketsIn != 0 || snap.Drops != 0 {
+		t.Fatal("byte counts are not reset", snap.BytesIn, snap.BytesOut)
+	}
+}
+
+func TestTransactionStats_Hedge(t *testing.T) {
+	var st transactionStats
+	st.init()
+	st.updateHedge(true)
+	st.updateHedge(false)
+	st.updateHedge(true)
+	if snap := st.snapshot(); snap.HedgeCount != 3 || snap.HedgeWins != 2 || snap.TransactionCount != 0 {
+		t.Fatal("hedge counts are not correct", snap.HedgeCount, snap.HedgeWins)
+	}
+	st.reset()
+	if snap := st.snapshot(); snap.HedgeCount != 0 || snap.HedgeWins != 0 {
+		t.Fatal("hedge counts are not reset", snap.HedgeCount, snap.HedgeWins)
+	}
+}
+
+func TestTransactionStats_Timeout(t *testing.T) {
+	var st transactionStats
+	st.init()
+	st.updateTimeout()
+	st.updateStatus(504)
+	if snap := st.snapshot(); snap.TimeoutCount != 1 || snap.ErrorCount != 1 {
+		t.Fatal("timeout counts are not correct", snap.TimeoutCount, snap.ErrorCount)
+	}
+	st.reset()
+	if snap := st.snapshot(); snap.TimeoutCount != 0 {
+		t.Fatal("timeout count is not reset", snap.TimeoutCount)
+	}
+}
+
+func TestTransactionStats_Connections(t *testing.T) {
+	var st transactionStats
+	st.init()
+	st.updateConn(time.Second)
+	st.updateConn(3 * time.Second)
+	snap := st.snapshot()
+	if snap.ConnectionCount != 2 || snap.AverageConnectionTime() != 2*time.Second || snap.TransactionCount != 0 {
+		t.Fatal("connection statistics are not correct", snap.ConnectionCount, snap.AverageConnectionTime())
+	}
+}
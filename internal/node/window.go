@@ -0,0 +1,187 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package node
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	//windowed statistics are kept in a ring of fixed width time buckets
+	WindowBucketWidth = 10 * time.Second
+	windowBuckets     = 90 // 15 minutes
+	//time constant of the exponentially weighted moving average transaction time
+	EWMATimeConstant = time.Minute
+)
+
+//The windows reported in a Stats snapshot
+var StatWindows = [...]time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+//returns the current window epoch, replaced by tests to control the clock
+var epochFunc = clockEpoch
+
+//reading the clock costs more than the rest of a statistics update, so the window epoch is
+//kept by a background ticker with a resolution much finer than WindowBucketWidth
+var (
+	clock     int64
+	clockOnce sync.Once
+)
+
+func clockEpoch() int64 {
+	clockOnce.Do(func() {
+		atomic.StoreInt64(&clock, windowEpoch(time.Now()))
+		go func() {
+			for t := range time.NewTicker(100 * time.Millisecond).C {
+				atomic.StoreInt64(&clock, windowEpoch(t))
+			}
+		}()
+	})
+	return atomic.LoadInt64(&clock)
+}
+
+//Transaction statistics for the most recent Window of time.
+//The window includes the current, partially filled, WindowBucketWidth bucket.
+type WindowStats struct {
+	Window             time.Duration
+	TransactionCount   int64
+	TransactionTime    time.Duration
+	MinTransactionTime time.Duration
+	MaxTransactionTime time.Duration
+	ErrorCount         int64
+}
+
+// returns the average transaction time for the window
+func (ws WindowStats) AverageTransactionTime() time.Duration {
+	if ws.TransactionCount == 0 {
+		return 0
+	}
+	return time.Duration(ws.TransactionTime.Nanoseconds() / ws.TransactionCount)
+}
+
+// returns the transaction rate for the window
+func (ws WindowStats) TransactionsPerSecond() float64 {
+	if ws.Window == 0 {
+		return 0
+	}
+	return float64(ws.TransactionCount) / ws.Window.Seconds()
+}
+
+//one WindowBucketWidth of transaction statistics. epoch identifies the time slice the bucket holds,
+//a bucket with an old epoch is stale and is cleared before it is reused.
+type windowBucket struct {
+	epoch int64
+	count int64
+	total time.Duration
+	min   time.Duration
+	max   time.Duration
+	errs  int64
+}
+
+func (b *windowBucket) empty() bool {
+	return b.count == 0 && b.errs == 0
+}
+
+//ring of window buckets
+type windowRing [windowBuckets]windowBucket
+
+//returns the epoch (bucket number since the unix epoch) for a time
+func windowEpoch(t time.Time) int64 {
+	return t.UnixNano() / int64(WindowBucketWidth)
+}
+
+//add a transaction duration to the bucket for epoch
+func (r *windowRing) update(epoch int64, duration time.Duration) {
+	b := &r[epoch%windowBuckets]
+	if b.epoch != epoch {
+		*b = windowBucket{epoch: epoch}
+	}
+	b.count++
+	b.total += duration
+	if b.min == 0 || b.min > duration {
+		b.min = duration
+	}
+	if b.max < duration {
+		b.max = duration
+	}
+}
+
+//count a failed transaction in the bucket for epoch
+func (r *windowRing) updateError(epoch int64) {
+	b := &r[epoch%windowBuckets]
+	if b.epoch != epoch {
+		*b = windowBucket{epoch: epoch}
+	}
+	b.errs++
+}
+
+//add the current buckets of another ring to this one
+func (r *windowRing) merge(o *windowRing, epoch int64) {
+	for idx := range o {
+		ob := &o[idx]
+		if ob.empty() || ob.epoch <= epoch-windowBuckets || ob.epoch > epoch {
+			continue
+		}
+		b := &r[idx]
+		if b.epoch != ob.epoch {
+			*b = windowBucket{epoch: ob.epoch}
+		}
+		b.count += ob.count
+		b.total += ob.total
+		b.errs += ob.errs
+		if b.min == 0 || (ob.min != 0 && b.min > ob.min) {
+			b.min = ob.min
+		}
+		if b.max < ob.max {
+			b.max = ob.max
+		}
+	}
+}
+
+//returns the statistics for the buckets inside window ending at epoch
+func (r *windowRing) window(window time.Duration, epoch int64) WindowStats {
+	ws := WindowStats{Window: window}
+	first := epoch - int64(window/WindowBucketWidth)
+	for idx := range r {
+		b := &r[idx]
+		if b.empty() || b.epoch <= first || b.epoch > epoch {
+			continue
+		}
+		ws.TransactionCount += b.count
+		ws.TransactionTime += b.total
+		ws.ErrorCount += b.errs
+		if b.min != 0 && (ws.MinTransactionTime == 0 || ws.MinTransactionTime > b.min) {
+			ws.MinTransactionTime = b.min
+		}
+		if ws.MaxTransactionTime < b.max {
+			ws.MaxTransactionTime = b.max
+		}
+	}
+	return ws
+}
+
+//returns the exponentially weighted moving average of the bucket average transaction times,
+//oldest to newest. Empty buckets decay the weight of the older buckets.
+func (r *windowRing) ewma(epoch int64) time.Duration {
+	ewma := 0.0
+	last := int64(0)
+	for e := epoch - windowBuckets + 1; e <= epoch; e++ {
+		b := &r[e%windowBuckets]
+		if b.count == 0 || b.epoch != e {
+			continue
+		}
+		avg := float64(b.total) / float64(b.count)
+		if last == 0 {
+			ewma = avg
+		} else {
+			elapsed := time.Duration(e-last) * WindowBucketWidth
+			alpha := 1 - math.Exp(-float64(elapsed)/float64(EWMATimeConstant))
+			ewma += alpha * (avg - ewma)
+		}
+		last = e
+	}
+	return time.Duration(ewma)
+}
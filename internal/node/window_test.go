@@ -0,0 +1,53 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package node
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTransactionStats_Windows(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	epochFunc = func() int64 { return windowEpoch(now) }
+	defer func() { epochFunc = clockEpoch }()
+
+	var st transactionStats
+	st.init()
+	// 10 minutes ago the node was fast, now it is slow
+	now = now.Add(-10 * time.Minute)
+	for i := 0; i < 100; i++ {
+		st.update(time.Millisecond)
+	}
+	now = now.Add(10 * time.Minute)
+	for i := 0; i < 100; i++ {
+		st.update(100 * time.Millisecond)
+	}
+	snap := st.snapshot()
+	if snap.Windows[0].TransactionCount != 100 || snap.Windows[0].AverageTransactionTime() != 100*time.Millisecond {
+		t.Fatal("1 minute window is not correct", snap.Windows[0])
+	}
+	if snap.Windows[1].TransactionCount != 100 {
+		t.Fatal("5 minute window is not correct", snap.Windows[1])
+	}
+	if snap.Windows[2].TransactionCount != 200 || snap.Windows[2].MinTransactionTime != time.Millisecond {
+		t.Fatal("15 minute window is not correct", snap.Windows[2])
+	}
+	if snap.Windows[0].TransactionsPerSecond() != 100.0/60 {
+		t.Fatal("transaction rate is not correct", snap.Windows[0].TransactionsPerSecond())
+	}
+	// the lifetime average hides the slow down, the EWMA follows it
+	if snap.EWMATransactionTime < 99*time.Millisecond {
+		t.Fatal("EWMA transaction time does not follow recent transactions", snap.EWMATransactionTime)
+	}
+	// after 15 minutes everything has left the windows
+	now = now.Add(15 * time.Minute)
+	snap = st.snapshot()
+	if snap.Windows[2].TransactionCount != 0 || snap.EWMATransactionTime != 0 {
+		t.Fatal("15 minute window did not expire", snap.Windows[2])
+	}
+	if snap.TransactionCount != 200 {
+		t.Fatal("lifetime transaction count is not correct")
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package proxyproto
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+)
+
+//how long a trusted source has to send the PROXY protocol header. A connection that sends nothing
+//in that time has no header, e.g. a protocol where the server speaks first.
+const DefaultHeaderTimeout = 5 * time.Second
+
+//Wraps a net.Listener to read the PROXY protocol header sent by trusted sources.
+//Connections from other sources are returned as they are.
+type Listener struct {
+	net.Listener
+	// sources allowed to send a PROXY protocol header
+	Trusted []*net.IPNet
+	// DefaultHeaderTimeout when 0
+	HeaderTimeout time.Duration
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	addr, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok || !l.trusted(addr.IP) {
+		return c, nil
+	}
+	timeout := l.HeaderTimeout
+	if timeout == 0 {
+		timeout = DefaultHeaderTimeout
+	}
+	return &Conn{Conn: c, r: bufio.NewReader(c), timeout: timeout}, nil
+}
+
+func (l *Listener) trusted(ip net.IP) bool {
+	for _, n := range l.Trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//A connection from a trusted source. The PROXY protocol header is read on the first Read,
+//RemoteAddr or LocalAddr call so Accept is never blocked by a slow client.
+type Conn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+	once    sync.Once
+	header  *Header
+	err     error
+}
+
+//returns the PROXY protocol header, nil if the connection did not send one or sent nothing
+//before the header timeout
+func (c *Conn) Header() (*Header, error) {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.header, c.err = Read(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if ne, ok := c.err.(net.Error); ok && ne.Timeout() && c.r.Buffered() == 0 {
+			// the client waits for the server to speak first, the reader forgets the timeout
+			c.header, c.err = nil, nil
+			c.r.Reset(c.Conn)
+		}
+		if c.err != nil {
+			c.Conn.Close()
+		}
+	})
+	return c.header, c.err
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if _, err := c.Header(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(b)
+}
+
+//the client address sent in the PROXY protocol header
+func (c *Conn) RemoteAddr() net.Addr {
+	if h, _ := c.Header(); h != nil && h.Source != nil {
+		return h.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+//the address the client connected to, as sent in the PROXY protocol header
+func (c *Conn) LocalAddr() net.Addr {
+	if h, _ := c.Header(); h != nil && h.Destination != nil {
+		return h.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+//half close the connection, see net.TCPConn.CloseWrite
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
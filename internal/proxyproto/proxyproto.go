@@ -0,0 +1,187 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+//the PROXY protocol versions
+const (
+	V1 = 1 // human readable text header
+	V2 = 2 // binary header
+)
+
+//the maximum length of a v1 header line, including the CRLF
+const v1MaxLen = 107
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	ErrInvalidHeader = errors.New("invalid PROXY protocol header")
+)
+
+//A PROXY protocol header: the addresses of the connection between the client and the proxy.
+//Source and Destination are nil for a LOCAL (v2) or UNKNOWN (v1) connection.
+type Header struct {
+	Version     int
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+}
+
+//Write the header to w in the format of h.Version
+func (h *Header) WriteTo(w io.Writer) (int64, error) {
+	var buf []byte
+	if h.Version == V2 {
+		buf = h.v2()
+	} else {
+		buf = h.v1()
+	}
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+func (h *Header) v1() []byte {
+	if h.Source == nil || h.Destination == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	proto := "TCP4"
+	src, dst := h.Source.IP.To4(), h.Destination.IP.To4()
+	if src == nil || dst == nil {
+		proto, src, dst = "TCP6", h.Source.IP.To16(), h.Destination.IP.To16()
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, src, dst, h.Source.Port, h.Destination.Port))
+}
+
+func (h *Header) v2() []byte {
+	buf := append([]byte{}, v2Signature...)
+	if h.Source == nil || h.Destination == nil {
+		// LOCAL command, no addresses
+		return append(buf, 0x20, 0x00, 0x00, 0x00)
+	}
+	fam := byte(0x11) // TCP over IPv4
+	src, dst := h.Source.IP.To4(), h.Destination.IP.To4()
+	if src == nil || dst == nil {
+		fam, src, dst = 0x21, h.Source.IP.To16(), h.Destination.IP.To16()
+	}
+	buf = append(buf, 0x21, fam)
+	buf = appendUint16(buf, uint16(2*len(src)+4))
+	buf = append(buf, src...)
+	buf = append(buf, dst...)
+	buf = appendUint16(buf, uint16(h.Source.Port))
+	return appendUint16(buf, uint16(h.Destination.Port))
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+//Read a PROXY protocol header from r. A nil Header and nil error are returned when the
+//stream does not start with a PROXY protocol header, nothing is consumed in that case.
+func Read(r *bufio.Reader) (*Header, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch b[0] {
+	case v1Prefix[0]:
+		if b, err := r.Peek(len(v1Prefix)); err != nil || !bytes.Equal(b, v1Prefix) {
+			return nil, nil
+		}
+		return readV1(r)
+	case v2Signature[0]:
+		if b, err := r.Peek(len(v2Signature)); err != nil || !bytes.Equal(b, v2Signature) {
+			return nil, nil
+		}
+		return readV2(r)
+	}
+	return nil, nil
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for len(line) < v1MaxLen {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidHeader
+	}
+	f := strings.Fields(string(line[:len(line)-2]))
+	h := &Header{Version: V1}
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, ErrInvalidHeader
+	}
+	src, dst := net.ParseIP(f[2]), net.ParseIP(f[3])
+	sport, err1 := strconv.ParseUint(f[4], 10, 16)
+	dport, err2 := strconv.ParseUint(f[5], 10, 16)
+	if src == nil || dst == nil || err1 != nil || err2 != nil || (f[1] == "TCP4") != (src.To4() != nil) {
+		return nil, ErrInvalidHeader
+	}
+	h.Source = &net.TCPAddr{IP: src, Port: int(sport)}
+	h.Destination = &net.TCPAddr{IP: dst, Port: int(dport)}
+	return h, nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, ErrInvalidHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	h := &Header{Version: V2}
+	// LOCAL command: health checks from the proxy itself, keep the real connection addresses
+	if hdr[12]&0x0f == 0 {
+		return h, nil
+	}
+	if hdr[12]&0x0f != 1 {
+		return nil, ErrInvalidHeader
+	}
+	var alen int
+	switch hdr[13] {
+	case 0x11, 0x12: // TCP or UDP over IPv4
+		alen = net.IPv4len
+	case 0x21, 0x22: // TCP or UDP over IPv6
+		alen = net.IPv6len
+	default:
+		// unix sockets and unspecified families carry no usable address
+		return h, nil
+	}
+	if len(body) < 2*alen+4 {
+		return nil, ErrInvalidHeader
+	}
+	h.Source = &net.TCPAddr{
+		IP:   net.IP(append([]byte{}, body[:alen]...)),
+		Port: int(binary.BigEndian.Uint16(body[2*alen:])),
+	}
+	h.Destination = &net.TCPAddr{
+		IP:   net.IP(append([]byte{}, body[alen:2*alen]...)),
+		Port: int(binary.BigEndian.Uint16(body[2*alen+2:])),
+	}
+	return h, nil
+}
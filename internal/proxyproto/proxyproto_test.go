@@ -0,0 +1,160 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadV1(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\nGET / HTTP/1.1\r\n"))
+	h, err := Read(r)
+	if err != nil || h == nil {
+		t.Fatal("cannot read header", err)
+	}
+	if h.Version != V1 || h.Source.String() != "192.0.2.1:56324" || h.Destination.String() != "198.51.100.2:443" {
+		t.Fatal("wrong header", h.Source, h.Destination)
+	}
+	rest, _ := ioutil.ReadAll(r)
+	if string(rest) != "GET / HTTP/1.1\r\n" {
+		t.Fatal("header was not consumed", string(rest))
+	}
+
+	for _, bad := range []string{
+		"PROXY TCP4 192.0.2.1 198.51.100.2 56324\r\n",
+		"PROXY TCP4 2001:db8::1 198.51.100.2 1 2\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\n",
+		"PROXY " + strings.Repeat("x", 120),
+	} {
+		if _, err := Read(bufio.NewReader(strings.NewReader(bad))); err == nil {
+			t.Error("invalid header accepted", bad)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, h := range []*Header{
+		{Version: V1, Source: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1}, Destination: &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 2}},
+		{Version: V1, Source: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1}, Destination: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 2}},
+		{Version: V2, Source: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1}, Destination: &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 2}},
+		{Version: V2, Source: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1}, Destination: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 2}},
+		{Version: V1},
+		{Version: V2},
+	} {
+		var buf bytes.Buffer
+		h.WriteTo(&buf)
+		buf.WriteString("data")
+		r := bufio.NewReader(&buf)
+		got, err := Read(r)
+		if err != nil || got == nil || got.Version != h.Version {
+			t.Fatal("cannot read the header written", h, err)
+		}
+		if h.Source != nil && (got.Source.String() != h.Source.String() || got.Destination.String() != h.Destination.String()) {
+			t.Error("wrong addresses", got.Source, got.Destination, "want", h.Source, h.Destination)
+		}
+		if h.Source == nil && got.Source != nil {
+			t.Error("addresses for a LOCAL/UNKNOWN header")
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "data" {
+			t.Error("header was not consumed", string(rest))
+		}
+	}
+}
+
+func TestNoHeader(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PRI * HTTP/2.0\r\n"))
+	if h, err := Read(r); h != nil || err != nil {
+		t.Fatal("not a PROXY protocol header", h, err)
+	}
+	if rest, _ := ioutil.ReadAll(r); string(rest) != "PRI * HTTP/2.0\r\n" {
+		t.Fatal("data consumed", string(rest))
+	}
+}
+
+func TestListener(t *testing.T) {
+	for _, trusted := range []string{"127.0.0.0/8", "192.0.2.0/24"} {
+		_, n, _ := net.ParseCIDR(trusted)
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := &Listener{Listener: ln, Trusted: []*net.IPNet{n}}
+		go func() {
+			c, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				return
+			}
+			c.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\nhello"))
+			c.Close()
+		}()
+		c, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(c)
+		remote := c.RemoteAddr().String()
+		c.Close()
+		ln.Close()
+		if trusted == "127.0.0.0/8" {
+			if remote != "192.0.2.1:56324" || string(data) != "hello" {
+				t.Error("trusted source", remote, string(data))
+			}
+		} else if strings.HasPrefix(remote, "192.0.2.1") || !strings.HasPrefix(string(data), "PROXY") {
+			t.Error("header of an untrusted source was used", remote, string(data))
+		}
+	}
+}
+
+// a trusted source that sends nothing waits for the server to speak first, it has no header
+func TestListenerServerFirst(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, n, _ := net.ParseCIDR("127.0.0.0/8")
+	l := &Listener{Listener: ln, Trusted: []*net.IPNet{n}, HeaderTimeout: 50 * time.Millisecond}
+	reply := make(chan string, 1)
+	go func() {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			reply <- err.Error()
+			return
+		}
+		defer c.Close()
+		greeting := make([]byte, 5)
+		if _, err := io.ReadFull(c, greeting); err != nil {
+			reply <- err.Error()
+			return
+		}
+		c.Write([]byte("hello"))
+		reply <- string(greeting)
+	}()
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if h, err := c.(*Conn).Header(); h != nil || err != nil {
+		t.Fatal("header of a connection that sent nothing", h, err)
+	}
+	if c.RemoteAddr().String() != c.(*Conn).Conn.RemoteAddr().String() {
+		t.Error("remote address", c.RemoteAddr())
+	}
+	c.Write([]byte("ready"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("the connection was not kept", string(buf), err)
+	}
+	if got := <-reply; got != "ready" {
+		t.Fatal("greeting", got)
+	}
+}
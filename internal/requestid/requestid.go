@@ -0,0 +1,81 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package requestid
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+//the request ID header used when none is configured
+const DefaultHeader = "X-Request-ID"
+
+//incoming request IDs longer than this are replaced
+const maxLen = 128
+
+var (
+	lock   sync.Mutex
+	lastMs int64
+	seq    uint16
+)
+
+//Returns a new UUIDv7 (RFC 9562): a 48 bit unix millisecond timestamp followed by random bits,
+//so IDs sort in the order they were generated. IDs generated in the same millisecond use a
+//counter in the rand_a bits to stay in order, when the counter runs out the next millisecond is used.
+func New() string {
+	var u [16]byte
+	rand.Read(u[6:])
+	ms := time.Now().UnixNano() / int64(time.Millisecond)
+	lock.Lock()
+	if ms <= lastMs {
+		ms = lastMs
+		seq++
+	}
+	if ms > lastMs || seq > 0x0fff {
+		if ms <= lastMs {
+			ms = lastMs + 1
+		}
+		lastMs = ms
+		seq = uint16(u[6])<<8 | uint16(u[7])
+		seq &= 0x07ff // leave room for the counter
+	}
+	s := seq
+	lock.Unlock()
+	u[0] = byte(ms >> 40)
+	u[1] = byte(ms >> 32)
+	u[2] = byte(ms >> 24)
+	u[3] = byte(ms >> 16)
+	u[4] = byte(ms >> 8)
+	u[5] = byte(ms)
+	u[6] = 0x70 | byte(s>>8)&0x0f
+	u[7] = byte(s)
+	u[8] = 0x80 | u[8]&0x3f
+	var buf [36]byte
+	hex.Encode(buf[0:8], u[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], u[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], u[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], u[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], u[10:])
+	return string(buf[:])
+}
+
+//Returns true when an incoming request ID can be used as is: not empty, not too long and
+//only printable ASCII so it cannot be used to inject anything into the logs.
+func Valid(id string) bool {
+	if id == "" || len(id) > maxLen {
+		return false
+	}
+	for idx := 0; idx < len(id); idx++ {
+		if id[idx] < 0x21 || id[idx] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
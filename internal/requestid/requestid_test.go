@@ -0,0 +1,57 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package requestid
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+var uuidv7 = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestNew(t *testing.T) {
+	prev := ""
+	for i := 0; i < 5000; i++ {
+		id := New()
+		if !uuidv7.MatchString(id) {
+			t.Fatal("not a UUIDv7", id)
+		}
+		if id <= prev {
+			t.Fatal("IDs are not in generation order", prev, id)
+		}
+		prev = id
+	}
+}
+
+func TestNewCounterOverflow(t *testing.T) {
+	// the counter of a millisecond that is still to come is about to run out
+	lock.Lock()
+	lastMs = time.Now().Add(time.Hour).UnixNano() / int64(time.Millisecond)
+	seq = 0x0ffe
+	lock.Unlock()
+	prev := New()
+	for i := 0; i < 3; i++ {
+		id := New()
+		if id <= prev {
+			t.Fatal("IDs are not in generation order when the counter runs out", prev, id)
+		}
+		prev = id
+	}
+}
+
+func TestValid(t *testing.T) {
+	for id, valid := range map[string]bool{
+		"abc-123":                 true,
+		New():                     true,
+		"":                        false,
+		"has space":               false,
+		"new\nline":               false,
+		string(make([]byte, 129)): false,
+	} {
+		if Valid(id) != valid {
+			t.Fatal("Valid is not correct for", id)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package trace
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	//spans waiting for export, spans are dropped when the queue is full so tracing never blocks a request
+	exportQueueLen = 4096
+	exportBatchLen = 512
+	exportInterval = time.Second
+)
+
+//the service.name resource attribute of the exported spans
+var ServiceName = "dalb"
+
+//Sends completed spans to a tracing backend
+type Exporter interface {
+	Export(spans []*Span) error
+}
+
+//collects completed spans and exports them in batches from a background goroutine
+type batcher struct {
+	exporter Exporter
+	queue    chan *Span
+	closed   int32 // 1 once close was called, spans finishing afterwards are dropped
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newBatcher(exporter Exporter) *batcher {
+	b := &batcher{
+		exporter: exporter,
+		queue:    make(chan *Span, exportQueueLen),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+func (b *batcher) add(s *Span) {
+	// the queue is never closed, spans of requests still in progress can finish at any time
+	if atomic.LoadInt32(&b.closed) != 0 {
+		return
+	}
+	select {
+	case b.queue <- s:
+	default:
+		// the exporter is not keeping up, drop the span
+	}
+}
+
+//export the queued spans and stop, waits until they have been exported
+func (b *batcher) close() {
+	if atomic.CompareAndSwapInt32(&b.closed, 0, 1) {
+		close(b.stop)
+	}
+	<-b.done
+}
+
+func (b *batcher) run() {
+	defer close(b.done)
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, exportBatchLen)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := b.exporter.Export(batch); err != nil {
+			log.WithError(err).Error("Cannot export trace spans")
+		}
+		batch = make([]*Span, 0, exportBatchLen)
+	}
+	for {
+		select {
+		case s := <-b.queue:
+			batch = append(batch, s)
+			if len(batch) == exportBatchLen {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-b.stop:
+			for {
+				select {
+				case s := <-b.queue:
+					batch = append(batch, s)
+					if len(batch) == exportBatchLen {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+//
+// OTLP JSON encoding
+//
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	TraceState        string          `json:"traceState,omitempty"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpAttr(key string, value interface{}) otlpAttribute {
+	a := otlpAttribute{Key: key}
+	switch v := value.(type) {
+	case string:
+		a.Value.StringValue = &v
+	case int:
+		s := strconv.Itoa(v)
+		a.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		a.Value.IntValue = &s
+	case float64:
+		a.Value.DoubleValue = &v
+	case bool:
+		a.Value.BoolValue = &v
+	default:
+		s := fmt.Sprint(v)
+		a.Value.StringValue = &s
+	}
+	return a
+}
+
+//encode spans as an OTLP/JSON ExportTraceServiceRequest
+func encodeOTLP(spans []*Span) ([]byte, error) {
+	scope := otlpScopeSpans{Spans: make([]otlpSpan, 0, len(spans))}
+	scope.Scope.Name = ServiceName
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.Context.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.Context.SpanID[:]),
+			TraceState:        s.Context.TraceState,
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		}
+		if s.Parent != (SpanID{}) {
+			span.ParentSpanID = hex.EncodeToString(s.Parent[:])
+		}
+		for _, a := range s.Attributes {
+			span.Attributes = append(span.Attributes, otlpAttr(a.Key, a.Value))
+		}
+		if s.Err != "" {
+			span.Status = otlpStatus{Code: 2, Message: s.Err}
+		}
+		scope.Spans = append(scope.Spans, span)
+	}
+	rs := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	rs.Resource.Attributes = []otlpAttribute{otlpAttr("service.name", ServiceName)}
+	return json.Marshal(otlpTraces{ResourceSpans: []otlpResourceSpans{rs}})
+}
+
+//Exports spans to an OpenTelemetry collector with OTLP/HTTP using the JSON encoding
+type OTLPExporter struct {
+	URL    string
+	Client *http.Client
+}
+
+//returns an exporter for the collector at endpoint, e.g. http://collector:4318
+func NewOTLPExporter(endpoint string) *OTLPExporter {
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	return &OTLPExporter{
+		URL:    url,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (e *OTLPExporter) Export(spans []*Span) error {
+	body, err := encodeOTLP(spans)
+	if err != nil {
+		return err
+	}
+	resp, err := e.Client.Post(e.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("OTLP export to %s failed: %s", e.URL, resp.Status)
+	}
+	return nil
+}
+
+//Writes each batch of spans as one line of OTLP/JSON, used for testing and local debugging
+type FileExporter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+func NewFileExporter(w io.Writer) *FileExporter {
+	return &FileExporter{w: w}
+}
+
+//returns a FileExporter appending to the file at path
+func OpenFileExporter(path string) (*FileExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return NewFileExporter(f), nil
+}
+
+func (e *FileExporter) Export(spans []*Span) error {
+	line, err := encodeOTLP(spans)
+	if err != nil {
+		return err
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	_, err = e.w.Write(append(line, '\n'))
+	return err
+}
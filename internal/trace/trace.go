@@ -0,0 +1,264 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package trace
+
+import (
+	"context"
+	"encoding/hex"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//The kind of a span, the values match the OpenTelemetry SpanKind
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+//W3C trace context headers
+const (
+	TraceparentHeader = "traceparent"
+	TracestateHeader  = "tracestate"
+)
+
+const sampledFlag = 0x01
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+//identifies a span and carries the W3C trace flags and state
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Flags      byte
+	TraceState string
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+func (sc SpanContext) IsSampled() bool {
+	return sc.Flags&sampledFlag != 0
+}
+
+//returns the W3C traceparent header value for the span context
+func (sc SpanContext) Traceparent() string {
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + hex.EncodeToString([]byte{sc.Flags})
+}
+
+//parse a W3C traceparent header value
+func ParseTraceparent(tp string) (sc SpanContext, ok bool) {
+	parts := strings.Split(strings.TrimSpace(tp), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	flags := []byte{0}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(flags, []byte(parts[3])); err != nil {
+		return sc, false
+	}
+	sc.Flags = flags[0]
+	return sc, sc.IsValid()
+}
+
+//a span attribute, Value is a string, int64, float64 or bool
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+//A timed operation. A nil *Span is a span that is not recorded, all of its methods are no-ops.
+type Span struct {
+	Name       string
+	Kind       SpanKind
+	Context    SpanContext
+	Parent     SpanID
+	Start      time.Time
+	End        time.Time
+	Attributes []Attribute
+	Err        string
+	tracer     *Tracer
+}
+
+// add an attribute to the span
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.Attributes = append(s.Attributes, Attribute{Key: key, Value: value})
+}
+
+// mark the span as failed
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.Err = err.Error()
+}
+
+// returns the span context, the zero SpanContext for a nil span
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.Context
+}
+
+// complete the span and queue it for export
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+	s.tracer.export(s)
+}
+
+//Creates spans and hands the completed spans to an Exporter
+type Tracer struct {
+	exporter   *batcher
+	sampleRate float64
+	randLock   sync.Mutex
+	rand       *rand.Rand
+}
+
+//the Tracer used by dalb, a nil *Tracer when tracing is disabled
+var (
+	tracer     atomic.Value // *Tracer
+	tracerLock sync.Mutex   // serializes Init and Shutdown
+)
+
+//returns the Tracer used by dalb, nil when tracing is disabled
+func currentTracer() *Tracer {
+	t, _ := tracer.Load().(*Tracer)
+	return t
+}
+
+//Enable tracing. Completed spans are sent to exporter. New traces (requests without a sampled
+//traceparent) are sampled at sampleRate (0.0 - 1.0).
+func Init(exporter Exporter, sampleRate float64) {
+	tracerLock.Lock()
+	defer tracerLock.Unlock()
+	tracer.Store(&Tracer{
+		exporter:   newBatcher(exporter),
+		sampleRate: sampleRate,
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	})
+}
+
+//Disable tracing, queued spans are exported before Shutdown returns
+func Shutdown() {
+	tracerLock.Lock()
+	defer tracerLock.Unlock()
+	if t := currentTracer(); t != nil {
+		tracer.Store((*Tracer)(nil))
+		t.exporter.close()
+	}
+}
+
+//returns true when tracing is enabled
+func Enabled() bool {
+	return currentTracer() != nil
+}
+
+func (t *Tracer) randomIDs(traceID *TraceID, spanID *SpanID) {
+	t.randLock.Lock()
+	if traceID != nil {
+		t.rand.Read(traceID[:])
+	}
+	t.rand.Read(spanID[:])
+	t.randLock.Unlock()
+}
+
+func (t *Tracer) export(s *Span) {
+	if s.Context.IsSampled() {
+		t.exporter.add(s)
+	}
+}
+
+type ctxKey int
+
+const spanKey ctxKey = 0
+
+//returns a context carrying span
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey, span)
+}
+
+//returns the span carried by ctx, or nil
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey).(*Span)
+	return s
+}
+
+//Start a span that is a child of the span in ctx. The new span is returned with a context carrying it.
+//When tracing is disabled or the trace is not sampled the span is nil and ctx is returned unchanged.
+func StartSpan(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	return startSpan(ctx, name, kind, parent.Context)
+}
+
+//Start a server span for an incoming request. The span continues the trace in the traceparent
+//and tracestate headers of the request, if there are any.
+func StartServerSpan(ctx context.Context, name string, traceparent, tracestate string) (context.Context, *Span) {
+	t := currentTracer()
+	if t == nil {
+		return ctx, nil
+	}
+	parent, ok := ParseTraceparent(traceparent)
+	if !ok {
+		parent = SpanContext{}
+		t.randLock.Lock()
+		sampled := t.rand.Float64() < t.sampleRate
+		t.randLock.Unlock()
+		if sampled {
+			parent.Flags = sampledFlag
+		}
+	} else {
+		parent.TraceState = tracestate
+	}
+	return startSpan(ctx, name, KindServer, parent)
+}
+
+func startSpan(ctx context.Context, name string, kind SpanKind, parent SpanContext) (context.Context, *Span) {
+	t := currentTracer()
+	if t == nil || !parent.IsSampled() {
+		return ctx, nil
+	}
+	s := &Span{
+		Name:   name,
+		Kind:   kind,
+		Parent: parent.SpanID,
+		Start:  time.Now(),
+		tracer: t,
+		Context: SpanContext{
+			TraceID:    parent.TraceID,
+			Flags:      parent.Flags,
+			TraceState: parent.TraceState,
+		},
+	}
+	if parent.TraceID == (TraceID{}) {
+		t.randomIDs(&s.Context.TraceID, &s.Context.SpanID)
+	} else {
+		t.randomIDs(nil, &s.Context.SpanID)
+	}
+	return ContextWithSpan(ctx, s), s
+}
@@ -0,0 +1,105 @@
+/*
+Copyright (c) 2019 Dave Hammers
+*/
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tp := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceparent(tp)
+	if !ok || !sc.IsSampled() {
+		t.Fatal("valid traceparent not parsed", tp)
+	}
+	if sc.Traceparent() != tp {
+		t.Fatal("traceparent not encoded correctly", sc.Traceparent())
+	}
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+	} {
+		if _, ok := ParseTraceparent(bad); ok {
+			t.Fatal("invalid traceparent parsed", bad)
+		}
+	}
+}
+
+func TestSpans(t *testing.T) {
+	if _, span := StartServerSpan(context.Background(), "disabled", "", ""); span != nil {
+		t.Fatal("span created with tracing disabled")
+	}
+	out := &bytes.Buffer{}
+	Init(NewFileExporter(out), 1.0)
+	tp := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	ctx, server := StartServerSpan(context.Background(), "server", tp, "vendor=1")
+	_, client := StartSpan(ctx, "client", KindClient)
+	client.SetAttribute("http.status_code", 200)
+	if client.SpanContext().TraceID != server.SpanContext().TraceID || client.Parent != server.SpanContext().SpanID {
+		t.Fatal("child span is not part of the trace")
+	}
+	if client.SpanContext().TraceState != "vendor=1" {
+		t.Fatal("tracestate not propagated")
+	}
+	client.Finish()
+	server.Finish()
+	// not sampled by the caller
+	_, unsampled := StartServerSpan(context.Background(), "server", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", "")
+	if unsampled != nil {
+		t.Fatal("span created for a trace that is not sampled")
+	}
+	Shutdown()
+
+	traces := otlpTraces{}
+	if err := json.Unmarshal(out.Bytes(), &traces); err != nil {
+		t.Fatal("exported spans are not OTLP JSON", err)
+	}
+	spans := traces.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 || spans[0].Name != "client" || spans[0].Kind != KindClient {
+		t.Fatal("exported spans are not correct", spans)
+	}
+	if spans[1].TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || spans[1].ParentSpanID != "00f067aa0ba902b7" {
+		t.Fatal("exported server span does not continue the trace", spans[1])
+	}
+	if !strings.Contains(out.String(), `"intValue":"200"`) {
+		t.Fatal("span attribute not exported", out.String())
+	}
+}
+
+func TestShutdownWithSpansInProgress(t *testing.T) {
+	Init(NewFileExporter(ioutil.Discard), 1.0)
+	stop := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			_, span := StartServerSpan(context.Background(), "server", "", "")
+			span.Finish()
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	// spans that finish while and after tracing is shut down are dropped
+	Shutdown()
+	time.Sleep(10 * time.Millisecond)
+	close(stop)
+	<-finished
+	if Enabled() {
+		t.Fatal("tracing is still enabled")
+	}
+}